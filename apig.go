@@ -6,15 +6,35 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
 
+	"apigateway/internal/admin"
 	"apigateway/internal/config"
+	"apigateway/internal/conntrack"
+	"apigateway/internal/flags"
+	"apigateway/internal/health"
+	"apigateway/internal/jwt"
 	"apigateway/internal/logger"
+	"apigateway/internal/metrics"
 	"apigateway/internal/middleware"
 	"apigateway/internal/proxy"
+	"apigateway/internal/redis"
 	"apigateway/internal/router"
+
+	"golang.org/x/net/http2"
 )
 
 func main() {
@@ -26,61 +46,302 @@ func main() {
 
 	// Initialize structured logger
 	logger.Init(cfg.Logging.Level, cfg.Logging.Format)
+	var asyncLog *logger.AsyncHandler
+	if cfg.Logging.Async {
+		asyncLog = logger.Async(cfg.Logging.BufferSize)
+	}
 	logger.Log.Info("gateway_starting",
 		"port", cfg.Server.Port,
 		"log_level", cfg.Logging.Level,
 		"log_format", cfg.Logging.Format,
 	)
+	for _, w := range cfg.Warnings() {
+		logger.Log.Warn("config_warning",
+			"warning", w,
+		)
+	}
 
-	// Parse upstream URLs
-	authTargetURL, err := url.Parse(cfg.Upstream.AuthURL)
-	if err != nil {
-		log.Fatalf("invalid IAM_SERVICE_URL: %v", err)
+	// Client IPs come from X-Forwarded-For only behind trusted proxies
+	if err := middleware.SetTrustedProxies(cfg.Forwarded.TrustedProxies); err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
 	}
 
-	exampleURL, err := url.Parse(cfg.Upstream.ExampleURL)
-	if err != nil {
-		log.Fatalf("invalid EXAMPLE_TARGET_URL: %v", err)
+	// Optional body-based retry predicate (off unless RETRY_BODY_MATCH is set)
+	var retryMatch *proxy.RetryMatch
+	if cfg.Retry.BodyMatch != "" {
+		retryMatch = &proxy.RetryMatch{
+			Status:   cfg.Retry.BodyStatus,
+			JSONPath: cfg.Retry.BodyJSONPath,
+			Value:    cfg.Retry.BodyMatch,
+			MaxBytes: cfg.Retry.BodyMaxBytes,
+		}
+	}
+
+	// Per-backend upstream latency histograms
+	upstreamMetrics := metrics.NewUpstream(cfg.Upstream.LatencyBuckets)
+	if cfg.Middleware.Exemplars {
+		upstreamMetrics.WithExemplars()
+	}
+
+	// Dead-letter sink for critical routes (no-op unless DEAD_LETTER_FILE is set)
+	var deadLetter proxy.DeadLetterSink = proxy.NopSink{}
+	if cfg.Upstream.DeadLetterFile != "" {
+		sink, err := proxy.NewFileSink(cfg.Upstream.DeadLetterFile)
+		if err != nil {
+			log.Fatalf("invalid DEAD_LETTER_FILE: %v", err)
+		}
+		defer sink.Close()
+		deadLetter = sink
 	}
 
-	// Create reverse proxies
-	authProxy := proxy.NewReverseProxy(authTargetURL, proxy.Config{
-		Attempts:     cfg.Retry.Attempts,
-		BaseBackoff:  cfg.Retry.BaseBackoff,
-		MaxBackoff:   cfg.Retry.MaxBackoff,
-		TargetServer: authTargetURL.Hostname(),
-	})
+	// Shared across routes so an outage is summarized, not logged per request
+	var errorLog *proxy.ErrorLog
+	if cfg.Logging.ErrorWindow > 0 {
+		errorLog = proxy.NewErrorLog(cfg.Logging.ErrorWindow)
+	}
+
+	// Create reverse proxies; an alternate proxy (flagged rollout or
+	// canary) sends to the given URLs, equally weighted, with the route's
+	// other settings unchanged
+	probeTransports := make(map[string]http.RoundTripper, len(cfg.Routes))
+	newProxy := func(name string, urls []string, alternate bool) *httputil.ReverseProxy {
+		rc := cfg.Routes[name]
+
+		// Upstream replicas, weighted for load balancing (URLs validated by config.Load)
+		backends := make([]proxy.Backend, len(urls))
+		for i, raw := range urls {
+			backends[i].URL, _ = url.Parse(raw)
+			backends[i].Weight = 1
+			if len(rc.Weights) > 0 && !alternate {
+				backends[i].Weight = rc.Weights[i]
+			}
+		}
 
-	exampleProxy := proxy.NewReverseProxy(exampleURL, proxy.Config{
-		Attempts:     cfg.Retry.Attempts,
-		BaseBackoff:  cfg.Retry.BaseBackoff,
-		MaxBackoff:   cfg.Retry.MaxBackoff,
-		TargetServer: exampleURL.Hostname(),
-	})
+		if rc.TLSMinVersion < tls.VersionTLS12 {
+			logger.Log.Warn("upstream_legacy_tls",
+				"route", name,
+				"min_version", tls.VersionName(rc.TLSMinVersion),
+			)
+		}
+		if rc.TLSInsecure {
+			logger.Log.Warn("upstream_tls_unverified",
+				"route", name,
+			)
+		}
 
-	// Initialize middleware
-	throttle := middleware.NewSemaphore(cfg.Throttle.MaxInFlight)
-	globalLimiter := middleware.NewTokenBucket(cfg.RateLimit.GlobalRPS, cfg.RateLimit.GlobalBurst, cfg.LimiterTTL)
-	perIPLimiter := middleware.NewPerKeyTokenBucket(cfg.RateLimit.PerIPRPS, cfg.RateLimit.PerIPBurst, cfg.LimiterTTL)
+		pc := proxy.Config{
+			Attempts:              routeAttempts(cfg, rc),
+			BaseBackoff:           cfg.Retry.BaseBackoff,
+			MaxBackoff:            cfg.Retry.MaxBackoff,
+			MinRetryInterval:      cfg.Retry.MinInterval,
+			TargetServer:          backends[0].URL.Hostname(),
+			ResponseHeaderTimeout: rc.ResponseHeaderTimeout,
+			FlushInterval:         rc.FlushInterval,
+			MinTLSVersion:         rc.TLSMinVersion,
+			MaxTLSVersion:         rc.TLSMaxVersion,
+			ReadIdleTimeout:       cfg.Upstream.H2ReadIdleTimeout,
+			PingTimeout:           cfg.Upstream.H2PingTimeout,
+			MaxConnAge:            cfg.Upstream.MaxConnAge,
+			MaxIdleConnAge:        cfg.Upstream.MaxIdleConnAge,
+			PreserveHeaders:       cfg.Upstream.PreserveHeaders,
+			Recorder:              upstreamMetrics,
+			RetryMatch:            routeRetryMatch(cfg, rc, retryMatch),
+			RetryOn429:            cfg.Retry.On429,
+			Replay: proxy.ReplayConfig{
+				MemoryBytes: cfg.Retry.ReplayMemoryBytes,
+				Spill:       cfg.Retry.ReplaySpill,
+				MaxBytes:    cfg.Retry.ReplayMaxBytes,
+				TempDir:     cfg.Retry.ReplayTempDir,
+			},
+			Breaker: proxy.BreakerConfig{
+				Threshold: cfg.Upstream.BreakerThreshold,
+				Cooldown:  cfg.Upstream.BreakerCooldown,
+
+				LatencyThreshold:   cfg.Upstream.BreakerLatencyThreshold,
+				LatencyPercentile:  cfg.Upstream.BreakerLatencyPercentile,
+				LatencyWindow:      cfg.Upstream.BreakerLatencyWindow,
+				LatencyMinRequests: cfg.Upstream.BreakerLatencyMinRequests,
+			},
+			Outlier: proxy.OutlierConfig{
+				Threshold: cfg.Upstream.OutlierThreshold,
+				Cooldown:  cfg.Upstream.OutlierCooldown,
+			},
+			Balancer:    proxy.BalancerConfig{Policy: rc.Balancer, HashOn: rc.HashOn},
+			ErrorStatus: cfg.Upstream.ErrorStatus,
+			ErrorLog:    errorLog,
+		}
+		if rc.SelectHeader != "" && len(rc.SelectBackends) > 0 && !alternate {
+			pc.Select = &proxy.HeaderSelect{Header: rc.SelectHeader, Values: rc.SelectBackends}
+		}
+		if rc.StripPrefix {
+			pc.StripPrefix = rc.PathPrefix
+		}
+		if rc.Coalesce {
+			pc.Coalesce = &proxy.Coalesce{Headers: rc.CoalesceHeaders, MaxBytes: rc.CoalesceMaxBytes}
+		}
+		if rc.CacheTTL > 0 {
+			pc.Cache = &proxy.Cache{
+				TTL:        rc.CacheTTL,
+				MaxEntries: rc.CacheMaxEntries,
+				MaxBytes:   rc.CacheMaxBytes,
+				Private:    rc.CachePrivate,
+
+				CredentialHeaders: []string{cfg.APIKeys.Header},
+			}
+		}
+		if rc.StaleIfError > 0 {
+			pc.StaleIfError = &proxy.StaleIfError{
+				Window:     rc.StaleIfError,
+				MaxEntries: rc.StaleMaxEntries,
+				MaxBytes:   rc.StaleMaxBytes,
+			}
+		}
+		if rc.FallbackBody != "" {
+			pc.Fallback = &proxy.Fallback{
+				Status:      rc.FallbackStatus,
+				ContentType: rc.FallbackContentType,
+				Body:        []byte(rc.FallbackBody),
+			}
+		}
+		if rc.ProtoResponseType != nil {
+			pc.Transcode = &proxy.Transcode{Message: rc.ProtoResponseType, MaxBytes: rc.ProtoMaxBytes}
+		}
+		if len(rc.RewriteURLs) > 0 {
+			pc.URLRewrite = proxy.NewURLRewrite(rc.RewriteURLs, rc.RewriteMaxBytes)
+		}
+		if len(rc.Minify) > 0 {
+			pc.Minify = &proxy.Minify{
+				JSON:     slices.Contains(rc.Minify, "json"),
+				HTML:     slices.Contains(rc.Minify, "html"),
+				MaxBytes: rc.MinifyMaxBytes,
+			}
+		}
+		if len(rc.StripResponseHeaders) > 0 || len(rc.RenameResponseHeaders) > 0 {
+			pc.ResponseHeaders = &proxy.HeaderRules{
+				Strip:  rc.StripResponseHeaders,
+				Rename: rc.RenameResponseHeaders,
+			}
+		}
+		if rc.PathPattern != "" {
+			tmpl, err := proxy.ParsePathTemplate(rc.PathPattern, rc.PathTemplate)
+			if err != nil {
+				log.Fatalf("route %s: invalid path template: %v", name, err)
+			}
+			pc.PathTemplate = tmpl
+		}
+		pc.StripQuery = rc.StripQuery
+		pc.IsolateConnections = rc.IsolateConnections
+		pc.DisableHTTP2 = !rc.HTTP2
+		if rc.TLSClientCert != "" || rc.TLSCAFile != "" || rc.TLSInsecure {
+			pc.ClientTLS = &proxy.ClientTLS{
+				CertFile:           rc.TLSClientCert,
+				KeyFile:            rc.TLSClientKey,
+				CAFile:             rc.TLSCAFile,
+				InsecureSkipVerify: rc.TLSInsecure,
+			}
+		}
+		if cfg.Middleware.Chaos && rc.Chaos.FaultRate > 0 {
+			pc.Fault = &proxy.Fault{Type: rc.Chaos.FaultType, Rate: rc.Chaos.FaultRate}
+		}
+		if rc.Critical {
+			pc.DeadLetter = deadLetter
+			pc.DeadLetterMaxBytes = cfg.Upstream.DeadLetterMaxBytes
+		}
+		pc.MaxResponseBytes = cfg.Upstream.MaxResponseBytes
+		if rc.MaxResponseBytes != 0 {
+			pc.MaxResponseBytes = rc.MaxResponseBytes
+		}
+		switch rc.OutboundProxy {
+		case "":
+		case "direct":
+			pc.DirectEgress = true
+		default:
+			pc.OutboundProxy, _ = url.Parse(rc.OutboundProxy) // validated by config.Load
+		}
+		rp, err := proxy.NewBalancedProxy(backends, pc)
+		if err != nil {
+			log.Fatalf("route %s: %v", name, err)
+		}
+		if cfg.Health.Enabled && !alternate {
+			// Probes reach the replicas with the route's TLS and egress settings
+			if probeTransports[name], err = proxy.NewTransport(backends, pc); err != nil {
+				log.Fatalf("route %s: %v", name, err)
+			}
+		}
+		return rp
+	}
+
+	proxies := make(map[string]http.Handler, len(cfg.Routes))
+	flagged := make(map[string]*httputil.ReverseProxy)
+	canaries := make(map[string]admin.VariantSplit)
+	for name, rc := range cfg.Routes {
+		proxies[name] = newProxy(name, rc.URLs, false)
+		if rc.Flag != "" {
+			flagged[name] = newProxy(name, rc.FlagURLs, true)
+		}
+		if len(rc.CanaryURLs) > 0 {
+			split, err := proxy.NewWeightedProxy([]proxy.Variant{
+				{Name: "stable", Handler: proxies[name], Weight: 100 - rc.CanaryWeight},
+				{Name: "canary", Handler: newProxy(name, rc.CanaryURLs, true), Weight: rc.CanaryWeight},
+			}, proxy.VariantPin{Header: rc.CanaryHeader, Cookie: rc.CanaryCookie})
+			if err != nil {
+				log.Fatalf("route %s: %v", name, err)
+			}
+			proxies[name] = split
+			canaries[name] = split
+		}
+	}
+
+	st := newSharedState(cfg)
+
+	// Prometheus metrics, on the admin listener when there is one
+	var registry *metrics.Registry
+	if cfg.Middleware.Metrics {
+		registry = &metrics.Registry{}
+		registry.Register(st.httpMetrics, upstreamMetrics)
+		if asyncLog != nil {
+			registry.Register(metrics.NewCounterFunc("gateway_log_records_dropped_total",
+				"Log records discarded because the async log buffer was full.", func() float64 {
+					return float64(asyncLog.Dropped())
+				}))
+		}
+		if st.rateLimitStats != nil {
+			registry.Register(metrics.NewCounterFunc("gateway_rate_limit_rejections_total",
+				"Requests rejected by the rate limiter.", func() float64 {
+					_, rejected := st.rateLimitStats.Snapshot()
+					return float64(rejected)
+				}))
+		}
+	}
 
 	// Setup routes
-	rt := router.New(authProxy, exampleProxy)
+	rt := router.New(proxies, cfg.Routes)
+	if registry != nil && cfg.Server.AdminPort == "" {
+		rt.SetMetrics(registry)
+	}
+	rt.SetAPINotFound(cfg.NotFound)
+	if cfg.Health.Enabled {
+		prober := health.NewProber(health.Config{
+			Interval: cfg.Health.Interval,
+			Timeout:  cfg.Health.Timeout,
+		}, healthTargets(cfg, probeTransports))
+		defer prober.Stop()
+		rt.SetHealth(prober)
+	}
+	if len(flagged) > 0 {
+		var provider flags.Provider = flags.NewMemory(cfg.Flags.Flags)
+		if cfg.Flags.Provider == "http" {
+			provider = flags.NewHTTP(cfg.Flags.URL, cfg.Flags.Token, cfg.Flags.Timeout)
+		}
+		rt.SetFlags(flags.NewCached(provider, cfg.Flags.CacheTTL), flagged)
+	}
+	if cfg.Middleware.Chaos {
+		logger.Log.Warn("chaos_enabled")
+		rt.EnableChaos()
+	}
 	rt.RegisterRoutes()
 
-	// Build middleware chain
-	handler := middleware.WithRecover(
-		middleware.WithRequestID(
-			middleware.WithLogging(
-				middleware.WithGzip(
-					middleware.WithThrottle(throttle,
-						middleware.WithRateLimit(globalLimiter, perIPLimiter,
-							rt.Handler(),
-						),
-					),
-				),
-			),
-		),
-	)
+	handler := buildHandler(cfg, st, rt)
 
 	// Create HTTP server
 	srv := &http.Server{
@@ -92,10 +353,514 @@ func main() {
 		IdleTimeout:       cfg.Server.IdleTimeout,
 	}
 
+	// Cap streams per HTTP/2 connection so one client can't multiplex past
+	// the intent of the in-flight limit
+	h2 := &http2.Server{
+		MaxConcurrentStreams: cfg.Server.HTTP2MaxConcurrentStreams,
+		IdleTimeout:          cfg.Server.HTTP2IdleTimeout,
+	}
+	if err := http2.ConfigureServer(srv, h2); err != nil {
+		log.Fatalf("http2: %v", err)
+	}
+	logger.Log.Info("http2_configured",
+		"max_concurrent_streams", h2.MaxConcurrentStreams,
+		"idle_timeout", h2.IdleTimeout.String(),
+	)
+
+	// The smuggling guard reads plaintext connections' framing, and
+	// fingerprints are taken during the handshake; both need the
+	// connection context to reach requests
+	srv.ConnContext = middleware.FramingConnContext
+	if cfg.Server.TLSFingerprint {
+		srv.TLSConfig = conntrack.FingerprintConfig(srv.TLSConfig)
+		srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return conntrack.FingerprintConnContext(middleware.FramingConnContext(ctx, c), c)
+		}
+	}
+
+	if cfg.Server.MaxConnLifetime > 0 {
+		lifetime := conntrack.NewLifetime(cfg.Server.MaxConnLifetime)
+		defer lifetime.Stop()
+		srv.ConnState = lifetime.ConnState
+	}
+
 	logger.Log.Info("gateway_listening",
 		"port", cfg.Server.Port,
+		"tls", cfg.Server.TLSCertFile != "",
 		"auth_service", cfg.Upstream.AuthURL,
 		"example_service", cfg.Upstream.ExampleURL,
 	)
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		var err error
+		if cfg.Server.TLSCertFile != "" {
+			err = srv.ListenAndServeTLS(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		} else {
+			var ln net.Listener
+			if ln, err = net.Listen("tcp", srv.Addr); err == nil {
+				err = srv.Serve(middleware.FramingListener(ln))
+			}
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Operator endpoints live on a separate listener that should never be
+	// exposed publicly
+	var adminSrv *http.Server
+	if cfg.Server.AdminPort != "" {
+		adminMux := http.NewServeMux()
+		rateLimitAdmin := admin.RateLimit(st.perKey, st.authPerKey)
+		adminMux.Handle("/admin/ratelimit", rateLimitAdmin)
+		adminMux.Handle("/admin/ratelimit/reset", rateLimitAdmin)
+		adminMux.Handle("/admin/ratelimit/allowlist", admin.AllowList(st.allowList))
+		adminMux.Handle("/admin/load", admin.Load(admin.LoadConfig{
+			WeightInFlight:   cfg.Load.WeightInFlight,
+			WeightLatency:    cfg.Load.WeightLatency,
+			WeightRejections: cfg.Load.WeightRejections,
+			LatencyTarget:    cfg.Load.LatencyTarget,
+		}, admin.LoadSources{
+			Throttle:  st.sem,
+			Latency:   st.latency,
+			RateLimit: st.rateLimitStats,
+		}))
+		adminMux.Handle("/admin/config", admin.Config(cfg.Redacted()))
+		adminMux.Handle("/admin/logging", admin.Logging(asyncLog, cfg.Logging.BufferSize))
+		if len(canaries) > 0 {
+			adminMux.Handle("/admin/canary", admin.Canary(canaries))
+		}
+		if registry != nil {
+			adminMux.Handle("/metrics", registry)
+		}
+
+		adminSrv = &http.Server{
+			Addr:              ":" + cfg.Server.AdminPort,
+			Handler:           adminMux,
+			ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		}
+		logger.Log.Info("admin_listening",
+			"port", cfg.Server.AdminPort,
+		)
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	logger.Log.Info("gateway_shutting_down",
+		"signal", sig.String(),
+		"timeout", cfg.Server.ShutdownTimeout.String(),
+	)
+
+	// Fail readiness first and give the load balancer time to notice,
+	// so it stops routing new requests before we start draining
+	rt.SetReady(false)
+	logger.Log.Info("gateway_pre_stop",
+		"delay", cfg.Server.PreStopDelay.String(),
+	)
+	time.Sleep(cfg.Server.PreStopDelay)
+
+	// Drain in-flight requests; whatever is still running when the grace
+	// period ends is cut off
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Log.Warn("shutdown_timeout",
+			"error", err.Error(),
+		)
+		srv.Close()
+	}
+	if adminSrv != nil {
+		// A deadline of its own: a slow public drain may have used up ctx,
+		// and admin requests are short
+		adminCtx, cancelAdmin := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelAdmin()
+		if err := adminSrv.Shutdown(adminCtx); err != nil {
+			adminSrv.Close()
+		}
+	}
+	st.stop()
+	if errorLog != nil {
+		errorLog.Close()
+	}
+	logger.Log.Info("gateway_stopped")
+
+	// Write out buffered log records, including the two above
+	if asyncLog != nil {
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFlush()
+		asyncLog.Close(flushCtx)
+	}
+}
+
+// sharedState holds instances used by both the middleware chain and the
+// admin endpoints; fields are nil when their feature is disabled
+type sharedState struct {
+	perKey         middleware.KeyedLimiter
+	authPerKey     middleware.KeyedLimiter // nil when tiers are identical
+	sem            *middleware.Semaphore
+	rateLimitStats *middleware.RateLimitStats
+	allowList      *middleware.AllowList // replaced through /admin/ratelimit/allowlist
+	redisLimiter   *redis.Limiter        // nil unless RATE_LIMIT_BACKEND=redis
+	redisClient    *redis.Client
+	latency        *metrics.LatencyWindow
+	httpMetrics    *metrics.HTTP
+}
+
+// stop ends the background goroutines owned by the shared instances
+func (st *sharedState) stop() {
+	if st.perKey != nil {
+		st.perKey.Stop()
+	}
+	if st.authPerKey != nil {
+		st.authPerKey.Stop()
+	}
+	if st.rateLimitStats != nil {
+		st.rateLimitStats.Stop()
+	}
+	if st.redisClient != nil {
+		st.redisClient.Close()
+	}
+}
+
+func newSharedState(cfg *config.Config) *sharedState {
+	st := &sharedState{}
+	if cfg.RateLimit.Enabled {
+		st.perKey = newKeyedLimiter(cfg, cfg.RateLimit.PerIPRPS, cfg.RateLimit.PerIPBurst)
+		if cfg.RateLimit.AuthRPS != cfg.RateLimit.PerIPRPS || cfg.RateLimit.AuthBurst != cfg.RateLimit.PerIPBurst {
+			st.authPerKey = newKeyedLimiter(cfg, cfg.RateLimit.AuthRPS, cfg.RateLimit.AuthBurst)
+		}
+		// Shared buckets in Redis, falling back to the in-memory ones above
+		if cfg.RateLimit.Backend == "redis" {
+			client, err := redis.NewClient(cfg.RateLimit.RedisURL, cfg.RateLimit.RedisTimeout)
+			if err != nil {
+				log.Fatalf("invalid REDIS_URL: %v", err)
+			}
+			st.redisClient = client
+			st.redisLimiter = redis.NewLimiter(client, cfg.RateLimit.RedisKeyPrefix)
+			st.perKey = st.redisLimiter.PerKey("anonymous", redisLimits(cfg, cfg.RateLimit.PerIPRPS, cfg.RateLimit.PerIPBurst), st.perKey)
+			if st.authPerKey != nil {
+				st.authPerKey = st.redisLimiter.PerKey("authenticated", redisLimits(cfg, cfg.RateLimit.AuthRPS, cfg.RateLimit.AuthBurst), st.authPerKey)
+			}
+		}
+		allowList, err := middleware.NewAllowList(cfg.RateLimit.AllowList, cfg.RateLimit.AllowListKeys)
+		if err != nil {
+			log.Fatalf("invalid RATE_LIMIT_ALLOWLIST: %v", err)
+		}
+		st.allowList = allowList
+		st.rateLimitStats = &middleware.RateLimitStats{}
+		if cfg.RateLimit.AlertThreshold > 0 {
+			st.rateLimitStats.WatchRejections(cfg.RateLimit.AlertWindow, cfg.RateLimit.AlertThreshold)
+		}
+	}
+	if cfg.Throttle.Enabled {
+		// Shares only apply once some route is in the class they're for
+		var lowShare, criticalReserve float64
+		for _, rc := range cfg.Routes {
+			switch rc.Priority {
+			case "low":
+				lowShare = cfg.Throttle.LowPriorityShare
+			case "critical":
+				criticalReserve = cfg.Throttle.CriticalReserve
+			}
+		}
+		st.sem = middleware.NewPrioritySemaphore(cfg.Throttle.MaxInFlight, lowShare, criticalReserve)
+	}
+	if cfg.Middleware.Metrics {
+		prefixes := []string{"/api/", "/readyz", "/healthz/live", "/healthz/ready", "/metrics"}
+		for _, rc := range cfg.Routes {
+			prefixes = append(prefixes, rc.PathPrefix)
+		}
+		st.httpMetrics = metrics.NewHTTP(cfg.Upstream.LatencyBuckets, prefixes, cfg.Methods.Allowed)
+		if cfg.Middleware.Exemplars {
+			st.httpMetrics.WithExemplars()
+		}
+	}
+	// Only the admin load endpoint reads the latency window
+	if cfg.Server.AdminPort != "" {
+		st.latency = metrics.NewLatencyWindow(cfg.Load.Window)
+	}
+	return st
+}
+
+// buildHandler wraps next with the global middleware chain in its canonical
+// order. Disabled middleware is left out entirely rather than configured
+// with huge limits.
+func buildHandler(cfg *config.Config, st *sharedState, rt *router.Router) http.Handler {
+	handler, active := middleware.Build(rt.Handler(),
+		middleware.Stage{Name: "start_time", Enabled: true, Wrap: middleware.WithStartTime},
+		middleware.Stage{Name: "recover", Enabled: true, Wrap: middleware.WithRecover},
+		middleware.Stage{Name: "latency_window", Enabled: st.latency != nil, Wrap: func(h http.Handler) http.Handler {
+			return metrics.WithLatencyWindow(st.latency, h)
+		}},
+		middleware.Stage{Name: "metrics", Enabled: st.httpMetrics != nil, Wrap: func(h http.Handler) http.Handler {
+			return metrics.WithMetrics(st.httpMetrics, h)
+		}},
+		middleware.Stage{Name: "static_files", Enabled: len(cfg.Static.Files) > 0, Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithStaticFiles(cfg.Static.Files, h)
+		}},
+		middleware.Stage{Name: "request_id", Enabled: cfg.Middleware.RequestID, Wrap: middleware.WithRequestID},
+		middleware.Stage{Name: "header_size_limit", Enabled: cfg.Headers.MaxBytes > 0, Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithHeaderSizeLimit(cfg.Headers.MaxBytes, h)
+		}},
+		middleware.Stage{Name: "logging", Enabled: cfg.Logging.AccessLog, Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithLogging(middleware.LoggingConfig{TLSFields: cfg.Logging.TLSFields}, h)
+		}},
+		middleware.Stage{Name: "trailers", Enabled: cfg.Middleware.Trailers, Wrap: middleware.WithTrailers},
+		middleware.Stage{Name: "smuggling_guard", Enabled: true, Wrap: middleware.WithSmugglingGuard},
+		middleware.Stage{Name: "cors", Enabled: len(cfg.CORS.AllowedOrigins) > 0, Wrap: func(h http.Handler) http.Handler {
+			// Preflights see the same methods the method checks enforce
+			global := middleware.NewMethodSet(cfg.Methods.Allowed)
+			routeMethods := make(map[string]middleware.MethodSet, len(cfg.Routes))
+			for name, rc := range cfg.Routes {
+				if len(rc.Methods) > 0 {
+					routeMethods[name] = middleware.NewMethodSet(rc.Methods)
+				}
+			}
+			return middleware.WithCORS(middleware.CORSConfig{
+				AllowedOrigins:   cfg.CORS.AllowedOrigins,
+				AllowedMethods:   cfg.CORS.AllowedMethods,
+				AllowedHeaders:   cfg.CORS.AllowedHeaders,
+				ExposedHeaders:   cfg.CORS.ExposedHeaders,
+				AllowCredentials: cfg.CORS.AllowCredentials,
+				MaxAge:           cfg.CORS.MaxAge,
+				Methods: func(r *http.Request) middleware.MethodSet {
+					if name, ok := rt.Match(r); ok {
+						if set, ok := routeMethods[name]; ok {
+							return set
+						}
+					}
+					return global
+				},
+			}, h)
+		}},
+		middleware.Stage{Name: "method_allowlist", Enabled: true, Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithAllowedMethods(middleware.NewMethodSet(cfg.Methods.Allowed), h)
+		}},
+		middleware.Stage{Name: "body_policy", Enabled: cfg.BodyPolicy.Action != "off", Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithBodyPolicy(middleware.BodyPolicyConfig{
+				Methods: cfg.BodyPolicy.Methods,
+				Action:  cfg.BodyPolicy.Action,
+			}, h)
+		}},
+		middleware.Stage{Name: "forwarded_for_limit", Enabled: cfg.Forwarded.MaxEntries > 0, Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithForwardedForLimit(middleware.ForwardedForConfig{
+				MaxEntries: cfg.Forwarded.MaxEntries,
+				Action:     cfg.Forwarded.Action,
+			}, h)
+		}},
+		middleware.Stage{Name: "tls_fingerprint", Enabled: cfg.Server.TLSFingerprint, Wrap: func(h http.Handler) http.Handler {
+			return conntrack.WithFingerprintHeader(cfg.Server.TLSFingerprintHeader, h)
+		}},
+		middleware.Stage{Name: "jwt_auth", Enabled: cfg.JWTEnabled(), Wrap: func(h http.Handler) http.Handler {
+			keys := jwt.NewKeySet(cfg.JWT.JWKSURL, cfg.JWT.Refresh, cfg.JWT.Timeout)
+			// Requests are answered 503 until the keys can be fetched
+			if err := keys.Refresh(context.Background()); err == nil {
+				logger.Log.Info("jwks_loaded",
+					"url", cfg.JWT.JWKSURL,
+				)
+			}
+			return middleware.WithJWTAuth(middleware.JWTConfig{
+				Validator: &jwt.Validator{
+					Keys:     keys,
+					Issuer:   cfg.JWT.Issuer,
+					Audience: cfg.JWT.Audience,
+					Leeway:   cfg.JWT.Leeway,
+				},
+				Required: func(r *http.Request) bool {
+					name, ok := rt.Match(r)
+					return ok && cfg.Routes[name].JWT
+				},
+			}, h)
+		}},
+		middleware.Stage{Name: "api_key_auth", Enabled: len(cfg.APIKeys.Keys) > 0, Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithAPIKeyAuth(middleware.APIKeyConfig{
+				Store:  middleware.NewStaticKeyStore(cfg.APIKeys.Keys),
+				Header: cfg.APIKeys.Header,
+				Required: func(r *http.Request) bool {
+					name, ok := rt.Match(r)
+					return ok && cfg.Routes[name].APIKey
+				},
+			}, h)
+		}},
+		middleware.Stage{Name: "gzip", Enabled: cfg.Middleware.Gzip, Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithGzip(middleware.GzipConfig{
+				Level:     cfg.Gzip.Level,
+				MinBytes:  cfg.Gzip.MinBytes,
+				SkipTypes: cfg.Gzip.SkipTypes,
+			}, h)
+		}},
+		middleware.Stage{Name: "priority", Enabled: cfg.Throttle.Enabled && st.sem.Prioritized(), Wrap: func(h http.Handler) http.Handler {
+			priorities := make(map[string]middleware.Priority, len(cfg.Routes))
+			for name, rc := range cfg.Routes {
+				priorities[name], _ = middleware.ParsePriority(rc.Priority) // validated by config
+			}
+			return middleware.WithPriority(func(r *http.Request) middleware.Priority {
+				name, _ := rt.Match(r)
+				return priorities[name]
+			}, h)
+		}},
+		middleware.Stage{Name: "throttle", Enabled: cfg.Throttle.Enabled, Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithThrottle(st.sem, h)
+		}},
+		middleware.Stage{Name: "rate_limit", Enabled: cfg.RateLimit.Enabled, Wrap: func(h http.Handler) http.Handler {
+			// Per-key limiter key: client IP by default, or the authenticated subject
+			rateLimitKey := middleware.ClientIPKey
+			if cfg.RateLimit.KeyBy == "subject" {
+				rateLimitKey = middleware.SubjectKey(cfg.RateLimit.SubjectClaim)
+			}
+			// Partners are limited per API key wherever they call from
+			if len(cfg.APIKeys.Keys) > 0 {
+				rateLimitKey = middleware.APIKeyRateKey(rateLimitKey)
+			}
+
+			global := newLimiter(cfg, cfg.RateLimit.GlobalRPS, cfg.RateLimit.GlobalBurst)
+			if st.redisLimiter != nil {
+				global = st.redisLimiter.Bucket("global", redisLimits(cfg, cfg.RateLimit.GlobalRPS, cfg.RateLimit.GlobalBurst), global)
+			}
+
+			return middleware.WithRateLimit(middleware.RateLimitConfig{
+				Global:        global,
+				PerKey:        st.perKey,
+				Authenticated: st.authPerKey,
+				Stats:         st.rateLimitStats,
+				Key:           rateLimitKey,
+				AllowList:     st.allowList,
+				APIKeyHeader:  cfg.APIKeys.Header,
+			}, h)
+		}},
+		middleware.Stage{Name: "experiments", Enabled: len(cfg.Experiments.Experiments) > 0, Wrap: func(h http.Handler) http.Handler {
+			experiments := make([]middleware.Experiment, len(cfg.Experiments.Experiments))
+			for i, e := range cfg.Experiments.Experiments {
+				experiments[i].Name = e.Name
+				for _, b := range e.Buckets {
+					experiments[i].Buckets = append(experiments[i].Buckets, middleware.ExperimentBucket{Name: b.Name, Percent: b.Percent})
+				}
+			}
+			return middleware.WithExperiments(middleware.ExperimentConfig{
+				Experiments: experiments,
+				Header:      cfg.Experiments.Header,
+				Claim:       cfg.Experiments.Claim,
+				Cookie:      cfg.Experiments.Cookie,
+				Secret:      []byte(cfg.Experiments.CookieSecret),
+				MaxAge:      cfg.Experiments.CookieMaxAge,
+			}, h)
+		}},
+		middleware.Stage{Name: "idempotency", Enabled: cfg.Idempotency.Enabled, Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithIdempotency(middleware.NewIdempotencyCache(middleware.IdempotencyConfig{
+				Header:       cfg.Idempotency.Header,
+				Methods:      cfg.Idempotency.Methods,
+				TTL:          cfg.Idempotency.TTL,
+				MaxEntries:   cfg.Idempotency.MaxEntries,
+				MaxBytes:     cfg.Idempotency.MaxBytes,
+				APIKeyHeader: cfg.APIKeys.Header,
+			}), h)
+		}},
+		middleware.Stage{Name: "timeout", Enabled: cfg.Server.RequestTimeout > 0, Wrap: func(h http.Handler) http.Handler {
+			return middleware.WithTimeout(cfg.Server.RequestTimeout, h)
+		}},
+	)
+
+	logger.Log.Info("middleware_chain",
+		"active", active,
+	)
+	return handler
+}
+
+// newLimiter builds the RATE_LIMIT_ALGORITHM limiter for rps. A sliding
+// window allows rps requests per second over RATE_LIMIT_WINDOW and has no
+// separate burst.
+func newLimiter(cfg *config.Config, rps, burst float64) middleware.Limiter {
+	if cfg.RateLimit.Algorithm == "sliding_window" {
+		return middleware.NewSlidingWindow(windowLimit(cfg, rps), cfg.RateLimit.Window, cfg.LimiterTTL)
+	}
+	return middleware.NewTokenBucket(rps, burst, cfg.LimiterTTL)
+}
+
+// newKeyedLimiter is newLimiter per client key
+func newKeyedLimiter(cfg *config.Config, rps, burst float64) middleware.KeyedLimiter {
+	if cfg.RateLimit.Algorithm == "sliding_window" {
+		return middleware.NewPerKeySlidingWindow(windowLimit(cfg, rps), cfg.RateLimit.Window, cfg.LimiterTTL)
+	}
+	return middleware.NewPerKeyTokenBucket(rps, burst, cfg.LimiterTTL).
+		WithInitialFraction(cfg.RateLimit.InitialFraction)
+}
+
+// redisLimits describes a shared token bucket for rps and burst
+func redisLimits(cfg *config.Config, rps, burst float64) redis.Limits {
+	return redis.Limits{
+		Rate:            rps,
+		Burst:           burst,
+		InitialFraction: cfg.RateLimit.InitialFraction,
+		TTL:             cfg.LimiterTTL,
+	}
+}
+
+// windowLimit converts rps to requests per RATE_LIMIT_WINDOW, at least one
+func windowLimit(cfg *config.Config, rps float64) int {
+	return max(int(math.Round(rps*cfg.RateLimit.Window.Seconds())), 1)
+}
+
+// routeAttempts is how many upstream attempts a request on rc gets.
+// Upstreams with side effects on every call never see a second attempt, so
+// ROUTE_<NAME>_NO_RETRY overrides both the route's retries and
+// RETRY_ATTEMPTS.
+func routeAttempts(cfg *config.Config, rc config.RouteConfig) int {
+	switch {
+	case rc.NoRetry:
+		return 1
+	case rc.Attempts > 0:
+		return rc.Attempts
+	}
+	return cfg.Retry.Attempts
+}
+
+// routeRetryMatch is the body-based retry predicate for rc: its own
+// ROUTE_<NAME>_RETRY_BODY_* settings when it has a match value, otherwise
+// the global one (nil when RETRY_BODY_MATCH is unset too)
+func routeRetryMatch(cfg *config.Config, rc config.RouteConfig, global *proxy.RetryMatch) *proxy.RetryMatch {
+	if rc.RetryBodyMatch == "" {
+		return global
+	}
+	maxBytes := rc.RetryBodyMaxBytes
+	if maxBytes == 0 {
+		maxBytes = cfg.Retry.BodyMaxBytes
+	}
+	return &proxy.RetryMatch{
+		Status:   rc.RetryBodyStatus,
+		JSONPath: rc.RetryBodyJSONPath,
+		Value:    rc.RetryBodyMatch,
+		MaxBytes: maxBytes,
+	}
+}
+
+// healthTargets lists every upstream replica of every route for probing
+func healthTargets(cfg *config.Config, transports map[string]http.RoundTripper) []health.Target {
+	var targets []health.Target
+	for name, rc := range cfg.Routes {
+		path := rc.HealthPath
+		if path == "" {
+			path = cfg.Health.Path
+		}
+		var body *health.BodyMatch
+		if rc.HealthBodyMatch != "" {
+			body = &health.BodyMatch{JSONPath: rc.HealthBodyJSONPath, Value: rc.HealthBodyMatch}
+		}
+		for _, raw := range rc.URLs {
+			u, _ := url.Parse(raw) // validated by config.Load
+			targets = append(targets, health.Target{
+				Route:     name,
+				URL:       u,
+				Path:      path,
+				Critical:  rc.Critical,
+				Transport: transports[name],
+				Body:      body,
+			})
+		}
+	}
+	return targets
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"apigateway/internal/config"
+	"apigateway/internal/health"
+	"apigateway/internal/logger"
+	"apigateway/internal/proxy"
+	"apigateway/internal/router"
+)
+
+func TestRouteAttempts(t *testing.T) {
+	cfg := &config.Config{Retry: config.RetryConfig{Attempts: 3}}
+	tests := []struct {
+		name string
+		rc   config.RouteConfig
+		want int
+	}{
+		{"global", config.RouteConfig{}, 3},
+		{"route retries", config.RouteConfig{Attempts: 5}, 5},
+		{"no retry", config.RouteConfig{NoRetry: true}, 1},
+		{"no retry beats route retries", config.RouteConfig{NoRetry: true, Attempts: 5}, 1},
+	}
+	for _, tt := range tests {
+		if got := routeAttempts(cfg, tt.rc); got != tt.want {
+			t.Errorf("%s: %d attempts, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDisabledLimitersLeftOutOfChain(t *testing.T) {
+	saved := logger.Log
+	defer func() { logger.Log = saved }()
+
+	// active builds the chain and reads the stage names it logs
+	active := func() map[string]bool {
+		cfg, err := config.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf strings.Builder
+		logger.Log = slog.New(slog.NewJSONHandler(&buf, nil))
+		buildHandler(cfg, newSharedState(cfg), router.New(nil, cfg.Routes))
+
+		var record struct {
+			Active []string `json:"active"`
+		}
+		if err := json.Unmarshal([]byte(buf.String()), &record); err != nil {
+			t.Fatal(err)
+		}
+		set := make(map[string]bool, len(record.Active))
+		for _, name := range record.Active {
+			set[name] = true
+		}
+		return set
+	}
+
+	chain := active()
+	if !chain["throttle"] || !chain["rate_limit"] {
+		t.Fatalf("default chain %v lacks throttle or rate_limit", chain)
+	}
+
+	t.Setenv("THROTTLE_ENABLED", "false")
+	t.Setenv("RATE_LIMIT_ENABLED", "false")
+	chain = active()
+	for _, name := range []string{"throttle", "rate_limit"} {
+		if chain[name] {
+			t.Errorf("%s still in the chain with its limiter disabled", name)
+		}
+	}
+}
+
+func TestRouteRetryMatch(t *testing.T) {
+	cfg := &config.Config{Retry: config.RetryConfig{BodyMaxBytes: 65536}}
+	global := &proxy.RetryMatch{JSONPath: "error", Value: "try_again", MaxBytes: 65536}
+
+	if got := routeRetryMatch(cfg, config.RouteConfig{}, global); got != global {
+		t.Errorf("route without overrides got %+v, want the global predicate", got)
+	}
+	if got := routeRetryMatch(cfg, config.RouteConfig{}, nil); got != nil {
+		t.Errorf("route without overrides got %+v with no global predicate", got)
+	}
+
+	got := routeRetryMatch(cfg, config.RouteConfig{RetryBodyMatch: "busy", RetryBodyStatus: 200}, global)
+	want := proxy.RetryMatch{Status: 200, Value: "busy", MaxBytes: 65536}
+	if got == nil || *got != want {
+		t.Errorf("route predicate = %+v, want %+v (own settings, global size cap)", got, want)
+	}
+	got = routeRetryMatch(cfg, config.RouteConfig{RetryBodyMatch: "busy", RetryBodyJSONPath: "status", RetryBodyMaxBytes: 1024}, nil)
+	want = proxy.RetryMatch{JSONPath: "status", Value: "busy", MaxBytes: 1024}
+	if got == nil || *got != want {
+		t.Errorf("route predicate = %+v, want %+v", got, want)
+	}
+}
+
+func TestHealthTargetsBodyMatch(t *testing.T) {
+	cfg := &config.Config{
+		Health: config.HealthConfig{Path: "/health"},
+		Routes: map[string]config.RouteConfig{
+			"users":  {URLs: []string{"http://a", "http://b"}, HealthBodyMatch: "ok", HealthBodyJSONPath: "status"},
+			"orders": {URLs: []string{"http://c"}},
+		},
+	}
+	for _, target := range healthTargets(cfg, nil) {
+		switch target.Route {
+		case "users":
+			if target.Body == nil || *target.Body != (health.BodyMatch{JSONPath: "status", Value: "ok"}) {
+				t.Errorf("%s: body matcher %+v", target.URL, target.Body)
+			}
+		case "orders":
+			if target.Body != nil {
+				t.Errorf("%s: unexpected body matcher %+v", target.URL, target.Body)
+			}
+		}
+	}
+}
@@ -3,3 +3,13 @@ module apigateway
 go 1.21
 
 require github.com/google/uuid v1.6.0
+
+require (
+	github.com/alicebob/miniredis/v2 v2.33.0
+	golang.org/x/net v0.30.0
+	google.golang.org/protobuf v1.34.2
+	gopkg.in/yaml.v3 v3.0.1
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/text v0.19.0 // indirect
+)
@@ -0,0 +1,329 @@
+package admin
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/metrics"
+	"apigateway/internal/middleware"
+)
+
+// Handlers in this package are for operators and must only be mounted on
+// the admin listener (ADMIN_PORT), never on the public one.
+
+// ---------------- Rate Limit ----------------
+
+// RateLimit serves GET /admin/ratelimit?key=K to inspect a per-key limiter
+// and POST /admin/ratelimit/reset?key=K to restore its full limit. Keys are the limiter
+// keys: a client IP, or "sub:<subject>" when keyed by subject. anonymous
+// is the default tier; authenticated may be nil when tiers are shared.
+func RateLimit(anonymous, authenticated middleware.KeyedLimiter) http.Handler {
+	tiers := []struct {
+		name    string
+		limiter middleware.KeyedLimiter
+	}{{"anonymous", anonymous}, {"authenticated", authenticated}}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if anonymous == nil {
+			writeJSON(w, http.StatusNotFound, map[string]any{"error": "rate limiting disabled"})
+			return
+		}
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "missing key"})
+			return
+		}
+
+		switch r.URL.Path {
+		case "/admin/ratelimit":
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", http.MethodGet)
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+				return
+			}
+			var found []map[string]any
+			for _, t := range tiers {
+				if t.limiter == nil {
+					continue
+				}
+				if state, ok := t.limiter.Inspect(key); ok {
+					found = append(found, map[string]any{
+						"tier":      t.name,
+						"tokens":    state.Tokens,
+						"burst":     state.Burst,
+						"last_seen": state.LastSeen.UTC().Format(time.RFC3339Nano),
+					})
+				}
+			}
+			if len(found) == 0 {
+				writeJSON(w, http.StatusNotFound, map[string]any{"error": "unknown key", "key": key})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"key": key, "buckets": found})
+
+		case "/admin/ratelimit/reset":
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+				return
+			}
+			reset := false
+			for _, t := range tiers {
+				if t.limiter != nil && t.limiter.Reset(key) {
+					reset = true
+				}
+			}
+			if !reset {
+				writeJSON(w, http.StatusNotFound, map[string]any{"error": "unknown key", "key": key})
+				return
+			}
+			logger.Log.Info("rate_limit_reset",
+				slog.String("key", key),
+				slog.String("remote_addr", r.RemoteAddr),
+			)
+			writeJSON(w, http.StatusOK, map[string]any{"key": key, "reset": true})
+
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// AllowList serves GET /admin/ratelimit/allowlist, the IPs/CIDRs and the
+// number of API keys that bypass rate limiting, and PUT with a JSON body
+// {"cidrs": [...], "keys": [...]} replacing both without a restart. list
+// is nil when rate limiting is disabled.
+func AllowList(list *middleware.AllowList) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if list == nil {
+			writeJSON(w, http.StatusNotFound, map[string]any{"error": "rate limiting disabled"})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			cidrs, keys := list.Snapshot()
+			writeJSON(w, http.StatusOK, map[string]any{"cidrs": cidrs, "keys": keys})
+
+		case http.MethodPut:
+			var body struct {
+				CIDRs []string `json:"cidrs"`
+				Keys  []string `json:"keys"`
+			}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid JSON body"})
+				return
+			}
+			if err := list.Update(body.CIDRs, body.Keys); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+				return
+			}
+			cidrs, keys := list.Snapshot()
+			logger.Log.Info("rate_limit_allowlist_updated",
+				slog.Int("cidrs", len(cidrs)),
+				slog.Int("keys", keys),
+				slog.String("remote_addr", r.RemoteAddr),
+			)
+			writeJSON(w, http.StatusOK, map[string]any{"cidrs": cidrs, "keys": keys})
+
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+		}
+	})
+}
+
+// ---------------- Load ----------------
+
+// LoadConfig weights the components of the load figure. A zero weight
+// drops a component; components whose source is disabled are skipped.
+type LoadConfig struct {
+	WeightInFlight   float64
+	WeightLatency    float64
+	WeightRejections float64
+	LatencyTarget    time.Duration // p95 at which the latency component reads 1.0
+}
+
+// LoadSources are the live instances the load figure is computed from;
+// any may be nil when the corresponding feature is disabled
+type LoadSources struct {
+	Throttle  *middleware.Semaphore
+	Latency   *metrics.LatencyWindow
+	RateLimit *middleware.RateLimitStats
+}
+
+// Load serves GET /admin/load: a weighted average of normalized in-flight
+// utilization, p95 latency against a target, and the rate-limit rejection
+// rate since the previous call. 1.0 means "at capacity"; values can exceed
+// it when latency overshoots the target.
+func Load(cfg LoadConfig, src LoadSources) http.Handler {
+	var (
+		mu                        sync.Mutex
+		lastAllowed, lastRejected uint64
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+			return
+		}
+
+		components := map[string]any{}
+		var sum, weights float64
+		add := func(name string, value, weight float64, detail map[string]any) {
+			detail["value"] = value
+			detail["weight"] = weight
+			components[name] = detail
+			if weight > 0 {
+				sum += value * weight
+				weights += weight
+			}
+		}
+
+		if src.Throttle != nil {
+			inFlight, capacity := src.Throttle.InFlight(), src.Throttle.Capacity()
+			add("in_flight", float64(inFlight)/float64(capacity), cfg.WeightInFlight, map[string]any{
+				"in_flight":     inFlight,
+				"max_in_flight": capacity,
+			})
+		}
+
+		if src.Latency != nil && cfg.LatencyTarget > 0 {
+			p95 := src.Latency.Quantile(0.95)
+			add("latency", float64(p95)/float64(cfg.LatencyTarget), cfg.WeightLatency, map[string]any{
+				"p95_ms":    float64(p95) / float64(time.Millisecond),
+				"target_ms": float64(cfg.LatencyTarget) / float64(time.Millisecond),
+			})
+		}
+
+		if src.RateLimit != nil {
+			allowed, rejected := src.RateLimit.Snapshot()
+			mu.Lock()
+			dAllowed, dRejected := allowed-lastAllowed, rejected-lastRejected
+			lastAllowed, lastRejected = allowed, rejected
+			mu.Unlock()
+
+			rate := 0.0
+			if total := dAllowed + dRejected; total > 0 {
+				rate = float64(dRejected) / float64(total)
+			}
+			add("rejections", rate, cfg.WeightRejections, map[string]any{
+				"allowed":  dAllowed,
+				"rejected": dRejected,
+			})
+		}
+
+		load := 0.0
+		if weights > 0 {
+			load = sum / weights
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"load":       load,
+			"components": components,
+		})
+	})
+}
+
+// ---------------- Canary ----------------
+
+// VariantSplit is a route's traffic split between its "stable" and
+// "canary" variants, e.g. a *proxy.WeightedProxy
+type VariantSplit interface {
+	Weights() map[string]int
+	SetWeights(weights map[string]int) error
+}
+
+// Canary serves GET /admin/canary, the current split of every canary
+// route, and POST /admin/canary?route=R&weight=P, which sends P percent of
+// route R's traffic to its canary and the rest to stable. Clients pinned
+// by cookie stay put unless their variant's weight drops to 0.
+func Canary(routes map[string]VariantSplit) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			out := make(map[string]any, len(routes))
+			for name, split := range routes {
+				out[name] = split.Weights()
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"routes": out})
+
+		case http.MethodPost:
+			name := r.URL.Query().Get("route")
+			split, ok := routes[name]
+			if !ok {
+				writeJSON(w, http.StatusNotFound, map[string]any{"error": "unknown canary route", "route": name})
+				return
+			}
+			weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+			if err != nil || weight < 0 || weight > 100 {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "weight must be 0-100"})
+				return
+			}
+			if err := split.SetWeights(map[string]int{"canary": weight, "stable": 100 - weight}); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+				return
+			}
+			logger.Log.Info("canary_weight_changed",
+				slog.String("route", name),
+				slog.Int("weight", weight),
+				slog.String("remote_addr", r.RemoteAddr),
+			)
+			writeJSON(w, http.StatusOK, map[string]any{"route": name, "weights": split.Weights()})
+
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+		}
+	})
+}
+
+// ---------------- Config ----------------
+
+// Config serves GET /admin/config: the effective configuration after
+// environment, file, and default merging. view must already have secrets
+// redacted; it is encoded as-is on every request.
+func Config(view any) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, view)
+	})
+}
+
+// ---------------- Logging ----------------
+
+// Logging serves GET /admin/logging: whether records go through the async
+// buffer, and how many it has dropped because it was full. async is nil
+// when LOG_ASYNC is off.
+func Logging(async *logger.AsyncHandler, bufferSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]any{"error": "method not allowed"})
+			return
+		}
+		if async == nil {
+			writeJSON(w, http.StatusOK, map[string]any{"async": false})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"async":       true,
+			"buffer_size": bufferSize,
+			"dropped":     async.Dropped(),
+		})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,262 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/metrics"
+	"apigateway/internal/middleware"
+	"apigateway/internal/proxy"
+)
+
+// do serves one request and decodes the JSON answer, nil if there is none
+func do(t *testing.T, h http.Handler, method, target, body string) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		return rec, nil
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("%s %s: Cache-Control = %q", method, target, cc)
+	}
+	var out map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+		t.Fatalf("%s %s: %v in %q", method, target, err, rec.Body.String())
+	}
+	return rec, out
+}
+
+func TestCanary(t *testing.T) {
+	split, err := proxy.NewWeightedProxy([]proxy.Variant{
+		{Name: "stable", Handler: http.NotFoundHandler(), Weight: 100},
+		{Name: "canary", Handler: http.NotFoundHandler()},
+	}, proxy.VariantPin{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Canary(map[string]VariantSplit{"orders": split})
+
+	rec, out := do(t, h, http.MethodGet, "/admin/canary", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET status = %d", rec.Code)
+	}
+	if w := out["routes"].(map[string]any)["orders"].(map[string]any); w["stable"] != 100.0 || w["canary"] != 0.0 {
+		t.Errorf("GET weights = %v", w)
+	}
+
+	rec, out = do(t, h, http.MethodPost, "/admin/canary?route=orders&weight=25", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST status = %d: %v", rec.Code, out)
+	}
+	if w := split.Weights(); w["canary"] != 25 || w["stable"] != 75 {
+		t.Errorf("weights after POST = %v", w)
+	}
+	if w := out["weights"].(map[string]any); w["canary"] != 25.0 {
+		t.Errorf("POST answered %v", out)
+	}
+
+	for _, tc := range []struct {
+		method, target string
+		status         int
+	}{
+		{http.MethodPost, "/admin/canary?route=payments&weight=10", http.StatusNotFound},
+		{http.MethodPost, "/admin/canary?weight=10", http.StatusNotFound},
+		{http.MethodPost, "/admin/canary?route=orders", http.StatusBadRequest},
+		{http.MethodPost, "/admin/canary?route=orders&weight=ten", http.StatusBadRequest},
+		{http.MethodPost, "/admin/canary?route=orders&weight=-1", http.StatusBadRequest},
+		{http.MethodPost, "/admin/canary?route=orders&weight=101", http.StatusBadRequest},
+		{http.MethodDelete, "/admin/canary?route=orders&weight=10", http.StatusMethodNotAllowed},
+	} {
+		if rec, _ := do(t, h, tc.method, tc.target, ""); rec.Code != tc.status {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.target, rec.Code, tc.status)
+		}
+	}
+	if w := split.Weights(); w["canary"] != 25 {
+		t.Errorf("rejected requests changed weights to %v", w)
+	}
+
+	// Both ends of the range are valid splits
+	for _, weight := range []string{"0", "100"} {
+		if rec, out := do(t, h, http.MethodPost, "/admin/canary?route=orders&weight="+weight, ""); rec.Code != http.StatusOK {
+			t.Errorf("weight=%s: %d %v", weight, rec.Code, out)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	anonymous := middleware.NewPerKeySlidingWindow(10, time.Minute, time.Minute)
+	defer anonymous.Stop()
+	authenticated := middleware.NewPerKeySlidingWindow(100, time.Minute, time.Minute)
+	defer authenticated.Stop()
+	anonymous.Get("10.0.0.1").Allow(time.Now())
+	authenticated.Get("10.0.0.1").Allow(time.Now())
+	authenticated.Get("sub:alice").Allow(time.Now())
+	h := RateLimit(anonymous, authenticated)
+
+	rec, out := do(t, h, http.MethodGet, "/admin/ratelimit?key=10.0.0.1", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("inspect = %d %v", rec.Code, out)
+	}
+	buckets := out["buckets"].([]any)
+	if len(buckets) != 2 {
+		t.Fatalf("buckets = %v, want both tiers", buckets)
+	}
+	if b := buckets[0].(map[string]any); b["tier"] != "anonymous" || b["tokens"] != 9.0 || b["burst"] != 10.0 {
+		t.Errorf("anonymous bucket = %v", b)
+	}
+
+	if rec, out := do(t, h, http.MethodPost, "/admin/ratelimit/reset?key=sub:alice", ""); rec.Code != http.StatusOK || out["reset"] != true {
+		t.Fatalf("reset = %d %v", rec.Code, out)
+	}
+	if state, _ := authenticated.Inspect("sub:alice"); state.Tokens != 100 {
+		t.Errorf("tokens after reset = %v", state.Tokens)
+	}
+
+	for _, tc := range []struct {
+		method, target string
+		status         int
+		allow          string
+	}{
+		{http.MethodGet, "/admin/ratelimit", http.StatusBadRequest, ""},
+		{http.MethodGet, "/admin/ratelimit?key=10.9.9.9", http.StatusNotFound, ""},
+		{http.MethodPost, "/admin/ratelimit/reset?key=10.9.9.9", http.StatusNotFound, ""},
+		{http.MethodPost, "/admin/ratelimit?key=10.0.0.1", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodGet, "/admin/ratelimit/reset?key=10.0.0.1", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodGet, "/admin/ratelimit/other?key=10.0.0.1", http.StatusNotFound, ""},
+	} {
+		rec, _ := do(t, h, tc.method, tc.target, "")
+		if rec.Code != tc.status || rec.Header().Get("Allow") != tc.allow {
+			t.Errorf("%s %s = %d Allow %q, want %d Allow %q", tc.method, tc.target, rec.Code, rec.Header().Get("Allow"), tc.status, tc.allow)
+		}
+	}
+
+	if rec, _ := do(t, RateLimit(nil, nil), http.MethodGet, "/admin/ratelimit?key=10.0.0.1", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("rate limiting disabled: %d", rec.Code)
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	list, err := middleware.NewAllowList([]string{"10.0.0.0/8"}, []string{"secret-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := AllowList(list)
+
+	rec, out := do(t, h, http.MethodGet, "/admin/ratelimit/allowlist", "")
+	if rec.Code != http.StatusOK || out["keys"] != 1.0 || len(out["cidrs"].([]any)) != 1 {
+		t.Fatalf("GET = %d %v", rec.Code, out)
+	}
+	if strings.Contains(rec.Body.String(), "secret-key") {
+		t.Fatal("allow-listed key exposed")
+	}
+
+	rec, out = do(t, h, http.MethodPut, "/admin/ratelimit/allowlist", `{"cidrs": ["192.0.2.1", "198.51.100.0/24"], "keys": []}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %d %v", rec.Code, out)
+	}
+	if cidrs, keys := list.Snapshot(); len(cidrs) != 2 || cidrs[0] != "192.0.2.1/32" || keys != 0 {
+		t.Fatalf("after PUT: %v, %d keys", cidrs, keys)
+	}
+
+	for _, body := range []string{`{"cidrs": ["not-an-ip"]}`, `{"cidrs": `, `["10.0.0.0/8"]`} {
+		if rec, _ := do(t, h, http.MethodPut, "/admin/ratelimit/allowlist", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s = %d, want 400", body, rec.Code)
+		}
+	}
+	if cidrs, _ := list.Snapshot(); len(cidrs) != 2 {
+		t.Errorf("rejected PUT changed the list to %v", cidrs)
+	}
+
+	if rec, _ := do(t, h, http.MethodPost, "/admin/ratelimit/allowlist", "{}"); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, PUT" {
+		t.Errorf("POST = %d Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	if rec, _ := do(t, AllowList(nil), http.MethodGet, "/admin/ratelimit/allowlist", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("rate limiting disabled: %d", rec.Code)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	latency := metrics.NewLatencyWindow(10)
+	for i := 0; i < 10; i++ {
+		latency.Observe(200 * time.Millisecond)
+	}
+	stats := &middleware.RateLimitStats{}
+	perKey := middleware.NewPerKeySlidingWindow(1, time.Minute, time.Minute)
+	defer perKey.Stop()
+	limited := middleware.WithRateLimit(middleware.RateLimitConfig{
+		Global: middleware.NewTokenBucket(1000, 1000, 0),
+		PerKey: perKey,
+		Stats:  stats,
+	}, http.NotFoundHandler())
+	for i := 0; i < 4; i++ {
+		limited.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	h := Load(LoadConfig{WeightInFlight: 1, WeightLatency: 1, WeightRejections: 2, LatencyTarget: 100 * time.Millisecond},
+		LoadSources{Throttle: middleware.NewSemaphore(10), Latency: latency, RateLimit: stats})
+
+	// in_flight 0, latency 2.0, rejections 3 of 4: (0 + 2 + 0.75*2) / 4
+	rec, out := do(t, h, http.MethodGet, "/admin/load", "")
+	if rec.Code != http.StatusOK || out["load"] != 0.875 {
+		t.Fatalf("load = %d %v", rec.Code, out)
+	}
+	components := out["components"].(map[string]any)
+	if c := components["rejections"].(map[string]any); c["allowed"] != 1.0 || c["rejected"] != 3.0 {
+		t.Errorf("rejections = %v", c)
+	}
+	if c := components["latency"].(map[string]any); c["p95_ms"] != 200.0 || c["target_ms"] != 100.0 {
+		t.Errorf("latency = %v", c)
+	}
+
+	// Rejections are counted since the previous call
+	if _, out := do(t, h, http.MethodGet, "/admin/load", ""); out["load"] != 0.5 {
+		t.Errorf("second load = %v, want 0.5", out["load"])
+	}
+
+	// Disabled sources are left out
+	rec, out = do(t, Load(LoadConfig{WeightInFlight: 1}, LoadSources{}), http.MethodGet, "/admin/load", "")
+	if rec.Code != http.StatusOK || out["load"] != 0.0 || len(out["components"].(map[string]any)) != 0 {
+		t.Errorf("no sources = %d %v", rec.Code, out)
+	}
+
+	if rec, _ := do(t, h, http.MethodPost, "/admin/load", ""); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET" {
+		t.Errorf("POST = %d Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestConfig(t *testing.T) {
+	h := Config(map[string]any{"Flags": map[string]any{"Token": "[REDACTED]"}})
+	rec, out := do(t, h, http.MethodGet, "/admin/config", "")
+	if rec.Code != http.StatusOK || out["Flags"].(map[string]any)["Token"] != "[REDACTED]" {
+		t.Fatalf("GET = %d %v", rec.Code, out)
+	}
+	if rec, _ := do(t, h, http.MethodPut, "/admin/config", "{}"); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET" {
+		t.Errorf("PUT = %d Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestLogging(t *testing.T) {
+	if rec, out := do(t, Logging(nil, 0), http.MethodGet, "/admin/logging", ""); rec.Code != http.StatusOK || out["async"] != false {
+		t.Errorf("sync logging = %d %v", rec.Code, out)
+	}
+
+	async := logger.NewAsyncHandler(slog.NewTextHandler(io.Discard, nil), 64)
+	defer async.Close(context.Background())
+	h := Logging(async, 64)
+	rec, out := do(t, h, http.MethodGet, "/admin/logging", "")
+	if rec.Code != http.StatusOK || out["async"] != true || out["buffer_size"] != 64.0 || out["dropped"] != 0.0 {
+		t.Errorf("async logging = %d %v", rec.Code, out)
+	}
+	if rec, _ := do(t, h, http.MethodDelete, "/admin/logging", ""); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET" {
+		t.Errorf("DELETE = %d Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
@@ -1,55 +1,475 @@
 package config
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
+	"mime"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"apigateway/internal/middleware"
+	"apigateway/internal/protobuf"
+	"apigateway/internal/schema"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Config holds all application configuration
 type Config struct {
-	Server     ServerConfig
-	Upstream   UpstreamConfig
-	Throttle   ThrottleConfig
-	RateLimit  RateLimitConfig
-	Retry      RetryConfig
-	Logging    LoggingConfig
-	LimiterTTL time.Duration
+	Server      ServerConfig
+	Upstream    UpstreamConfig
+	Methods     MethodPolicyConfig
+	NotFound    APINotFoundConfig
+	Load        LoadConfig
+	BodyPolicy  BodyPolicyConfig
+	Forwarded   ForwardedForConfig
+	Headers     HeaderLimitConfig
+	CORS        CORSConfig
+	Gzip        GzipConfig
+	Idempotency IdempotencyConfig
+	Health      HealthConfig
+	Experiments ExperimentConfig
+	Flags       FlagConfig
+	JWT         JWTConfig
+	APIKeys     APIKeyConfig
+	Throttle    ThrottleConfig
+	RateLimit   RateLimitConfig
+	Retry       RetryConfig
+	Logging     LoggingConfig
+	Middleware  MiddlewareConfig
+	Static      StaticConfig
+	LimiterTTL  time.Duration
+
+	// Routes holds per-route overrides keyed by route name ("auth", "example")
+	Routes map[string]RouteConfig
+}
+
+// RouteConfig holds per-route overrides; zero values fall back to global defaults
+type RouteConfig struct {
+	PathPrefix  string   // request paths with this prefix use the route
+	Hosts       []string // requests for these hosts use the route, whatever their path
+	StripPrefix bool     // remove PathPrefix before forwarding
+	Attempts    int      // upstream attempts including retries (0 = RETRY_ATTEMPTS)
+
+	URLs     []string `redact:"userinfo"` // upstream replicas
+	Weights  []int    // relative traffic share per URL (empty = equal)
+	Balancer string   // load balancing policy across URLs
+	HashOn   string   // consistent_hash key: ip, path, header:<Name> or cookie:<Name>
+
+	// Header-driven backend choice ahead of balancing: header value -> URL
+	SelectHeader   string
+	SelectBackends map[string]string `redact:"userinfo"`
+
+	Timeout               time.Duration // deadline for the whole proxied request
+	ResponseHeaderTimeout time.Duration // time to wait for upstream response headers
+	OutboundProxy         string        `redact:"userinfo"` // egress proxy URL, "direct", or empty for the environment
+	TLSMinVersion         uint16        // tls.VersionTLS* floor for the upstream connection
+	TLSMaxVersion         uint16        // tls.VersionTLS* ceiling (0 = newest supported)
+	LegacyTLS             bool          // opt-in required for a floor below TLS 1.2
+	TLSClientCert         string        // PEM client certificate for mutual TLS
+	TLSClientKey          string        // PEM key for TLSClientCert
+	TLSCAFile             string        // PEM bundle trusted instead of the system roots
+	TLSInsecure           bool          // skip upstream certificate verification (dev only)
+	IsolateConnections    bool          // separate transport (pool, TLS sessions, HTTP/2 connections) per URL
+	HTTP2                 bool          // false speaks HTTP/1.1 only to the upstream
+	MaxResponseBytes      int64         // upstream body cap; 0 uses the global value, negative disables
+	FlushInterval         time.Duration // response streaming; negative flushes every write
+	Critical              bool          // dead-letter failed non-idempotent requests; gates readiness when probing
+	HealthPath            string        // probe path, overriding HEALTH_PROBE_PATH
+	HealthBodyMatch       string        // probe body must contain this, or equal it at HealthBodyJSONPath
+	HealthBodyJSONPath    string        // dot-separated JSON path for HealthBodyMatch
+	NoRetry               bool          // single attempt, overriding RETRY_ATTEMPTS
+	MaxConcurrent         int           // in-flight requests on this route (0 = unlimited)
+	FairQueue             bool          // hand freed slots to waiting clients in turn
+
+	// Body-based retry predicate replacing RETRY_BODY_* on this route (empty
+	// RetryBodyMatch keeps the global one)
+	RetryBodyMatch    string
+	RetryBodyJSONPath string
+	RetryBodyStatus   int   // 0 = any status
+	RetryBodyMaxBytes int64 // 0 = RETRY_BODY_MAX_BYTES
+
+	// Coalescing of concurrent identical GET/HEAD requests (opt-in)
+	Coalesce         bool
+	CoalesceHeaders  []string // request headers added to the method+URL key
+	CoalesceMaxBytes int64
+
+	// Fresh GET responses answered from memory (0 TTL disables); private
+	// mode also caches authenticated callers, per identity
+	CacheTTL        time.Duration
+	CachePrivate    bool
+	CacheMaxEntries int
+	CacheMaxBytes   int64
+
+	// Last good GET responses served when the upstream fails (0 disables)
+	StaleIfError    time.Duration
+	StaleMaxEntries int
+	StaleMaxBytes   int64
+
+	// Static answer to GET/HEAD when the upstream is unavailable (empty body disables)
+	FallbackBody        string
+	FallbackStatus      int
+	FallbackContentType string
+
+	// JSON response bodies: upstream base URL -> external base URL
+	RewriteURLs     map[string]string `redact:"userinfo"`
+	RewriteMaxBytes int64
+
+	// Response minification: content kinds ("json", "html") and body cap
+	Minify         []string
+	MinifyMaxBytes int64
+
+	// Request bodies carrying a digest header for one of these algorithms
+	// ("md5", "sha256") are verified against it (empty disables)
+	Checksums        []string
+	ChecksumMaxBytes int64
+
+	// JSON request bodies are validated against this schema (opt-in)
+	SchemaFile     string
+	SchemaMaxBytes int64
+	Schema         *schema.Schema `json:"-"` // compiled from SchemaFile by Load
+
+	// JSON bodies are transcoded to and from Protobuf for upstreams that
+	// only speak it, using message types from a descriptor set (opt-in)
+	ProtoDescriptor   string
+	ProtoRequest      string // full message names, e.g. acme.orders.v1.CreateOrderRequest
+	ProtoResponse     string
+	ProtoMaxBytes     int64
+	ProtoRequestType  *protobuf.Message `json:"-"` // resolved from ProtoDescriptor by Load
+	ProtoResponseType *protobuf.Message `json:"-"`
+
+	// Upstream response headers removed or renamed before reaching clients
+	StripResponseHeaders  []string
+	RenameResponseHeaders map[string]string
+	Methods               []string // narrows ALLOWED_METHODS for this route (empty = global set)
+	PathPattern           string   // e.g. /api/v1/users/{id}; matching paths are rewritten
+	PathTemplate          string   // e.g. /internal/user?id={id}
+
+	// Requests must carry a valid JWT (validated against JWT_JWKS_URL)
+	// or API key (from API_KEYS/API_KEYS_FILE)
+	JWT    bool
+	APIKey bool
+
+	// Load shedding class under the throttle: low, normal, or critical
+	Priority string
+
+	// Feature-flagged rollout: while Flag is on for a client, its requests
+	// go to FlagURLs instead of URLs, with the route's other settings
+	Flag       string
+	FlagURLs   []string `redact:"userinfo"`
+	StripQuery bool     // drop the client's query string before forwarding
+
+	// Canary release: CanaryWeight percent of the route's own traffic goes
+	// to CanaryURLs, the rest to URLs. Clients are pinned to their variant
+	// by CanaryCookie (empty disables) and may pick one with CanaryHeader
+	// (empty disables).
+	CanaryURLs   []string `redact:"userinfo"`
+	CanaryWeight int
+	CanaryCookie string
+	CanaryHeader string
+
+	Chaos ChaosConfig // fault injection, only honored when CHAOS_ENABLED is set
+}
+
+// ChaosConfig holds per-route latency/error injection for resilience testing
+type ChaosConfig struct {
+	Fraction  float64       // share of requests affected (0 disables)
+	DelayMin  time.Duration // injected delay is uniform in [DelayMin, DelayMax]
+	DelayMax  time.Duration
+	ErrorRate float64 // share of affected requests answered with a synthetic 500
+
+	FaultType string  // upstream fault: refused, 503, or timeout
+	FaultRate float64 // share of upstream attempts that fail (0 disables)
 }
 
 // LoggingConfig holds logging settings
 type LoggingConfig struct {
-	Level  string // DEBUG, INFO, WARN, ERROR
-	Format string // json or text
+	Level     string // DEBUG, INFO, WARN, ERROR
+	Format    string // json or text
+	AccessLog bool   // request_started/request_completed middleware
+	TLSFields bool   // tls_version/tls_cipher on request_started
+
+	// Async logging: records go through a bounded buffer and are dropped
+	// when it is full instead of blocking requests
+	Async      bool
+	BufferSize int
+
+	// ErrorWindow collapses identical proxy_error lines into one count per
+	// window (zero logs every error)
+	ErrorWindow time.Duration
+}
+
+// MiddlewareConfig toggles optional middleware in the global chain
+type MiddlewareConfig struct {
+	RequestID bool
+	Gzip      bool
+	Chaos     bool // never enable in production
+	Trailers  bool // request ID/status/duration trailers for TE: trailers clients
+	Metrics   bool // Prometheus request metrics and /metrics endpoint
+	Exemplars bool // trace ID exemplars on latency histograms (OpenMetrics only)
 }
 
 // ServerConfig holds HTTP server settings
 type ServerConfig struct {
 	Port              string
+	AdminPort         string // operator endpoints listener (empty disables)
 	ReadHeaderTimeout time.Duration
 	ReadTimeout       time.Duration
 	WriteTimeout      time.Duration
 	IdleTimeout       time.Duration
+	PreStopDelay      time.Duration // time between failing readiness and draining
+	ShutdownTimeout   time.Duration // drain grace period before connections are closed
+	RequestTimeout    time.Duration // per-request deadline including the upstream call (0 disables)
+	MaxConnLifetime   time.Duration // absolute client connection lifetime (0 = unlimited)
+
+	// HTTP/2 limits (apply to TLS connections negotiating h2)
+	HTTP2MaxConcurrentStreams uint32
+	HTTP2IdleTimeout          time.Duration
+
+	// TLS termination: serve HTTPS with this PEM certificate and key
+	// (both empty serves plaintext)
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSFingerprint forwards a fingerprint of each client's ClientHello
+	// upstream in TLSFingerprintHeader; requires TLS termination
+	TLSFingerprint       bool
+	TLSFingerprintHeader string
 }
 
 // UpstreamConfig holds upstream service URLs
 type UpstreamConfig struct {
-	AuthURL    string
-	ExampleURL string
+	AuthURL    string `redact:"userinfo"`
+	ExampleURL string `redact:"userinfo"`
+
+	// PreserveHeaders are forwarded even if hop-by-hop stripping would remove them
+	PreserveHeaders []string
+
+	// MaxResponseBytes caps upstream response bodies (0 = unlimited)
+	MaxResponseBytes int64
+
+	// LatencyBuckets are histogram upper bounds in seconds
+	LatencyBuckets []float64
+
+	// Circuit breaker per upstream host (threshold 0 disables it)
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Latency trip for the circuit breaker (0 threshold disables it)
+	BreakerLatencyThreshold   time.Duration
+	BreakerLatencyPercentile  float64
+	BreakerLatencyWindow      time.Duration
+	BreakerLatencyMinRequests int
+
+	// Passive ejection of failing replicas on multi-URL routes (threshold 0 disables it)
+	OutlierThreshold int
+	OutlierCooldown  time.Duration
+
+	// Dead-letter sink for critical routes (empty file disables it)
+	DeadLetterFile     string
+	DeadLetterMaxBytes int64
+
+	// HTTP/2 keepalive pings for idle upstream connections (0 disables)
+	H2ReadIdleTimeout time.Duration
+	H2PingTimeout     time.Duration
+
+	// Pooled connection retirement: by age since dialed (0 disables)
+	// and by time spent idle
+	MaxConnAge     time.Duration
+	MaxIdleConnAge time.Duration
+
+	// ErrorStatus overrides the client status per upstream error class
+	// (refused, timeout, tls, protocol, canceled, circuit)
+	ErrorStatus map[string]int
+}
+
+// LoadConfig weights the components of the /admin/load figure
+type LoadConfig struct {
+	WeightInFlight   float64
+	WeightLatency    float64
+	WeightRejections float64
+	LatencyTarget    time.Duration // p95 that counts as full load
+	Window           int           // recent requests kept for the p95
+}
+
+// APINotFoundConfig shapes the JSON body for unmatched /api/ paths
+type APINotFoundConfig struct {
+	Code    string
+	Message string
+	Fields  map[string]string // schema field -> JSON key (code, message, request_id, timestamp)
+}
+
+// MethodPolicyConfig holds the methods the gateway accepts at all
+type MethodPolicyConfig struct {
+	Allowed []string
+}
+
+// BodyPolicyConfig holds rules for request bodies on bodyless methods
+type BodyPolicyConfig struct {
+	Methods []string // methods that must not carry a body
+	Action  string   // off, reject, or strip
+}
+
+// ForwardedForConfig holds X-Forwarded-For trust and chain limits
+type ForwardedForConfig struct {
+	MaxEntries int    // 0 disables the limit
+	Action     string // trim or reject
+
+	// TrustedProxies are the IPs/CIDRs whose X-Forwarded-For is believed
+	// when resolving client IPs (empty trusts none)
+	TrustedProxies []string
+}
+
+// HeaderLimitConfig bounds the total size of request headers
+type HeaderLimitConfig struct {
+	MaxBytes int // 0 disables the limit
+}
+
+// IdempotencyConfig controls replaying responses to repeated requests that
+// carry the same idempotency key
+type IdempotencyConfig struct {
+	Enabled    bool
+	Header     string
+	Methods    []string
+	TTL        time.Duration
+	MaxEntries int
+	MaxBytes   int64
+}
+
+// HealthConfig controls active probing of upstream replicas
+type HealthConfig struct {
+	Enabled  bool
+	Path     string // default probe path; routes may override it
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// ExperimentConfig controls A/B bucket assignment (empty Experiments disables it)
+type ExperimentConfig struct {
+	Experiments  []Experiment
+	Header       string
+	Claim        string // claim holding the user ID
+	Cookie       string
+	CookieSecret string `redact:"secret"`
+	CookieMaxAge time.Duration
+}
+
+// FlagConfig selects the feature flag provider consulted by flagged routes
+type FlagConfig struct {
+	Provider string         // memory or http
+	Flags    map[string]int // memory provider: flag -> percent of traffic it is on for
+	URL      string         `redact:"userinfo"` // http provider: JSON flag document
+	Token    string         `redact:"secret"`   // http provider: bearer token
+	Timeout  time.Duration  // http provider: per fetch
+	CacheTTL time.Duration  // how long an evaluation is reused
+}
+
+// JWTConfig holds local bearer token validation for routes with JWT set
+type JWTConfig struct {
+	JWKSURL  string        `redact:"userinfo"` // signing keys (JSON Web Key Set)
+	Issuer   string        // required iss (empty accepts any)
+	Audience []string      // accepted aud values (empty accepts any)
+	Leeway   time.Duration // clock skew allowed on exp/nbf
+	Refresh  time.Duration // how long fetched keys are used before refetching
+	Timeout  time.Duration // per JWKS fetch
+}
+
+// APIKeyConfig holds the static API key store: key ID (e.g. the partner's
+// name) -> key, from API_KEYS and API_KEYS_FILE
+type APIKeyConfig struct {
+	Keys   map[string]string `redact:"secret"`
+	Header string            // request header carrying the key
+}
+
+// Experiment is one A/B test and its bucket allocations
+type Experiment struct {
+	Name    string
+	Buckets []ExperimentBucket
+}
+
+// ExperimentBucket is one arm of an experiment with its share of traffic
+type ExperimentBucket struct {
+	Name    string
+	Percent int
+}
+
+// GzipConfig tunes response compression (enabled by GZIP_ENABLED)
+type GzipConfig struct {
+	Level     int      // 1-9
+	MinBytes  int      // smaller bodies are sent uncompressed
+	SkipTypes []string // already-compressed Content-Types; "image/" matches the family
+}
+
+// CORSConfig holds cross-origin settings; no origins disables CORS
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// StaticConfig holds files served directly by the gateway, keyed by path
+type StaticConfig struct {
+	Files map[string]string
 }
 
 // ThrottleConfig holds concurrent request limits
 type ThrottleConfig struct {
+	Enabled     bool
 	MaxInFlight int
+
+	// Priority classes (only used when some route has that class)
+	LowPriorityShare float64 // of MaxInFlight that low-priority requests may hold
+	CriticalReserve  float64 // of MaxInFlight held back for critical requests
 }
 
-// RateLimitConfig holds token bucket rate limiting settings
+// RateLimitConfig holds rate limiting settings
 type RateLimitConfig struct {
+	Enabled     bool
+	Algorithm   string        // token_bucket or sliding_window
+	Window      time.Duration // sliding_window: rolling window length
 	PerIPRPS    float64
 	PerIPBurst  float64
 	GlobalRPS   float64
 	GlobalBurst float64
+
+	// Per-key tier for authenticated callers (defaults to the PerIP values)
+	AuthRPS   float64
+	AuthBurst float64
+
+	// InitialFraction is the share of PerIPBurst a newly seen key starts with
+	InitialFraction float64
+
+	KeyBy        string // "ip" or "subject"
+	SubjectClaim string // claim used when KeyBy is "subject"
+
+	AllowList     []string // client IPs/CIDRs that bypass rate limiting
+	AllowListKeys []string `redact:"secret"` // API keys (X-API-Key) that bypass rate limiting
+
+	// Rejection alerting: warn when more than AlertThreshold of requests
+	// are rejected over AlertWindow (0 disables)
+	AlertThreshold float64
+	AlertWindow    time.Duration
+
+	// Shared state across replicas: memory keeps buckets per instance,
+	// redis keeps them in Redis with in-memory fallback
+	Backend        string
+	RedisURL       string        `redact:"userinfo"`
+	RedisTimeout   time.Duration // per command, including dialing
+	RedisKeyPrefix string
 }
 
 // RetryConfig holds retry behavior settings
@@ -57,42 +477,1164 @@ type RetryConfig struct {
 	Attempts    int
 	BaseBackoff time.Duration
 	MaxBackoff  time.Duration
+	MinInterval time.Duration // least time between attempt starts (0 = none)
+	On429       bool          // retry 429 Too Many Requests like 5xx
+
+	// Body-based retry predicate (disabled when BodyMatch is empty)
+	BodyStatus   int    // only inspect responses with this status (0 = any)
+	BodyJSONPath string // dot-separated JSON path; empty means substring match
+	BodyMatch    string // expected value or substring
+	BodyMaxBytes int64  // largest body buffered for inspection
+
+	// Request body replay buffer for retries
+	ReplayMemoryBytes int64  // bodies up to this size are kept in memory
+	ReplaySpill       string // above it: none, gzip, or file
+	ReplayMaxBytes    int64  // largest spilled body (0 = unlimited)
+	ReplayTempDir     string // spill file directory (empty = system default)
 }
 
 // Load reads configuration from environment variables with defaults
 func Load() (*Config, error) {
-	return &Config{
+	cfg := &Config{
 		Server: ServerConfig{
 			Port:              env("PORT", "80"),
 			ReadHeaderTimeout: 10 * time.Second,
 			ReadTimeout:       30 * time.Second,
 			WriteTimeout:      60 * time.Second,
 			IdleTimeout:       120 * time.Second,
+			AdminPort:         env("ADMIN_PORT", ""),
+			PreStopDelay:      mustDuration(env("PRE_STOP_DELAY", "5s")),
+			ShutdownTimeout:   mustDuration(env("SHUTDOWN_TIMEOUT", "30s")),
+			RequestTimeout:    mustDuration(env("REQUEST_TIMEOUT", "0s")),
+			MaxConnLifetime:   mustDuration(env("MAX_CONN_LIFETIME", "0s")),
+
+			HTTP2MaxConcurrentStreams: uint32(mustInt(env("HTTP2_MAX_CONCURRENT_STREAMS", "100"))),
+			HTTP2IdleTimeout:          mustDuration(env("HTTP2_IDLE_TIMEOUT", "60s")),
+
+			TLSCertFile: env("TLS_CERT_FILE", ""),
+			TLSKeyFile:  env("TLS_KEY_FILE", ""),
+
+			TLSFingerprint:       mustBool(env("TLS_FINGERPRINT_ENABLED", "false")),
+			TLSFingerprintHeader: env("TLS_FINGERPRINT_HEADER", "X-TLS-Fingerprint"),
 		},
 		Upstream: UpstreamConfig{
 			AuthURL:    env("IAM_SERVICE_URL", "https://exampleservice1.com"),
 			ExampleURL: env("EXAMPLE_TARGET_URL", "https://dogapi.dog/api/v2/breeds"),
+
+			PreserveHeaders:    envList("PRESERVE_HEADERS"),
+			MaxResponseBytes:   int64(mustInt(env("MAX_RESPONSE_BYTES", "0"))),
+			DeadLetterFile:     env("DEAD_LETTER_FILE", ""),
+			DeadLetterMaxBytes: int64(mustInt(env("DEAD_LETTER_MAX_BYTES", "1048576"))),
+			LatencyBuckets:     mustFloatList(env("UPSTREAM_LATENCY_BUCKETS", "0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10")),
+			ErrorStatus:        mustStatusMap(env("PROXY_ERROR_STATUS", "")),
+			H2ReadIdleTimeout:  mustDuration(env("UPSTREAM_H2_READ_IDLE_TIMEOUT", "30s")),
+			H2PingTimeout:      mustDuration(env("UPSTREAM_H2_PING_TIMEOUT", "15s")),
+			MaxConnAge:         mustDuration(env("UPSTREAM_MAX_CONN_AGE", "0s")),
+			MaxIdleConnAge:     mustDuration(env("UPSTREAM_MAX_IDLE_CONN_AGE", "90s")),
+			BreakerThreshold:   mustInt(env("CIRCUIT_BREAKER_THRESHOLD", "5")),
+			BreakerCooldown:    mustDuration(env("CIRCUIT_BREAKER_COOLDOWN", "30s")),
+
+			BreakerLatencyThreshold:   mustDuration(env("CIRCUIT_BREAKER_LATENCY_THRESHOLD", "0s")),
+			BreakerLatencyPercentile:  mustFloat(env("CIRCUIT_BREAKER_LATENCY_PERCENTILE", "0.99")),
+			BreakerLatencyWindow:      mustDuration(env("CIRCUIT_BREAKER_LATENCY_WINDOW", "30s")),
+			BreakerLatencyMinRequests: mustInt(env("CIRCUIT_BREAKER_LATENCY_MIN_REQUESTS", "100")),
+			OutlierThreshold:          mustInt(env("OUTLIER_EJECTION_THRESHOLD", "5")),
+			OutlierCooldown:           mustDuration(env("OUTLIER_EJECTION_COOLDOWN", "30s")),
+		},
+		Load: LoadConfig{
+			WeightInFlight:   mustFloat(env("LOAD_WEIGHT_IN_FLIGHT", "1")),
+			WeightLatency:    mustFloat(env("LOAD_WEIGHT_LATENCY", "1")),
+			WeightRejections: mustFloat(env("LOAD_WEIGHT_REJECTIONS", "1")),
+			LatencyTarget:    mustDuration(env("LOAD_LATENCY_TARGET", "500ms")),
+			Window:           mustInt(env("LOAD_LATENCY_WINDOW", "1024")),
+		},
+		NotFound: APINotFoundConfig{
+			Code:    env("API_NOT_FOUND_CODE", "ROUTE_NOT_FOUND"),
+			Message: env("API_NOT_FOUND_MESSAGE", "no route matches this path"),
+			Fields:  mustStringMap(env("API_ERROR_FIELDS", "")),
+		},
+		Methods: MethodPolicyConfig{
+			Allowed: envListDefault("ALLOWED_METHODS", "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS"),
+		},
+		BodyPolicy: BodyPolicyConfig{
+			Methods: envListDefault("BODYLESS_METHODS", "GET,HEAD"),
+			Action:  env("BODYLESS_ACTION", "off"),
+		},
+		Forwarded: ForwardedForConfig{
+			MaxEntries: mustInt(env("XFF_MAX_ENTRIES", "0")),
+			Action:     env("XFF_OVERFLOW_ACTION", "trim"),
+
+			TrustedProxies: envList("TRUSTED_PROXIES"),
+		},
+		CORS: CORSConfig{
+			AllowedOrigins:   envList("CORS_ALLOWED_ORIGINS"),
+			AllowedMethods:   envListDefault("CORS_ALLOWED_METHODS", "GET,HEAD,POST,PUT,PATCH,DELETE"),
+			AllowedHeaders:   envListDefault("CORS_ALLOWED_HEADERS", "Authorization,Content-Type,X-Request-ID"),
+			ExposedHeaders:   envList("CORS_EXPOSED_HEADERS"),
+			AllowCredentials: mustBool(env("CORS_ALLOW_CREDENTIALS", "false")),
+			MaxAge:           mustDuration(env("CORS_MAX_AGE", "10m")),
+		},
+		Gzip: GzipConfig{
+			Level:     mustInt(env("GZIP_LEVEL", "6")),
+			MinBytes:  mustInt(env("GZIP_MIN_BYTES", "1024")),
+			SkipTypes: envListDefault("GZIP_SKIP_TYPES", "image/png,image/jpeg,image/gif,image/webp,image/avif,video/,audio/,font/woff2,application/zip,application/gzip,application/x-gzip,application/zstd"),
+		},
+		Idempotency: IdempotencyConfig{
+			Enabled:    mustBool(env("IDEMPOTENCY_ENABLED", "false")),
+			Header:     env("IDEMPOTENCY_KEY_HEADER", "Idempotency-Key"),
+			Methods:    envListDefault("IDEMPOTENCY_METHODS", "POST,PATCH"),
+			TTL:        mustDuration(env("IDEMPOTENCY_TTL", "10m")),
+			MaxEntries: mustInt(env("IDEMPOTENCY_MAX_ENTRIES", "1000")),
+			MaxBytes:   int64(mustInt(env("IDEMPOTENCY_MAX_BYTES", "65536"))),
+		},
+		Health: HealthConfig{
+			Enabled:  mustBool(env("HEALTH_PROBE_ENABLED", "false")),
+			Path:     env("HEALTH_PROBE_PATH", "/health"),
+			Interval: mustDuration(env("HEALTH_PROBE_INTERVAL", "10s")),
+			Timeout:  mustDuration(env("HEALTH_PROBE_TIMEOUT", "2s")),
+		},
+		Experiments: ExperimentConfig{
+			Experiments:  mustExperiments(env("EXPERIMENTS", "")),
+			Header:       env("EXPERIMENT_HEADER", "X-Experiment-Bucket"),
+			Claim:        env("EXPERIMENT_KEY_CLAIM", "sub"),
+			Cookie:       env("EXPERIMENT_COOKIE", "exp_id"),
+			CookieSecret: env("EXPERIMENT_COOKIE_SECRET", ""),
+			CookieMaxAge: mustDuration(env("EXPERIMENT_COOKIE_MAX_AGE", "720h")),
+		},
+		Flags: FlagConfig{
+			Provider: env("FEATURE_FLAG_PROVIDER", "memory"),
+			Flags:    mustIntMap(env("FEATURE_FLAGS", "")),
+			URL:      env("FEATURE_FLAG_URL", ""),
+			Token:    env("FEATURE_FLAG_TOKEN", ""),
+			Timeout:  mustDuration(env("FEATURE_FLAG_TIMEOUT", "2s")),
+			CacheTTL: mustDuration(env("FEATURE_FLAG_CACHE_TTL", "30s")),
+		},
+		JWT: JWTConfig{
+			JWKSURL:  env("JWT_JWKS_URL", ""),
+			Issuer:   env("JWT_ISSUER", ""),
+			Audience: envList("JWT_AUDIENCE"),
+			Leeway:   mustDuration(env("JWT_CLOCK_SKEW", "30s")),
+			Refresh:  mustDuration(env("JWT_JWKS_REFRESH", "10m")),
+			Timeout:  mustDuration(env("JWT_JWKS_TIMEOUT", "5s")),
+		},
+		APIKeys: APIKeyConfig{
+			Keys:   mustStringMap(env("API_KEYS", "")),
+			Header: env("API_KEY_HEADER", "X-API-Key"),
+		},
+		Headers: HeaderLimitConfig{
+			MaxBytes: mustInt(env("MAX_REQUEST_HEADER_BYTES", "0")),
 		},
 		Throttle: ThrottleConfig{
+			Enabled:     mustBool(env("THROTTLE_ENABLED", "true")),
 			MaxInFlight: mustInt(env("MAX_IN_FLIGHT", "256")),
+
+			LowPriorityShare: mustFloat(env("THROTTLE_LOW_PRIORITY_SHARE", "0.5")),
+			CriticalReserve:  mustFloat(env("THROTTLE_CRITICAL_RESERVE", "0.1")),
 		},
 		RateLimit: RateLimitConfig{
+			Enabled:     mustBool(env("RATE_LIMIT_ENABLED", "true")),
+			Algorithm:   env("RATE_LIMIT_ALGORITHM", "token_bucket"),
+			Window:      mustDuration(env("RATE_LIMIT_WINDOW", "1s")),
 			PerIPRPS:    mustFloat(env("PER_IP_RPS", "10")),
 			PerIPBurst:  mustFloat(env("PER_IP_BURST", "20")),
 			GlobalRPS:   mustFloat(env("GLOBAL_RPS", "200")),
 			GlobalBurst: mustFloat(env("GLOBAL_BURST", "400")),
+
+			AuthRPS:   mustFloat(env("AUTH_RPS", env("PER_IP_RPS", "10"))),
+			AuthBurst: mustFloat(env("AUTH_BURST", env("PER_IP_BURST", "20"))),
+
+			InitialFraction: mustFloat(env("RATE_LIMIT_INITIAL_FRACTION", "1")),
+
+			KeyBy:        env("RATE_LIMIT_KEY", "ip"),
+			SubjectClaim: env("RATE_LIMIT_SUBJECT_CLAIM", "sub"),
+
+			AllowList:     envList("RATE_LIMIT_ALLOWLIST"),
+			AllowListKeys: envList("RATE_LIMIT_ALLOWLIST_KEYS"),
+
+			AlertThreshold: mustFloat(env("RATE_LIMIT_ALERT_THRESHOLD", "0.5")),
+			AlertWindow:    mustDuration(env("RATE_LIMIT_ALERT_WINDOW", "1m")),
+
+			Backend:        env("RATE_LIMIT_BACKEND", "memory"),
+			RedisURL:       env("REDIS_URL", ""),
+			RedisTimeout:   mustDuration(env("REDIS_TIMEOUT", "100ms")),
+			RedisKeyPrefix: env("REDIS_KEY_PREFIX", "canary:ratelimit:"),
 		},
 		Retry: RetryConfig{
 			Attempts:    mustInt(env("RETRY_ATTEMPTS", "3")),
 			BaseBackoff: mustDuration(env("RETRY_BACKOFF", "150ms")),
 			MaxBackoff:  mustDuration(env("RETRY_MAX_BACKOFF", "1500ms")),
+			MinInterval: mustDuration(env("RETRY_MIN_INTERVAL", "0s")),
+			On429:       mustBool(env("RETRY_ON_429", "true")),
+
+			BodyStatus:   mustInt(env("RETRY_BODY_STATUS", "0")),
+			BodyJSONPath: env("RETRY_BODY_JSON_PATH", ""),
+			BodyMatch:    env("RETRY_BODY_MATCH", ""),
+			BodyMaxBytes: int64(mustInt(env("RETRY_BODY_MAX_BYTES", "65536"))),
+
+			ReplayMemoryBytes: int64(mustInt(env("RETRY_REPLAY_MEMORY_BYTES", "1048576"))),
+			ReplaySpill:       env("RETRY_REPLAY_SPILL", "none"),
+			ReplayMaxBytes:    int64(mustInt(env("RETRY_REPLAY_MAX_BYTES", "67108864"))),
+			ReplayTempDir:     env("RETRY_REPLAY_TEMP_DIR", ""),
 		},
 		Logging: LoggingConfig{
 			Level:  env("LOG_LEVEL", "INFO"),
 			Format: env("LOG_FORMAT", "json"),
+
+			AccessLog: mustBool(env("ACCESS_LOG_ENABLED", "true")),
+			TLSFields: mustBool(env("LOG_TLS_FIELDS", "false")),
+
+			Async:      mustBool(env("LOG_ASYNC", "false")),
+			BufferSize: mustInt(env("LOG_BUFFER_SIZE", "4096")),
+
+			ErrorWindow: mustDuration(env("LOG_ERROR_WINDOW", "0s")),
+		},
+		Middleware: MiddlewareConfig{
+			RequestID: mustBool(env("REQUEST_ID_ENABLED", "true")),
+			Gzip:      mustBool(env("GZIP_ENABLED", "true")),
+			Chaos:     mustBool(env("CHAOS_ENABLED", "false")),
+			Trailers:  mustBool(env("TRAILERS_ENABLED", "false")),
+			Metrics:   mustBool(env("METRICS_ENABLED", "false")),
+			Exemplars: mustBool(env("METRICS_EXEMPLARS", "false")),
 		},
 		LimiterTTL: mustDuration(env("LIMITER_TTL", "10m")),
-	}, nil
+		Routes: map[string]RouteConfig{
+			"auth":    loadRoute("AUTH", "/api/auth", "IAM_SERVICE_URL", "https://exampleservice1.com"),
+			"example": loadRoute("EXAMPLE", "/api/example", "EXAMPLE_TARGET_URL", "https://dogapi.dog/api/v2/breeds"),
+		},
+	}
+
+	if path := env("ROUTES_FILE", ""); path != "" {
+		if err := loadRoutesFile(path, cfg.Routes); err != nil {
+			return nil, fmt.Errorf("ROUTES_FILE: %w", err)
+		}
+	}
+
+	if path := env("API_KEYS_FILE", ""); path != "" {
+		if err := loadAPIKeysFile(path, cfg.APIKeys.Keys); err != nil {
+			return nil, fmt.Errorf("API_KEYS_FILE: %w", err)
+		}
+	}
+
+	for name, rc := range cfg.Routes {
+		if rc.SchemaFile == "" {
+			continue
+		}
+		s, err := schema.Load(rc.SchemaFile)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: JSON schema %s: %w", name, rc.SchemaFile, err)
+		}
+		rc.Schema = s
+		cfg.Routes[name] = rc
+	}
+
+	for name, rc := range cfg.Routes {
+		if rc.ProtoDescriptor == "" {
+			continue
+		}
+		set, err := protobuf.Load(rc.ProtoDescriptor)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: protobuf descriptor set %s: %w", name, rc.ProtoDescriptor, err)
+		}
+		if rc.ProtoRequest != "" {
+			if rc.ProtoRequestType, err = set.Message(rc.ProtoRequest); err != nil {
+				return nil, fmt.Errorf("route %q: protobuf request type: %w", name, err)
+			}
+		}
+		if rc.ProtoResponse != "" {
+			if rc.ProtoResponseType, err = set.Message(rc.ProtoResponse); err != nil {
+				return nil, fmt.Errorf("route %q: protobuf response type: %w", name, err)
+			}
+		}
+		cfg.Routes[name] = rc
+	}
+
+	static, err := loadStatic()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Static = static
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// defaultRobotsTxt keeps crawlers off the gateway entirely
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// loadStatic resolves robots.txt and security.txt from files or built-in
+// defaults. security.txt requires a contact, so without SECURITY_TXT_FILE
+// or SECURITY_CONTACT it isn't served.
+func loadStatic() (StaticConfig, error) {
+	files := map[string]string{"/robots.txt": defaultRobotsTxt}
+
+	if path := env("ROBOTS_TXT_FILE", ""); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return StaticConfig{}, fmt.Errorf("ROBOTS_TXT_FILE: %w", err)
+		}
+		files["/robots.txt"] = string(b)
+	}
+
+	if path := env("SECURITY_TXT_FILE", ""); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return StaticConfig{}, fmt.Errorf("SECURITY_TXT_FILE: %w", err)
+		}
+		files["/.well-known/security.txt"] = string(b)
+	} else if contact := env("SECURITY_CONTACT", ""); contact != "" {
+		// RFC 9116 requires Contact and Expires
+		expires := time.Now().AddDate(1, 0, 0).UTC().Format(time.RFC3339)
+		files["/.well-known/security.txt"] = "Contact: " + contact + "\nExpires: " + expires + "\n"
+	}
+
+	return StaticConfig{Files: files}, nil
+}
+
+// loadAPIKeysFile adds the keys in a YAML (.yaml/.yml) or JSON object of
+// key ID -> key to keys; an ID set in both places is an error
+func loadAPIKeysFile(path string, keys map[string]string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var entries map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &entries)
+	default:
+		err = json.Unmarshal(b, &entries)
+	}
+	if err != nil {
+		return err
+	}
+	for id, key := range entries {
+		if _, dup := keys[id]; dup {
+			return fmt.Errorf("key ID %q is also set in API_KEYS", id)
+		}
+		keys[id] = key
+	}
+	return nil
+}
+
+// FileRoute is one entry of ROUTES_FILE
+type FileRoute struct {
+	Name        string   `json:"name" yaml:"name"` // optional; derived from the prefix, lowercased, non-alphanumerics as _
+	PathPrefix  string   `json:"pathPrefix" yaml:"pathPrefix"`
+	UpstreamURL string   `json:"upstreamURL" yaml:"upstreamURL"`
+	Hosts       []string `json:"hosts" yaml:"hosts"` // added to ROUTE_<NAME>_HOSTS
+	StripPrefix bool     `json:"stripPrefix" yaml:"stripPrefix"`
+	Retries     *int     `json:"retries" yaml:"retries"` // nil uses RETRY_ATTEMPTS
+}
+
+// routeNameChars are replaced when deriving a route name from its prefix
+var routeNameChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// loadRoutesFile adds the routes described by a YAML (.yaml/.yml) or JSON
+// file to routes. Each still honors ROUTE_<NAME>_* overrides from the
+// environment, with the upstream URL coming from the file.
+func loadRoutesFile(path string, routes map[string]RouteConfig) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Unknown keys are rejected so a typo can't silently drop a setting
+	var entries []FileRoute
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(&entries)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&entries)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, e := range entries {
+		name := e.Name
+		if name == "" {
+			name = e.PathPrefix
+		}
+		name = strings.Trim(routeNameChars.ReplaceAllString(strings.ToLower(name), "_"), "_")
+		if name == "" || e.PathPrefix == "" {
+			return fmt.Errorf("entry %d: pathPrefix is required", i)
+		}
+		if _, dup := routes[name]; dup {
+			return fmt.Errorf("entry %d: duplicate route name %q", i, name)
+		}
+		if e.UpstreamURL == "" {
+			return fmt.Errorf("entry %d: upstreamURL is required", i)
+		}
+
+		rc := loadRoute(strings.ToUpper(name), e.PathPrefix, "", e.UpstreamURL)
+		rc.StripPrefix = e.StripPrefix
+		for _, h := range e.Hosts {
+			rc.Hosts = append(rc.Hosts, middleware.CanonicalHostname(h))
+		}
+		if e.Retries != nil {
+			if *e.Retries < 0 {
+				return fmt.Errorf("entry %d: retries must not be negative", i)
+			}
+			rc.Attempts = *e.Retries + 1
+		}
+		routes[name] = rc
+	}
+	return nil
+}
+
+// loadRoute reads a route's upstream URLs (comma-separated replicas) and
+// its ROUTE_<NAME>_* overrides
+func loadRoute(name, pathPrefix, urlKey, defaultURL string) RouteConfig {
+	prefix := "ROUTE_" + name + "_"
+	return RouteConfig{
+		PathPrefix: strings.TrimSuffix(pathPrefix, "/"),
+		Hosts:      normalizeHosts(envList(prefix + "HOSTS")),
+
+		URLs:     envListDefault(urlKey, defaultURL),
+		Weights:  mustIntList(env(prefix+"WEIGHTS", "")),
+		Balancer: env(prefix+"BALANCER", "weighted_random"),
+		HashOn:   env(prefix+"HASH_ON", "ip"),
+
+		SelectHeader:   env(prefix+"SELECT_HEADER", ""),
+		SelectBackends: mustStringMap(env(prefix+"SELECT_BACKENDS", "")),
+
+		Timeout:               mustDuration(env(prefix+"TIMEOUT", "0s")),
+		ResponseHeaderTimeout: mustDuration(env(prefix+"RESPONSE_HEADER_TIMEOUT", "0s")),
+		OutboundProxy:         env(prefix+"OUTBOUND_PROXY", ""),
+		TLSMinVersion:         mustTLSVersion(env(prefix+"TLS_MIN_VERSION", "1.2")),
+		TLSMaxVersion:         mustTLSVersion(env(prefix+"TLS_MAX_VERSION", "")),
+		LegacyTLS:             mustBool(env(prefix+"ALLOW_LEGACY_TLS", "false")),
+		TLSClientCert:         env(prefix+"TLS_CLIENT_CERT", ""),
+		TLSClientKey:          env(prefix+"TLS_CLIENT_KEY", ""),
+		TLSCAFile:             env(prefix+"TLS_CA_FILE", ""),
+		TLSInsecure:           mustBool(env(prefix+"TLS_INSECURE_SKIP_VERIFY", "false")),
+		IsolateConnections:    mustBool(env(prefix+"ISOLATE_CONNECTIONS", "false")),
+		HTTP2:                 mustBool(env(prefix+"HTTP2", "true")),
+		MaxResponseBytes:      int64(mustInt(env(prefix+"MAX_RESPONSE_BYTES", "0"))),
+		FlushInterval:         mustDuration(env(prefix+"FLUSH_INTERVAL", "0s")),
+		Critical:              mustBool(env(prefix+"CRITICAL", "false")),
+		HealthPath:            env(prefix+"HEALTH_PATH", ""),
+		HealthBodyMatch:       env(prefix+"HEALTH_BODY_MATCH", ""),
+		HealthBodyJSONPath:    env(prefix+"HEALTH_BODY_JSON_PATH", ""),
+		NoRetry:               mustBool(env(prefix+"NO_RETRY", "false")),
+		MaxConcurrent:         mustInt(env(prefix+"MAX_CONCURRENT", "0")),
+		FairQueue:             mustBool(env(prefix+"FAIR_QUEUE", "true")),
+
+		RetryBodyMatch:    env(prefix+"RETRY_BODY_MATCH", ""),
+		RetryBodyJSONPath: env(prefix+"RETRY_BODY_JSON_PATH", ""),
+		RetryBodyStatus:   mustInt(env(prefix+"RETRY_BODY_STATUS", "0")),
+		RetryBodyMaxBytes: int64(mustInt(env(prefix+"RETRY_BODY_MAX_BYTES", "0"))),
+
+		Coalesce:         mustBool(env(prefix+"COALESCE", "false")),
+		CoalesceHeaders:  envList(prefix + "COALESCE_HEADERS"),
+		CoalesceMaxBytes: int64(mustInt(env(prefix+"COALESCE_MAX_BYTES", "1048576"))),
+
+		CacheTTL:        mustDuration(env(prefix+"CACHE_TTL", "0s")),
+		CachePrivate:    mustBool(env(prefix+"CACHE_PRIVATE", "false")),
+		CacheMaxEntries: mustInt(env(prefix+"CACHE_MAX_ENTRIES", "1000")),
+		CacheMaxBytes:   int64(mustInt(env(prefix+"CACHE_MAX_BYTES", "1048576"))),
+
+		StaleIfError:    mustDuration(env(prefix+"STALE_IF_ERROR", "0s")),
+		StaleMaxEntries: mustInt(env(prefix+"STALE_MAX_ENTRIES", "1000")),
+		StaleMaxBytes:   int64(mustInt(env(prefix+"STALE_MAX_BYTES", "1048576"))),
+
+		FallbackBody:        env(prefix+"FALLBACK_BODY", ""),
+		FallbackStatus:      mustInt(env(prefix+"FALLBACK_STATUS", "200")),
+		FallbackContentType: env(prefix+"FALLBACK_CONTENT_TYPE", "application/json"),
+
+		RewriteURLs:     mustStringMap(env(prefix+"REWRITE_URLS", "")),
+		RewriteMaxBytes: int64(mustInt(env(prefix+"REWRITE_MAX_BYTES", "1048576"))),
+		Minify:          envList(prefix + "MINIFY"),
+		MinifyMaxBytes:  int64(mustInt(env(prefix+"MINIFY_MAX_BYTES", "1048576"))),
+
+		SchemaFile:     env(prefix+"JSON_SCHEMA", ""),
+		SchemaMaxBytes: int64(mustInt(env(prefix+"JSON_SCHEMA_MAX_BYTES", "1048576"))),
+
+		Checksums:        envList(prefix + "CHECKSUMS"),
+		ChecksumMaxBytes: int64(mustInt(env(prefix+"CHECKSUM_MAX_BYTES", "1048576"))),
+
+		ProtoDescriptor: env(prefix+"PROTO_DESCRIPTOR", ""),
+		ProtoRequest:    env(prefix+"PROTO_REQUEST", ""),
+		ProtoResponse:   env(prefix+"PROTO_RESPONSE", ""),
+		ProtoMaxBytes:   int64(mustInt(env(prefix+"PROTO_MAX_BYTES", "1048576"))),
+
+		StripResponseHeaders:  headerList(env(prefix+"STRIP_RESPONSE_HEADERS", env("STRIP_RESPONSE_HEADERS", "Server,X-Powered-By"))),
+		RenameResponseHeaders: mustStringMap(env(prefix+"RENAME_RESPONSE_HEADERS", env("RENAME_RESPONSE_HEADERS", ""))),
+		Methods:               envList(prefix + "METHODS"),
+		PathPattern:           env(prefix+"PATH_PATTERN", ""),
+		PathTemplate:          env(prefix+"PATH_TEMPLATE", ""),
+		StripQuery:            mustBool(env(prefix+"STRIP_QUERY", "false")),
+
+		JWT:    mustBool(env(prefix+"JWT", "false")),
+		APIKey: mustBool(env(prefix+"API_KEY", "false")),
+
+		Priority: strings.ToLower(env(prefix+"PRIORITY", "normal")),
+
+		Flag:     env(prefix+"FLAG", ""),
+		FlagURLs: envList(prefix + "FLAG_URLS"),
+
+		CanaryURLs:   envList(prefix + "CANARY_URLS"),
+		CanaryWeight: mustInt(env(prefix+"CANARY_WEIGHT", "0")),
+		CanaryCookie: env(prefix+"CANARY_COOKIE", "gw_variant_"+strings.ToLower(name)),
+		CanaryHeader: env(prefix+"CANARY_HEADER", ""),
+
+		Chaos: ChaosConfig{
+			Fraction:  mustFloat(env(prefix+"CHAOS_FRACTION", "0")),
+			DelayMin:  mustDuration(env(prefix+"CHAOS_DELAY_MIN", "0s")),
+			DelayMax:  mustDuration(env(prefix+"CHAOS_DELAY_MAX", "0s")),
+			ErrorRate: mustFloat(env(prefix+"CHAOS_ERROR_RATE", "0")),
+
+			FaultType: env(prefix+"FAULT_TYPE", "refused"),
+			FaultRate: mustFloat(env(prefix+"FAULT_RATE", "0")),
+		},
+	}
+}
+
+// validatePrefixes requires every route to live under /api/ and rejects
+// prefixes that overlap ambiguously. Routing picks the longest matching
+// prefix, so nesting on a segment boundary (/api/users under /api) is fine,
+// but duplicates, or one prefix ending mid-segment of another (/api/user
+// and /api/users), are almost certainly mistakes.
+func validatePrefixes(routes map[string]RouteConfig) error {
+	names := make([]string, 0, len(routes))
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, a := range names {
+		pa := routes[a].PathPrefix
+		if !strings.HasPrefix(pa+"/", "/api/") || pa == "/api" {
+			return fmt.Errorf("route %q: path prefix %q must be under /api/", a, pa)
+		}
+		for _, b := range names[i+1:] {
+			pb := routes[b].PathPrefix
+			if pa == pb {
+				return fmt.Errorf("routes %q and %q have the same path prefix %q", a, b, pa)
+			}
+			short, long := pa, pb
+			if len(short) > len(long) {
+				short, long = long, short
+			}
+			if strings.HasPrefix(long, short) && long[len(short)] != '/' {
+				return fmt.Errorf("routes %q and %q: path prefixes %q and %q overlap mid-segment", a, b, pa, pb)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeHosts puts configured hosts in the form Host headers are
+// matched in
+func normalizeHosts(hosts []string) []string {
+	for i, h := range hosts {
+		hosts[i] = middleware.CanonicalHostname(h)
+	}
+	return hosts
+}
+
+// validateHosts rejects host names that can't match a Host header and
+// hosts claimed by more than one route
+func validateHosts(routes map[string]RouteConfig) error {
+	owner := make(map[string]string)
+	for name, rc := range routes {
+		for _, h := range rc.Hosts {
+			if h == "" || strings.ContainsAny(h, "/*?# ") {
+				return fmt.Errorf("route %q: invalid host %q", name, h)
+			}
+			if other, dup := owner[h]; dup && other != name {
+				a, b := min(name, other), max(name, other)
+				return fmt.Errorf("routes %q and %q both list host %q", a, b, h)
+			}
+			owner[h] = name
+		}
+	}
+	return nil
+}
+
+// Warnings reports settings that are valid but probably not intended. They
+// are logged at startup rather than failing it.
+func (c *Config) Warnings() []string {
+	var out []string
+	rl := c.RateLimit
+	if rl.Enabled {
+		if rl.GlobalRPS < rl.PerIPRPS {
+			out = append(out, fmt.Sprintf("GLOBAL_RPS (%v) is below PER_IP_RPS (%v); a single client can exhaust the global limit", rl.GlobalRPS, rl.PerIPRPS))
+		}
+		if rl.GlobalBurst < rl.GlobalRPS {
+			out = append(out, fmt.Sprintf("GLOBAL_BURST (%v) is below GLOBAL_RPS (%v); the rate can never be reached in bursts", rl.GlobalBurst, rl.GlobalRPS))
+		}
+		if rl.PerIPBurst < rl.PerIPRPS {
+			out = append(out, fmt.Sprintf("PER_IP_BURST (%v) is below PER_IP_RPS (%v); the rate can never be reached in bursts", rl.PerIPBurst, rl.PerIPRPS))
+		}
+		if rl.GlobalBurst < rl.PerIPBurst {
+			out = append(out, fmt.Sprintf("GLOBAL_BURST (%v) is below PER_IP_BURST (%v)", rl.GlobalBurst, rl.PerIPBurst))
+		}
+	}
+	// Below 1/(1-p) samples the percentile is the slowest request, so a
+	// single slow one opens the circuit
+	if up := c.Upstream; up.BreakerLatencyThreshold > 0 {
+		if need := int(math.Ceil(1/(1-up.BreakerLatencyPercentile) - 1e-9)); up.BreakerLatencyMinRequests < need {
+			out = append(out, fmt.Sprintf("CIRCUIT_BREAKER_LATENCY_MIN_REQUESTS (%d) is below %d, so one slow request can open a circuit at CIRCUIT_BREAKER_LATENCY_PERCENTILE %v", up.BreakerLatencyMinRequests, need, up.BreakerLatencyPercentile))
+		}
+	}
+	return out
+}
+
+// JWTEnabled reports whether any route requires a JWT
+func (c *Config) JWTEnabled() bool {
+	for _, rc := range c.Routes {
+		if rc.JWT {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks cross-field constraints that parsing alone can't catch
+func (c *Config) validate() error {
+	if f := c.RateLimit.InitialFraction; f < 0 || f > 1 {
+		return fmt.Errorf("RATE_LIMIT_INITIAL_FRACTION must be between 0 and 1, got %v", f)
+	}
+	switch c.RateLimit.Algorithm {
+	case "token_bucket":
+	case "sliding_window":
+		if c.RateLimit.Window <= 0 {
+			return fmt.Errorf("RATE_LIMIT_WINDOW must be positive")
+		}
+	default:
+		return fmt.Errorf("RATE_LIMIT_ALGORITHM must be token_bucket or sliding_window, got %q", c.RateLimit.Algorithm)
+	}
+	switch c.RateLimit.Backend {
+	case "memory":
+	case "redis":
+		if u, err := url.Parse(c.RateLimit.RedisURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			return fmt.Errorf("REDIS_URL must be a redis:// or rediss:// URL when RATE_LIMIT_BACKEND=redis")
+		}
+		if c.RateLimit.Algorithm != "token_bucket" {
+			return fmt.Errorf("RATE_LIMIT_BACKEND=redis supports RATE_LIMIT_ALGORITHM=token_bucket only")
+		}
+		if c.RateLimit.RedisTimeout <= 0 {
+			return fmt.Errorf("REDIS_TIMEOUT must be positive")
+		}
+	default:
+		return fmt.Errorf("RATE_LIMIT_BACKEND must be memory or redis, got %q", c.RateLimit.Backend)
+	}
+
+	for class, status := range c.Upstream.ErrorStatus {
+		switch class {
+		case "refused", "timeout", "tls", "protocol", "canceled", "circuit":
+		default:
+			return fmt.Errorf("PROXY_ERROR_STATUS: unknown error class %q", class)
+		}
+		if status < 400 || status > 599 {
+			return fmt.Errorf("PROXY_ERROR_STATUS: %s status must be 4xx or 5xx, got %d", class, status)
+		}
+	}
+
+	if c.Retry.MinInterval < 0 {
+		return fmt.Errorf("RETRY_MIN_INTERVAL must not be negative")
+	}
+	if c.Retry.MaxBackoff > 0 && c.Retry.MinInterval > c.Retry.MaxBackoff {
+		return fmt.Errorf("RETRY_MIN_INTERVAL (%s) must not exceed RETRY_MAX_BACKOFF (%s)", c.Retry.MinInterval, c.Retry.MaxBackoff)
+	}
+
+	if s := c.Throttle.LowPriorityShare; s <= 0 || s > 1 {
+		return fmt.Errorf("THROTTLE_LOW_PRIORITY_SHARE must be above 0 and at most 1, got %v", s)
+	}
+	if r := c.Throttle.CriticalReserve; r < 0 || r >= 1 {
+		return fmt.Errorf("THROTTLE_CRITICAL_RESERVE must be at least 0 and below 1, got %v", r)
+	}
+
+	switch c.Retry.ReplaySpill {
+	case "none", "gzip", "file":
+	default:
+		return fmt.Errorf("RETRY_REPLAY_SPILL must be none, gzip, or file, got %q", c.Retry.ReplaySpill)
+	}
+	if c.Retry.ReplayMemoryBytes <= 0 || c.Retry.ReplayMaxBytes < 0 {
+		return fmt.Errorf("RETRY_REPLAY_MEMORY_BYTES must be positive and RETRY_REPLAY_MAX_BYTES not negative")
+	}
+
+	if t := c.RateLimit.AlertThreshold; t < 0 || t > 1 {
+		return fmt.Errorf("RATE_LIMIT_ALERT_THRESHOLD must be between 0 and 1, got %v", t)
+	}
+	if c.RateLimit.AlertThreshold > 0 && c.RateLimit.AlertWindow <= 0 {
+		return fmt.Errorf("RATE_LIMIT_ALERT_WINDOW must be positive")
+	}
+
+	if c.Load.WeightInFlight < 0 || c.Load.WeightLatency < 0 || c.Load.WeightRejections < 0 {
+		return fmt.Errorf("LOAD_WEIGHT_* must not be negative")
+	}
+	if c.Load.LatencyTarget <= 0 || c.Load.Window < 1 {
+		return fmt.Errorf("LOAD_LATENCY_TARGET and LOAD_LATENCY_WINDOW must be positive")
+	}
+
+	if c.Upstream.H2ReadIdleTimeout < 0 || c.Upstream.H2PingTimeout < 0 {
+		return fmt.Errorf("UPSTREAM_H2_READ_IDLE_TIMEOUT and UPSTREAM_H2_PING_TIMEOUT must not be negative")
+	}
+	if c.Upstream.MaxConnAge < 0 {
+		return fmt.Errorf("UPSTREAM_MAX_CONN_AGE must not be negative")
+	}
+	if c.Upstream.MaxIdleConnAge <= 0 {
+		return fmt.Errorf("UPSTREAM_MAX_IDLE_CONN_AGE must be positive")
+	}
+
+	if c.Server.HTTP2MaxConcurrentStreams < 1 {
+		return fmt.Errorf("HTTP2_MAX_CONCURRENT_STREAMS must be positive")
+	}
+	if c.Server.HTTP2IdleTimeout < 0 {
+		return fmt.Errorf("HTTP2_IDLE_TIMEOUT must not be negative")
+	}
+
+	if c.Upstream.BreakerThreshold < 0 {
+		return fmt.Errorf("CIRCUIT_BREAKER_THRESHOLD must not be negative")
+	}
+	if c.Upstream.BreakerLatencyThreshold < 0 {
+		return fmt.Errorf("CIRCUIT_BREAKER_LATENCY_THRESHOLD must not be negative")
+	}
+	if (c.Upstream.BreakerThreshold > 0 || c.Upstream.BreakerLatencyThreshold > 0) && c.Upstream.BreakerCooldown <= 0 {
+		return fmt.Errorf("CIRCUIT_BREAKER_COOLDOWN must be positive")
+	}
+	if c.Upstream.BreakerLatencyThreshold > 0 {
+		if p := c.Upstream.BreakerLatencyPercentile; p <= 0 || p >= 1 {
+			return fmt.Errorf("CIRCUIT_BREAKER_LATENCY_PERCENTILE must be between 0 and 1, got %v", p)
+		}
+		if c.Upstream.BreakerLatencyWindow <= 0 {
+			return fmt.Errorf("CIRCUIT_BREAKER_LATENCY_WINDOW must be positive")
+		}
+		if c.Upstream.BreakerLatencyMinRequests < 1 {
+			return fmt.Errorf("CIRCUIT_BREAKER_LATENCY_MIN_REQUESTS must be positive")
+		}
+	}
+	if c.Upstream.OutlierThreshold < 0 {
+		return fmt.Errorf("OUTLIER_EJECTION_THRESHOLD must not be negative")
+	}
+	if c.Upstream.OutlierThreshold > 0 && c.Upstream.OutlierCooldown <= 0 {
+		return fmt.Errorf("OUTLIER_EJECTION_COOLDOWN must be positive")
+	}
+
+	if c.Server.ShutdownTimeout <= 0 {
+		return fmt.Errorf("SHUTDOWN_TIMEOUT must be positive")
+	}
+	if c.Server.RequestTimeout < 0 {
+		return fmt.Errorf("REQUEST_TIMEOUT must not be negative")
+	}
+
+	if c.Server.MaxConnLifetime < 0 {
+		return fmt.Errorf("MAX_CONN_LIFETIME must not be negative")
+	}
+
+	if c.Forwarded.Action != "trim" && c.Forwarded.Action != "reject" {
+		return fmt.Errorf("XFF_OVERFLOW_ACTION must be trim or reject, got %q", c.Forwarded.Action)
+	}
+
+	for _, o := range c.CORS.AllowedOrigins {
+		if o == "*" {
+			// Browsers refuse credentials with a wildcard; echoing any origin
+			// instead would hand every site the user's session
+			if c.CORS.AllowCredentials {
+				return fmt.Errorf("CORS_ALLOW_CREDENTIALS cannot be combined with CORS_ALLOWED_ORIGINS=*")
+			}
+			continue
+		}
+		if strings.Count(o, "*") > 1 {
+			return fmt.Errorf("CORS_ALLOWED_ORIGINS: %q may contain at most one *", o)
+		}
+		if u, err := url.Parse(strings.Replace(o, "*", "x", 1)); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("CORS_ALLOWED_ORIGINS: %q is not an origin like https://app.example.com", o)
+		}
+	}
+	if c.CORS.MaxAge < 0 {
+		return fmt.Errorf("CORS_MAX_AGE must not be negative")
+	}
+
+	if c.Gzip.Level < 1 || c.Gzip.Level > 9 {
+		return fmt.Errorf("GZIP_LEVEL must be between 1 and 9, got %d", c.Gzip.Level)
+	}
+	if c.Idempotency.Enabled {
+		if c.Idempotency.Header == "" {
+			return fmt.Errorf("IDEMPOTENCY_KEY_HEADER must not be empty")
+		}
+		if c.Idempotency.TTL <= 0 || c.Idempotency.MaxEntries < 1 || c.Idempotency.MaxBytes < 1 {
+			return fmt.Errorf("IDEMPOTENCY_TTL, IDEMPOTENCY_MAX_ENTRIES, and IDEMPOTENCY_MAX_BYTES must be positive")
+		}
+	}
+	if c.Health.Enabled {
+		if c.Health.Interval <= 0 || c.Health.Timeout <= 0 {
+			return fmt.Errorf("HEALTH_PROBE_INTERVAL and HEALTH_PROBE_TIMEOUT must be positive")
+		}
+		if !strings.HasPrefix(c.Health.Path, "/") {
+			return fmt.Errorf("HEALTH_PROBE_PATH must start with /")
+		}
+	}
+	if c.JWTEnabled() {
+		if u, err := url.Parse(c.JWT.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("JWT_JWKS_URL must be an http(s) URL when a route sets ROUTE_<NAME>_JWT")
+		}
+		if c.JWT.Leeway < 0 {
+			return fmt.Errorf("JWT_CLOCK_SKEW must not be negative")
+		}
+		if c.JWT.Refresh <= 0 || c.JWT.Timeout <= 0 {
+			return fmt.Errorf("JWT_JWKS_REFRESH and JWT_JWKS_TIMEOUT must be positive")
+		}
+	}
+	seenKeys := make(map[string]string, len(c.APIKeys.Keys))
+	for id, key := range c.APIKeys.Keys {
+		if id == "" || key == "" {
+			return fmt.Errorf("API_KEYS: key IDs and keys must not be empty")
+		}
+		if other, dup := seenKeys[key]; dup {
+			return fmt.Errorf("API_KEYS: %s and %s share a key", min(id, other), max(id, other))
+		}
+		seenKeys[key] = id
+	}
+	for name, rc := range c.Routes {
+		if rc.APIKey && len(c.APIKeys.Keys) == 0 {
+			return fmt.Errorf("route %q sets ROUTE_<NAME>_API_KEY but API_KEYS and API_KEYS_FILE are empty", name)
+		}
+	}
+	if len(c.APIKeys.Keys) > 0 && c.APIKeys.Header == "" {
+		return fmt.Errorf("API_KEY_HEADER must not be empty")
+	}
+	// Once keys are checked, an allow-listed key the store doesn't know
+	// would be rejected before it could bypass anything
+	if len(c.APIKeys.Keys) > 0 && strings.EqualFold(c.APIKeys.Header, "X-API-Key") {
+		for _, key := range c.RateLimit.AllowListKeys {
+			if _, ok := seenKeys[key]; !ok {
+				return fmt.Errorf("RATE_LIMIT_ALLOWLIST_KEYS entries must also be in API_KEYS or API_KEYS_FILE")
+			}
+		}
+	}
+	switch c.Flags.Provider {
+	case "memory":
+	case "http":
+		if u, err := url.Parse(c.Flags.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("FEATURE_FLAG_URL must be a URL when FEATURE_FLAG_PROVIDER=http")
+		}
+		if c.Flags.Timeout <= 0 {
+			return fmt.Errorf("FEATURE_FLAG_TIMEOUT must be positive")
+		}
+	default:
+		return fmt.Errorf("FEATURE_FLAG_PROVIDER must be memory or http, got %q", c.Flags.Provider)
+	}
+	if c.Flags.CacheTTL <= 0 {
+		return fmt.Errorf("FEATURE_FLAG_CACHE_TTL must be positive")
+	}
+	for name, percent := range c.Flags.Flags {
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("FEATURE_FLAGS: %s must be a percentage from 0 to 100, got %d", name, percent)
+		}
+	}
+	if len(c.Experiments.Experiments) > 0 {
+		if c.Experiments.CookieSecret == "" {
+			return fmt.Errorf("EXPERIMENT_COOKIE_SECRET is required when EXPERIMENTS is set")
+		}
+		if c.Experiments.Header == "" || c.Experiments.Cookie == "" {
+			return fmt.Errorf("EXPERIMENT_HEADER and EXPERIMENT_COOKIE must not be empty")
+		}
+		if c.Experiments.CookieMaxAge <= 0 {
+			return fmt.Errorf("EXPERIMENT_COOKIE_MAX_AGE must be positive")
+		}
+		seen := make(map[string]bool)
+		for _, e := range c.Experiments.Experiments {
+			if seen[e.Name] {
+				return fmt.Errorf("EXPERIMENTS: experiment %q listed twice", e.Name)
+			}
+			seen[e.Name] = true
+			total := 0
+			for _, b := range e.Buckets {
+				if b.Percent < 0 {
+					return fmt.Errorf("EXPERIMENTS: %s: negative allocation for %q", e.Name, b.Name)
+				}
+				total += b.Percent
+			}
+			if total != 100 {
+				return fmt.Errorf("EXPERIMENTS: %s: allocations add up to %d, want 100", e.Name, total)
+			}
+		}
+	}
+	if c.Gzip.MinBytes < 0 {
+		return fmt.Errorf("GZIP_MIN_BYTES must not be negative")
+	}
+	if c.Headers.MaxBytes < 0 {
+		return fmt.Errorf("MAX_REQUEST_HEADER_BYTES must not be negative")
+	}
+
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.Server.TLSFingerprint {
+		if c.Server.TLSCertFile == "" {
+			return fmt.Errorf("TLS_FINGERPRINT_ENABLED requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		if c.Server.TLSFingerprintHeader == "" {
+			return fmt.Errorf("TLS_FINGERPRINT_HEADER must not be empty")
+		}
+	}
+
+	if c.Middleware.Trailers && !c.Middleware.RequestID {
+		return fmt.Errorf("TRAILERS_ENABLED requires REQUEST_ID_ENABLED")
+	}
+
+	// Access logs correlate on request IDs; without them every line is orphaned
+	if c.Logging.AccessLog && !c.Middleware.RequestID {
+		return fmt.Errorf("ACCESS_LOG_ENABLED requires REQUEST_ID_ENABLED")
+	}
+	if c.Logging.ErrorWindow < 0 {
+		return fmt.Errorf("LOG_ERROR_WINDOW must not be negative")
+	}
+	if c.Logging.Async && c.Logging.BufferSize <= 0 {
+		return fmt.Errorf("LOG_BUFFER_SIZE must be positive when LOG_ASYNC=true")
+	}
+	if c.RateLimit.KeyBy != "ip" && c.RateLimit.KeyBy != "subject" {
+		return fmt.Errorf("RATE_LIMIT_KEY must be ip or subject, got %q", c.RateLimit.KeyBy)
+	}
+	for i := 1; i < len(c.Upstream.LatencyBuckets); i++ {
+		if c.Upstream.LatencyBuckets[i] <= c.Upstream.LatencyBuckets[i-1] {
+			return fmt.Errorf("UPSTREAM_LATENCY_BUCKETS must be strictly increasing")
+		}
+	}
+	if !c.RateLimit.Enabled && (len(c.RateLimit.AllowList) > 0 || len(c.RateLimit.AllowListKeys) > 0) {
+		return fmt.Errorf("RATE_LIMIT_ALLOWLIST is set but RATE_LIMIT_ENABLED=false")
+	}
+
+	switch c.BodyPolicy.Action {
+	case "off", "reject", "strip":
+	default:
+		return fmt.Errorf("BODYLESS_ACTION must be off, reject, or strip, got %q", c.BodyPolicy.Action)
+	}
+
+	for field, key := range c.NotFound.Fields {
+		switch field {
+		case "code", "message", "request_id", "timestamp":
+		default:
+			return fmt.Errorf("API_ERROR_FIELDS: unknown field %q", field)
+		}
+		if key == "" {
+			return fmt.Errorf("API_ERROR_FIELDS: empty name for %q", field)
+		}
+	}
+
+	if len(c.Methods.Allowed) == 0 {
+		return fmt.Errorf("ALLOWED_METHODS must not be empty")
+	}
+	global := make(map[string]bool, len(c.Methods.Allowed))
+	for _, m := range c.Methods.Allowed {
+		global[strings.ToUpper(m)] = true
+	}
+
+	// Preflights can't advertise methods the gateway then rejects
+	if len(c.CORS.AllowedOrigins) > 0 {
+		for _, m := range c.CORS.AllowedMethods {
+			if !global[strings.ToUpper(m)] {
+				return fmt.Errorf("CORS_ALLOWED_METHODS: %s is not in ALLOWED_METHODS", m)
+			}
+		}
+	}
+
+	if err := validatePrefixes(c.Routes); err != nil {
+		return err
+	}
+	if err := validateHosts(c.Routes); err != nil {
+		return err
+	}
+
+	for name, rc := range c.Routes {
+		// A route can only narrow the global set; anything else is unreachable
+		for _, m := range rc.Methods {
+			if !global[strings.ToUpper(m)] {
+				return fmt.Errorf("route %q: method %s is not in ALLOWED_METHODS", name, m)
+			}
+		}
+		if len(rc.URLs) == 0 {
+			return fmt.Errorf("route %q: no upstream URLs", name)
+		}
+		for _, raw := range rc.URLs {
+			if u, err := url.Parse(raw); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("route %q: invalid upstream URL %q", name, raw)
+			}
+		}
+		if (rc.Flag == "") != (len(rc.FlagURLs) == 0) {
+			return fmt.Errorf("route %q: ROUTE_%s_FLAG and ROUTE_%s_FLAG_URLS must be set together", name, strings.ToUpper(name), strings.ToUpper(name))
+		}
+		for _, raw := range rc.FlagURLs {
+			if u, err := url.Parse(raw); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("route %q: invalid flagged upstream URL %q", name, raw)
+			}
+		}
+		for _, raw := range rc.CanaryURLs {
+			if u, err := url.Parse(raw); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("route %q: invalid canary upstream URL %q", name, raw)
+			}
+		}
+		if rc.CanaryWeight < 0 || rc.CanaryWeight > 100 {
+			return fmt.Errorf("route %q: canary weight must be 0-100, got %d", name, rc.CanaryWeight)
+		}
+		if len(rc.Weights) > 0 && len(rc.Weights) != len(rc.URLs) {
+			return fmt.Errorf("route %q: %d weights for %d upstream URLs", name, len(rc.Weights), len(rc.URLs))
+		}
+		for _, w := range rc.Weights {
+			if w < 1 {
+				return fmt.Errorf("route %q: weights must be positive, got %d", name, w)
+			}
+		}
+		switch rc.Balancer {
+		case "weighted_random", "round_robin", "least_conn":
+		case "consistent_hash":
+			kind, key, _ := strings.Cut(rc.HashOn, ":")
+			switch strings.ToLower(kind) {
+			case "ip", "path":
+			case "header", "cookie":
+				if key == "" {
+					return fmt.Errorf("route %q: HASH_ON %q needs a name, e.g. %s:X-User-ID", name, rc.HashOn, kind)
+				}
+			default:
+				return fmt.Errorf("route %q: unknown HASH_ON %q (want ip, path, header:<Name> or cookie:<Name>)", name, rc.HashOn)
+			}
+		default:
+			return fmt.Errorf("route %q: unknown balancer %q", name, rc.Balancer)
+		}
+		if len(rc.SelectBackends) > 0 && rc.SelectHeader == "" {
+			return fmt.Errorf("route %q: SELECT_BACKENDS requires SELECT_HEADER", name)
+		}
+		for value, raw := range rc.SelectBackends {
+			if !slices.Contains(rc.URLs, raw) {
+				return fmt.Errorf("route %q: SELECT_BACKENDS %s=%s is not one of the route's upstream URLs", name, value, raw)
+			}
+		}
+		if rc.Timeout < 0 {
+			return fmt.Errorf("route %q: timeout must be positive, got %s", name, rc.Timeout)
+		}
+		if rc.CacheTTL < 0 || rc.CacheMaxEntries < 0 || rc.CacheMaxBytes < 0 {
+			return fmt.Errorf("route %q: cache settings must not be negative", name)
+		}
+		if rc.CachePrivate && rc.CacheTTL == 0 {
+			return fmt.Errorf("route %q: CACHE_PRIVATE requires CACHE_TTL", name)
+		}
+		if rc.StaleIfError < 0 || rc.StaleMaxEntries < 0 || rc.StaleMaxBytes < 0 {
+			return fmt.Errorf("route %q: stale-if-error settings must not be negative", name)
+		}
+		if rc.FallbackBody != "" {
+			if rc.FallbackStatus < 200 || rc.FallbackStatus > 599 {
+				return fmt.Errorf("route %q: fallback status must be 200-599, got %d", name, rc.FallbackStatus)
+			}
+			if mediaType, _, _ := mime.ParseMediaType(rc.FallbackContentType); (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) && !json.Valid([]byte(rc.FallbackBody)) {
+				return fmt.Errorf("route %q: fallback body is not valid JSON", name)
+			}
+		}
+		if rc.SchemaMaxBytes < 0 {
+			return fmt.Errorf("route %q: JSON schema max bytes must not be negative", name)
+		}
+		for _, alg := range rc.Checksums {
+			if alg != "md5" && alg != "sha256" {
+				return fmt.Errorf("route %q: unknown checksum algorithm %q (want md5 or sha256)", name, alg)
+			}
+		}
+		if rc.ChecksumMaxBytes < 0 {
+			return fmt.Errorf("route %q: checksum max bytes must not be negative", name)
+		}
+		if rc.ProtoDescriptor == "" && (rc.ProtoRequest != "" || rc.ProtoResponse != "") {
+			return fmt.Errorf("route %q: protobuf message types require ROUTE_%s_PROTO_DESCRIPTOR", name, strings.ToUpper(name))
+		}
+		if rc.ProtoDescriptor != "" && rc.ProtoRequest == "" && rc.ProtoResponse == "" {
+			return fmt.Errorf("route %q: ROUTE_%s_PROTO_DESCRIPTOR is set but neither a request nor a response type is", name, strings.ToUpper(name))
+		}
+		if rc.ProtoDescriptor != "" && rc.ProtoMaxBytes <= 0 {
+			return fmt.Errorf("route %q: protobuf max bytes must be positive", name)
+		}
+		switch rc.Priority {
+		case "low", "normal", "critical":
+		default:
+			return fmt.Errorf("route %q: priority must be low, normal, or critical, got %q", name, rc.Priority)
+		}
+		if rc.ResponseHeaderTimeout < 0 {
+			return fmt.Errorf("route %q: response header timeout must be positive, got %s", name, rc.ResponseHeaderTimeout)
+		}
+		if p := rc.OutboundProxy; p != "" && p != "direct" {
+			if u, err := url.Parse(p); err != nil || u.Host == "" {
+				return fmt.Errorf("route %q: invalid outbound proxy %q", name, p)
+			}
+		}
+		if rc.TLSMinVersion < tls.VersionTLS12 && !rc.LegacyTLS {
+			return fmt.Errorf("route %q: TLS minimum below 1.2 requires ROUTE_%s_ALLOW_LEGACY_TLS=true", name, strings.ToUpper(name))
+		}
+		if (rc.TLSClientCert == "") != (rc.TLSClientKey == "") {
+			return fmt.Errorf("route %q: TLS client certificate and key must be set together", name)
+		}
+		if rc.TLSMaxVersion != 0 && rc.TLSMaxVersion < rc.TLSMinVersion {
+			return fmt.Errorf("route %q: TLS maximum version is below the minimum", name)
+		}
+		if rc.Coalesce && rc.CoalesceMaxBytes <= 0 {
+			return fmt.Errorf("route %q: coalesce max bytes must be positive", name)
+		}
+		if !rc.Coalesce && len(rc.CoalesceHeaders) > 0 {
+			return fmt.Errorf("route %q: ROUTE_%s_COALESCE_HEADERS is set but coalescing is disabled", name, strings.ToUpper(name))
+		}
+		for from, to := range rc.RewriteURLs {
+			for _, raw := range []string{from, to} {
+				if u, err := url.Parse(raw); err != nil || u.Scheme == "" || u.Host == "" {
+					return fmt.Errorf("route %q: invalid URL rewrite base %q", name, raw)
+				}
+			}
+		}
+		for _, kind := range rc.Minify {
+			if kind != "json" && kind != "html" {
+				return fmt.Errorf("route %q: minify must list json and/or html, got %q", name, kind)
+			}
+		}
+		if len(rc.Minify) > 0 && rc.MinifyMaxBytes <= 0 {
+			return fmt.Errorf("route %q: minify max bytes must be positive", name)
+		}
+		if len(rc.RewriteURLs) > 0 && rc.RewriteMaxBytes <= 0 {
+			return fmt.Errorf("route %q: URL rewrite max bytes must be positive", name)
+		}
+		for from, to := range rc.RenameResponseHeaders {
+			if from == "" || to == "" {
+				return fmt.Errorf("route %q: response header rename %q=%q needs both names", name, from, to)
+			}
+		}
+		if rc.MaxConcurrent < 0 {
+			return fmt.Errorf("route %q: max concurrent must not be negative", name)
+		}
+		if rc.RetryBodyMatch == "" && (rc.RetryBodyJSONPath != "" || rc.RetryBodyStatus != 0 || rc.RetryBodyMaxBytes != 0) {
+			return fmt.Errorf("route %q: RETRY_BODY_JSON_PATH, RETRY_BODY_STATUS and RETRY_BODY_MAX_BYTES require RETRY_BODY_MATCH", name)
+		}
+		if rc.RetryBodyMaxBytes < 0 {
+			return fmt.Errorf("route %q: retry body max bytes must not be negative", name)
+		}
+		if rc.HealthPath != "" && !strings.HasPrefix(rc.HealthPath, "/") {
+			return fmt.Errorf("route %q: health path must start with /", name)
+		}
+		if rc.HealthBodyJSONPath != "" && rc.HealthBodyMatch == "" {
+			return fmt.Errorf("route %q: HEALTH_BODY_JSON_PATH requires HEALTH_BODY_MATCH", name)
+		}
+		if (rc.PathPattern == "") != (rc.PathTemplate == "") {
+			return fmt.Errorf("route %q: path pattern and path template must be set together", name)
+		}
+		if f := rc.Chaos.Fraction; f < 0 || f > 1 {
+			return fmt.Errorf("route %q: chaos fraction must be between 0 and 1, got %v", name, f)
+		}
+		if e := rc.Chaos.ErrorRate; e < 0 || e > 1 {
+			return fmt.Errorf("route %q: chaos error rate must be between 0 and 1, got %v", name, e)
+		}
+		if rc.Chaos.DelayMin < 0 || rc.Chaos.DelayMax < rc.Chaos.DelayMin {
+			return fmt.Errorf("route %q: chaos delay range %s-%s is invalid", name, rc.Chaos.DelayMin, rc.Chaos.DelayMax)
+		}
+		if r := rc.Chaos.FaultRate; r < 0 || r > 1 {
+			return fmt.Errorf("route %q: fault rate must be between 0 and 1, got %v", name, r)
+		}
+		switch rc.Chaos.FaultType {
+		case "refused", "503", "timeout":
+		default:
+			return fmt.Errorf("route %q: fault type must be refused, 503, or timeout, got %q", name, rc.Chaos.FaultType)
+		}
+	}
+	return nil
 }
 
 // env returns environment variable value or default
@@ -103,6 +1645,37 @@ func env(key, defaultValue string) string {
 	return defaultValue
 }
 
+// envList returns a comma-separated environment variable as a trimmed slice
+func envList(key string) []string {
+	return envListDefault(key, "")
+}
+
+// envListDefault is envList with a comma-separated default
+func envListDefault(key, defaultValue string) []string {
+	var out []string
+	for _, v := range strings.Split(env(key, defaultValue), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// headerList splits a comma-separated header list; "none" yields an empty
+// list so a non-empty default can be switched off
+func headerList(s string) []string {
+	if strings.TrimSpace(s) == "none" {
+		return nil
+	}
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 // mustInt parses string to int or fails
 func mustInt(s string) int {
 	var x int
@@ -123,6 +1696,130 @@ func mustFloat(s string) float64 {
 	return x
 }
 
+// mustFloatList parses a comma-separated list of floats or fails
+func mustFloatList(s string) []float64 {
+	var out []float64
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, mustFloat(v))
+		}
+	}
+	return out
+}
+
+// mustIntList parses a comma-separated list of ints or fails
+func mustIntList(s string) []int {
+	var out []int
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, mustInt(v))
+		}
+	}
+	return out
+}
+
+// mustStringMap parses "key=value,..." pairs or fails
+func mustStringMap(s string) map[string]string {
+	out := make(map[string]string)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		k, val, ok := strings.Cut(v, "=")
+		if !ok {
+			log.Fatalf("invalid mapping %q", v)
+		}
+		out[strings.TrimSpace(k)] = strings.TrimSpace(val)
+	}
+	return out
+}
+
+// mustExperiments parses "name=bucket:pct,bucket:pct;name=..." or fails
+func mustExperiments(s string) []Experiment {
+	var out []Experiment
+	for _, def := range strings.Split(s, ";") {
+		if def = strings.TrimSpace(def); def == "" {
+			continue
+		}
+		name, buckets, ok := strings.Cut(def, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			log.Fatalf("invalid experiment %q (want name=bucket:percent,...)", def)
+		}
+		e := Experiment{Name: name}
+		for _, b := range strings.Split(buckets, ",") {
+			bucket, pct, ok := strings.Cut(strings.TrimSpace(b), ":")
+			if bucket = strings.TrimSpace(bucket); !ok || bucket == "" {
+				log.Fatalf("invalid bucket %q in experiment %q (want bucket:percent)", b, name)
+			}
+			e.Buckets = append(e.Buckets, ExperimentBucket{Name: bucket, Percent: mustInt(strings.TrimSpace(pct))})
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// mustIntMap parses "name=integer,..." pairs or fails
+func mustIntMap(s string) map[string]int {
+	out := make(map[string]int)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		k, n, ok := strings.Cut(v, "=")
+		if !ok {
+			log.Fatalf("invalid mapping %q", v)
+		}
+		out[strings.TrimSpace(k)] = mustInt(strings.TrimSpace(n))
+	}
+	return out
+}
+
+// mustStatusMap parses "class=status,..." pairs or fails
+func mustStatusMap(s string) map[string]int {
+	out := make(map[string]int)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		k, status, ok := strings.Cut(v, "=")
+		if !ok {
+			log.Fatalf("invalid status mapping %q", v)
+		}
+		out[strings.TrimSpace(k)] = mustInt(strings.TrimSpace(status))
+	}
+	return out
+}
+
+// mustBool parses string to bool or fails
+func mustBool(s string) bool {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		log.Fatalf("invalid bool %q", s)
+	}
+	return b
+}
+
+// tlsVersions maps configuration strings to crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// mustTLSVersion parses "1.0".."1.3" or fails; empty yields 0 (unset)
+func mustTLSVersion(s string) uint16 {
+	if s == "" {
+		return 0
+	}
+	v, ok := tlsVersions[s]
+	if !ok {
+		log.Fatalf("invalid TLS version %q (want 1.0, 1.1, 1.2, or 1.3)", s)
+	}
+	return v
+}
+
 // mustDuration parses string to time.Duration or fails
 func mustDuration(s string) time.Duration {
 	d, err := time.ParseDuration(s)
@@ -0,0 +1,102 @@
+package conntrack
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"apigateway/internal/logger"
+)
+
+// Lifetime enforces an absolute lifetime on client connections. Register
+// ConnState on http.Server; a background sweep closes connections that
+// have been open longer than the limit, whether idle or mid-request.
+// This complements the header/body timeouts, which reset per request and
+// so never bound a slow client that keeps a connection trickling.
+type Lifetime struct {
+	max time.Duration
+
+	mu    sync.Mutex
+	conns map[net.Conn]time.Time // accepted at
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewLifetime starts the sweeper; call Stop when the server is done
+func NewLifetime(max time.Duration) *Lifetime {
+	l := &Lifetime{
+		max:   max,
+		conns: make(map[net.Conn]time.Time),
+		stop:  make(chan struct{}),
+	}
+	go l.sweep()
+	return l
+}
+
+// ConnState is the http.Server hook. It only touches the map on the first
+// and last transition, so steady request traffic costs nothing.
+func (l *Lifetime) ConnState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		l.mu.Lock()
+		l.conns[c] = time.Now()
+		l.mu.Unlock()
+	case http.StateHijacked, http.StateClosed:
+		l.mu.Lock()
+		delete(l.conns, c)
+		l.mu.Unlock()
+	}
+}
+
+// Stop ends the sweeper
+func (l *Lifetime) Stop() {
+	l.once.Do(func() { close(l.stop) })
+}
+
+func (l *Lifetime) sweep() {
+	// Check often enough that connections overshoot by at most a quarter
+	interval := l.max / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			l.closeExpired(now)
+		}
+	}
+}
+
+func (l *Lifetime) closeExpired(now time.Time) {
+	var expired []net.Conn
+	l.mu.Lock()
+	for c, opened := range l.conns {
+		if now.Sub(opened) > l.max {
+			expired = append(expired, c)
+			delete(l.conns, c)
+		}
+	}
+	open := len(l.conns)
+	l.mu.Unlock()
+
+	if len(expired) == 0 {
+		return
+	}
+	// Close outside the lock; the server's StateClosed callback re-locks
+	for _, c := range expired {
+		c.Close()
+	}
+	logger.Log.Warn("connection_lifetime_exceeded",
+		slog.Int("closed", len(expired)),
+		slog.Int("open", open),
+		slog.String("max_lifetime", l.max.String()),
+	)
+}
@@ -0,0 +1,92 @@
+package conntrack
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLifetimeSweepsIdleKeepAlive(t *testing.T) {
+	l := NewLifetime(100 * time.Millisecond)
+	defer l.Stop()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	ts.Config.ConnState = l.ConnState
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: gw\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The sweep runs at least every second; the idle connection must not
+	// outlive the next one by much
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("read on swept connection: %v, want EOF", err)
+	}
+}
+
+func TestLifetimeClosesOnlyExpiredConnections(t *testing.T) {
+	l := &Lifetime{max: time.Minute, conns: make(map[net.Conn]time.Time), stop: make(chan struct{})}
+	old, oldPeer := net.Pipe()
+	fresh, freshPeer := net.Pipe()
+	gone, _ := net.Pipe()
+	defer freshPeer.Close()
+
+	l.ConnState(old, http.StateNew)
+	l.ConnState(gone, http.StateNew)
+	l.ConnState(gone, http.StateClosed)
+	// Request traffic in between doesn't refresh a connection's age
+	l.ConnState(old, http.StateActive)
+	l.ConnState(old, http.StateIdle)
+	l.conns[old] = time.Now().Add(-2 * time.Minute)
+	l.ConnState(fresh, http.StateNew)
+
+	l.closeExpired(time.Now())
+
+	if _, err := oldPeer.Read(make([]byte, 1)); err == nil {
+		t.Error("expired connection left open")
+	}
+	freshPeer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := freshPeer.Read(make([]byte, 1)); err == nil || !isTimeout(err) {
+		t.Errorf("young connection closed: %v", err)
+	}
+	if _, ok := l.conns[fresh]; !ok || len(l.conns) != 1 {
+		t.Errorf("tracked connections = %d, want only the young one", len(l.conns))
+	}
+}
+
+func TestLifetimeForgetsHijackedConnections(t *testing.T) {
+	l := &Lifetime{max: time.Minute, conns: make(map[net.Conn]time.Time), stop: make(chan struct{})}
+	c, peer := net.Pipe()
+	defer peer.Close()
+	l.ConnState(c, http.StateNew)
+	l.ConnState(c, http.StateHijacked)
+	if len(l.conns) != 0 {
+		t.Fatal("hijacked connection still tracked")
+	}
+}
+
+func TestLifetimeStopIsIdempotent(t *testing.T) {
+	l := NewLifetime(time.Minute)
+	l.Stop()
+	l.Stop()
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,129 @@
+package conntrack
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ---------------- TLS Client Fingerprints ----------------
+
+type fingerprintKey struct{}
+
+// fingerprintHolder is filled in during the handshake; each connection
+// gets its own, so no locking is needed once the handshake is done
+type fingerprintHolder struct {
+	value string
+}
+
+// FingerprintConnContext is the http.Server ConnContext hook. It gives the
+// connection a slot that FingerprintConfig fills during the handshake;
+// requests on the connection inherit it.
+func FingerprintConnContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, fingerprintKey{}, &fingerprintHolder{})
+}
+
+// FingerprintConfig wraps base so every handshake records the client's
+// fingerprint. Requires FingerprintConnContext on the server.
+func FingerprintConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	next := base.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if h, ok := hello.Context().Value(fingerprintKey{}).(*fingerprintHolder); ok {
+			h.value = Fingerprint(hello)
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+	return cfg
+}
+
+// ClientFingerprint returns the fingerprint of the TLS connection a request
+// arrived on ("" for plaintext or when fingerprinting is off)
+func ClientFingerprint(ctx context.Context) string {
+	if h, ok := ctx.Value(fingerprintKey{}).(*fingerprintHolder); ok {
+		return h.value
+	}
+	return ""
+}
+
+// WithFingerprintHeader passes the client's TLS fingerprint upstream in
+// header. Any value the client sent is removed first, so upstreams can
+// trust it; plaintext requests carry none.
+func WithFingerprintHeader(header string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(header)
+		if r.TLS != nil {
+			if fp := ClientFingerprint(r.Context()); fp != "" {
+				r.Header.Set(header, fp)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Fingerprint summarizes what a client offered in its ClientHello, in the
+// spirit of JA3: versions, cipher suites, curves, point formats, signature
+// schemes, and ALPN protocols, in the client's order and without GREASE
+// values, hashed to 32 hex digits. The same TLS stack yields the same
+// value regardless of server name or session. The extension list isn't
+// exposed by crypto/tls, so values are not comparable with JA3 databases.
+func Fingerprint(hello *tls.ClientHelloInfo) string {
+	fields := []string{
+		joinUint16(hello.SupportedVersions),
+		joinUint16(hello.CipherSuites),
+		joinUint16(curveIDs(hello.SupportedCurves)),
+		joinUint16(pointFormats(hello.SupportedPoints)),
+		joinUint16(signatureSchemes(hello.SignatureSchemes)),
+		strings.Join(hello.SupportedProtos, "-"),
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// grease reports whether v is a reserved GREASE value (RFC 8701), which
+// clients pick at random and would otherwise make fingerprints unstable
+func grease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func joinUint16(vs []uint16) string {
+	parts := make([]string, 0, len(vs))
+	for _, v := range vs {
+		if !grease(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+func curveIDs(cs []tls.CurveID) []uint16 {
+	out := make([]uint16, len(cs))
+	for i, c := range cs {
+		out[i] = uint16(c)
+	}
+	return out
+}
+
+func pointFormats(ps []uint8) []uint16 {
+	out := make([]uint16, len(ps))
+	for i, p := range ps {
+		out[i] = uint16(p)
+	}
+	return out
+}
+
+func signatureSchemes(ss []tls.SignatureScheme) []uint16 {
+	out := make([]uint16, len(ss))
+	for i, s := range ss {
+		out[i] = uint16(s)
+	}
+	return out
+}
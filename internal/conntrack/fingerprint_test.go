@@ -0,0 +1,79 @@
+package conntrack
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestFingerprintStableAcrossGREASEAndServerName(t *testing.T) {
+	hello := func(serverName string, ciphers ...uint16) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:        serverName,
+			CipherSuites:      ciphers,
+			SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+			SupportedCurves:   []tls.CurveID{tls.X25519, tls.CurveP256},
+			SupportedPoints:   []uint8{0},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedProtos:   []string{"h2", "http/1.1"},
+		}
+	}
+	base := Fingerprint(hello("a.example.com", tls.TLS_AES_128_GCM_SHA256, tls.TLS_AES_256_GCM_SHA384))
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(base) {
+		t.Fatalf("fingerprint %q isn't 32 hex digits", base)
+	}
+	// GREASE values are random per connection and the server name varies
+	greased := Fingerprint(hello("b.example.com", 0x1a1a, tls.TLS_AES_128_GCM_SHA256, 0xfafa, tls.TLS_AES_256_GCM_SHA384))
+	if greased != base {
+		t.Errorf("GREASE or server name changed the fingerprint: %s vs %s", greased, base)
+	}
+	// The client's order is part of what identifies its TLS stack
+	if Fingerprint(hello("a.example.com", tls.TLS_AES_256_GCM_SHA384, tls.TLS_AES_128_GCM_SHA256)) == base {
+		t.Error("reordered cipher suites share a fingerprint")
+	}
+}
+
+func TestGREASE(t *testing.T) {
+	for v, want := range map[uint16]bool{0x0a0a: true, 0x1a1a: true, 0xfafa: true, 0x0a1a: false, 0x1301: false} {
+		if grease(v) != want {
+			t.Errorf("grease(%#04x) = %v, want %v", v, !want, want)
+		}
+	}
+}
+
+func TestFingerprintHeaderFromHandshake(t *testing.T) {
+	var got string
+	ts := httptest.NewUnstartedServer(WithFingerprintHeader("X-TLS-Fingerprint", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-TLS-Fingerprint")
+	})))
+	ts.TLS = FingerprintConfig(&tls.Config{})
+	ts.Config.ConnContext = FingerprintConnContext
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(client *http.Client, url string) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("X-TLS-Fingerprint", "spoofed")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	get(ts.Client(), ts.URL)
+	if len(got) != 32 || got == "spoofed" {
+		t.Fatalf("TLS request: header = %q, want the handshake's fingerprint", got)
+	}
+
+	// Plaintext requests carry none, whatever the client sent
+	plain := httptest.NewServer(ts.Config.Handler)
+	defer plain.Close()
+	get(plain.Client(), plain.URL)
+	if got != "" {
+		t.Fatalf("plaintext request: header = %q, want none", got)
+	}
+}
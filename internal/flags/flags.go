@@ -0,0 +1,189 @@
+// Package flags evaluates feature flags so routes can send part of their
+// traffic to alternate upstreams while a rollout is in progress.
+package flags
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"apigateway/internal/logger"
+)
+
+// maxDocumentBytes bounds the flag document read from an HTTP provider
+const maxDocumentBytes = 1 << 20
+
+// Provider reports how much traffic a flag is on for, as a percentage:
+// 0 is off, 100 is on for everyone. Unknown flags are off.
+type Provider interface {
+	Percent(ctx context.Context, name string) (int, error)
+}
+
+// Enabled reports whether the flag is on for key at the given percentage.
+// The same key always gets the same answer, so a client isn't bounced
+// between upstreams while a rollout holds steady.
+func Enabled(name, key string, percent int) bool {
+	switch {
+	case percent <= 0:
+		return false
+	case percent >= 100:
+		return true
+	}
+	sum := sha256.Sum256([]byte(name + "\x00" + key))
+	return int(binary.BigEndian.Uint64(sum[:8])%100) < percent
+}
+
+// ---------------- In-Memory Provider ----------------
+
+// Memory holds flags in process, set from configuration or at runtime;
+// safe for concurrent use
+type Memory struct {
+	mu    sync.RWMutex
+	flags map[string]int
+}
+
+// NewMemory returns a provider serving a copy of flags
+func NewMemory(flags map[string]int) *Memory {
+	m := &Memory{flags: make(map[string]int, len(flags))}
+	for name, percent := range flags {
+		m.flags[name] = percent
+	}
+	return m
+}
+
+// Set changes a flag's percentage
+func (m *Memory) Set(name string, percent int) {
+	m.mu.Lock()
+	m.flags[name] = percent
+	m.mu.Unlock()
+}
+
+func (m *Memory) Percent(_ context.Context, name string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.flags[name], nil
+}
+
+// ---------------- HTTP Provider ----------------
+
+// HTTP reads flags from a JSON document served by an external flag
+// service, e.g. {"new-checkout": true, "search-v2": 25}: booleans are on
+// or off, numbers are percentages
+type HTTP struct {
+	url    string
+	token  string // sent as a bearer token when set
+	client *http.Client
+}
+
+// NewHTTP returns a provider fetching url with the given per-request timeout
+func NewHTTP(url, token string, timeout time.Duration) *HTTP {
+	return &HTTP{url: url, token: token, client: &http.Client{Timeout: timeout}}
+}
+
+func (h *HTTP) Percent(ctx context.Context, name string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("flag service returned %s", resp.Status)
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDocumentBytes)).Decode(&doc); err != nil {
+		return 0, fmt.Errorf("flag document: %w", err)
+	}
+	raw, ok := doc[name]
+	if !ok {
+		return 0, nil
+	}
+	var on bool
+	if json.Unmarshal(raw, &on) == nil {
+		if on {
+			return 100, nil
+		}
+		return 0, nil
+	}
+	var percent float64
+	if err := json.Unmarshal(raw, &percent); err != nil || percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("flag %q: want a boolean or a percentage, got %s", name, raw)
+	}
+	return int(percent), nil
+}
+
+// ---------------- Caching ----------------
+
+// Cached remembers each flag's percentage for a TTL so requests don't wait
+// on the provider. When a refresh fails, the last known value keeps being
+// served (or off, for a flag never fetched) until the next TTL elapses;
+// one caller refreshes an expired flag while the others use the old value.
+type Cached struct {
+	provider Provider
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cachedFlag
+}
+
+type cachedFlag struct {
+	percent    int
+	expires    time.Time
+	refreshing bool
+}
+
+// NewCached wraps p with a cache of the given TTL
+func NewCached(p Provider, ttl time.Duration) *Cached {
+	return &Cached{provider: p, ttl: ttl, entries: make(map[string]*cachedFlag)}
+}
+
+// Percent never fails: provider errors are logged and answered from cache
+func (c *Cached) Percent(ctx context.Context, name string) (int, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	if ok && (now.Before(e.expires) || e.refreshing) {
+		percent := e.percent
+		c.mu.Unlock()
+		return percent, nil
+	}
+	if !ok {
+		e = &cachedFlag{}
+		c.entries[name] = e
+	}
+	e.refreshing = true
+	c.mu.Unlock()
+
+	// A client disconnecting mustn't fail the refresh for everyone else
+	percent, err := c.provider.Percent(context.WithoutCancel(ctx), name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.refreshing = false
+	e.expires = time.Now().Add(c.ttl)
+	if err != nil {
+		logger.Log.Warn("feature_flag_unavailable",
+			slog.String("flag", name),
+			slog.Int("percent", e.percent),
+			slog.String("error", err.Error()),
+		)
+		return e.percent, nil
+	}
+	e.percent = percent
+	return percent, nil
+}
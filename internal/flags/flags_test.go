@@ -0,0 +1,198 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEnabled(t *testing.T) {
+	on := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		got := Enabled("new-checkout", key, 25)
+		if got != Enabled("new-checkout", key, 25) {
+			t.Fatalf("%s got different answers", key)
+		}
+		if got && !Enabled("new-checkout", key, 50) {
+			t.Fatalf("%s dropped out when the rollout grew", key)
+		}
+		if got {
+			on++
+		}
+	}
+	if on < 2200 || on > 2800 {
+		t.Errorf("%d of 10000 keys enabled at 25%%", on)
+	}
+	if Enabled("f", "k", 0) || Enabled("f", "k", -5) || !Enabled("f", "k", 100) || !Enabled("f", "k", 150) {
+		t.Error("0 and 100 percent should be off and on for everyone")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	flags := map[string]int{"a": 30}
+	m := NewMemory(flags)
+	flags["a"] = 90
+	if p, _ := m.Percent(context.Background(), "a"); p != 30 {
+		t.Errorf("a = %d, want the copied 30", p)
+	}
+	m.Set("b", 100)
+	if p, _ := m.Percent(context.Background(), "b"); p != 100 {
+		t.Errorf("b = %d after Set", p)
+	}
+	if p, err := m.Percent(context.Background(), "unknown"); p != 0 || err != nil {
+		t.Errorf("unknown flag = %d, %v", p, err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"on": true, "off": false, "quarter": 25, "half": 50.9, "big": 101, "text": "yes"}`)
+	}))
+	defer srv.Close()
+
+	p := NewHTTP(srv.URL, "secret", time.Second)
+	for _, tc := range []struct {
+		name    string
+		percent int
+		err     bool
+	}{
+		{"on", 100, false},
+		{"off", 0, false},
+		{"quarter", 25, false},
+		{"half", 50, false},
+		{"missing", 0, false},
+		{"big", 0, true},
+		{"text", 0, true},
+	} {
+		percent, err := p.Percent(context.Background(), tc.name)
+		if percent != tc.percent || (err != nil) != tc.err {
+			t.Errorf("%s = %d, %v; want %d, err=%v", tc.name, percent, err, tc.percent, tc.err)
+		}
+	}
+
+	if _, err := NewHTTP(srv.URL, "wrong", time.Second).Percent(context.Background(), "on"); err == nil {
+		t.Error("non-200 response accepted")
+	}
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	if _, err := NewHTTP(srv.URL, "", 50*time.Millisecond).Percent(context.Background(), "on"); err == nil {
+		t.Error("slow flag service didn't time out")
+	}
+}
+
+// stubProvider answers from percent or err and counts calls; a non-nil
+// gate holds each call until it is closed
+type stubProvider struct {
+	mu      sync.Mutex
+	percent int
+	err     error
+	calls   atomic.Int32
+	gate    chan struct{}
+}
+
+func (s *stubProvider) set(percent int, err error) {
+	s.mu.Lock()
+	s.percent, s.err = percent, err
+	s.mu.Unlock()
+}
+
+func (s *stubProvider) Percent(context.Context, string) (int, error) {
+	s.calls.Add(1)
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.percent, s.err
+}
+
+func TestCachedServesLastKnownValue(t *testing.T) {
+	stub := &stubProvider{percent: 40}
+	c := NewCached(stub, 20*time.Millisecond)
+	ctx := context.Background()
+
+	if p, _ := c.Percent(ctx, "f"); p != 40 {
+		t.Fatalf("first fetch = %d", p)
+	}
+	stub.set(80, nil)
+	if p, _ := c.Percent(ctx, "f"); p != 40 || stub.calls.Load() != 1 {
+		t.Fatalf("within TTL: %d after %d calls, want cached 40 after 1", p, stub.calls.Load())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if p, _ := c.Percent(ctx, "f"); p != 80 {
+		t.Fatalf("after TTL = %d, want 80", p)
+	}
+
+	stub.set(0, errors.New("flag service down"))
+	time.Sleep(30 * time.Millisecond)
+	if p, err := c.Percent(ctx, "f"); p != 80 || err != nil {
+		t.Errorf("provider error: %d, %v; want last known 80", p, err)
+	}
+	if p, err := c.Percent(ctx, "never-fetched"); p != 0 || err != nil {
+		t.Errorf("never fetched flag on error: %d, %v; want off", p, err)
+	}
+}
+
+func TestCachedRefreshesOnce(t *testing.T) {
+	stub := &stubProvider{percent: 10, gate: make(chan struct{})}
+	c := NewCached(stub, time.Minute)
+
+	done := make(chan int)
+	go func() {
+		p, _ := c.Percent(context.Background(), "f")
+		done <- p
+	}()
+	for stub.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// While the first fetch is in flight the others get the old value
+	for i := 0; i < 5; i++ {
+		if p, _ := c.Percent(context.Background(), "f"); p != 0 {
+			t.Errorf("during refresh = %d, want 0", p)
+		}
+	}
+	close(stub.gate)
+	if p := <-done; p != 10 {
+		t.Errorf("refreshing caller = %d, want 10", p)
+	}
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("provider called %d times, want 1", n)
+	}
+}
+
+func TestCachedRefreshOutlivesCaller(t *testing.T) {
+	stub := &stubProvider{percent: 60}
+	c := NewCached(ctxProvider{stub}, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if p, err := c.Percent(ctx, "f"); p != 60 || err != nil {
+		t.Errorf("canceled caller: %d, %v; want 60", p, err)
+	}
+}
+
+// ctxProvider fails when its context is done, like a provider making a request
+type ctxProvider struct{ Provider }
+
+func (p ctxProvider) Percent(ctx context.Context, name string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return p.Provider.Percent(ctx, name)
+}
@@ -0,0 +1,219 @@
+// Package health actively probes upstream replicas so the gateway can stop
+// advertising itself as ready when it can't reach the services it fronts.
+package health
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"apigateway/internal/logger"
+)
+
+// maxProbeBody bounds how much of a probe response is read before the
+// connection is reused
+const maxProbeBody = 4 << 10
+
+// Config controls how upstreams are probed
+type Config struct {
+	Interval time.Duration // time between probe rounds
+	Timeout  time.Duration // per probe
+}
+
+// Target is one upstream replica of a route
+type Target struct {
+	Route    string
+	URL      *url.URL // replica base URL; only scheme and host are used
+	Path     string   // probed with GET, e.g. /health
+	Critical bool     // the gateway isn't ready while none of the route's replicas is healthy
+
+	// Transport reaches the replica the way the route's proxy does (client
+	// TLS, CA bundle, egress proxy); nil uses http.DefaultTransport
+	Transport http.RoundTripper
+
+	// Body must also match for the replica to count as healthy, for health
+	// endpoints that answer 200 {"status":"degraded"} (nil checks status only)
+	Body *BodyMatch
+}
+
+// BodyMatch checks the first maxProbeBody bytes of a probe response
+type BodyMatch struct {
+	JSONPath string // dot-separated path into a JSON body, e.g. "status"
+	Value    string // expected value at JSONPath, or a body substring when JSONPath is empty
+}
+
+// matches reports whether body satisfies m
+func (m *BodyMatch) matches(body []byte) bool {
+	if m.JSONPath == "" {
+		return bytes.Contains(body, []byte(m.Value))
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return false
+	}
+	for _, key := range strings.Split(m.JSONPath, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return false
+		}
+		if v, ok = obj[key]; !ok {
+			return false
+		}
+	}
+	return fmt.Sprint(v) == m.Value
+}
+
+// Prober checks every target on an interval. Responses with a 2xx or 3xx
+// status (and a matching body, where the target has a BodyMatch) count as
+// healthy; anything else, including a timeout, doesn't.
+type Prober struct {
+	cfg     Config
+	targets []Target
+	clients []*http.Client // by target index
+
+	mu      sync.Mutex
+	healthy []bool // by target index
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewProber runs a first probe round before returning, so readiness is
+// accurate from the start, then keeps probing in the background. Call
+// Stop when the gateway shuts down.
+func NewProber(cfg Config, targets []Target) *Prober {
+	p := &Prober{
+		cfg:     cfg,
+		targets: targets,
+		clients: make([]*http.Client, len(targets)),
+		healthy: make([]bool, len(targets)),
+		stop:    make(chan struct{}),
+	}
+	for i, t := range targets {
+		p.clients[i] = &http.Client{
+			Transport: t.Transport,
+			// A redirect answer already shows the upstream is up
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+	}
+	// Replicas start healthy so the first round only logs the failures
+	for i := range p.healthy {
+		p.healthy[i] = true
+	}
+	p.probeAll()
+	go p.loop()
+	return p
+}
+
+// Stop ends background probing
+func (p *Prober) Stop() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+// Unavailable returns the critical routes that have no healthy replica,
+// sorted; empty means the gateway can serve all of them
+func (p *Prober) Unavailable() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	up := make(map[string]bool)
+	for i, t := range p.targets {
+		if t.Critical {
+			up[t.Route] = up[t.Route] || p.healthy[i]
+		}
+	}
+	var down []string
+	for route, ok := range up {
+		if !ok {
+			down = append(down, route)
+		}
+	}
+	sort.Strings(down)
+	return down
+}
+
+func (p *Prober) loop() {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.probeAll()
+		}
+	}
+}
+
+// probeAll probes every target concurrently, so one slow replica doesn't
+// delay the others' results
+func (p *Prober) probeAll() {
+	var wg sync.WaitGroup
+	for i := range p.targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p.probe(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (p *Prober) probe(i int) {
+	t := p.targets[i]
+	u := url.URL{Scheme: t.URL.Scheme, Host: t.URL.Host, Path: t.Path}
+
+	status := 0
+	errMsg := ""
+	var body []byte
+	ctx, cancel := context.WithTimeout(context.Background(), p.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = p.clients[i].Do(req); err == nil {
+			status = resp.StatusCode
+			body, err = io.ReadAll(io.LimitReader(resp.Body, maxProbeBody))
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		errMsg = err.Error()
+	}
+	healthy := err == nil && status >= 200 && status < 400
+	if healthy && t.Body != nil && !t.Body.matches(body) {
+		healthy = false
+		errMsg = "response body does not match"
+	}
+
+	p.mu.Lock()
+	changed := p.healthy[i] != healthy
+	p.healthy[i] = healthy
+	p.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	if healthy {
+		logger.Log.Info("upstream_healthy",
+			slog.String("route", t.Route),
+			slog.String("upstream", t.URL.Host),
+			slog.Int("status", status),
+		)
+		return
+	}
+	logger.Log.Warn("upstream_unhealthy",
+		slog.String("route", t.Route),
+		slog.String("upstream", t.URL.Host),
+		slog.Int("status", status),
+		slog.String("error", errMsg),
+	)
+}
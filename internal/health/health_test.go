@@ -0,0 +1,67 @@
+package health
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeUsesTargetTransport(t *testing.T) {
+	// The upstream's certificate is only trusted by its own client
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	cfg := Config{Interval: time.Hour, Timeout: 5 * time.Second}
+
+	p := NewProber(cfg, []Target{{Route: "users", URL: u, Path: "/health", Critical: true}})
+	defer p.Stop()
+	if got := p.Unavailable(); len(got) != 1 {
+		t.Fatalf("default transport: Unavailable = %v, want [users]", got)
+	}
+
+	p = NewProber(cfg, []Target{{Route: "users", URL: u, Path: "/health", Critical: true, Transport: srv.Client().Transport}})
+	defer p.Stop()
+	if got := p.Unavailable(); len(got) != 0 {
+		t.Fatalf("route transport: Unavailable = %v, want none", got)
+	}
+}
+
+func TestProbeBodyMatch(t *testing.T) {
+	status := `{"status":"ok","checks":{"db":"up"}}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, status)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	cfg := Config{Interval: time.Hour, Timeout: 5 * time.Second}
+
+	tests := []struct {
+		name    string
+		body    string
+		match   *BodyMatch
+		healthy bool
+	}{
+		{"no matcher", `{"status":"degraded"}`, nil, true},
+		{"json path match", status, &BodyMatch{JSONPath: "status", Value: "ok"}, true},
+		{"nested json path match", status, &BodyMatch{JSONPath: "checks.db", Value: "up"}, true},
+		{"json path mismatch", `{"status":"degraded"}`, &BodyMatch{JSONPath: "status", Value: "ok"}, false},
+		{"json path missing", `{"state":"ok"}`, &BodyMatch{JSONPath: "status", Value: "ok"}, false},
+		{"not json", "ok", &BodyMatch{JSONPath: "status", Value: "ok"}, false},
+		{"substring match", "all systems OK", &BodyMatch{Value: "OK"}, true},
+		{"substring mismatch", "DEGRADED", &BodyMatch{Value: "OK"}, false},
+		// Only the first maxProbeBody bytes are read
+		{"match past the limit", strings.Repeat(" ", maxProbeBody) + "OK", &BodyMatch{Value: "OK"}, false},
+	}
+	for _, tt := range tests {
+		status = tt.body
+		p := NewProber(cfg, []Target{{Route: "users", URL: u, Path: "/health", Critical: true, Body: tt.match}})
+		p.Stop()
+		if healthy := len(p.Unavailable()) == 0; healthy != tt.healthy {
+			t.Errorf("%s: healthy = %v, want %v", tt.name, healthy, tt.healthy)
+		}
+	}
+}
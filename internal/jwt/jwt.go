@@ -0,0 +1,493 @@
+// Package jwt verifies JSON Web Tokens locally against keys published as a
+// JWKS document, so authenticating a request doesn't take a call to the
+// identity provider. Only asymmetric signatures are accepted (RS*, PS*,
+// ES*, EdDSA); "none" and shared-secret HMAC tokens are refused.
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register hashes for crypto.Hash.New
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"apigateway/internal/logger"
+)
+
+// maxJWKSBytes bounds the key set document
+const maxJWKSBytes = 1 << 20
+
+// minRefetchInterval limits how often a token with an unknown key ID can
+// make the key set be fetched again, so forged kids can't flood the
+// identity provider
+const minRefetchInterval = 30 * time.Second
+
+// Verification failures; Reason maps them to short log values
+var (
+	ErrMalformed       = errors.New("malformed token")
+	ErrAlgorithm       = errors.New("unsupported or mismatched algorithm")
+	ErrUnknownKey      = errors.New("unknown signing key")
+	ErrSignature       = errors.New("invalid signature")
+	ErrExpired         = errors.New("token expired")
+	ErrNotYetValid     = errors.New("token not yet valid")
+	ErrIssuer          = errors.New("unexpected issuer")
+	ErrAudience        = errors.New("unexpected audience")
+	ErrKeysUnavailable = errors.New("signing keys unavailable")
+)
+
+// Reason returns a short name for a verification error, for logs
+func Reason(err error) string {
+	for _, e := range []struct {
+		err    error
+		reason string
+	}{
+		{ErrKeysUnavailable, "keys_unavailable"},
+		{ErrAlgorithm, "algorithm"},
+		{ErrUnknownKey, "unknown_key"},
+		{ErrSignature, "signature"},
+		{ErrExpired, "expired"},
+		{ErrNotYetValid, "not_yet_valid"},
+		{ErrIssuer, "issuer"},
+		{ErrAudience, "audience"},
+	} {
+		if errors.Is(err, e.err) {
+			return e.reason
+		}
+	}
+	return "malformed"
+}
+
+// ---------------- Verification ----------------
+
+// Validator checks a token's signature and its registered claims
+type Validator struct {
+	Keys     *KeySet
+	Issuer   string        // required iss (empty accepts any)
+	Audience []string      // aud must contain one of these (empty accepts any)
+	Leeway   time.Duration // clock skew allowed on exp and nbf
+}
+
+// Verify returns the token's claims when it is signed by a key in the set,
+// has not expired (exp is required), is already valid, and matches the
+// configured issuer and audience
+func (v *Validator) Verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	k, err := v.Keys.lookup(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.verify(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Validator) checkClaims(claims map[string]any, now time.Time) error {
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return fmt.Errorf("%w: exp missing", ErrMalformed)
+	}
+	if now.After(exp.Add(v.Leeway)) {
+		return ErrExpired
+	}
+	if raw, ok := claims["nbf"]; ok {
+		nbf, ok := numericDate(raw)
+		if !ok {
+			return fmt.Errorf("%w: nbf is not a number", ErrMalformed)
+		}
+		if now.Before(nbf.Add(-v.Leeway)) {
+			return ErrNotYetValid
+		}
+	}
+	if v.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.Issuer {
+			return ErrIssuer
+		}
+	}
+	if len(v.Audience) > 0 && !audienceMatches(claims["aud"], v.Audience) {
+		return ErrAudience
+	}
+	return nil
+}
+
+// numericDate reads a JWT NumericDate (seconds since the epoch)
+func numericDate(v any) (time.Time, bool) {
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true
+}
+
+// audienceMatches accepts aud as a string or an array of strings
+func audienceMatches(aud any, want []string) bool {
+	var got []string
+	switch a := aud.(type) {
+	case string:
+		got = []string{a}
+	case []any:
+		for _, v := range a {
+			if s, ok := v.(string); ok {
+				got = append(got, s)
+			}
+		}
+	}
+	for _, g := range got {
+		for _, w := range want {
+			if g == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// ---------------- Keys ----------------
+
+// key is a public key from the set, with the algorithm it is pinned to
+// when the JWKS names one
+type key struct {
+	pub crypto.PublicKey
+	alg string
+}
+
+// verify checks sig over signed with alg, which must suit the key type
+func (k *key) verify(alg, signed string, sig []byte) error {
+	if k.alg != "" && alg != k.alg {
+		return ErrAlgorithm
+	}
+	if alg == "EdDSA" {
+		pub, ok := k.pub.(ed25519.PublicKey)
+		if !ok {
+			return ErrAlgorithm
+		}
+		if !ed25519.Verify(pub, []byte(signed), sig) {
+			return ErrSignature
+		}
+		return nil
+	}
+
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return ErrAlgorithm
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := k.pub.(*rsa.PublicKey)
+		if !ok {
+			return ErrAlgorithm
+		}
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if err != nil {
+			return ErrSignature
+		}
+		return nil
+	case "ES":
+		pub, ok := k.pub.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrAlgorithm
+		}
+		// The curve is fixed by the algorithm: ES256 is P-256, ES512 is P-521
+		if curveAlg(pub.Curve) != alg {
+			return ErrAlgorithm
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrSignature
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrSignature
+		}
+		return nil
+	}
+	return ErrAlgorithm
+}
+
+func curveAlg(c elliptic.Curve) string {
+	switch c {
+	case elliptic.P256():
+		return "ES256"
+	case elliptic.P384():
+		return "ES384"
+	case elliptic.P521():
+		return "ES512"
+	}
+	return ""
+}
+
+// KeySet fetches a JWKS document and caches its keys. Keys are refreshed
+// once they are older than the refresh interval, and early when a token
+// names a key ID the set doesn't have (at most every 30s), so rotated keys
+// are picked up. Those refreshes run in the background, so a token signed
+// with a key that isn't loaded yet is rejected until the refresh lands.
+// When a refresh fails, the keys already known keep being used. Safe for
+// concurrent use.
+type KeySet struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu      sync.RWMutex
+	keys    map[string]*key
+	fetched time.Time // last successful fetch
+	tried   time.Time // last attempt, successful or not
+
+	fetchMu    sync.Mutex  // one fetch at a time
+	refreshing atomic.Bool // a background refresh is running
+}
+
+// NewKeySet returns a key set served at url; call Refresh to load it
+// before the first request
+func NewKeySet(url string, refresh, timeout time.Duration) *KeySet {
+	return &KeySet{url: url, refresh: refresh, client: &http.Client{Timeout: timeout}}
+}
+
+// lookup never waits for the identity provider: a stale set, or a kid the
+// set doesn't have, starts a background refresh and the answer is given
+// from the keys already loaded
+func (s *KeySet) lookup(kid string) (*key, error) {
+	s.mu.RLock()
+	k := s.find(kid)
+	stale := time.Since(s.fetched) >= s.refresh
+	recent := time.Since(s.tried) < minRefetchInterval
+	loaded := s.keys != nil
+	s.mu.RUnlock()
+
+	if (k == nil || stale) && !recent {
+		s.refreshInBackground()
+	}
+	switch {
+	case k != nil:
+		return k, nil
+	case loaded:
+		return nil, ErrUnknownKey
+	}
+	return nil, ErrKeysUnavailable
+}
+
+// refreshInBackground starts a refresh unless one is already running
+func (s *KeySet) refreshInBackground() {
+	if !s.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer s.refreshing.Store(false)
+		s.Refresh(context.Background())
+	}()
+}
+
+// find looks up kid; a token without one is accepted when the set holds
+// a single key. Callers hold mu.
+func (s *KeySet) find(kid string) *key {
+	if k, ok := s.keys[kid]; ok {
+		return k
+	}
+	if kid == "" && len(s.keys) == 1 {
+		for _, k := range s.keys {
+			return k
+		}
+	}
+	return nil
+}
+
+// Refresh fetches the key set now. Callers that find a fetch in progress
+// wait for it instead of starting another.
+func (s *KeySet) Refresh(ctx context.Context) error {
+	start := time.Now()
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+	s.mu.RLock()
+	done := s.tried.After(start)
+	s.mu.RUnlock()
+	if done {
+		return nil // someone else fetched while we waited
+	}
+
+	// A client disconnecting mustn't fail the refresh for everyone else
+	keys, err := s.fetch(context.WithoutCancel(ctx))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tried = time.Now()
+	if err != nil {
+		logger.Log.Warn("jwks_refresh_failed",
+			slog.String("url", s.url),
+			slog.Int("keys", len(s.keys)),
+			slog.String("error", err.Error()),
+		)
+		return err
+	}
+	s.keys, s.fetched = keys, s.tried
+	return nil
+}
+
+// jwk holds the members of a JSON Web Key the gateway understands
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (s *KeySet) fetch(ctx context.Context) (map[string]*key, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key set returned %s", resp.Status)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSBytes)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("key set: %w", err)
+	}
+	keys := make(map[string]*key, len(doc.Keys))
+	for _, j := range doc.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		pub, err := j.publicKey()
+		if err != nil {
+			// One odd key (e.g. a new type) mustn't take down the others
+			logger.Log.Warn("jwks_key_skipped",
+				slog.String("kid", j.Kid),
+				slog.String("kty", j.Kty),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		keys[j.Kid] = &key{pub: pub, alg: j.Alg}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("key set has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (j *jwk) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err1 := decodeInt(j.N)
+		e, err2 := decodeInt(j.E)
+		if err1 != nil || err2 != nil || !e.IsInt64() || e.Int64() < 2 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA key")
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key too short (%d bits)", n.BitLen())
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err1 := decodeInt(j.X)
+		y, err2 := decodeInt(j.Y)
+		if err1 != nil || err2 != nil || !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if j.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP key (only Ed25519 is supported)")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,324 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	rsaKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+	rsaOther, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _    = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ = ed25519.GenerateKey(rand.Reader)
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// publicJWK is the JWKS entry for priv's public key
+func publicJWK(kid, alg string, priv crypto.Signer) map[string]string {
+	j := map[string]string{"kid": kid, "use": "sig"}
+	if alg != "" {
+		j["alg"] = alg
+	}
+	switch pub := priv.Public().(type) {
+	case *rsa.PublicKey:
+		j["kty"], j["n"], j["e"] = "RSA", b64(pub.N.Bytes()), b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		j["kty"], j["crv"] = "EC", pub.Curve.Params().Name
+		j["x"], j["y"] = b64(pub.X.FillBytes(make([]byte, size))), b64(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		j["kty"], j["crv"], j["x"] = "OKP", "Ed25519", b64(pub)
+	}
+	return j
+}
+
+// sign builds a token; priv is a crypto.Signer or, for HS256, a []byte
+func sign(t *testing.T, alg, kid string, priv any, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch k := priv.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		if alg == "PS256" {
+			sig, err = rsa.SignPSS(rand.Reader, k, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case nil:
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+// jwksServer serves the given keys and counts fetches
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+	mu      sync.Mutex
+	keys    []map[string]string
+	gate    chan struct{} // when set, fetches wait for it to close
+}
+
+func newJWKSServer(t *testing.T, keys ...map[string]string) *jwksServer {
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		gate, keys := s.gate, s.keys
+		s.mu.Unlock()
+		if gate != nil {
+			<-gate
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newValidator(t *testing.T, srv *jwksServer) *Validator {
+	t.Helper()
+	keys := NewKeySet(srv.URL, time.Hour, 5*time.Second)
+	if err := keys.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return &Validator{Keys: keys, Issuer: "https://issuer", Audience: []string{"api"}}
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"sub": "user-1",
+		"iss": "https://issuer",
+		"aud": "api",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	srv := newJWKSServer(t,
+		publicJWK("rsa", "", rsaKey),
+		publicJWK("ec", "", ecKey),
+		publicJWK("ed", "", edKey),
+	)
+	v := newValidator(t, srv)
+	claims := validClaims()
+
+	for _, tt := range []struct {
+		name string
+		alg  string
+		kid  string
+		priv any
+	}{
+		{"RS256", "RS256", "rsa", rsaKey},
+		{"PS256", "PS256", "rsa", rsaKey},
+		{"ES256", "ES256", "ec", ecKey},
+		{"EdDSA", "EdDSA", "ed", edKey},
+	} {
+		if _, err := v.Verify(context.Background(), sign(t, tt.alg, tt.kid, tt.priv, claims)); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	good := sign(t, "RS256", "rsa", rsaKey, claims)
+	parts := strings.Split(good, ".")
+	other := validClaims()
+	other["sub"] = "admin"
+	forged, _ := json.Marshal(other)
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"other key", sign(t, "RS256", "rsa", rsaOther, claims), ErrSignature},
+		{"payload swapped", parts[0] + "." + b64(forged) + "." + parts[2], ErrSignature},
+		{"signature truncated", good[:len(good)-4], ErrSignature},
+		{"ecdsa wrong length", sign(t, "ES256", "ec", ecKey, claims) + "AAAA", ErrSignature},
+		{"unknown kid", sign(t, "RS256", "nope", rsaKey, claims), ErrUnknownKey},
+		{"two segments", parts[0] + "." + parts[1], ErrMalformed},
+		{"bad base64", parts[0] + "." + parts[1] + ".!!", ErrMalformed},
+	} {
+		if _, err := v.Verify(context.Background(), tt.token); !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyAlgorithmConfusion(t *testing.T) {
+	srv := newJWKSServer(t,
+		publicJWK("rsa", "", rsaKey),
+		publicJWK("pinned", "PS256", rsaKey),
+		publicJWK("ec", "", ecKey),
+	)
+	v := newValidator(t, srv)
+	claims := validClaims()
+
+	// The classic attack: HMAC keyed with the RSA public key's bytes
+	pubDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+
+	for _, tt := range []struct {
+		name  string
+		token string
+	}{
+		{"none", sign(t, "none", "rsa", nil, claims)},
+		{"HS256 with public key", sign(t, "HS256", "rsa", pubDER, claims)},
+		{"HS256 with modulus", sign(t, "HS256", "rsa", rsaKey.N.Bytes(), claims)},
+		{"EC alg on RSA key", sign(t, "ES256", "rsa", ecKey, claims)},
+		{"RSA alg on EC key", sign(t, "RS256", "ec", rsaKey, claims)},
+		{"EdDSA on RSA key", sign(t, "EdDSA", "rsa", edKey, claims)},
+		{"curve mismatch", sign(t, "ES384", "ec", ecKey, claims)},
+		{"alg pinned by JWKS", sign(t, "RS256", "pinned", rsaKey, claims)},
+	} {
+		if _, err := v.Verify(context.Background(), tt.token); !errors.Is(err, ErrAlgorithm) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, ErrAlgorithm)
+		}
+	}
+	if _, err := v.Verify(context.Background(), sign(t, "PS256", "pinned", rsaKey, claims)); err != nil {
+		t.Errorf("pinned alg: %v", err)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	srv := newJWKSServer(t, publicJWK("rsa", "", rsaKey))
+	v := newValidator(t, srv)
+	v.Audience = []string{"api", "admin"}
+	v.Leeway = time.Minute
+	now := time.Now()
+
+	for _, tt := range []struct {
+		name   string
+		modify func(map[string]any)
+		want   error
+	}{
+		{"valid", func(map[string]any) {}, nil},
+		{"exp missing", func(c map[string]any) { delete(c, "exp") }, ErrMalformed},
+		{"exp not a number", func(c map[string]any) { c["exp"] = "tomorrow" }, ErrMalformed},
+		{"expired", func(c map[string]any) { c["exp"] = now.Add(-2 * time.Minute).Unix() }, ErrExpired},
+		{"expired within leeway", func(c map[string]any) { c["exp"] = now.Add(-30 * time.Second).Unix() }, nil},
+		{"not yet valid", func(c map[string]any) { c["nbf"] = now.Add(2 * time.Minute).Unix() }, ErrNotYetValid},
+		{"nbf within leeway", func(c map[string]any) { c["nbf"] = now.Add(30 * time.Second).Unix() }, nil},
+		{"nbf not a number", func(c map[string]any) { c["nbf"] = "soon" }, ErrMalformed},
+		{"wrong issuer", func(c map[string]any) { c["iss"] = "https://evil" }, ErrIssuer},
+		{"no issuer", func(c map[string]any) { delete(c, "iss") }, ErrIssuer},
+		{"wrong audience", func(c map[string]any) { c["aud"] = "other" }, ErrAudience},
+		{"no audience", func(c map[string]any) { delete(c, "aud") }, ErrAudience},
+		{"audience array", func(c map[string]any) { c["aud"] = []string{"other", "admin"} }, nil},
+		{"audience array without match", func(c map[string]any) { c["aud"] = []string{"other"} }, ErrAudience},
+	} {
+		claims := validClaims()
+		tt.modify(claims)
+		_, err := v.Verify(context.Background(), sign(t, "RS256", "rsa", rsaKey, claims))
+		if tt.want == nil && err != nil || !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestUnknownKeyRefreshesInBackground(t *testing.T) {
+	srv := newJWKSServer(t, publicJWK("old", "", rsaKey))
+	v := newValidator(t, srv)
+	// Past the refetch limit the first Refresh started
+	v.Keys.mu.Lock()
+	v.Keys.tried = time.Now().Add(-time.Minute)
+	v.Keys.mu.Unlock()
+
+	// The issuer rotates to a new key, and the JWKS is slow to answer
+	gate := make(chan struct{})
+	srv.mu.Lock()
+	srv.keys = append(srv.keys, publicJWK("new", "", rsaOther))
+	srv.gate = gate
+	srv.mu.Unlock()
+	token := sign(t, "RS256", "new", rsaOther, validClaims())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.Verify(context.Background(), token); !errors.Is(err, ErrUnknownKey) {
+				t.Errorf("err = %v, want %v", err, ErrUnknownKey)
+			}
+		}()
+	}
+	// Verify returned while the fetch is still stuck
+	wg.Wait()
+	if _, err := v.Verify(context.Background(), sign(t, "RS256", "old", rsaKey, validClaims())); err != nil {
+		t.Fatalf("known key during refresh: %v", err)
+	}
+	close(gate)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := v.Verify(context.Background(), token)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rotated key never picked up: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := srv.fetches.Load(); got != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2 (startup and one refresh)", got)
+	}
+}
+
+func TestKeysUnavailableDoesNotBlock(t *testing.T) {
+	gate := make(chan struct{})
+	defer close(gate)
+	srv := newJWKSServer(t, publicJWK("rsa", "", rsaKey))
+	srv.gate = gate
+	v := &Validator{Keys: NewKeySet(srv.URL, time.Hour, 5*time.Second)}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.Verify(context.Background(), sign(t, "RS256", "rsa", rsaKey, validClaims()))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrKeysUnavailable) {
+			t.Fatalf("err = %v, want %v", err, ErrKeysUnavailable)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Verify waited for the JWKS")
+	}
+}
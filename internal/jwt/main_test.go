@@ -0,0 +1,15 @@
+package jwt
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"apigateway/internal/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.Log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
@@ -0,0 +1,133 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AsyncHandler hands records to a background goroutine through a bounded
+// buffer, so a slow log sink can't hold up request handling. When the
+// buffer is full, records are dropped and counted instead of waiting:
+// completeness is traded for latency under extreme load.
+type AsyncHandler struct {
+	next  slog.Handler
+	queue *asyncQueue // shared with handlers derived by WithAttrs/WithGroup
+}
+
+type asyncQueue struct {
+	records chan asyncRecord
+	dropped atomic.Uint64
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	// Handle holds mu for reading while it queues a record, so Close can't
+	// stop the drain between the closed check and the send and strand the
+	// record in the buffer, neither written nor counted
+	mu     sync.RWMutex
+	closed bool
+}
+
+type asyncRecord struct {
+	handler slog.Handler
+	ctx     context.Context
+	record  slog.Record
+}
+
+// Async makes Log asynchronous with the given buffer size; call it once,
+// after Init and before logging from other goroutines
+func Async(buffer int) *AsyncHandler {
+	h := NewAsyncHandler(Log.Handler(), buffer)
+	Log = slog.New(h)
+	return h
+}
+
+// NewAsyncHandler starts draining a buffer of the given size into next.
+// Call Close before exiting to write out what is still buffered.
+func NewAsyncHandler(next slog.Handler, buffer int) *AsyncHandler {
+	q := &asyncQueue{
+		records: make(chan asyncRecord, buffer),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go q.drain()
+	return &AsyncHandler{next: next, queue: q}
+}
+
+func (q *asyncQueue) drain() {
+	defer close(q.done)
+	for {
+		select {
+		case r := <-q.records:
+			r.handler.Handle(r.ctx, r.record)
+		case <-q.stop:
+			for {
+				select {
+				case r := <-q.records:
+					r.handler.Handle(r.ctx, r.record)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (h *AsyncHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle queues r without blocking; it never fails, even when r is dropped
+func (h *AsyncHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.queue.mu.RLock()
+	defer h.queue.mu.RUnlock()
+	if h.queue.closed {
+		h.queue.dropped.Add(1)
+		return nil
+	}
+	// The record's attributes may be reused by the caller once we return
+	rec := asyncRecord{handler: h.next, ctx: context.WithoutCancel(ctx), record: r.Clone()}
+	select {
+	case h.queue.records <- rec:
+	default:
+		h.queue.dropped.Add(1)
+	}
+	return nil
+}
+
+func (h *AsyncHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &AsyncHandler{next: h.next.WithAttrs(attrs), queue: h.queue}
+}
+
+func (h *AsyncHandler) WithGroup(name string) slog.Handler {
+	return &AsyncHandler{next: h.next.WithGroup(name), queue: h.queue}
+}
+
+// Dropped returns how many records were discarded because the buffer was full
+func (h *AsyncHandler) Dropped() uint64 {
+	return h.queue.dropped.Load()
+}
+
+// Close stops accepting records and waits until the buffered ones are
+// written or ctx ends. Records logged after Close are dropped; a summary
+// of all drops is written directly to the underlying handler.
+func (h *AsyncHandler) Close(ctx context.Context) {
+	h.queue.once.Do(func() {
+		h.queue.mu.Lock()
+		h.queue.closed = true
+		h.queue.mu.Unlock()
+		close(h.queue.stop)
+	})
+	select {
+	case <-h.queue.done:
+	case <-ctx.Done():
+	}
+	if n := h.Dropped(); n > 0 {
+		r := slog.NewRecord(time.Now(), slog.LevelWarn, "log_records_dropped", 0)
+		r.AddAttrs(slog.Uint64("dropped", n))
+		h.next.Handle(context.Background(), r)
+	}
+}
@@ -0,0 +1,119 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingHandler counts records by message, optionally holding each one
+// until gate is closed
+type countingHandler struct {
+	gate chan struct{}
+
+	mu   sync.Mutex
+	msgs map[string]int
+}
+
+func newCountingHandler() *countingHandler {
+	return &countingHandler{msgs: make(map[string]int)}
+}
+
+func (h *countingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *countingHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *countingHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *countingHandler) Handle(_ context.Context, r slog.Record) error {
+	if h.gate != nil {
+		<-h.gate
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.msgs[r.Message]++
+	return nil
+}
+
+func (h *countingHandler) count(msg string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.msgs[msg]
+}
+
+func TestAsyncHandlerWritesBufferedRecordsOnClose(t *testing.T) {
+	next := newCountingHandler()
+	next.gate = make(chan struct{})
+	h := NewAsyncHandler(next, 100)
+	log := slog.New(h)
+	for i := 0; i < 50; i++ {
+		log.Info("request_completed")
+	}
+	close(next.gate)
+	h.Close(context.Background())
+
+	if got := next.count("request_completed"); got != 50 {
+		t.Fatalf("wrote %d records, want all 50", got)
+	}
+	if h.Dropped() != 0 || next.count("log_records_dropped") != 0 {
+		t.Fatalf("dropped %d records with room to spare", h.Dropped())
+	}
+}
+
+func TestAsyncHandlerDropsWhenFull(t *testing.T) {
+	next := newCountingHandler()
+	next.gate = make(chan struct{})
+	h := NewAsyncHandler(next, 2)
+	log := slog.New(h)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			log.Info("request_completed")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logging blocked on a stalled sink")
+	}
+	close(next.gate)
+	h.Close(context.Background())
+
+	written := uint64(next.count("request_completed"))
+	if h.Dropped() == 0 || written+h.Dropped() != 20 {
+		t.Fatalf("wrote %d and dropped %d of 20", written, h.Dropped())
+	}
+	if next.count("log_records_dropped") != 1 {
+		t.Fatal("no drop summary on Close")
+	}
+}
+
+func TestAsyncHandlerAccountsForEveryRecordAroundClose(t *testing.T) {
+	for round := 0; round < 200; round++ {
+		next := newCountingHandler()
+		h := NewAsyncHandler(next, 1024)
+		log := slog.New(h).With("round", round)
+
+		const writers, each = 16, 20
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < each; j++ {
+					log.Info("request_completed")
+				}
+			}()
+		}
+		h.Close(context.Background())
+		wg.Wait()
+
+		// Records logged after Close are counted as dropped; none may be
+		// left behind in the buffer
+		if written := uint64(next.count("request_completed")); written+h.Dropped() != writers*each {
+			t.Fatalf("round %d: wrote %d and dropped %d of %d", round, written, h.Dropped(), writers*each)
+		}
+	}
+}
@@ -0,0 +1,625 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Histogram ----------------
+
+// DefaultUpstreamBuckets are tuned for upstream latencies (seconds)
+var DefaultUpstreamBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// HistogramVec is a Prometheus-style cumulative histogram partitioned by label values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	exemplars bool // keep the latest traced observation per bucket
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64    // per bucket, non-cumulative
+	exemplars   []*exemplar // per bucket plus +Inf; nil until one is recorded
+	count       uint64
+	sum         float64
+}
+
+// exemplar links a bucket to one trace that landed in it
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+// NewHistogramVec creates a histogram with the given upper bounds (sorted ascending)
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: b,
+		series:  make(map[string]*histogram),
+	}
+}
+
+// EnableExemplars makes ObserveExemplar keep trace IDs for the
+// OpenMetrics output
+func (h *HistogramVec) EnableExemplars() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.exemplars = true
+}
+
+// Observe records v for the series identified by labelValues
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.ObserveExemplar(v, "", labelValues...)
+}
+
+// ObserveExemplar records v like Observe and, when exemplars are enabled
+// and traceID is set, remembers it as the bucket's exemplar
+func (h *HistogramVec) ObserveExemplar(v float64, traceID string, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+	bucket := len(h.buckets) // +Inf
+	for i, ub := range h.buckets {
+		if v <= ub {
+			bucket = i
+			break
+		}
+	}
+	if bucket < len(h.buckets) {
+		s.counts[bucket]++
+	}
+	s.count++
+	s.sum += v
+
+	if h.exemplars && traceID != "" {
+		if s.exemplars == nil {
+			s.exemplars = make([]*exemplar, len(h.buckets)+1)
+		}
+		s.exemplars[bucket] = &exemplar{traceID: traceID, value: v, at: time.Now()}
+	}
+}
+
+// WritePrometheus writes the histogram in the Prometheus text exposition format
+func (h *HistogramVec) WritePrometheus(w io.Writer) {
+	h.write(w, false)
+}
+
+// WriteOpenMetrics writes the histogram in the OpenMetrics text format,
+// with exemplars on buckets that have one
+func (h *HistogramVec) WriteOpenMetrics(w io.Writer) {
+	h.write(w, true)
+}
+
+func (h *HistogramVec) write(w io.Writer, openMetrics bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := h.series[k]
+		labels := formatLabels(h.labels, s.labelValues)
+		var cum uint64
+		for i, ub := range h.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d%s\n", h.name, labels, formatFloat(ub), cum, s.exemplar(i, openMetrics))
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d%s\n", h.name, labels, s.count, s.exemplar(len(h.buckets), openMetrics))
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, strings.TrimSuffix(labels, ","), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, strings.TrimSuffix(labels, ","), s.count)
+	}
+}
+
+// exemplar renders bucket i's exemplar suffix, or nothing in the plain
+// text format, which has no exemplars
+func (s *histogram) exemplar(i int, openMetrics bool) string {
+	if !openMetrics || s.exemplars == nil || s.exemplars[i] == nil {
+		return ""
+	}
+	e := s.exemplars[i]
+	return fmt.Sprintf(" # {trace_id=\"%s\"} %s %.3f", labelEscaper.Replace(e.traceID), formatFloat(e.value),
+		float64(e.at.UnixNano())/1e9)
+}
+
+// ---------------- Counter ----------------
+
+// CounterVec is a monotonically increasing counter partitioned by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*counter
+}
+
+type counter struct {
+	labelValues []string
+	value       uint64
+}
+
+// NewCounterVec creates a counter with the given label names
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*counter),
+	}
+}
+
+// Inc adds one to the series identified by labelValues
+func (c *CounterVec) Inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.series[key]
+	if !ok {
+		s = &counter{labelValues: append([]string(nil), labelValues...)}
+		c.series[key] = s
+	}
+	s.value++
+}
+
+// WritePrometheus writes the counter in the Prometheus text exposition format
+func (c *CounterVec) WritePrometheus(w io.Writer) {
+	c.write(w, c.name)
+}
+
+// WriteOpenMetrics writes the counter in the OpenMetrics text format
+func (c *CounterVec) WriteOpenMetrics(w io.Writer) {
+	c.write(w, familyName(c.name, "counter"))
+}
+
+func (c *CounterVec) write(w io.Writer, family string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", family, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", family)
+
+	keys := make([]string, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := c.series[k]
+		labels := strings.TrimSuffix(formatLabels(c.labels, s.labelValues), ",")
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, labels, s.value)
+	}
+}
+
+// ---------------- Func Metrics ----------------
+
+// Func exposes a value owned elsewhere (an in-flight count, a running
+// total) as an unlabeled gauge or counter, read at scrape time
+type Func struct {
+	name  string
+	help  string
+	kind  string // "gauge" or "counter"
+	value func() float64
+}
+
+// NewGaugeFunc exposes a value that can go up and down
+func NewGaugeFunc(name, help string, value func() float64) *Func {
+	return &Func{name: name, help: help, kind: "gauge", value: value}
+}
+
+// NewCounterFunc exposes a running total
+func NewCounterFunc(name, help string, value func() float64) *Func {
+	return &Func{name: name, help: help, kind: "counter", value: value}
+}
+
+// WritePrometheus writes the metric in the Prometheus text exposition format
+func (f *Func) WritePrometheus(w io.Writer) {
+	f.write(w, f.name)
+}
+
+// WriteOpenMetrics writes the metric in the OpenMetrics text format
+func (f *Func) WriteOpenMetrics(w io.Writer) {
+	f.write(w, familyName(f.name, f.kind))
+}
+
+func (f *Func) write(w io.Writer, family string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", family, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", family, f.kind)
+	fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.value()))
+}
+
+// familyName is the OpenMetrics metric family for a sample name: counter
+// samples carry a _total suffix that the family name must not repeat
+func familyName(name, kind string) string {
+	if kind == "counter" {
+		return strings.TrimSuffix(name, "_total")
+	}
+	return name
+}
+
+// ---------------- Registry ----------------
+
+// Collector is anything that can write itself in the text exposition format
+type Collector interface {
+	WritePrometheus(w io.Writer)
+}
+
+// OpenMetricsCollector is a Collector with a distinct OpenMetrics rendering
+// (exemplars, counter family names); others are written as plain text
+type OpenMetricsCollector interface {
+	WriteOpenMetrics(w io.Writer)
+}
+
+// Registry serves a fixed set of collectors as a Prometheus scrape target
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// Register adds collectors; they are written in registration order
+func (r *Registry) Register(cs ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, cs...)
+}
+
+// ServeHTTP writes every registered collector, in the OpenMetrics format
+// when the scraper asks for it (Prometheus does when exemplar storage is
+// enabled) and the classic text format otherwise
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	cs := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	if !strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text") {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, c := range cs {
+			c.WritePrometheus(w)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	for _, c := range cs {
+		if oc, ok := c.(OpenMetricsCollector); ok {
+			oc.WriteOpenMetrics(w)
+		} else {
+			c.WritePrometheus(w)
+		}
+	}
+	io.WriteString(w, "# EOF\n")
+}
+
+// ---------------- Upstream Latency ----------------
+
+// Upstream records per-backend upstream latency, retries, and errors
+type Upstream struct {
+	latency *HistogramVec
+	retries *CounterVec
+	errors  *CounterVec
+}
+
+// NewUpstream creates an upstream latency recorder (nil buckets uses DefaultUpstreamBuckets)
+func NewUpstream(buckets []float64) *Upstream {
+	if len(buckets) == 0 {
+		buckets = DefaultUpstreamBuckets
+	}
+	return &Upstream{
+		latency: NewHistogramVec(
+			"gateway_upstream_duration_seconds",
+			"Upstream round-trip latency by backend and status class.",
+			buckets, "upstream", "status_class",
+		),
+		retries: NewCounterVec(
+			"gateway_upstream_retries_total",
+			"Upstream attempts retried, by backend and reason.",
+			"upstream", "reason",
+		),
+		errors: NewCounterVec(
+			"gateway_upstream_errors_total",
+			"Upstream attempts that failed without a response, by backend and error class.",
+			"upstream", "class",
+		),
+	}
+}
+
+// WithExemplars attaches trace IDs to latency buckets in the OpenMetrics output
+func (u *Upstream) WithExemplars() *Upstream {
+	u.latency.EnableExemplars()
+	return u
+}
+
+// ObserveUpstream records one upstream attempt; traceID may be empty
+func (u *Upstream) ObserveUpstream(upstream, statusClass, traceID string, d time.Duration) {
+	u.latency.ObserveExemplar(d.Seconds(), traceID, upstream, statusClass)
+}
+
+// ObserveRetry records an attempt that is about to be retried
+func (u *Upstream) ObserveRetry(upstream, reason string) {
+	u.retries.Inc(upstream, reason)
+}
+
+// ObserveError records an attempt that failed without a response
+func (u *Upstream) ObserveError(upstream, class string) {
+	u.errors.Inc(upstream, class)
+}
+
+// WritePrometheus writes all upstream metrics in the text exposition format
+func (u *Upstream) WritePrometheus(w io.Writer) {
+	u.latency.WritePrometheus(w)
+	u.retries.WritePrometheus(w)
+	u.errors.WritePrometheus(w)
+}
+
+// WriteOpenMetrics writes all upstream metrics in the OpenMetrics format
+func (u *Upstream) WriteOpenMetrics(w io.Writer) {
+	u.latency.WriteOpenMetrics(w)
+	u.retries.WriteOpenMetrics(w)
+	u.errors.WriteOpenMetrics(w)
+}
+
+// ---------------- HTTP Requests ----------------
+
+// HTTP records gateway requests as seen by clients. Paths are labeled by
+// the longest matching route prefix and methods by name when standard or
+// allowed (anything else is "other") to keep label cardinality bounded no
+// matter what clients request.
+type HTTP struct {
+	prefixes []string
+	methods  map[string]bool
+	requests *CounterVec
+	duration *HistogramVec
+	inFlight atomic.Int64
+}
+
+// standardMethods are labeled by name whether or not they are allowed
+var standardMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// NewHTTP creates request metrics (nil buckets uses DefaultUpstreamBuckets).
+// methods are labeled by name in addition to the standard ones.
+func NewHTTP(buckets []float64, prefixes, methods []string) *HTTP {
+	if len(buckets) == 0 {
+		buckets = DefaultUpstreamBuckets
+	}
+	p := append([]string(nil), prefixes...)
+	sort.Slice(p, func(i, j int) bool { return len(p[i]) > len(p[j]) })
+	known := make(map[string]bool, len(standardMethods)+len(methods))
+	for _, m := range append(standardMethods, methods...) {
+		known[strings.ToUpper(m)] = true
+	}
+	return &HTTP{
+		prefixes: p,
+		methods:  known,
+		requests: NewCounterVec(
+			"gateway_requests_total",
+			"Requests handled, by method, route prefix, and status.",
+			"method", "path", "status",
+		),
+		duration: NewHistogramVec(
+			"gateway_request_duration_seconds",
+			"Request latency by method and route prefix.",
+			buckets, "method", "path",
+		),
+	}
+}
+
+// WithExemplars attaches trace IDs to latency buckets in the OpenMetrics output
+func (h *HTTP) WithExemplars() *HTTP {
+	h.duration.EnableExemplars()
+	return h
+}
+
+// pathLabel matches whole segments like the router, so /api/usersx isn't
+// counted under /api/users. A prefix ending in "/" covers everything below
+// it, like a ServeMux pattern.
+func (h *HTTP) pathLabel(path string) string {
+	for _, p := range h.prefixes {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return p
+		}
+	}
+	return "other"
+}
+
+func (h *HTTP) methodLabel(method string) string {
+	if h.methods[method] {
+		return method
+	}
+	return "other"
+}
+
+// WritePrometheus writes all request metrics in the text exposition format
+func (h *HTTP) WritePrometheus(w io.Writer) {
+	h.requests.WritePrometheus(w)
+	h.duration.WritePrometheus(w)
+	h.inFlightGauge().WritePrometheus(w)
+}
+
+// WriteOpenMetrics writes all request metrics in the OpenMetrics format
+func (h *HTTP) WriteOpenMetrics(w io.Writer) {
+	h.requests.WriteOpenMetrics(w)
+	h.duration.WriteOpenMetrics(w)
+	h.inFlightGauge().WriteOpenMetrics(w)
+}
+
+func (h *HTTP) inFlightGauge() *Func {
+	return NewGaugeFunc("gateway_requests_in_flight", "Requests currently being handled.", func() float64 {
+		return float64(h.inFlight.Load())
+	})
+}
+
+// WithMetrics records every request's count, latency, and status into m
+func WithMetrics(m *HTTP, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Later stages share r.URL; label by the path as received
+		method, path := m.methodLabel(r.Method), m.pathLabel(r.URL.Path)
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+
+		sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+		m.duration.ObserveExemplar(time.Since(start).Seconds(), middleware.TraceID(r), method, path)
+		m.requests.Inc(method, path, strconv.Itoa(sw.status))
+	})
+}
+
+// statusWriter captures the response status for labeling
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ---------------- Utilities ----------------
+
+// formatLabels renders `k="v",` pairs (with trailing comma) for embedding
+func formatLabels(names, values []string) string {
+	var b strings.Builder
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		fmt.Fprintf(&b, "%s=\"%s\",", n, labelEscaper.Replace(v))
+	}
+	return b.String()
+}
+
+// labelEscaper applies the escaping rules for label values in the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", f)
+}
+
+// ---------------- Latency Window ----------------
+
+// LatencyWindow keeps the most recent request durations in a fixed ring so
+// quantiles reflect current traffic at a bounded, constant cost
+type LatencyWindow struct {
+	mu   sync.Mutex
+	ring []time.Duration
+	next int
+	full bool
+}
+
+// NewLatencyWindow tracks the last size observations
+func NewLatencyWindow(size int) *LatencyWindow {
+	if size < 1 {
+		size = 1
+	}
+	return &LatencyWindow{ring: make([]time.Duration, size)}
+}
+
+// Observe records one request duration
+func (w *LatencyWindow) Observe(d time.Duration) {
+	w.mu.Lock()
+	w.ring[w.next] = d
+	w.next++
+	if w.next == len(w.ring) {
+		w.next = 0
+		w.full = true
+	}
+	w.mu.Unlock()
+}
+
+// Quantile returns the q-quantile (0..1) of the window, or zero if empty
+func (w *LatencyWindow) Quantile(q float64) time.Duration {
+	w.mu.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.ring)
+	}
+	sample := append([]time.Duration(nil), w.ring[:n]...)
+	w.mu.Unlock()
+
+	if len(sample) == 0 {
+		return 0
+	}
+	sort.Slice(sample, func(i, j int) bool { return sample[i] < sample[j] })
+	idx := int(math.Ceil(q*float64(len(sample)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sample[idx]
+}
+
+// WithLatencyWindow records the duration of every request into w
+func WithLatencyWindow(w *LatencyWindow, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(rw, r)
+		w.Observe(time.Since(start))
+	})
+}
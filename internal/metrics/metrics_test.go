@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestHTTPLabelsStayBounded(t *testing.T) {
+	m := NewHTTP([]float64{1}, []string{"/api/users", "/metrics/"}, []string{"PURGE"})
+	h := WithMetrics(m, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/api/users"},
+		{"GET", "/api/users/42"},
+		{"GET", "/api/usersx"},
+		{"GET", "/metrics/x"},
+		{"PURGE", "/api/users"},
+		{"X-RANDOM-1", "/api/users"},
+		{"X-RANDOM-2", "/api/users"},
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, nil))
+	}
+
+	var b strings.Builder
+	m.WritePrometheus(&b)
+	out := b.String()
+	for _, want := range []string{
+		`gateway_requests_total{method="GET",path="/api/users",status="200"} 2`,
+		`gateway_requests_total{method="GET",path="other",status="200"} 1`,
+		`gateway_requests_total{method="GET",path="/metrics/",status="200"} 1`,
+		`gateway_requests_total{method="PURGE",path="/api/users",status="200"} 1`,
+		`gateway_requests_total{method="other",path="/api/users",status="200"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "X-RANDOM") {
+		t.Errorf("unknown method became a label value:\n%s", out)
+	}
+}
+
+func TestExemplarsOnlyInOpenMetrics(t *testing.T) {
+	m := NewHTTP([]float64{1}, []string{"/api"}, nil).WithExemplars()
+	h := WithMetrics(m, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/api", nil)
+	req.Header.Set("Traceparent", traceparent)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var text, om strings.Builder
+	m.WritePrometheus(&text)
+	m.WriteOpenMetrics(&om)
+	if strings.Contains(text.String(), "trace_id") {
+		t.Errorf("exemplar in the Prometheus text format:\n%s", text.String())
+	}
+	want := `gateway_request_duration_seconds_bucket{method="GET",path="/api",le="1"} 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} `
+	if !strings.Contains(om.String(), want) {
+		t.Errorf("missing exemplar %s in\n%s", want, om.String())
+	}
+}
+
+func TestRegistryNegotiatesOpenMetrics(t *testing.T) {
+	var reg Registry
+	c := NewCounterVec("gateway_things_total", "Things.", "kind")
+	c.Inc("a")
+	reg.Register(c)
+
+	scrape := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		reg.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := scrape("text/plain")
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("text scrape: Content-Type = %q", ct)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "# TYPE gateway_things_total counter") || strings.Contains(body, "# EOF") {
+		t.Errorf("text scrape body:\n%s", body)
+	}
+
+	rec = scrape("application/openmetrics-text;version=1.0.0,text/plain;q=0.5")
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("OpenMetrics scrape: Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "# TYPE gateway_things counter") || !strings.Contains(body, `gateway_things_total{kind="a"} 1`) {
+		t.Errorf("OpenMetrics scrape names the family wrong:\n%s", body)
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("OpenMetrics scrape not terminated by # EOF:\n%s", body)
+	}
+}
@@ -1,60 +1,331 @@
 package middleware
 
 import (
+	"bytes"
 	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/netip"
 	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"apigateway/internal/jwt"
 	"apigateway/internal/logger"
+	"apigateway/internal/protobuf"
+	"apigateway/internal/schema"
 
 	"github.com/google/uuid"
 )
 
+// ---------------- Chain Builder ----------------
+
+// Stage is one named, optionally disabled middleware in a chain
+type Stage struct {
+	Name    string
+	Enabled bool
+	Wrap    func(http.Handler) http.Handler
+}
+
+// Middleware wraps a handler, as Stage.Wrap does
+type Middleware func(http.Handler) http.Handler
+
+// Chain composes middleware into one, listed outermost first like Build's
+// stages: Chain(a, b)(h) is a(b(h)). Nil entries are skipped, so optional
+// middleware can be left out inline.
+func Chain(mws ...Middleware) Middleware {
+	return func(h http.Handler) http.Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			if mws[i] != nil {
+				h = mws[i](h)
+			}
+		}
+		return h
+	}
+}
+
+// Build wraps h with the enabled stages, listed outermost first (the order
+// a request passes through them). Wrap is only called for enabled stages,
+// so disabled middleware allocates nothing. It returns the handler and the
+// names of the active stages.
+func Build(h http.Handler, stages ...Stage) (http.Handler, []string) {
+	var active []string
+	for i := len(stages) - 1; i >= 0; i-- {
+		if !stages[i].Enabled {
+			continue
+		}
+		h = stages[i].Wrap(h)
+		active = append([]string{stages[i].Name}, active...)
+	}
+	return h, active
+}
+
 // ---------------- Gzip Compression ----------------
 
+// GzipConfig tunes response compression
+type GzipConfig struct {
+	Level     int      // 1 (fastest) to 9 (smallest); 0 uses gzip.DefaultCompression
+	MinBytes  int      // bodies shorter than this are sent uncompressed
+	SkipTypes []string // Content-Types never compressed; a trailing "/" matches the whole family
+}
+
 // WithGzip adds gzip compression to responses
-func WithGzip(next http.Handler) http.Handler {
+func WithGzip(cfg GzipConfig, next http.Handler) http.Handler {
+	if cfg.Level == 0 {
+		cfg.Level = gzip.DefaultCompression
+	}
+	// Writers are reused across requests; each holds sizeable compression
+	// state that would otherwise be allocated per response
+	pool := &sync.Pool{New: func() any {
+		gz, err := gzip.NewWriterLevel(io.Discard, cfg.Level)
+		if err != nil {
+			gz = gzip.NewWriter(io.Discard)
+		}
+		return gz
+	}}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if client accepts gzip encoding
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		// Check if client accepts gzip encoding. HEAD has no body to
+		// compress, so its headers (Content-Length included) are relayed
+		// untouched rather than claiming an encoding that was never applied
+		if r.Method == http.MethodHead || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Wrap the response writer with gzip
-		w.Header().Set("Content-Encoding", "gzip")
-		w.Header().Del("Content-Length") // Length will change after compression
-
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-
-		gzw := &gzipResponseWriter{
-			ResponseWriter: w,
-			Writer:         gz,
-		}
+		// Headers are only switched to gzip once the handler starts writing
+		// and the body is known to be worth compressing
+		gzw := &gzipResponseWriter{ResponseWriter: w, cfg: cfg, pool: pool}
+		defer gzw.release() // also on panic, including finish's abort
 
 		next.ServeHTTP(gzw, r)
+		gzw.finish(r)
 	})
 }
 
 type gzipResponseWriter struct {
 	http.ResponseWriter
-	io.Writer
+	cfg         GzipConfig
+	pool        *sync.Pool
+	gz          *gzip.Writer // checked out of pool only once compressing
+	code        int          // status held back until compression is decided
+	buf         []byte       // body prefix held back while shorter than MinBytes
+	wroteHeader bool         // the handler has set the status
+	decided     bool         // status and headers have been sent to the client
+	passthrough bool         // no body, already encoded, or too small, so nothing is compressed
+	err         error
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if code < http.StatusOK {
+		// Informational responses (103 Early Hints) never carry a body
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.code = code
+
+	h := w.Header()
+	switch {
+	case code == http.StatusNoContent || code == http.StatusNotModified || alreadyEncoded(h) || w.skipType(h.Get("Content-Type")):
+		w.start(false)
+	case w.cfg.MinBytes <= 0:
+		w.start(true)
+	default:
+		// A declared length settles it now; otherwise Write buffers until
+		// MinBytes arrive or the handler returns
+		if cl, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+			w.start(cl >= int64(w.cfg.MinBytes))
+		}
+	}
+}
+
+// start sends the held-back status, switching headers to gzip if compress
+// is set. Passthrough framing (Content-Length or chunked) is left to net/http.
+func (w *gzipResponseWriter) start(compress bool) {
+	w.decided = true
+	w.passthrough = !compress
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length") // Length will change after compression
+		w.gz = w.pool.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+// release returns the gzip writer to the pool, detached from the response
+// so the pool doesn't keep it reachable
+func (w *gzipResponseWriter) release() {
+	if w.gz == nil {
+		return
+	}
+	w.gz.Reset(io.Discard)
+	w.pool.Put(w.gz)
+	w.gz = nil
+}
+
+// skipType reports whether contentType is already compressed (images,
+// video, archives) and would only grow by being gzipped again
+func (w *gzipResponseWriter) skipType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, t := range w.cfg.SkipTypes {
+		t = strings.ToLower(t)
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// alreadyEncoded reports whether the handler (typically the proxy relaying
+// an upstream) already set a content coding; compressing again would hand
+// the client a doubly-encoded body it decodes only once
+func alreadyEncoded(h http.Header) bool {
+	ce := strings.TrimSpace(h.Get("Content-Encoding"))
+	return ce != "" && !strings.EqualFold(ce, "identity")
 }
 
 func (w *gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.cfg.MinBytes {
+			return len(b), nil
+		}
+		w.start(true)
+		if _, err := w.writeBuffered(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	return w.write(b)
 }
 
-func (w *gzipResponseWriter) WriteHeader(code int) {
-	w.ResponseWriter.WriteHeader(code)
+func (w *gzipResponseWriter) write(b []byte) (int, error) {
+	if w.passthrough {
+		return w.ResponseWriter.Write(b)
+	}
+	n, err := w.gz.Write(b)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// writeBuffered releases the body prefix held back before start
+func (w *gzipResponseWriter) writeBuffered() (int, error) {
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	return w.write(buf)
+}
+
+// Flush pushes compressed bytes buffered so far to the client. A flush
+// before MinBytes have arrived commits to compressing only if what is
+// buffered already reaches it, so small streamed events go out as-is.
+func (w *gzipResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.start(len(w.buf) >= w.cfg.MinBytes)
+		w.writeBuffered()
+	}
+	if !w.passthrough {
+		if err := w.gz.Flush(); err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish flushes the gzip stream. Headers are already sent by now, so on a
+// compression or write error the only honest option is to abort the
+// connection: the client then sees a truncated transfer instead of
+// silently accepting a corrupt body.
+func (w *gzipResponseWriter) finish(r *http.Request) {
+	if !w.wroteHeader {
+		return
+	}
+	if !w.decided {
+		// The whole body stayed under MinBytes
+		w.start(false)
+		w.writeBuffered()
+		return
+	}
+	if w.passthrough {
+		return
+	}
+	if err := w.gz.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if w.err != nil {
+		logger.Log.Warn("gzip_write_failed",
+			slog.String("request_id", GetRequestID(r)),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("error", w.err.Error()),
+		)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ---------------- Static Files ----------------
+
+// WithStaticFiles answers GET/HEAD for the given exact paths with fixed
+// text content (robots.txt, security.txt). It sits ahead of logging and
+// rate limiting so scanner traffic neither floods logs nor burns quota.
+func WithStaticFiles(files map[string]string, next http.Handler) http.Handler {
+	if len(files) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	})
 }
 
 // ---------------- Request ID ----------------
@@ -84,22 +355,321 @@ func GetRequestID(r *http.Request) string {
 	return ""
 }
 
+// ---------------- Error Responses ----------------
+
+// jsonError is the body of errors the gateway answers itself
+type jsonError struct {
+	Error jsonErrorDetail `json:"error"`
+}
+
+type jsonErrorDetail struct {
+	Code      string                   `json:"code"`
+	Message   string                   `json:"message"`
+	RequestID string                   `json:"request_id,omitempty"`
+	Details   []schema.ValidationError `json:"details,omitempty"`
+}
+
+// WriteJSONError answers with status and a body of the form
+// {"error":{"code":...,"message":...,"request_id":...}}. code is a stable
+// UPPER_SNAKE identifier clients can switch on; message is for humans.
+func WriteJSONError(w http.ResponseWriter, status int, code, message, requestID string) {
+	writeJSONError(w, status, jsonErrorDetail{Code: code, Message: message, RequestID: requestID})
+}
+
+// writeJSONError is WriteJSONError for bodies with details, such as the
+// fields a request body got wrong
+func writeJSONError(w http.ResponseWriter, status int, detail jsonErrorDetail) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(jsonError{Error: detail})
+}
+
+// TraceID returns the trace ID from the request's W3C traceparent header
+// ("00-<32 hex trace id>-<16 hex parent id>-<2 hex flags>"), or "" if the
+// header is missing or malformed
+func TraceID(r *http.Request) string {
+	parts := strings.Split(strings.TrimSpace(r.Header.Get("Traceparent")), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 {
+		return ""
+	}
+	id := parts[1]
+	if strings.Trim(id, "0") == "" {
+		return "" // all zeros is invalid
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return ""
+		}
+	}
+	return id
+}
+
+// ---------------- Start Time ----------------
+
+const startTimeKey contextKey = "start_time"
+
+// WithStartTime stamps the edge-arrival time into the request context. It
+// should be the outermost middleware so later stages measure from the same
+// instant.
+func WithStartTime(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), startTimeKey, time.Now())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetStartTime returns when the request arrived at the gateway, or the zero
+// time if WithStartTime isn't in the chain
+func GetStartTime(r *http.Request) time.Time {
+	if t, ok := r.Context().Value(startTimeKey).(time.Time); ok {
+		return t
+	}
+	return time.Time{}
+}
+
+// ---------------- Auth Claims ----------------
+
+const claimsKey contextKey = "claims"
+
+// WithClaims returns a copy of ctx carrying verified identity claims
+func WithClaims(ctx context.Context, claims map[string]any) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// GetClaims extracts verified identity claims from context (nil if unauthenticated)
+func GetClaims(r *http.Request) map[string]any {
+	if claims, ok := r.Context().Value(claimsKey).(map[string]any); ok {
+		return claims
+	}
+	return nil
+}
+
+// ---------------- JWT Authentication ----------------
+
+// JWTConfig validates bearer tokens locally
+type JWTConfig struct {
+	Validator *jwt.Validator
+
+	// Required selects the requests that must carry a valid token, e.g.
+	// those for routes with JWT enabled (nil requires one on every request)
+	Required func(*http.Request) bool
+}
+
+// WithJWTAuth verifies the Authorization: Bearer token of requests that
+// require one and rejects missing or invalid tokens with 401. Valid tokens'
+// claims are put in the request context (GetClaims), and the subject is
+// logged on request_completed. Other requests pass through unauthenticated.
+func WithJWTAuth(cfg JWTConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Required != nil && !cfg.Required(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reject := func(reason string, err error) {
+			attrs := []any{
+				slog.String("request_id", GetRequestID(r)),
+				slog.String("client_ip", ExtractClientIP(r)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("reason", reason),
+			}
+			if err != nil {
+				attrs = append(attrs, slog.String("error", err.Error()))
+			}
+			if reason == "keys_unavailable" {
+				// Not the client's fault; don't tell it to fetch a new token
+				logger.Log.Error("jwt_rejected", attrs...)
+				WriteJSONError(w, http.StatusServiceUnavailable, "AUTH_UNAVAILABLE", "authentication unavailable", GetRequestID(r))
+				return
+			}
+			logger.Log.Warn("jwt_rejected", attrs...)
+			// RFC 6750: no error code when the request had no credentials
+			challenge := `Bearer realm="api"`
+			if reason != "missing" {
+				challenge += `, error="invalid_token"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			WriteJSONError(w, http.StatusUnauthorized, "UNAUTHORIZED", "unauthorized", GetRequestID(r))
+		}
+
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			reject("missing", nil)
+			return
+		}
+		claims, err := cfg.Validator.Verify(r.Context(), token)
+		if err != nil {
+			reject(jwt.Reason(err), err)
+			return
+		}
+
+		if sub, ok := claims["sub"].(string); ok {
+			setAccessLog(r, func(s *accessLogSlot) { s.subject = sub })
+		}
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+	})
+}
+
+// ---------------- API Key Authentication ----------------
+
+// APIKey is the identity a valid API key resolves to. The key itself is a
+// secret and is never logged or used as a rate limit key.
+type APIKey struct {
+	ID string // e.g. the partner the key was issued to
+
+	secret string // the verified key, only for RATE_LIMIT_ALLOWLIST_KEYS
+}
+
+// APIKeyStore resolves API keys to identities. StaticKeyStore serves keys
+// from configuration; other implementations (e.g. a database) can be
+// plugged in. Lookup reports ok=false for unknown keys and an error only
+// when the store itself failed.
+type APIKeyStore interface {
+	Lookup(ctx context.Context, key string) (APIKey, bool, error)
+}
+
+// StaticKeyStore holds a fixed set of keys. Keys are stored as SHA-256
+// digests, so lookups don't compare secrets byte by byte.
+type StaticKeyStore struct {
+	ids map[[sha256.Size]byte]string
+}
+
+// NewStaticKeyStore builds a store from ID -> key pairs
+func NewStaticKeyStore(keys map[string]string) *StaticKeyStore {
+	st := &StaticKeyStore{ids: make(map[[sha256.Size]byte]string, len(keys))}
+	for id, key := range keys {
+		st.ids[sha256.Sum256([]byte(key))] = id
+	}
+	return st
+}
+
+func (st *StaticKeyStore) Lookup(_ context.Context, key string) (APIKey, bool, error) {
+	id, ok := st.ids[sha256.Sum256([]byte(key))]
+	return APIKey{ID: id}, ok, nil
+}
+
+const apiKeyKey contextKey = "api_key"
+
+// WithAPIKey returns a copy of ctx carrying an authenticated API key identity
+func WithAPIKey(ctx context.Context, key APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyKey, key)
+}
+
+// GetAPIKey returns the identity of the request's API key, if it had a
+// valid one
+func GetAPIKey(r *http.Request) (APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyKey).(APIKey)
+	return key, ok
+}
+
+// APIKeyConfig authenticates requests by API key
+type APIKeyConfig struct {
+	Store  APIKeyStore
+	Header string // defaults to X-API-Key
+
+	// Required selects the requests that must carry a valid key, e.g.
+	// those for routes with API keys enabled (nil makes keys optional)
+	Required func(*http.Request) bool
+}
+
+// WithAPIKeyAuth validates the API key header. Unknown keys get 401, as
+// do requests without a key where one is required; other requests without
+// a key pass through anonymously. The key's identity is put in the request
+// context (GetAPIKey) and logged on request_completed.
+//
+// The header is removed once checked: the key is the partner's secret for
+// the gateway, and upstreams have no use for it.
+func WithAPIKeyAuth(cfg APIKeyConfig, next http.Handler) http.Handler {
+	header := cfg.Header
+	if header == "" {
+		header = "X-API-Key"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reject := func(status int, reason string, err error) {
+			attrs := []any{
+				slog.String("request_id", GetRequestID(r)),
+				slog.String("client_ip", ExtractClientIP(r)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("reason", reason),
+			}
+			if err != nil {
+				attrs = append(attrs, slog.String("error", err.Error()))
+				logger.Log.Error("api_key_rejected", attrs...)
+				WriteJSONError(w, status, "AUTH_UNAVAILABLE", "authentication unavailable", GetRequestID(r))
+				return
+			}
+			logger.Log.Warn("api_key_rejected", attrs...)
+			WriteJSONError(w, status, "UNAUTHORIZED", "unauthorized", GetRequestID(r))
+		}
+
+		key := r.Header.Get(header)
+		r.Header.Del(header)
+		if key == "" {
+			if cfg.Required == nil || !cfg.Required(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			reject(http.StatusUnauthorized, "missing", nil)
+			return
+		}
+		id, ok, err := cfg.Store.Lookup(r.Context(), key)
+		switch {
+		case err != nil:
+			reject(http.StatusServiceUnavailable, "store_unavailable", err)
+			return
+		case !ok:
+			reject(http.StatusUnauthorized, "unknown", nil)
+			return
+		}
+
+		id.secret = key
+		setAccessLog(r, func(s *accessLogSlot) { s.apiKeyID = id.ID })
+		next.ServeHTTP(w, r.WithContext(WithAPIKey(r.Context(), id)))
+	})
+}
+
 // ---------------- Logging ----------------
 
+// LoggingConfig controls optional access log fields
+type LoggingConfig struct {
+	TLSFields bool // add tls_version/tls_cipher for TLS connections
+}
+
 // WithLogging logs HTTP requests and responses with structured logging
-func WithLogging(next http.Handler) http.Handler {
+func WithLogging(cfg LoggingConfig, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+		start := GetStartTime(r)
+		if start.IsZero() {
+			start = time.Now()
+		}
 		lw := &loggingResponseWriter{ResponseWriter: w, status: 200}
 
+		// Later stages share r.URL; keep the client's path as received
+		path := r.URL.Path
+		slot := &accessLogSlot{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey, slot))
+
 		// Log request started
-		logger.Log.Info("request_started",
+		attrs := []any{
 			slog.String("request_id", GetRequestID(r)),
 			slog.String("method", r.Method),
-			slog.String("path", r.URL.Path),
+			slog.String("path", path),
 			slog.String("client_ip", ExtractClientIP(r)),
 			slog.String("user_agent", r.UserAgent()),
-		)
+		}
+		if cfg.TLSFields && r.TLS != nil {
+			attrs = append(attrs,
+				slog.String("tls_version", tls.VersionName(r.TLS.Version)),
+				slog.String("tls_cipher", tls.CipherSuiteName(r.TLS.CipherSuite)),
+			)
+		}
+		logger.Log.Info("request_started", attrs...)
 
 		next.ServeHTTP(lw, r)
 
@@ -119,34 +689,196 @@ func WithLogging(next http.Handler) http.Handler {
 		}
 
 		// Log request completed
-		logger.Log.Log(r.Context(), logLevel, "request_completed",
+		attrs = []any{
 			slog.String("request_id", GetRequestID(r)),
 			slog.String("method", r.Method),
-			slog.String("path", r.URL.Path),
+			slog.String("path", path),
+		}
+		upstreamPath, subject, apiKeyID, variant := slot.get()
+		if upstreamPath != "" {
+			attrs = append(attrs, slog.String("upstream_path", upstreamPath))
+		}
+		if subject != "" {
+			attrs = append(attrs, slog.String("subject", subject))
+		}
+		if apiKeyID != "" {
+			attrs = append(attrs, slog.String("api_key_id", apiKeyID))
+		}
+		if variant != "" {
+			attrs = append(attrs, slog.String("variant", variant))
+		}
+		attrs = append(attrs,
 			slog.Int("status", lw.status),
 			slog.Duration("duration_ms", duration),
 			slog.Int("bytes", lw.bytes),
 		)
+		logger.Log.Log(r.Context(), logLevel, "request_completed", attrs...)
 	})
 }
 
 type loggingResponseWriter struct {
 	http.ResponseWriter
-	status int
-	bytes  int
+	status      int
+	bytes       int
+	wroteHeader bool
 }
 
 func (lw *loggingResponseWriter) WriteHeader(code int) {
-	lw.status = code
+	// Superfluous WriteHeader calls are ignored by net/http; don't let them
+	// overwrite the status that was actually sent
+	if !lw.wroteHeader {
+		lw.status = code
+		lw.wroteHeader = true
+	}
 	lw.ResponseWriter.WriteHeader(code)
 }
 
+// Write counts bytes actually accepted by the underlying writer; Flush only
+// pushes them out, so streamed responses are never counted twice
 func (lw *loggingResponseWriter) Write(b []byte) (int, error) {
+	lw.wroteHeader = true
 	n, err := lw.ResponseWriter.Write(b)
 	lw.bytes += n
 	return n, err
 }
 
+// Flush forwards streaming flushes (e.g. from the reverse proxy)
+func (lw *loggingResponseWriter) Flush() {
+	lw.wroteHeader = true
+	http.NewResponseController(lw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (lw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// ---------------- Trailers ----------------
+
+// WithTrailers repeats the request ID and adds the final status and
+// duration as HTTP trailers, for streaming clients that read metadata after
+// the body. Only clients that advertise "TE: trailers" get them.
+func WithTrailers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// HEAD has no body for trailers to follow
+		if r.Method == http.MethodHead || !acceptsTrailers(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := GetStartTime(r)
+		if start.IsZero() {
+			start = time.Now()
+		}
+
+		// Trailers must be announced before the first byte of the body
+		w.Header().Add("Trailer", "X-Request-ID, X-Gateway-Status, X-Gateway-Duration-Ms")
+		tw := &trailerResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(tw, r)
+
+		w.Header().Set("X-Request-ID", GetRequestID(r))
+		w.Header().Set("X-Gateway-Status", strconv.Itoa(tw.status))
+		w.Header().Set("X-Gateway-Duration-Ms", strconv.FormatFloat(float64(time.Since(start))/float64(time.Millisecond), 'f', 3, 64))
+	})
+}
+
+func acceptsTrailers(r *http.Request) bool {
+	for _, v := range r.Header.Values("TE") {
+		for _, te := range strings.Split(v, ",") {
+			if te, _, _ = strings.Cut(te, ";"); strings.EqualFold(strings.TrimSpace(te), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trailerResponseWriter records the status and keeps the body framed so
+// trailers can follow it; trailer values are set on the shared header map,
+// which every wrapper below passes through
+type trailerResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (tw *trailerResponseWriter) WriteHeader(code int) {
+	if code < http.StatusOK {
+		// Informational responses (103 Early Hints) aren't the final status
+		tw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !tw.wroteHeader {
+		tw.status = code
+		tw.wroteHeader = true
+		// HTTP/1.1 only sends trailers after a chunked body; a declared
+		// length (e.g. relayed from the upstream) would silently drop them
+		tw.Header().Del("Content-Length")
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *trailerResponseWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Flush forwards streaming flushes (e.g. from the reverse proxy)
+func (tw *trailerResponseWriter) Flush() {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (tw *trailerResponseWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// ---------------- Access Log Fields ----------------
+
+const accessLogKey contextKey = "access_log"
+
+// accessLogSlot is a slot WithLogging places in the context so later
+// stages, which work on derived requests (or, in the proxy director, a
+// clone), can add fields to request_completed
+type accessLogSlot struct {
+	mu           sync.Mutex
+	upstreamPath string
+	subject      string
+	apiKeyID     string
+	variant      string
+}
+
+func (s *accessLogSlot) get() (upstreamPath, subject, apiKeyID, variant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.upstreamPath, s.subject, s.apiKeyID, s.variant
+}
+
+func setAccessLog(r *http.Request, set func(*accessLogSlot)) {
+	if slot, ok := r.Context().Value(accessLogKey).(*accessLogSlot); ok {
+		slot.mu.Lock()
+		set(slot)
+		slot.mu.Unlock()
+	}
+}
+
+// SetUpstreamPath records that the request was forwarded under a different
+// path; it is logged as upstream_path. A no-op without the logging stage.
+func SetUpstreamPath(r *http.Request, path string) {
+	setAccessLog(r, func(s *accessLogSlot) { s.upstreamPath = path })
+}
+
+// SetVariant records which version of a route's upstream (e.g. "canary")
+// served the request; it is logged as variant. A no-op without the
+// logging stage.
+func SetVariant(r *http.Request, name string) {
+	setAccessLog(r, func(s *accessLogSlot) { s.variant = name })
+}
+
 // ---------------- Panic Recovery ----------------
 
 // WithRecover recovers from panics and returns 500 errors with stack traces
@@ -154,6 +886,11 @@ func WithRecover(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if v := recover(); v != nil {
+				// ErrAbortHandler deliberately aborts the connection (e.g. a
+				// truncated upstream body); let net/http handle it quietly
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
 				logger.Log.Error("panic_recovered",
 					slog.String("request_id", GetRequestID(r)),
 					slog.Any("panic", v),
@@ -161,54 +898,1962 @@ func WithRecover(next http.Handler) http.Handler {
 					slog.String("method", r.Method),
 					slog.String("path", r.URL.Path),
 				)
-				http.Error(w, "internal server error", http.StatusInternalServerError)
+				WriteJSONError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "internal server error", GetRequestID(r))
 			}
 		}()
 		next.ServeHTTP(w, r)
 	})
 }
 
-// ---------------- Throttle (max in-flight) ----------------
+// ---------------- Request Smuggling Guard ----------------
+
+// net/http settles ambiguous framing before any handler runs: conflicting
+// or invalid Content-Length values are rejected, duplicates collapsed, and
+// a request with both Content-Length and Transfer-Encoding has its
+// Content-Length dropped and is read as chunked. A front end (load
+// balancer, CDN) that went by the Content-Length instead would take the
+// rest of the body for the start of another request, so the guard needs
+// the raw header block to see that case. FramingListener records it per
+// connection.
+
+// FramingListener wraps a plaintext listener so WithSmugglingGuard can see
+// each request's length headers as sent. Pair it with FramingConnContext
+// on the server. TLS listeners don't need it: the gateway terminates TLS,
+// so nothing HTTP-aware reads those requests before it does.
+func FramingListener(ln net.Listener) net.Listener {
+	return framingListener{ln}
+}
+
+type framingListener struct {
+	net.Listener
+}
+
+func (l framingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &framingConn{Conn: c, scan: framingScanner{start: true}}, nil
+}
+
+type framingConnKey struct{}
+
+// FramingConnContext is the http.Server ConnContext hook for
+// FramingListener; requests on the connection inherit its framing record
+func FramingConnContext(ctx context.Context, c net.Conn) context.Context {
+	if fc, ok := c.(*framingConn); ok {
+		return context.WithValue(ctx, framingConnKey{}, fc)
+	}
+	return ctx
+}
+
+// framingConn scans what the server reads. The server reads a connection
+// from one goroutine at a time, so only conflict is shared with handlers.
+type framingConn struct {
+	net.Conn
+	scan     framingScanner
+	conflict atomic.Bool // a request carried both Content-Length and Transfer-Encoding
+}
+
+func (c *framingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.scan.feed(p[:n]) {
+		c.conflict.Store(true)
+	}
+	return n, err
+}
+
+// maxFramingLine matches the server's default header limit; anything
+// longer has already been rejected by it
+const maxFramingLine = http.DefaultMaxHeaderBytes + 4096
+
+const (
+	scanHeaders = iota
+	scanBody
+	scanChunkSize
+	scanChunkData
+	scanChunkEnd
+	scanTrailers
+	scanDone // the server won't read another request on this connection
+)
+
+// framingScanner follows HTTP/1 requests through a byte stream the way
+// net/http reads them, skipping each body by its length or its chunks, so
+// bytes inside a body are never mistaken for headers
+type framingScanner struct {
+	state     int
+	line      []byte
+	start     bool  // the next non-empty line is a request line
+	http10    bool  // Transfer-Encoding is ignored for HTTP/1.0
+	remaining int64 // body or chunk bytes left to skip
+
+	// Length headers of the current header block
+	length     []byte
+	hasLength  bool
+	encodings  int
+	encoding   []byte
+	lastHeader string // for obs-fold continuation lines
+}
+
+// feed scans p and reports whether a request in it had both length headers
+func (s *framingScanner) feed(p []byte) bool {
+	for len(p) > 0 {
+		switch s.state {
+		case scanDone:
+			return false
+		case scanBody, scanChunkData:
+			n := s.remaining
+			if n > int64(len(p)) {
+				n = int64(len(p))
+			}
+			p, s.remaining = p[n:], s.remaining-n
+			if s.remaining == 0 {
+				if s.state == scanBody {
+					s.state = scanHeaders
+				} else {
+					s.state = scanChunkEnd
+				}
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.appendLine(p)
+			return false
+		}
+		s.appendLine(p[:i])
+		p = p[i+1:]
+		if s.state == scanDone {
+			return false
+		}
+		conflict := s.endLine(bytes.TrimSuffix(s.line, []byte("\r")))
+		s.line = s.line[:0]
+		if conflict {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *framingScanner) appendLine(p []byte) {
+	if len(s.line)+len(p) > maxFramingLine {
+		s.state = scanDone
+		s.line = nil
+		return
+	}
+	s.line = append(s.line, p...)
+}
+
+// endLine handles one complete line, reporting a framing conflict
+func (s *framingScanner) endLine(line []byte) bool {
+	switch s.state {
+	case scanHeaders:
+		if s.start {
+			if len(line) > 0 { // blank lines before a request are skipped
+				s.start = false
+				s.http10 = bytes.HasSuffix(line, []byte("HTTP/1.0"))
+			}
+			return false
+		}
+		if len(line) > 0 {
+			s.header(line)
+			return false
+		}
+		return s.endHeaders()
+
+	case scanChunkSize:
+		size, _, _ := bytes.Cut(line, []byte(";"))
+		n, err := strconv.ParseInt(string(bytes.TrimSpace(size)), 16, 64)
+		switch {
+		case err != nil || n < 0:
+			s.state = scanDone
+		case n == 0:
+			s.state = scanTrailers
+		default:
+			s.remaining, s.state = n, scanChunkData
+		}
+
+	case scanChunkEnd:
+		s.state = scanChunkSize
+		if len(line) > 0 {
+			s.state = scanDone
+		}
+
+	case scanTrailers:
+		if len(line) == 0 {
+			s.state = scanHeaders
+		}
+	}
+	return false
+}
+
+func (s *framingScanner) header(line []byte) {
+	if line[0] == ' ' || line[0] == '\t' {
+		if s.lastHeader == "Transfer-Encoding" {
+			s.encoding = append(append(s.encoding, ' '), bytes.TrimSpace(line)...)
+		}
+		return
+	}
+	name, value, _ := bytes.Cut(line, []byte(":"))
+	value = bytes.TrimSpace(value)
+	s.lastHeader = ""
+	switch {
+	case bytes.EqualFold(name, []byte("Content-Length")):
+		if !s.hasLength {
+			s.length = append(s.length[:0], value...)
+		}
+		s.hasLength = true
+	case bytes.EqualFold(name, []byte("Transfer-Encoding")):
+		s.encodings++
+		s.encoding = append(s.encoding[:0], value...)
+		s.lastHeader = "Transfer-Encoding"
+	}
+}
+
+// endHeaders decides how the body after a header block is delimited and
+// resets the block's state
+func (s *framingScanner) endHeaders() bool {
+	hasLength, encodings, http10 := s.hasLength, s.encodings, s.http10
+	chunked := encodings == 1 && bytes.EqualFold(bytes.TrimSpace(s.encoding), []byte("chunked"))
+	n, err := strconv.ParseInt(string(s.length), 10, 64)
+	s.start, s.hasLength, s.encodings, s.lastHeader = true, false, 0, ""
+
+	switch {
+	case hasLength && encodings > 0:
+		s.state = scanDone
+		return true
+	case encodings > 0 && !http10:
+		s.state = scanChunkSize
+		if !chunked {
+			s.state = scanDone // the server answers 501 and closes
+		}
+	case hasLength && (err != nil || n < 0):
+		s.state = scanDone // the server answers 400 and closes
+	case hasLength && n > 0:
+		s.remaining, s.state = n, scanBody
+	}
+	return false
+}
+
+// WithSmugglingGuard rejects requests on connections that carried both
+// Content-Length and Transfer-Encoding, then closes the connection: past
+// that point its requests can't be delimited the way a front end would.
+// It needs FramingListener; other requests pass through.
+func WithSmugglingGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fc, ok := r.Context().Value(framingConnKey{}).(*framingConn); ok && fc.conflict.Load() {
+			logger.Log.Warn("request_smuggling_rejected",
+				slog.String("request_id", GetRequestID(r)),
+				slog.String("client_ip", ExtractClientIP(r)),
+				slog.String("reason", "content_length_with_transfer_encoding"),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+			)
+			w.Header().Set("Connection", "close")
+			WriteJSONError(w, http.StatusBadRequest, "BAD_REQUEST", "bad request", GetRequestID(r))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ---------------- CORS ----------------
+
+// CORSConfig controls cross-origin access for browser clients
+type CORSConfig struct {
+	AllowedOrigins   []string // exact origins, "*" for any, or a single-wildcard pattern like "https://*.example.com"
+	AllowedMethods   []string
+	AllowedHeaders   []string // "*" allows whatever the preflight asks for
+	ExposedHeaders   []string // readable by scripts, in addition to X-Request-ID
+	AllowCredentials bool
+	MaxAge           time.Duration // how long browsers may cache a preflight (0 omits it)
+
+	// Methods returns the methods a preflight's target accepts, e.g. the
+	// route's narrowing of ALLOWED_METHODS; preflights only advertise
+	// AllowedMethods in it and are left to the method checks when it
+	// lacks OPTIONS. nil advertises AllowedMethods everywhere.
+	Methods func(*http.Request) MethodSet
+}
+
+// WithCORS answers preflight requests itself and adds CORS headers to
+// actual responses from allowed origins. Requests from other origins get no
+// CORS headers at all, which the browser reports as a CORS failure. The
+// gateway owns the policy: upstream Access-Control-Allow-* headers are
+// replaced, while upstream exposed headers are merged.
+func WithCORS(cfg CORSConfig, next http.Handler) http.Handler {
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	exposed := append([]string{"X-Request-ID"}, cfg.ExposedHeaders...)
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	anyOrigin := false
+	for _, o := range cfg.AllowedOrigins {
+		anyOrigin = anyOrigin || o == "*"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := originAllowed(cfg.AllowedOrigins, origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			allowMethods := methods
+			if cfg.Methods != nil {
+				accepted := cfg.Methods(r)
+				if !accepted.Has(http.MethodOptions) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				allowMethods = strings.Join(accepted.Filter(cfg.AllowedMethods), ", ")
+			}
+			if allowed {
+				setAllowOrigin(h, origin, anyOrigin && !cfg.AllowCredentials, cfg.AllowCredentials)
+				h.Set("Access-Control-Allow-Methods", allowMethods)
+				if headers == "*" {
+					h.Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+				} else if headers != "" {
+					h.Set("Access-Control-Allow-Headers", headers)
+				}
+				if cfg.MaxAge > 0 {
+					h.Set("Access-Control-Max-Age", maxAge)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &corsResponseWriter{ResponseWriter: w, apply: func(h http.Header) {
+			setAllowOrigin(h, origin, anyOrigin && !cfg.AllowCredentials, cfg.AllowCredentials)
+			mergeHeaderList(h, "Access-Control-Expose-Headers", exposed)
+		}}
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// originAllowed matches origin against exact entries, "*", and patterns
+// with one "*" standing for any run of subdomain labels
+func originAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(o, "*"); ok {
+			if len(origin) > len(prefix)+len(suffix) &&
+				strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+				!strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func setAllowOrigin(h http.Header, origin string, wildcard, credentials bool) {
+	if wildcard {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		h.Del("Access-Control-Allow-Credentials")
+	}
+}
+
+// mergeHeaderList adds names to a comma-separated header, keeping existing
+// entries and skipping case-insensitive duplicates
+func mergeHeaderList(h http.Header, key string, names []string) {
+	var merged []string
+	seen := make(map[string]bool)
+	for _, v := range h.Values(key) {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" && !seen[strings.ToLower(name)] {
+				seen[strings.ToLower(name)] = true
+				merged = append(merged, name)
+			}
+		}
+	}
+	for _, name := range names {
+		if !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			merged = append(merged, name)
+		}
+	}
+	h.Set(key, strings.Join(merged, ", "))
+}
+
+// corsResponseWriter applies CORS headers just before the status is sent,
+// after the upstream's headers have been copied in
+type corsResponseWriter struct {
+	http.ResponseWriter
+	apply       func(http.Header)
+	wroteHeader bool
+}
+
+func (cw *corsResponseWriter) WriteHeader(code int) {
+	if !cw.wroteHeader && code >= 200 {
+		cw.wroteHeader = true
+		cw.apply(cw.Header())
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *corsResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush forwards streaming flushes (e.g. from the reverse proxy)
+func (cw *corsResponseWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *corsResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// ---------------- Method Allow-List ----------------
+
+// MethodSet is a precomputed set of permitted HTTP methods
+type MethodSet struct {
+	methods map[string]bool
+	allow   string // Allow header value
+}
+
+// NewMethodSet builds a set from method names (case-insensitive)
+func NewMethodSet(methods []string) MethodSet {
+	set := MethodSet{methods: make(map[string]bool, len(methods))}
+	var names []string
+	for _, m := range methods {
+		m = strings.ToUpper(m)
+		if !set.methods[m] {
+			set.methods[m] = true
+			names = append(names, m)
+		}
+	}
+	set.allow = strings.Join(names, ", ")
+	return set
+}
+
+// Empty reports whether the set has no methods (i.e. is unconfigured)
+func (s MethodSet) Empty() bool {
+	return len(s.methods) == 0
+}
+
+// Has reports whether method is in the set
+func (s MethodSet) Has(method string) bool {
+	return s.methods[strings.ToUpper(method)]
+}
+
+// Filter returns the methods in the set, keeping their order
+func (s MethodSet) Filter(methods []string) []string {
+	var out []string
+	for _, m := range methods {
+		if s.Has(m) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// Reject answers 405 with an Allow header when r's method isn't in the
+// set, returning true if it did
+func (s MethodSet) Reject(w http.ResponseWriter, r *http.Request) bool {
+	if s.methods[r.Method] {
+		return false
+	}
+	logger.Log.Warn("method_not_allowed",
+		slog.String("request_id", GetRequestID(r)),
+		slog.String("client_ip", ExtractClientIP(r)),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+	)
+	w.Header().Set("Allow", s.allow)
+	WriteJSONError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed", GetRequestID(r))
+	return true
+}
+
+// WithAllowedMethods rejects requests whose method isn't in set with 405
+// before they reach routing or the upstream
+func WithAllowedMethods(set MethodSet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if set.Reject(w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ---------------- Request Header Size ----------------
+
+// headerSummaryLimit caps how many headers a rejection log lists
+const headerSummaryLimit = 5
+
+// WithHeaderSizeLimit rejects requests whose headers total more than
+// maxBytes with 431. Go's MaxHeaderBytes only bounds the raw read buffer per
+// connection; this is a per-request bound the operator can tune. Values are
+// never logged, only the largest header names and their sizes.
+func WithHeaderSizeLimit(maxBytes int, next http.Handler) http.Handler {
+	if maxBytes < 1 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Count each line as it appears on the wire: "Name: value\r\n"
+		total := len("Host") + len(r.Host) + 4
+		sizes := make(map[string]int, len(r.Header))
+		for name, values := range r.Header {
+			for _, v := range values {
+				sizes[name] += len(name) + len(v) + 4
+			}
+			total += sizes[name]
+		}
+		if total <= maxBytes {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logger.Log.Warn("request_headers_too_large",
+			slog.String("request_id", GetRequestID(r)),
+			slog.String("client_ip", ExtractClientIP(r)),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("header_bytes", total),
+			slog.Int("max_bytes", maxBytes),
+			slog.String("largest", headerSummary(sizes)),
+		)
+		WriteJSONError(w, http.StatusRequestHeaderFieldsTooLarge, "HEADERS_TOO_LARGE", "request header fields too large", GetRequestID(r))
+	})
+}
+
+// headerSummary lists the largest headers as "Name=bytes", biggest first
+func headerSummary(sizes map[string]int) string {
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if sizes[names[i]] != sizes[names[j]] {
+			return sizes[names[i]] > sizes[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > headerSummaryLimit {
+		names = names[:headerSummaryLimit]
+	}
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + strconv.Itoa(sizes[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+// ---------------- Request Body Policy ----------------
+
+// BodyPolicyConfig controls requests that carry a body on methods that
+// shouldn't have one
+type BodyPolicyConfig struct {
+	Methods []string // methods that must not carry a body
+	Action  string   // "reject" (400), "strip", or "off"
+}
+
+// WithBodyPolicy rejects or strips request bodies on the configured methods.
+// It returns next unchanged when the policy is off.
+func WithBodyPolicy(cfg BodyPolicyConfig, next http.Handler) http.Handler {
+	if cfg.Action != "reject" && cfg.Action != "strip" {
+		return next
+	}
+	methods := make(map[string]bool, len(cfg.Methods))
+	for _, m := range cfg.Methods {
+		methods[strings.ToUpper(m)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ContentLength is -1 for chunked bodies of unknown length
+		hasBody := r.ContentLength != 0 || len(r.TransferEncoding) > 0
+		if !methods[r.Method] || !hasBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if cfg.Action == "reject" {
+			logger.Log.Warn("request_body_rejected",
+				slog.String("request_id", GetRequestID(r)),
+				slog.String("client_ip", ExtractClientIP(r)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int64("content_length", r.ContentLength),
+			)
+			WriteJSONError(w, http.StatusBadRequest, "BODY_NOT_ALLOWED", "request body not allowed for "+r.Method, GetRequestID(r))
+			return
+		}
+
+		r.Body.Close()
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		r.TransferEncoding = nil
+		r.Header.Del("Content-Length")
+		r.Header.Del("Transfer-Encoding")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ---------------- X-Forwarded-For Limit ----------------
+
+// ForwardedForConfig bounds the X-Forwarded-For chain
+type ForwardedForConfig struct {
+	MaxEntries int    // maximum entries after the gateway appends its hop
+	Action     string // "trim" drops the oldest entries, "reject" returns 400
+}
+
+// WithForwardedForLimit keeps X-Forwarded-For from growing without bound
+// across long proxy chains. One slot is reserved for the client IP the
+// proxy director appends.
+func WithForwardedForLimit(cfg ForwardedForConfig, next http.Handler) http.Handler {
+	if cfg.MaxEntries < 1 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entries []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, e := range strings.Split(v, ",") {
+				if e = strings.TrimSpace(e); e != "" {
+					entries = append(entries, e)
+				}
+			}
+		}
+
+		keep := cfg.MaxEntries - 1
+		if len(entries) <= keep {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logger.Log.Warn("forwarded_for_overflow",
+			slog.String("request_id", GetRequestID(r)),
+			slog.String("action", cfg.Action),
+			slog.Int("entries", len(entries)),
+			slog.Int("max_entries", cfg.MaxEntries),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+		)
+		if cfg.Action == "reject" {
+			WriteJSONError(w, http.StatusBadRequest, "TOO_MANY_FORWARDED_FOR", "too many X-Forwarded-For entries", GetRequestID(r))
+			return
+		}
+
+		// Oldest (leftmost) entries are the least trustworthy; keep the newest
+		if keep == 0 {
+			r.Header.Del("X-Forwarded-For")
+		} else {
+			r.Header.Set("X-Forwarded-For", strings.Join(entries[len(entries)-keep:], ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ---------------- JSON Schema Validation ----------------
+
+// defaultSchemaBodyBytes caps validated bodies when MaxBytes is unset
+const defaultSchemaBodyBytes = 1 << 20
+
+// JSONSchemaConfig validates JSON request bodies before they are proxied
+type JSONSchemaConfig struct {
+	Schema   *schema.Schema
+	MaxBytes int64 // larger bodies are rejected with 413
+}
+
+// bodyRejectCodes are the error codes of request body checks by reason
+var bodyRejectCodes = map[string]string{
+	"content_type": "UNSUPPORTED_MEDIA_TYPE",
+	"too_large":    "BODY_TOO_LARGE",
+	"read_failed":  "BAD_REQUEST",
+	"invalid_json": "INVALID_JSON",
+	"schema":       "SCHEMA_VIOLATION",
+	"mismatch":     "INVALID_BODY",
+	"malformed":    "INVALID_CHECKSUM",
+}
+
+// WithJSONSchema buffers request bodies up to MaxBytes and rejects those
+// that aren't JSON or don't match the schema. Valid bodies are forwarded
+// from the buffer, which also makes them replayable for retries. Requests
+// without a body pass through untouched.
+func WithJSONSchema(cfg JSONSchemaConfig, next http.Handler) http.Handler {
+	limit := cfg.MaxBytes
+	if limit <= 0 {
+		limit = defaultSchemaBodyBytes
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hasBody := r.ContentLength != 0 || len(r.TransferEncoding) > 0
+		if cfg.Schema == nil || !hasBody || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reject := func(status int, reason, msg string, details []schema.ValidationError) {
+			logger.Log.Warn("request_schema_rejected",
+				slog.String("request_id", GetRequestID(r)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("reason", reason),
+				slog.Int("violations", len(details)),
+			)
+			writeJSONError(w, status, jsonErrorDetail{
+				Code:      bodyRejectCodes[reason],
+				Message:   msg,
+				RequestID: GetRequestID(r),
+				Details:   details,
+			})
+		}
+
+		mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+			reject(http.StatusUnsupportedMediaType, "content_type", "request body must be application/json", nil)
+			return
+		}
+		if r.ContentLength > limit {
+			reject(http.StatusRequestEntityTooLarge, "too_large", "request body too large", nil)
+			return
+		}
+
+		buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		r.Body.Close()
+		if err != nil {
+			reject(http.StatusBadRequest, "read_failed", "could not read request body", nil)
+			return
+		}
+		if int64(len(buf)) > limit {
+			reject(http.StatusRequestEntityTooLarge, "too_large", "request body too large", nil)
+			return
+		}
+
+		v, err := schema.Decode(buf)
+		if err != nil {
+			reject(http.StatusBadRequest, "invalid_json", "request body is not valid JSON", nil)
+			return
+		}
+		if errs := cfg.Schema.Validate(v); len(errs) > 0 {
+			reject(http.StatusBadRequest, "schema", "request body does not match schema", errs)
+			return
+		}
+
+		// Forward the buffered copy with a known length
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf)), nil
+		}
+		r.ContentLength = int64(len(buf))
+		r.TransferEncoding = nil
+		r.Header.Del("Transfer-Encoding")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ---------------- Request Body Checksums ----------------
+
+// defaultChecksumBodyBytes caps checksummed bodies when MaxBytes is unset
+const defaultChecksumBodyBytes = 1 << 20
+
+// ChecksumConfig verifies request bodies against digests sent by the client
+type ChecksumConfig struct {
+	Algorithms []string // "md5" (Content-MD5) and/or "sha256" (X-Content-SHA256)
+	MaxBytes   int64    // larger bodies carrying a digest are rejected with 413
+}
+
+// checksumHeaders maps supported algorithms to their header and digest
+var checksumHeaders = map[string]struct {
+	header string
+	sum    func([]byte) []byte
+}{
+	"md5":    {"Content-MD5", func(b []byte) []byte { s := md5.Sum(b); return s[:] }},
+	"sha256": {"X-Content-SHA256", func(b []byte) []byte { s := sha256.Sum256(b); return s[:] }},
+}
+
+// WithChecksum buffers request bodies that carry a digest header for one
+// of the configured algorithms, up to MaxBytes, and rejects them with 400
+// unless every such digest matches. Digests may be base64 (as RFC 1864
+// specifies for Content-MD5) or hex. Verified bodies are forwarded from
+// the buffer, headers included; requests without a digest pass through
+// untouched, and headers for other algorithms are not checked.
+func WithChecksum(cfg ChecksumConfig, next http.Handler) http.Handler {
+	limit := cfg.MaxBytes
+	if limit <= 0 {
+		limit = defaultChecksumBodyBytes
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var algorithms []string
+		for _, alg := range cfg.Algorithms {
+			if r.Header.Get(checksumHeaders[alg].header) != "" {
+				algorithms = append(algorithms, alg)
+			}
+		}
+		if len(algorithms) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reject := func(status int, alg, reason, msg string) {
+			logger.Log.Warn("request_checksum_rejected",
+				slog.String("request_id", GetRequestID(r)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("algorithm", alg),
+				slog.String("reason", reason),
+			)
+			code := bodyRejectCodes[reason]
+			if reason == "mismatch" {
+				code = "CHECKSUM_MISMATCH"
+			}
+			WriteJSONError(w, status, code, msg, GetRequestID(r))
+		}
+
+		if r.ContentLength > limit {
+			reject(http.StatusRequestEntityTooLarge, strings.Join(algorithms, ","), "too_large", "request body too large")
+			return
+		}
+		var buf []byte
+		hasBody := r.Body != nil && r.Body != http.NoBody
+		if hasBody {
+			var err error
+			buf, err = io.ReadAll(io.LimitReader(r.Body, limit+1))
+			r.Body.Close()
+			if err != nil {
+				reject(http.StatusBadRequest, strings.Join(algorithms, ","), "read_failed", "could not read request body")
+				return
+			}
+			if int64(len(buf)) > limit {
+				reject(http.StatusRequestEntityTooLarge, strings.Join(algorithms, ","), "too_large", "request body too large")
+				return
+			}
+		}
+
+		for _, alg := range algorithms {
+			h := checksumHeaders[alg]
+			want, ok := decodeDigest(r.Header.Get(h.header), len(h.sum(nil)))
+			if !ok {
+				reject(http.StatusBadRequest, alg, "malformed", "malformed "+h.header+" header")
+				return
+			}
+			if !hmac.Equal(h.sum(buf), want) {
+				reject(http.StatusBadRequest, alg, "mismatch", "request body does not match "+h.header)
+				return
+			}
+		}
+		if !hasBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Forward the buffered copy with a known length
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(buf)), nil
+		}
+		r.ContentLength = int64(len(buf))
+		r.TransferEncoding = nil
+		r.Header.Del("Transfer-Encoding")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeDigest reads a size-byte digest written as hex or base64
+func decodeDigest(v string, size int) ([]byte, bool) {
+	v = strings.TrimSpace(v)
+	if len(v) == hex.EncodedLen(size) {
+		if b, err := hex.DecodeString(v); err == nil {
+			return b, true
+		}
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(v); err == nil && len(b) == size {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// ---------------- Protobuf Transcoding ----------------
+
+// defaultTranscodeBodyBytes caps transcoded bodies when MaxBytes is unset
+const defaultTranscodeBodyBytes = 1 << 20
+
+// TranscodeConfig converts JSON request bodies to Protobuf for upstreams
+// that only speak Protobuf. Responses are converted back by the proxy.
+type TranscodeConfig struct {
+	Request  *protobuf.Message // request bodies are encoded as this (nil forwards them as-is)
+	Response *protobuf.Message // when set, the upstream is asked for Protobuf
+	MaxBytes int64             // larger bodies are rejected with 413
+}
+
+// WithTranscoding buffers JSON request bodies up to MaxBytes and forwards
+// them as the Request message in Protobuf wire format. Bodies that aren't
+// JSON, or don't fit the message, are rejected with 415 or 400 listing
+// the offending field. Requests without a body pass through untouched.
+func WithTranscoding(cfg TranscodeConfig, next http.Handler) http.Handler {
+	limit := cfg.MaxBytes
+	if limit <= 0 {
+		limit = defaultTranscodeBodyBytes
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Response != nil {
+			r.Header.Set("Accept", protobuf.ContentType)
+		}
+		hasBody := r.ContentLength != 0 || len(r.TransferEncoding) > 0
+		if cfg.Request == nil || !hasBody || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reject := func(status int, reason, msg string, details []schema.ValidationError) {
+			logger.Log.Warn("request_transcode_rejected",
+				slog.String("request_id", GetRequestID(r)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("message_type", cfg.Request.Name()),
+				slog.String("reason", reason),
+			)
+			writeJSONError(w, status, jsonErrorDetail{
+				Code:      bodyRejectCodes[reason],
+				Message:   msg,
+				RequestID: GetRequestID(r),
+				Details:   details,
+			})
+		}
+
+		mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+			reject(http.StatusUnsupportedMediaType, "content_type", "request body must be application/json", nil)
+			return
+		}
+		if r.ContentLength > limit {
+			reject(http.StatusRequestEntityTooLarge, "too_large", "request body too large", nil)
+			return
+		}
+
+		buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		r.Body.Close()
+		if err != nil {
+			reject(http.StatusBadRequest, "read_failed", "could not read request body", nil)
+			return
+		}
+		if int64(len(buf)) > limit {
+			reject(http.StatusRequestEntityTooLarge, "too_large", "request body too large", nil)
+			return
+		}
+
+		out, err := cfg.Request.FromJSON(buf)
+		var fieldErr *protobuf.FieldError
+		switch {
+		case errors.Is(err, protobuf.ErrInvalidJSON):
+			reject(http.StatusBadRequest, "invalid_json", "request body is not valid JSON", nil)
+			return
+		case errors.As(err, &fieldErr):
+			reject(http.StatusBadRequest, "mismatch", "request body does not match "+cfg.Request.Name(),
+				[]schema.ValidationError{{Path: fieldErr.Path, Message: fieldErr.Message}})
+			return
+		case err != nil:
+			reject(http.StatusBadRequest, "mismatch", "request body does not match "+cfg.Request.Name(), nil)
+			return
+		}
+
+		// Forward the encoded copy with a known length
+		r.Body = io.NopCloser(bytes.NewReader(out))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(out)), nil
+		}
+		r.ContentLength = int64(len(out))
+		r.TransferEncoding = nil
+		r.Header.Del("Transfer-Encoding")
+		r.Header.Set("Content-Type", protobuf.ContentType)
+		// Digests of the client's JSON don't match the encoded body
+		r.Header.Del("Content-MD5")
+		r.Header.Del("X-Content-SHA256")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ---------------- Chaos ----------------
+
+// ChaosConfig controls fault injection for resilience testing
+type ChaosConfig struct {
+	Fraction  float64       // share of requests affected
+	DelayMin  time.Duration // delay is uniform in [DelayMin, DelayMax]
+	DelayMax  time.Duration
+	ErrorRate float64 // share of affected requests failed with a synthetic 500
+}
+
+// WithChaos delays a sampled fraction of requests and optionally fails
+// some of them. It is strictly a test tool; callers gate it behind config.
+func WithChaos(cfg ChaosConfig, next http.Handler) http.Handler {
+	if cfg.Fraction <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64() >= cfg.Fraction {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		delay := cfg.DelayMin
+		if spread := cfg.DelayMax - cfg.DelayMin; spread > 0 {
+			delay += time.Duration(rand.Int63n(int64(spread) + 1))
+		}
+		fail := rand.Float64() < cfg.ErrorRate
+
+		logger.Log.Debug("chaos_injected",
+			slog.String("request_id", GetRequestID(r)),
+			slog.Duration("delay", delay),
+			slog.Bool("error", fail),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+		)
+
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		if fail {
+			WriteJSONError(w, http.StatusInternalServerError, "INJECTED_FAULT", "injected fault", GetRequestID(r))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ---------------- Experiment Bucketing ----------------
+
+// Experiment splits traffic into buckets by percentage
+type Experiment struct {
+	Name    string
+	Buckets []ExperimentBucket // percentages add up to 100
+}
+
+// ExperimentBucket is one arm of an experiment
+type ExperimentBucket struct {
+	Name    string
+	Percent int
+}
+
+// ExperimentConfig controls WithExperiments
+type ExperimentConfig struct {
+	Experiments []Experiment
+	Header      string        // upstream request header carrying the assignments
+	Claim       string        // verified claim used as the user ID (default "sub")
+	Cookie      string        // cookie carrying the anonymous ID and assignments
+	Secret      []byte        // HMAC key signing the cookie
+	MaxAge      time.Duration // cookie lifetime
+}
+
+// WithExperiments assigns every request a bucket in each experiment and
+// passes the assignments upstream as "name=bucket" pairs, e.g.
+// X-Experiment-Bucket: checkout=new,search=control. Assignment hashes the
+// experiment name with a stable key, so the same key always lands in the
+// same bucket: the user ID claim when the request is authenticated,
+// otherwise an ID kept in a signed cookie (issued on first visit). The
+// cookie also records the assignments; a forged or tampered one is
+// ignored and replaced. Client-sent copies of the header are dropped.
+func WithExperiments(cfg ExperimentConfig, next http.Handler) http.Handler {
+	claim := cfg.Claim
+	if claim == "" {
+		claim = "sub"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, cookieAssigned, signed := readExperimentCookie(r, cfg)
+		// Authenticated users get an ID too, so their cookie verifies and
+		// keeps them bucketed consistently if they later sign out
+		if id == "" {
+			id = uuid.New().String()
+		}
+		key := id
+		if sub, ok := GetClaims(r)[claim].(string); ok && sub != "" {
+			key = "sub:" + sub
+		}
+
+		assigned := assignBuckets(cfg.Experiments, key)
+		r.Header.Del(cfg.Header)
+		r.Header.Set(cfg.Header, assigned)
+
+		// Only (re)issue the cookie when it is missing, invalid, or stale,
+		// e.g. after allocations changed
+		if !signed || cookieAssigned != assigned {
+			http.SetCookie(w, &http.Cookie{
+				Name:     cfg.Cookie,
+				Value:    signExperimentCookie(cfg.Secret, id, assigned),
+				Path:     "/",
+				MaxAge:   int(cfg.MaxAge / time.Second),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// assignBuckets picks a bucket in each experiment for key
+func assignBuckets(experiments []Experiment, key string) string {
+	parts := make([]string, 0, len(experiments))
+	for _, e := range experiments {
+		sum := sha256.Sum256([]byte(e.Name + "\x00" + key))
+		point := int(binary.BigEndian.Uint64(sum[:8]) % 100)
+		bucket := e.Buckets[len(e.Buckets)-1].Name
+		for _, b := range e.Buckets {
+			if point < b.Percent {
+				bucket = b.Name
+				break
+			}
+			point -= b.Percent
+		}
+		parts = append(parts, e.Name+"="+bucket)
+	}
+	return strings.Join(parts, ",")
+}
+
+// The cookie value is base64url(id "|" assignments) "." base64url(HMAC-SHA256)
+func signExperimentCookie(secret []byte, id, assigned string) string {
+	payload := []byte(id + "|" + assigned)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// readExperimentCookie returns the ID and assignments from a validly
+// signed cookie; signed is false when it is missing or doesn't verify
+func readExperimentCookie(r *http.Request, cfg ExperimentConfig) (id, assigned string, signed bool) {
+	c, err := r.Cookie(cfg.Cookie)
+	if err != nil {
+		return "", "", false
+	}
+	encoded, sig, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return "", "", false
+	}
+	payload, err1 := base64.RawURLEncoding.DecodeString(encoded)
+	got, err2 := base64.RawURLEncoding.DecodeString(sig)
+	if err1 != nil || err2 != nil {
+		return "", "", false
+	}
+	mac := hmac.New(sha256.New, cfg.Secret)
+	mac.Write(payload)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return "", "", false
+	}
+	id, assigned, ok = strings.Cut(string(payload), "|")
+	if !ok || id == "" {
+		return "", "", false
+	}
+	return id, assigned, true
+}
+
+// ---------------- Idempotency Keys ----------------
+
+// IdempotencyConfig controls gateway-level deduplication of client retries
+type IdempotencyConfig struct {
+	Header     string        // request header carrying the client's key
+	Methods    []string      // methods that honor the header
+	TTL        time.Duration // how long a completed response is replayed
+	MaxEntries int           // oldest keys are forgotten beyond this
+	MaxBytes   int64         // larger request or response bodies aren't deduplicated
+
+	// APIKeyHeader scopes keys to the caller's API key when API key auth
+	// hasn't verified it; defaults to X-API-Key
+	APIKeyHeader string
+}
+
+// IdempotencyCache remembers responses by idempotency key; safe for
+// concurrent use
+type IdempotencyCache struct {
+	cfg     IdempotencyConfig
+	methods map[string]bool
+
+	mu      sync.Mutex
+	entries map[string]*idempotentEntry
+	order   *list.List // front is most recently started
+}
+
+type idempotentEntry struct {
+	key     string
+	reqHash [sha256.Size]byte // query and body of the first request
+	done    chan struct{}     // closed once the first request finished
+	elem    *list.Element
+
+	// Set before done is closed; stored is false if the response couldn't
+	// be kept, in which case the entry is gone and waiters start over
+	stored  bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// NewIdempotencyCache creates a cache for WithIdempotency
+func NewIdempotencyCache(cfg IdempotencyConfig) *IdempotencyCache {
+	if cfg.MaxEntries < 1 {
+		cfg.MaxEntries = 1
+	}
+	if cfg.APIKeyHeader == "" {
+		cfg.APIKeyHeader = "X-API-Key"
+	}
+	c := &IdempotencyCache{
+		cfg:     cfg,
+		methods: make(map[string]bool, len(cfg.Methods)),
+		entries: make(map[string]*idempotentEntry),
+		order:   list.New(),
+	}
+	for _, m := range cfg.Methods {
+		c.methods[strings.ToUpper(m)] = true
+	}
+	return c
+}
+
+// WithIdempotency answers a repeated request (same key, method, path, and
+// caller) with the response to the first one instead of proxying it again.
+// A duplicate that arrives while the first is still in flight waits for it.
+// Reusing a key for a different query or body is rejected with 422. Only responses
+// below 500 (and not 429) are kept, so failed attempts can be retried.
+func WithIdempotency(c *IdempotencyCache, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idemKey := r.Header.Get(c.cfg.Header)
+		if idemKey == "" || !c.methods[r.Method] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The body is part of the request's identity, so it is read up front
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			buf, err := io.ReadAll(io.LimitReader(r.Body, c.cfg.MaxBytes+1))
+			if err != nil {
+				WriteJSONError(w, http.StatusBadRequest, "BAD_REQUEST", "could not read request body", GetRequestID(r))
+				return
+			}
+			if int64(len(buf)) > c.cfg.MaxBytes {
+				// Too large to fingerprint; forward it undeduplicated
+				r.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(buf), r.Body), Closer: r.Body}
+				next.ServeHTTP(w, r)
+				return
+			}
+			r.Body.Close()
+			body = buf
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+		// A retry must repeat the query as well as the body
+		hash := sha256.Sum256(append([]byte(r.URL.RawQuery+"\n"), body...))
+		key := r.Method + " " + r.URL.Path + "\n" + idemKey + "\n" + idempotencyScope(r, c.cfg.APIKeyHeader)
+
+		for {
+			e, leader := c.claim(key, hash)
+			if leader {
+				c.lead(e, w, r, next)
+				return
+			}
+			if e.reqHash != hash {
+				logger.Log.Warn("idempotency_key_mismatch",
+					slog.String("request_id", GetRequestID(r)),
+					slog.String("client_ip", ExtractClientIP(r)),
+					slog.String("method", r.Method),
+					slog.String("path", r.URL.Path),
+				)
+				WriteJSONError(w, http.StatusUnprocessableEntity, "IDEMPOTENCY_KEY_REUSED", "idempotency key reused with a different request", GetRequestID(r))
+				return
+			}
+			select {
+			case <-e.done:
+			case <-r.Context().Done():
+				return
+			}
+			if e.stored {
+				c.replay(e, w, r)
+				return
+			}
+			// The first attempt's response wasn't kept; try again ourselves
+		}
+	})
+}
+
+// idempotencyScope keeps one caller's keys from matching another's: the
+// API key identity or credentials (Authorization or keyHeader) when
+// present, otherwise the client IP
+func idempotencyScope(r *http.Request, keyHeader string) string {
+	if key, ok := GetAPIKey(r); ok {
+		return "apikey:" + key.ID
+	}
+	for _, h := range []string{"Authorization", keyHeader} {
+		if v := r.Header.Get(h); v != "" {
+			sum := sha256.Sum256([]byte(v))
+			return hex.EncodeToString(sum[:])
+		}
+	}
+	return ExtractClientIP(r)
+}
+
+// claim returns the live entry for key, or registers a new one and makes
+// the caller its leader
+func (c *IdempotencyCache) claim(key string, hash [sha256.Size]byte) (*idempotentEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		if !e.stored || time.Now().Before(e.expires) {
+			return e, false
+		}
+		c.remove(e)
+	}
+	e := &idempotentEntry{key: key, reqHash: hash, done: make(chan struct{})}
+	e.elem = c.order.PushFront(e)
+	c.entries[key] = e
+	for c.order.Len() > c.cfg.MaxEntries {
+		c.remove(c.order.Back().Value.(*idempotentEntry))
+	}
+	return e, true
+}
+
+func (c *IdempotencyCache) remove(e *idempotentEntry) {
+	if c.entries[e.key] == e {
+		delete(c.entries, e.key)
+		c.order.Remove(e.elem)
+	}
+}
+
+// lead serves the first request for a key and records its response
+func (c *IdempotencyCache) lead(e *idempotentEntry, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	// Headers set by earlier stages belong to this request, not the response
+	rec := &recordingWriter{ResponseWriter: w, limit: c.cfg.MaxBytes, status: http.StatusOK, before: w.Header().Clone()}
+	// A panic (an aborted stream or a timeout after headers) leaves a
+	// truncated response, which must not be replayed
+	completed := false
+	defer func() {
+		c.mu.Lock()
+		if status := rec.status; completed && !rec.over && status < http.StatusInternalServerError && status != http.StatusTooManyRequests {
+			e.stored = true
+			e.status = status
+			e.header = rec.header
+			if !rec.wroteHeader {
+				e.header = rec.added()
+			}
+			e.body = rec.body.Bytes()
+			e.expires = time.Now().Add(c.cfg.TTL)
+		} else {
+			c.remove(e)
+		}
+		c.mu.Unlock()
+		close(e.done)
+	}()
+	next.ServeHTTP(rec, r)
+	completed = true
+}
+
+func (c *IdempotencyCache) replay(e *idempotentEntry, w http.ResponseWriter, r *http.Request) {
+	logger.Log.Debug("idempotent_replay",
+		slog.String("request_id", GetRequestID(r)),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", e.status),
+	)
+	h := w.Header()
+	for k, v := range e.header {
+		if k == "X-Request-Id" {
+			continue // this request keeps its own ID
+		}
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("Idempotent-Replayed", "true")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// recordingWriter passes a response through while keeping a copy of its
+// status, the headers added after before was taken, and up to limit body
+// bytes
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	before      http.Header
+	header      http.Header
+	body        bytes.Buffer
+	limit       int64
+	over        bool
+	wroteHeader bool
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= http.StatusOK {
+		w.wroteHeader = true
+		w.status = code
+		w.header = w.added()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// added returns the response headers that differ from before
+func (w *recordingWriter) added() http.Header {
+	out := make(http.Header)
+	for k, v := range w.Header() {
+		if !slices.Equal(v, w.before[k]) {
+			out[k] = append([]string(nil), v...)
+		}
+	}
+	return out
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.over {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.over = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush forwards to the underlying writer
+func (w *recordingWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// readCloser re-attaches already-consumed bytes in front of a body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ---------------- Request Timeout ----------------
+
+// WithTimeout bounds each request to d. The handler runs with a context that
+// expires after d, so the proxy aborts its upstream call; if it hasn't
+// returned by then the client gets 504. Unlike http.TimeoutHandler nothing
+// is buffered, so a response that already started streaming can't be
+// replaced and its connection is aborted instead.
+func WithTimeout(d time.Duration, next http.Handler) http.Handler {
+	if d <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		tw := &timeoutWriter{ResponseWriter: w, h: w.Header().Clone()}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if v := recover(); v != nil {
+					if v != http.ErrAbortHandler {
+						v = fmt.Sprintf("%v\n\n%s", v, debug.Stack())
+					}
+					panicked <- v
+				}
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			// Headers set after the response started, i.e. trailers
+			tw.mu.Lock()
+			tw.syncHeader()
+			tw.mu.Unlock()
+			return
+		case v := <-panicked:
+			// Re-raised here so WithRecover, which runs on this goroutine, sees it
+			panic(v)
+		case <-ctx.Done():
+		}
+
+		// The handler may still be running: from here on its writes are
+		// dropped, since the response belongs to this goroutine once it
+		// returns
+		tw.mu.Lock()
+		defer tw.mu.Unlock()
+		select {
+		case <-done:
+			tw.syncHeader()
+			return // finished just as the deadline passed
+		default:
+		}
+		tw.timedOut = true
+		if r.Context().Err() != nil {
+			return // the client went away; nobody is waiting for a 504
+		}
+		logger.Log.Warn("request_timeout",
+			slog.String("request_id", GetRequestID(r)),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("timeout", d.String()),
+			slog.Bool("response_started", tw.wroteHeader),
+		)
+		if tw.wroteHeader {
+			panic(http.ErrAbortHandler)
+		}
+		WriteJSONError(w, http.StatusGatewayTimeout, "TIMEOUT", "request timed out", GetRequestID(r))
+	})
+}
+
+// timeoutWriter stops the abandoned handler from writing once WithTimeout
+// has answered in its place. The handler gets its own header map, copied
+// to the real one under mu, so it can't race the 504 being written.
+type timeoutWriter struct {
+	http.ResponseWriter
+	h           http.Header
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.h
+}
+
+// syncHeader makes the real header map match the handler's; mu must be held
+func (w *timeoutWriter) syncHeader() {
+	dst := w.ResponseWriter.Header()
+	for k := range dst {
+		if _, ok := w.h[k]; !ok {
+			delete(dst, k)
+		}
+	}
+	for k, v := range w.h {
+		dst[k] = append([]string(nil), v...)
+	}
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut || w.wroteHeader {
+		return
+	}
+	w.syncHeader()
+	if code >= http.StatusOK {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !w.wroteHeader {
+		w.syncHeader()
+		w.wroteHeader = true
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush forwards to the underlying writer unless the request timed out
+func (w *timeoutWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return
+	}
+	if !w.wroteHeader {
+		w.syncHeader()
+		w.wroteHeader = true
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// ---------------- Request Priority ----------------
+
+// Priority is a route's class when the gateway is overloaded: low-priority
+// requests are shed first, and critical ones can use capacity held back
+// from the rest
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityLow
+	PriorityCritical
+)
+
+var priorityNames = map[Priority]string{
+	PriorityNormal:   "normal",
+	PriorityLow:      "low",
+	PriorityCritical: "critical",
+}
+
+func (p Priority) String() string {
+	return priorityNames[p]
+}
+
+// ParsePriority reads a priority class name: low, normal, or critical
+func ParsePriority(s string) (Priority, error) {
+	for p, name := range priorityNames {
+		if strings.EqualFold(s, name) {
+			return p, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q (want low, normal, or critical)", s)
+}
+
+const priorityKey contextKey = "priority"
+
+// WithPriority records each request's priority class, as chosen by
+// classify (typically from the route it will be served by), for the
+// throttle to read
+func WithPriority(classify func(*http.Request) Priority, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), priorityKey, classify(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// GetPriority returns the request's priority class (normal if unset)
+func GetPriority(r *http.Request) Priority {
+	if p, ok := r.Context().Value(priorityKey).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// ---------------- Throttle (max in-flight) ----------------
+
+// errShed rejects a low-priority request whose share of slots is in use
+var errShed = errors.New("low-priority share of in-flight slots exhausted")
+
+// Semaphore limits concurrent requests. With priorities, it also caps the
+// slots low-priority requests may hold and keeps some free for critical
+// ones.
+type Semaphore struct {
+	ch     chan struct{}
+	shared chan struct{} // slots outside the critical reserve (nil: no reserve)
+	low    chan struct{} // slots low-priority requests may hold (nil: no cap)
+}
+
+// NewSemaphore creates a new semaphore with max concurrent requests
+func NewSemaphore(max int) *Semaphore {
+	return NewPrioritySemaphore(max, 0, 0)
+}
+
+// NewPrioritySemaphore is NewSemaphore with priority classes. Low-priority
+// requests may hold up to lowShare of the slots and are shed rather than
+// queued beyond that; criticalReserve of the slots are only given to
+// critical requests. Zero disables either.
+func NewPrioritySemaphore(size int, lowShare, criticalReserve float64) *Semaphore {
+	size = max(size, 1)
+	s := &Semaphore{ch: make(chan struct{}, size)}
+	shared := size
+	if reserve := int(math.Ceil(float64(size) * criticalReserve)); reserve > 0 {
+		shared = max(size-reserve, 1)
+		s.shared = make(chan struct{}, shared)
+	}
+	if lowShare > 0 {
+		low := max(int(float64(size)*lowShare), 1)
+		if low > shared {
+			low = shared
+		}
+		s.low = make(chan struct{}, low)
+	}
+	return s
+}
+
+// Prioritized reports whether priority classes make any difference
+func (s *Semaphore) Prioritized() bool {
+	return s != nil && (s.shared != nil || s.low != nil)
+}
+
+// acquire takes a slot for a request of priority p. Requests queue while
+// the slots open to them are taken, except low-priority ones beyond their
+// share, which fail at once with errShed. release must be called once the
+// request is done.
+func (s *Semaphore) acquire(ctx context.Context, p Priority) (release func(), err error) {
+	var held []chan struct{}
+	release = func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			<-held[i]
+		}
+	}
+	if p == PriorityLow && s.low != nil {
+		select {
+		case s.low <- struct{}{}:
+			held = append(held, s.low)
+		default:
+			return nil, errShed
+		}
+	}
+	gates := []chan struct{}{s.shared, s.ch}
+	if p == PriorityCritical {
+		gates = gates[1:] // the reserve is theirs
+	}
+	for _, g := range gates {
+		if g == nil {
+			continue
+		}
+		select {
+		case g <- struct{}{}:
+			held = append(held, g)
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// InFlight reports how many requests currently hold a slot
+func (s *Semaphore) InFlight() int {
+	return len(s.ch)
+}
+
+// Capacity reports the maximum concurrent requests
+func (s *Semaphore) Capacity() int {
+	return cap(s.ch)
+}
+
+// WithThrottle limits concurrent requests. Requests wait for a slot until
+// the client gives up; low-priority requests beyond their share are shed
+// with 503 instead.
+func WithThrottle(sem *Semaphore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := sem.acquire(r.Context(), GetPriority(r))
+		if errors.Is(err, errShed) {
+			logger.Log.Warn("request_shed",
+				slog.String("request_id", GetRequestID(r)),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("priority", GetPriority(r).String()),
+				slog.Int("in_flight", sem.InFlight()),
+			)
+			w.Header().Set("Retry-After", "1")
+			WriteJSONError(w, http.StatusServiceUnavailable, "OVERLOADED", "service overloaded", GetRequestID(r))
+			return
+		}
+		if err != nil {
+			WriteJSONError(w, http.StatusRequestTimeout, "REQUEST_CANCELLED", "request cancelled", GetRequestID(r))
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ---------------- Fair Queuing (per-route concurrency) ----------------
+
+// FairQueue caps concurrent requests on one route. Requests beyond the
+// limit wait; with fairness on, each freed slot goes to the next waiting
+// client in turn rather than to the longest waiter, so a client that
+// queued a burst can't starve one that queued a single request.
+type FairQueue struct {
+	limit int
+	fair  bool
+
+	mu       sync.Mutex
+	inFlight int
+	clients  map[string]*list.Element // client key -> element of order
+	order    *list.List               // *fairClient with waiters, next to serve at the front
+}
+
+type fairClient struct {
+	key     string
+	waiters *list.List // *fairWaiter, oldest first
+}
+
+type fairWaiter struct {
+	ready   chan struct{} // closed once a slot has been handed over
+	granted bool
+}
+
+// NewFairQueue admits up to limit concurrent requests; fair selects
+// round-robin hand-over across clients instead of first come, first served
+func NewFairQueue(limit int, fair bool) *FairQueue {
+	if limit < 1 {
+		limit = 1
+	}
+	return &FairQueue{
+		limit:   limit,
+		fair:    fair,
+		clients: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// acquire waits for a slot until ctx ends
+func (q *FairQueue) acquire(ctx context.Context, client string) bool {
+	if !q.fair {
+		client = "" // one shared line
+	}
+
+	q.mu.Lock()
+	if q.inFlight < q.limit && q.order.Len() == 0 {
+		q.inFlight++
+		q.mu.Unlock()
+		return true
+	}
+	el, ok := q.clients[client]
+	if !ok {
+		el = q.order.PushBack(&fairClient{key: client, waiters: list.New()})
+		q.clients[client] = el
+	}
+	fc := el.Value.(*fairClient)
+	w := &fairWaiter{ready: make(chan struct{})}
+	wel := fc.waiters.PushBack(w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return true
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.granted {
+		// The slot arrived as we gave up; pass it on
+		q.handOver()
+		return false
+	}
+	fc.waiters.Remove(wel)
+	if fc.waiters.Len() == 0 {
+		q.order.Remove(el)
+		delete(q.clients, client)
+	}
+	return false
+}
+
+func (q *FairQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handOver()
+}
+
+// handOver gives the caller's slot to the next waiter, or frees it when
+// nobody waits. The served client moves to the back of the line.
+func (q *FairQueue) handOver() {
+	el := q.order.Front()
+	if el == nil {
+		q.inFlight--
+		return
+	}
+	fc := el.Value.(*fairClient)
+	w := fc.waiters.Remove(fc.waiters.Front()).(*fairWaiter)
+	if fc.waiters.Len() == 0 {
+		q.order.Remove(el)
+		delete(q.clients, fc.key)
+	} else {
+		q.order.MoveToBack(el)
+	}
+	w.granted = true
+	close(w.ready)
+}
+
+// WithFairQueue holds each request until q admits it. A request whose
+// context ends while waiting (route timeout or client gone) gets 503.
+func WithFairQueue(route string, q *FairQueue, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		clientIP := ExtractClientIP(r)
+		if !q.acquire(r.Context(), clientIP) {
+			logger.Log.Warn("route_queue_abandoned",
+				slog.String("request_id", GetRequestID(r)),
+				slog.String("route", route),
+				slog.String("client_ip", clientIP),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int64("waited_ms", time.Since(start).Milliseconds()),
+			)
+			WriteJSONError(w, http.StatusServiceUnavailable, "ROUTE_AT_CAPACITY", "route at capacity", GetRequestID(r))
+			return
+		}
+		defer q.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ---------------- Rate Limiting (limiters) ----------------
 
-// Semaphore limits concurrent requests
-type Semaphore struct {
-	ch chan struct{}
+// Limiter admits requests against a single limit. TokenBucket and
+// SlidingWindow implement it.
+type Limiter interface {
+	// Allow reports whether a request arriving at now fits, counting it if so
+	Allow(now time.Time) bool
+	// Quota describes the limit at now without counting a request
+	Quota(now time.Time) Quota
 }
 
-// NewSemaphore creates a new semaphore with max concurrent requests
-func NewSemaphore(max int) *Semaphore {
-	if max < 1 {
-		max = 1
-	}
-	return &Semaphore{ch: make(chan struct{}, max)}
+// Quota is a limiter's state as reported in the X-RateLimit-* headers
+type Quota struct {
+	Limit     int           // requests allowed in a burst or per window
+	Remaining int           // requests that would be allowed right now
+	Reset     time.Duration // until the limiter is back to its full limit
+	RetryIn   time.Duration // until the next request is allowed (0 if now)
 }
 
-func (s *Semaphore) acquire(ctx context.Context) bool {
-	select {
-	case s.ch <- struct{}{}:
-		return true
-	case <-ctx.Done():
-		return false
-	}
+// KeyedLimiter keeps a Limiter per key (e.g., client IP) and evicts keys
+// idle for longer than its TTL. PerKeyTokenBucket and PerKeySlidingWindow
+// implement it.
+type KeyedLimiter interface {
+	Get(key string) Limiter
+	// Inspect reports key's state without counting a request
+	Inspect(key string) (BucketState, bool)
+	// Reset restores key's full limit; false if the key is unknown
+	Reset(key string) bool
+	// Stop ends idle-key cleanup
+	Stop()
 }
 
-func (s *Semaphore) release() {
-	select {
-	case <-s.ch:
-	default:
-	}
+// BucketState is a point-in-time view of one key's limiter
+type BucketState struct {
+	Tokens   float64 // requests that would be allowed now
+	Burst    float64 // the key's full limit
+	LastSeen time.Time
 }
 
-// WithThrottle limits concurrent requests
-func WithThrottle(sem *Semaphore, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if ok := sem.acquire(r.Context()); !ok {
-			http.Error(w, "request cancelled", http.StatusRequestTimeout)
-			return
-		}
-		defer sem.release()
-		next.ServeHTTP(w, r)
-	})
+// setRateLimitHeaders describes l to the client: its limit, the requests
+// left, and the seconds until it is full again. Rejections also get a
+// Retry-After matching the wait for the next allowed request.
+func setRateLimitHeaders(w http.ResponseWriter, l Limiter, now time.Time, rejected bool) {
+	q := l.Quota(now)
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(q.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(q.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(q.Reset.Seconds()))))
+	if rejected {
+		h.Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(q.RetryIn.Seconds())))))
+	}
 }
 
 // ---------------- Rate Limiting (token bucket) ----------------
@@ -243,7 +2888,8 @@ func NewTokenBucket(rate, burst float64, ttl time.Duration) *TokenBucket {
 	}
 }
 
-func (b *TokenBucket) allow(now time.Time) bool {
+// Allow takes a token if one is available
+func (b *TokenBucket) Allow(now time.Time) bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -262,6 +2908,33 @@ func (b *TokenBucket) allow(now time.Time) bool {
 	return false
 }
 
+// Status reports the tokens available at now, refilled but not consumed,
+// and how long until the next whole token is earned (0 if one is available)
+func (b *TokenBucket) Status(now time.Time) (tokens float64, next time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tokens = b.tokens
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		tokens = min(b.burst, tokens+elapsed*b.rate)
+	}
+	if tokens < 1 {
+		next = time.Duration((1 - tokens) / b.rate * float64(time.Second))
+	}
+	return tokens, next
+}
+
+// Quota reports the burst, the whole tokens left, and the time until the
+// bucket is full again
+func (b *TokenBucket) Quota(now time.Time) Quota {
+	tokens, next := b.Status(now)
+	return Quota{
+		Limit:     int(b.burst),
+		Remaining: int(tokens),
+		Reset:     time.Duration((b.burst - tokens) / b.rate * float64(time.Second)),
+		RetryIn:   next,
+	}
+}
+
 func min(a, b float64) float64 {
 	if a < b {
 		return a
@@ -276,6 +2949,10 @@ type PerKeyTokenBucket struct {
 	rate    float64
 	burst   float64
 	ttl     time.Duration
+	initial float64 // fraction of burst a new key starts with
+
+	stop chan struct{}
+	once sync.Once
 }
 
 // NewPerKeyTokenBucket creates a new per-key token bucket
@@ -285,11 +2962,28 @@ func NewPerKeyTokenBucket(rate, burst float64, ttl time.Duration) *PerKeyTokenBu
 		rate:    rate,
 		burst:   burst,
 		ttl:     ttl,
+		initial: 1,
+		stop:    make(chan struct{}),
 	}
 	go p.cleanupLoop()
 	return p
 }
 
+// WithInitialFraction makes new keys start with fraction*burst tokens
+// (at least one, so a first request always passes) and earn the rest at
+// the normal rate. This blunts bursts from freshly rotated client IPs.
+func (p *PerKeyTokenBucket) WithInitialFraction(fraction float64) *PerKeyTokenBucket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.initial = min(max(fraction, 0), 1)
+	return p
+}
+
+// Get returns key's bucket, creating it on first use
+func (p *PerKeyTokenBucket) Get(key string) Limiter {
+	return p.get(key)
+}
+
 func (p *PerKeyTokenBucket) get(key string) *TokenBucket {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -298,36 +2992,434 @@ func (p *PerKeyTokenBucket) get(key string) *TokenBucket {
 		return b
 	}
 	b := NewTokenBucket(p.rate, p.burst, p.ttl)
+	if p.initial < 1 {
+		b.tokens = max(b.burst*p.initial, 1)
+	}
 	p.buckets[key] = b
 	return b
 }
 
-func (p *PerKeyTokenBucket) allow(key string, now time.Time) bool {
-	return p.get(key).allow(now)
+// Inspect reports key's current tokens, refilled to now, without consuming
+// any or counting as activity
+func (p *PerKeyTokenBucket) Inspect(key string) (BucketState, bool) {
+	p.mu.Lock()
+	b, ok := p.buckets[key]
+	p.mu.Unlock()
+	if !ok {
+		return BucketState{}, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tokens := b.tokens
+	if elapsed := time.Since(b.last).Seconds(); elapsed > 0 {
+		tokens = min(b.burst, tokens+elapsed*b.rate)
+	}
+	return BucketState{Tokens: tokens, Burst: b.burst, LastSeen: b.lastSeen}, true
+}
+
+// Reset refills key's bucket to its full burst; false if the key is unknown
+func (p *PerKeyTokenBucket) Reset(key string) bool {
+	p.mu.Lock()
+	b, ok := p.buckets[key]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = b.burst
+	b.last = time.Now()
+	return true
+}
+
+// Stop ends the idle-bucket cleanup goroutine
+func (p *PerKeyTokenBucket) Stop() {
+	p.once.Do(func() { close(p.stop) })
 }
 
 func (p *PerKeyTokenBucket) cleanupLoop() {
 	t := time.NewTicker(1 * time.Minute)
 	defer t.Stop()
-	for range t.C {
-		now := time.Now()
-		p.mu.Lock()
-		for k, b := range p.buckets {
-			b.mu.Lock()
-			seen := b.lastSeen
-			ttl := b.ttl
-			b.mu.Unlock()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-t.C:
+			p.evictIdle(now)
+		}
+	}
+}
+
+func (p *PerKeyTokenBucket) evictIdle(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, b := range p.buckets {
+		b.mu.Lock()
+		seen := b.lastSeen
+		ttl := b.ttl
+		b.mu.Unlock()
+
+		if ttl > 0 && now.Sub(seen) > ttl {
+			delete(p.buckets, k)
+		}
+	}
+}
+
+// ---------------- Rate Limiting (sliding window) ----------------
+
+// SlidingWindow limits requests per rolling window. Unlike a token bucket,
+// which refills continuously and lets a full burst through whenever it is
+// topped up, it counts every request of the last window, so a client that
+// used its limit early can't follow it with another burst until those
+// requests age out. Counts are kept for the current and previous fixed
+// windows, and the previous one is weighted by how much of it still
+// overlaps the rolling window: a constant-size approximation of a log of
+// request times.
+type SlidingWindow struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	start    time.Time // current fixed window
+	curr     int
+	prev     int
+	ttl      time.Duration
+	lastSeen time.Time
+}
+
+// NewSlidingWindow allows limit requests per window
+func NewSlidingWindow(limit int, window, ttl time.Duration) *SlidingWindow {
+	now := time.Now()
+	if limit < 1 {
+		limit = 1
+	}
+	if window <= 0 {
+		window = time.Second
+	}
+	return &SlidingWindow{limit: limit, window: window, start: now, ttl: ttl, lastSeen: now}
+}
+
+// advance moves the fixed windows forward to the one containing now
+func (s *SlidingWindow) advance(now time.Time) {
+	n := now.Sub(s.start) / s.window
+	if n <= 0 {
+		return
+	}
+	if n == 1 {
+		s.prev = s.curr
+	} else {
+		s.prev = 0
+	}
+	s.curr = 0
+	s.start = s.start.Add(n * s.window)
+}
+
+// count estimates the requests in the rolling window ending at now
+func (s *SlidingWindow) count(now time.Time) float64 {
+	overlap := 1 - float64(now.Sub(s.start))/float64(s.window)
+	return float64(s.prev)*max(overlap, 0) + float64(s.curr)
+}
+
+// Allow counts the request if the rolling window has room for it
+func (s *SlidingWindow) Allow(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance(now)
+	s.lastSeen = now
+	if s.count(now)+1 > float64(s.limit) {
+		return false
+	}
+	s.curr++
+	return true
+}
+
+// Quota reports the limit, the requests left in the rolling window, and
+// when its counted requests will have aged out
+func (s *SlidingWindow) Quota(now time.Time) Quota {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance(now)
+	count := s.count(now)
+	q := Quota{Limit: s.limit, Remaining: max(s.limit-int(math.Ceil(count)), 0)}
+
+	switch {
+	case s.curr > 0:
+		q.Reset = s.start.Add(2 * s.window).Sub(now)
+	case s.prev > 0:
+		q.Reset = s.start.Add(s.window).Sub(now)
+	}
+
+	// Room opens once the weighted count drops to limit-1
+	room := float64(s.limit - 1)
+	switch {
+	case count <= room:
+	case float64(s.curr) <= room:
+		// Within this window, as the previous one slides out
+		f := 1 - (room-float64(s.curr))/float64(s.prev)
+		q.RetryIn = s.start.Add(windowFraction(f, s.window)).Sub(now)
+	default:
+		// Only in the next window, as this one slides out
+		f := 1 - room/float64(s.curr)
+		q.RetryIn = s.start.Add(s.window + windowFraction(f, s.window)).Sub(now)
+	}
+	return q
+}
+
+// windowFraction is f of window, rounded up so a client retrying after it
+// isn't rejected by float error
+func windowFraction(f float64, window time.Duration) time.Duration {
+	return time.Duration(math.Ceil(f * float64(window)))
+}
+
+// PerKeySlidingWindow maintains a sliding window per key (e.g., client IP)
+type PerKeySlidingWindow struct {
+	mu      sync.Mutex
+	windows map[string]*SlidingWindow
+	limit   int
+	window  time.Duration
+	ttl     time.Duration
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewPerKeySlidingWindow allows each key limit requests per window
+func NewPerKeySlidingWindow(limit int, window, ttl time.Duration) *PerKeySlidingWindow {
+	p := &PerKeySlidingWindow{
+		windows: make(map[string]*SlidingWindow),
+		limit:   limit,
+		window:  window,
+		ttl:     ttl,
+		stop:    make(chan struct{}),
+	}
+	go p.cleanupLoop()
+	return p
+}
+
+// Get returns key's window, creating it on first use
+func (p *PerKeySlidingWindow) Get(key string) Limiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s, ok := p.windows[key]; ok {
+		return s
+	}
+	s := NewSlidingWindow(p.limit, p.window, p.ttl)
+	p.windows[key] = s
+	return s
+}
+
+// Inspect reports the requests key has left without counting one
+func (p *PerKeySlidingWindow) Inspect(key string) (BucketState, bool) {
+	p.mu.Lock()
+	s, ok := p.windows[key]
+	p.mu.Unlock()
+	if !ok {
+		return BucketState{}, false
+	}
+
+	q := s.Quota(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return BucketState{Tokens: float64(q.Remaining), Burst: float64(q.Limit), LastSeen: s.lastSeen}, true
+}
+
+// Reset forgets key's counted requests; false if the key is unknown
+func (p *PerKeySlidingWindow) Reset(key string) bool {
+	p.mu.Lock()
+	s, ok := p.windows[key]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.curr, s.prev = 0, 0
+	s.start = time.Now()
+	return true
+}
+
+// Stop ends the idle-window cleanup goroutine
+func (p *PerKeySlidingWindow) Stop() {
+	p.once.Do(func() { close(p.stop) })
+}
+
+func (p *PerKeySlidingWindow) cleanupLoop() {
+	t := time.NewTicker(1 * time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-t.C:
+			p.evictIdle(now)
+		}
+	}
+}
+
+func (p *PerKeySlidingWindow) evictIdle(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, s := range p.windows {
+		s.mu.Lock()
+		seen := s.lastSeen
+		s.mu.Unlock()
+
+		if p.ttl > 0 && now.Sub(seen) > p.ttl {
+			delete(p.windows, k)
+		}
+	}
+}
+
+// ---------------- Rate Limiting (keys and middleware) ----------------
+
+// KeyFunc derives the per-key rate limiter key from a request
+type KeyFunc func(r *http.Request) string
+
+// ClientIPKey keys rate limiting on the client IP
+func ClientIPKey(r *http.Request) string {
+	if ip := ExtractClientIP(r); ip != "" {
+		return ip
+	}
+	return "unknown"
+}
+
+// SubjectKey keys rate limiting on the given claim (default "sub") from the
+// verified claims in context, falling back to the client IP when the request
+// is unauthenticated or the claim is missing
+func SubjectKey(claim string) KeyFunc {
+	if claim == "" {
+		claim = "sub"
+	}
+	return func(r *http.Request) string {
+		if sub, ok := GetClaims(r)[claim].(string); ok && sub != "" {
+			// Prefix keeps subjects from colliding with IP keys
+			return "sub:" + sub
+		}
+		return ClientIPKey(r)
+	}
+}
+
+// APIKeyRateKey keys rate limiting on the request's API key identity, so
+// each partner gets its own bucket wherever it calls from, falling back to
+// next (e.g. ClientIPKey) for requests without a valid key
+func APIKeyRateKey(next KeyFunc) KeyFunc {
+	return func(r *http.Request) string {
+		if key, ok := GetAPIKey(r); ok {
+			// Prefix keeps key IDs from colliding with IP or subject keys
+			return "apikey:" + key.ID
+		}
+		return next(r)
+	}
+}
+
+// RateLimitConfig wires the limiters used by WithRateLimit; any Limiter
+// and KeyedLimiter implementations can be combined
+type RateLimitConfig struct {
+	Global Limiter
+	PerKey KeyedLimiter
+
+	// Authenticated is the per-key tier for requests carrying verified
+	// claims (see WithClaims) or a valid API key (see WithAPIKey); nil
+	// applies PerKey to everyone
+	Authenticated KeyedLimiter
+
+	Key       KeyFunc         // nil keys on the client IP
+	AllowList *AllowList      // nil disables bypass
+	Stats     *RateLimitStats // nil disables counting
 
-			if ttl > 0 && now.Sub(seen) > ttl {
-				delete(p.buckets, k)
+	// APIKeyHeader is the header allow-listed keys arrive in when API key
+	// auth hasn't verified them; defaults to X-API-Key
+	APIKeyHeader string
+}
+
+// RateLimitStats counts limiter decisions (bypassed requests aren't
+// counted); safe for concurrent use
+type RateLimitStats struct {
+	allowed  atomic.Uint64
+	rejected atomic.Uint64
+
+	stop chan struct{} // closed by Stop; created by WatchRejections
+	once sync.Once
+}
+
+// Snapshot returns the running totals
+func (s *RateLimitStats) Snapshot() (allowed, rejected uint64) {
+	return s.allowed.Load(), s.rejected.Load()
+}
+
+// minAlertSample keeps a handful of requests on a quiet gateway from
+// reading as a 100% rejection rate
+const minAlertSample = 20
+
+// WatchRejections logs a warning for every window in which the share of
+// rejected requests exceeds threshold, until Stop is called. Call it at
+// most once.
+func (s *RateLimitStats) WatchRejections(window time.Duration, threshold float64) {
+	s.stop = make(chan struct{})
+	go func() {
+		t := time.NewTicker(window)
+		defer t.Stop()
+		lastAllowed, lastRejected := s.Snapshot()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+			}
+			allowed, rejected := s.Snapshot()
+			dAllowed, dRejected := allowed-lastAllowed, rejected-lastRejected
+			lastAllowed, lastRejected = allowed, rejected
+
+			total := dAllowed + dRejected
+			if total < minAlertSample {
+				continue
+			}
+			if rate := float64(dRejected) / float64(total); rate > threshold {
+				logger.Log.Warn("rate_limit_rejections_high",
+					slog.Uint64("rejected", dRejected),
+					slog.Uint64("total", total),
+					slog.Float64("rate", rate),
+					slog.String("window", window.String()),
+				)
 			}
 		}
-		p.mu.Unlock()
+	}()
+}
+
+// Stop ends the WatchRejections goroutine, if any
+func (s *RateLimitStats) Stop() {
+	s.once.Do(func() {
+		if s.stop != nil {
+			close(s.stop)
+		}
+	})
+}
+
+func (s *RateLimitStats) record(allowed bool) {
+	if s == nil {
+		return
+	}
+	if allowed {
+		s.allowed.Add(1)
+	} else {
+		s.rejected.Add(1)
 	}
 }
 
-// WithRateLimit applies global and per-IP rate limiting
-func WithRateLimit(global *TokenBucket, perIP *PerKeyTokenBucket, next http.Handler) http.Handler {
+// WithRateLimit applies global and per-key rate limiting. Allow-listed
+// clients bypass both limits.
+func WithRateLimit(cfg RateLimitConfig, next http.Handler) http.Handler {
+	keyFn := cfg.Key
+	if keyFn == nil {
+		keyFn = ClientIPKey
+	}
+	keyHeader := cfg.APIKeyHeader
+	if keyHeader == "" {
+		keyHeader = "X-API-Key"
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		now := time.Now()
 		ip := ExtractClientIP(r)
@@ -335,8 +3427,23 @@ func WithRateLimit(global *TokenBucket, perIP *PerKeyTokenBucket, next http.Hand
 			ip = "unknown"
 		}
 
+		if reason, ok := cfg.AllowList.match(r, ip, keyHeader); ok {
+			logger.Log.Debug("rate_limit_bypassed",
+				slog.String("request_id", GetRequestID(r)),
+				slog.String("reason", reason),
+				slog.String("client_ip", ip),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+			)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := keyFn(r)
+
 		// Global limit first (protects upstream)
-		if !global.allow(now) {
+		if !cfg.Global.Allow(now) {
+			setRateLimitHeaders(w, cfg.Global, now, true)
 			logger.Log.Warn("rate_limit_exceeded",
 				slog.String("request_id", GetRequestID(r)),
 				slog.String("type", "global"),
@@ -344,50 +3451,259 @@ func WithRateLimit(global *TokenBucket, perIP *PerKeyTokenBucket, next http.Hand
 				slog.String("method", r.Method),
 				slog.String("path", r.URL.Path),
 			)
-			w.Header().Set("Retry-After", "1")
-			http.Error(w, "rate limit exceeded (global)", http.StatusTooManyRequests)
+			cfg.Stats.record(false)
+			WriteJSONError(w, http.StatusTooManyRequests, "RATE_LIMITED", "rate limit exceeded (global)", GetRequestID(r))
 			return
 		}
 
-		// Per-IP limit
-		if !perIP.allow(ip, now) {
+		// Per-key limit, tiered on whether the caller is authenticated
+		limiter, tier := cfg.PerKey, "anonymous"
+		if _, ok := GetAPIKey(r); cfg.Authenticated != nil && (GetClaims(r) != nil || ok) {
+			limiter, tier = cfg.Authenticated, "authenticated"
+		}
+		bucket := limiter.Get(key)
+		if !bucket.Allow(now) {
+			// IP-keyed limits keep the per-ip wording clients and alerts
+			// already match on
+			scope := "per-key"
+			if key == ip {
+				scope = "per-ip"
+			}
+			setRateLimitHeaders(w, bucket, now, true)
 			logger.Log.Warn("rate_limit_exceeded",
 				slog.String("request_id", GetRequestID(r)),
-				slog.String("type", "per-ip"),
+				slog.String("type", scope),
+				slog.String("tier", tier),
+				slog.String("key", key),
 				slog.String("client_ip", ip),
 				slog.String("method", r.Method),
 				slog.String("path", r.URL.Path),
 			)
-			w.Header().Set("Retry-After", "1")
-			http.Error(w, "rate limit exceeded (per-ip)", http.StatusTooManyRequests)
+			cfg.Stats.record(false)
+			WriteJSONError(w, http.StatusTooManyRequests, "RATE_LIMITED", "rate limit exceeded ("+scope+")", GetRequestID(r))
 			return
 		}
 
+		setRateLimitHeaders(w, bucket, now, false)
+		cfg.Stats.record(true)
 		next.ServeHTTP(w, r)
 	})
 }
 
-// ---------------- Utilities ----------------
+// ---------------- Rate Limit Allow-List ----------------
 
-// ExtractClientIP extracts the client IP from request
-func ExtractClientIP(r *http.Request) string {
-	// Prefer X-Forwarded-For if present (first IP)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		if len(parts) > 0 {
-			ip := strings.TrimSpace(parts[0])
-			if net.ParseIP(ip) != nil {
-				return ip
+// AllowList holds client IPs/CIDRs and API keys that bypass rate limiting
+// entirely. It is safe to Update while requests are being served.
+type AllowList struct {
+	set atomic.Pointer[allowSet]
+}
+
+type allowSet struct {
+	prefixes []netip.Prefix
+	keys     map[string]struct{}
+}
+
+// NewAllowList parses IPs/CIDRs and API keys into an allow-list
+func NewAllowList(cidrs, keys []string) (*AllowList, error) {
+	a := &AllowList{}
+	if err := a.Update(cidrs, keys); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Update atomically replaces the allow-list contents. Bare IPs are treated
+// as single-address prefixes. On error the current contents are kept.
+func (a *AllowList) Update(cidrs, keys []string) error {
+	prefixes, err := parsePrefixes(cidrs, "allow-list")
+	if err != nil {
+		return err
+	}
+	set := &allowSet{prefixes: prefixes, keys: make(map[string]struct{}, len(keys))}
+	for _, k := range keys {
+		set.keys[k] = struct{}{}
+	}
+	a.set.Store(set)
+	return nil
+}
+
+// Snapshot returns the allow-listed prefixes and how many keys there are;
+// the keys themselves are secrets
+func (a *AllowList) Snapshot() (prefixes []string, keys int) {
+	set := a.set.Load()
+	prefixes = make([]string, len(set.prefixes))
+	for i, p := range set.prefixes {
+		prefixes[i] = p.String()
+	}
+	return prefixes, len(set.keys)
+}
+
+// match reports whether the request is allow-listed and why ("ip" or
+// "api_key"); keyHeader carries the API key
+func (a *AllowList) match(r *http.Request, ip, keyHeader string) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	set := a.set.Load()
+	key := r.Header.Get(keyHeader)
+	if verified, ok := GetAPIKey(r); ok {
+		key = verified.secret // the header was removed once checked
+	}
+	if key != "" {
+		if _, ok := set.keys[key]; ok {
+			return "api_key", true
+		}
+	}
+	if addr, err := netip.ParseAddr(ip); err == nil && containsAddr(set.prefixes, addr) {
+		return "ip", true
+	}
+	return "", false
+}
+
+// parsePrefixes parses IPs and CIDRs; bare IPs become single-address
+// prefixes. what names the list in errors.
+func parsePrefixes(cidrs []string, what string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			addr, err := netip.ParseAddr(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s entry %q: %w", what, c, err)
 			}
+			addr = addr.Unmap()
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", what, c, err)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// containsAddr reports whether any prefix contains addr, matching
+// IPv4-mapped IPv6 addresses as IPv4
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
 		}
 	}
-	// Fallback: RemoteAddr
+	return false
+}
+
+// ---------------- Utilities ----------------
+
+// trustedProxies holds the peers whose X-Forwarded-For is believed
+// (nil trusts none)
+var trustedProxies atomic.Pointer[[]netip.Prefix]
+
+// SetTrustedProxies sets the IPs/CIDRs of proxies in front of the gateway,
+// e.g. a load balancer subnet. Call it at startup; an empty list makes
+// ExtractClientIP ignore X-Forwarded-For.
+func SetTrustedProxies(cidrs []string) error {
+	prefixes, err := parsePrefixes(cidrs, "trusted proxy")
+	if err != nil {
+		return err
+	}
+	trustedProxies.Store(&prefixes)
+	return nil
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	prefixes := trustedProxies.Load()
+	return prefixes != nil && containsAddr(*prefixes, addr)
+}
+
+// ExtractClientIP extracts the client IP from request. X-Forwarded-For is
+// only honored when the connection comes from a trusted proxy; it is then
+// walked from the right, skipping trusted hops, so the result is the
+// nearest address no trusted proxy vouches for. Entries further left could
+// have been written by anyone.
+func ExtractClientIP(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err == nil && net.ParseIP(host) != nil {
-		return host
+	if err != nil {
+		host = r.RemoteAddr
 	}
-	if net.ParseIP(r.RemoteAddr) != nil {
-		return r.RemoteAddr
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
 	}
-	return ""
+	if !trustedProxy(peer) {
+		return peer.String()
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseForwardedHop(hops[i])
+		if !ok {
+			break // garbage can't be attributed; stop at the last trusted hop
+		}
+		client = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// parseForwardedHop parses an X-Forwarded-For entry, which some proxies
+// (e.g. Azure Application Gateway) write with a port
+func parseForwardedHop(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr, true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr(), true
+	}
+	return netip.Addr{}, false
+}
+
+// CanonicalHost normalizes a Host value so equivalent spellings compare
+// equal in cache keys: lowercased, trailing dot removed, the scheme's
+// default port dropped (80 and 443 when scheme is empty), and IPv6
+// literals bracketed.
+func CanonicalHost(host, scheme string) string {
+	name, port := splitHost(host)
+	switch {
+	case port == "80" && (scheme == "http" || scheme == ""):
+		port = ""
+	case port == "443" && (scheme == "https" || scheme == ""):
+		port = ""
+	}
+	if port != "" {
+		return name + ":" + port
+	}
+	return name
+}
+
+// CanonicalHostname is CanonicalHost without any port, the form host-based
+// routing matches on
+func CanonicalHostname(host string) string {
+	name, _ := splitHost(host)
+	return name
+}
+
+// splitHost lowercases host and splits off its port. The name loses any
+// trailing dot, and IPv6 literals are bracketed in their shortest form.
+func splitHost(host string) (name, port string) {
+	host = strings.ToLower(strings.TrimSpace(host))
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		// No port; strip brackets so IPv6 literals are handled uniformly
+		name, port = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
+	}
+	name = strings.TrimSuffix(name, ".")
+	if addr, err := netip.ParseAddr(name); err == nil && addr.Is6() {
+		name = "[" + addr.String() + "]"
+	}
+	return name, port
 }
@@ -0,0 +1,1364 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/protobuf"
+	"apigateway/internal/schema"
+)
+
+// failingWriter is a ResponseWriter whose connection has gone away
+type failingWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *failingWriter) Header() http.Header { return w.header }
+func (w *failingWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+func (w *failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestGzipWriteErrorAbortsConnection(t *testing.T) {
+	body := []byte(strings.Repeat("hello gzip ", 500))
+	h := WithGzip(GzipConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	fw := &failingWriter{header: http.Header{}}
+
+	func() {
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Fatalf("recovered %v, want http.ErrAbortHandler so the client sees a truncated transfer", v)
+			}
+		}()
+		h.ServeHTTP(fw, req)
+	}()
+	if fw.code != http.StatusOK || fw.header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("status %d, Content-Encoding %q", fw.code, fw.header.Get("Content-Encoding"))
+	}
+}
+
+func TestGzipHeadersUnsetUntilWrite(t *testing.T) {
+	for name, handler := range map[string]http.HandlerFunc{
+		"no body":    func(w http.ResponseWriter, r *http.Request) {},
+		"no content": func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			WithGzip(GzipConfig{}, handler).ServeHTTP(rec, req)
+			if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+				t.Fatalf("Content-Encoding %q set on a response nothing was compressed into", enc)
+			}
+		})
+	}
+}
+
+func TestBuildSkipsDisabledStages(t *testing.T) {
+	var wrapped []string
+	stage := func(name string, enabled bool) Stage {
+		return Stage{Name: name, Enabled: enabled, Wrap: func(h http.Handler) http.Handler {
+			wrapped = append(wrapped, name)
+			return h
+		}}
+	}
+	_, active := Build(http.NotFoundHandler(), stage("a", true), stage("b", false), stage("c", true))
+	if got := strings.Join(active, ","); got != "a,c" {
+		t.Errorf("active stages %s, want a,c", got)
+	}
+	// Wrapped innermost first; the disabled stage is never constructed
+	if got := strings.Join(wrapped, ","); got != "c,a" {
+		t.Errorf("wrapped %s, want c,a", got)
+	}
+}
+
+// loggedBytes serves req through WithLogging around h and returns the
+// bytes the request_completed record reports alongside the response
+func loggedBytes(t *testing.T, h http.Handler, req *http.Request) (int, *httptest.ResponseRecorder) {
+	var buf strings.Builder
+	saved := logger.Log
+	logger.Log = slog.New(slog.NewJSONHandler(&buf, nil))
+	defer func() { logger.Log = saved }()
+
+	rec := httptest.NewRecorder()
+	WithLogging(LoggingConfig{}, h).ServeHTTP(rec, req)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record struct {
+			Msg   string `json:"msg"`
+			Bytes *int   `json:"bytes"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Msg == "request_completed" && record.Bytes != nil {
+			return *record.Bytes, rec
+		}
+	}
+	t.Fatal("no request_completed record")
+	return 0, nil
+}
+
+func TestLoggingCountsFlushedBytes(t *testing.T) {
+	chunk := strings.Repeat("event data ", 100)
+	streaming := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, chunk)
+			if err := rc.Flush(); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	t.Run("identity", func(t *testing.T) {
+		n, rec := loggedBytes(t, streaming, httptest.NewRequest(http.MethodGet, "/", nil))
+		if !rec.Flushed {
+			t.Fatal("flush did not reach the client")
+		}
+		if n != 5*len(chunk) || n != rec.Body.Len() {
+			t.Fatalf("logged %d bytes, client received %d", n, rec.Body.Len())
+		}
+	})
+	t.Run("gzip", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		n, rec := loggedBytes(t, WithGzip(GzipConfig{}, streaming), req)
+		// The log reports what went on the wire, compressed
+		if n != rec.Body.Len() {
+			t.Fatalf("logged %d bytes, client received %d", n, rec.Body.Len())
+		}
+	})
+}
+
+func TestGzipHeadMatchesGet(t *testing.T) {
+	body := strings.Repeat("hello gzip ", 500)
+	srv := httptest.NewServer(WithGzip(GzipConfig{MinBytes: 100}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		io.WriteString(w, body) // net/http drops it for HEAD
+	})))
+	defer srv.Close()
+
+	do := func(method string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	get := do(http.MethodGet)
+	if get.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("GET not compressed")
+	}
+	head := do(http.MethodHead)
+	if enc := head.Header.Get("Content-Encoding"); enc != "" {
+		t.Fatalf("HEAD claims Content-Encoding %q for a body that was never compressed", enc)
+	}
+	if cl := head.Header.Get("Content-Length"); cl != strconv.Itoa(len(body)) {
+		t.Fatalf("HEAD Content-Length = %q, want the identity length %d", cl, len(body))
+	}
+	if head.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("HEAD Content-Type = %q", head.Header.Get("Content-Type"))
+	}
+}
+
+// BenchmarkGzip compares WithGzip's pooled writers with allocating a
+// gzip.Writer per response; compare B/op and allocs/op with -benchmem
+func BenchmarkGzip(b *testing.B) {
+	body := []byte(strings.Repeat(`{"id":1,"name":"gateway"},`, 200))
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	perResponse := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz, _ := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+		gz.Write(body)
+		gz.Close()
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	for _, bm := range []struct {
+		name string
+		h    http.Handler
+	}{
+		{"pooled", WithGzip(GzipConfig{}, handler)},
+		{"per-response", perResponse},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bm.h.ServeHTTP(discardWriter{header: http.Header{}}, req)
+			}
+		})
+	}
+}
+
+// discardWriter is a ResponseWriter that keeps nothing
+type discardWriter struct{ header http.Header }
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+// admissionOrder fills q's single slot, queues a burst of five requests
+// from client a and then one from b, and returns the clients in the order
+// they were admitted once the slot frees up
+func admissionOrder(t *testing.T, fair bool) string {
+	t.Helper()
+	q := NewFairQueue(1, fair)
+	if !q.acquire(context.Background(), "holder") {
+		t.Fatal("first request not admitted")
+	}
+	queued := func() int {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		n := 0
+		for el := q.order.Front(); el != nil; el = el.Next() {
+			n += el.Value.(*fairClient).waiters.Len()
+		}
+		return n
+	}
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	for i, client := range []string{"a", "a", "a", "a", "a", "b"} {
+		wg.Add(1)
+		go func(client string) {
+			defer wg.Done()
+			if !q.acquire(context.Background(), client) {
+				t.Error("request not admitted")
+				return
+			}
+			mu.Lock()
+			order = append(order, client)
+			mu.Unlock()
+			q.release()
+		}(client)
+		// Queue them one at a time so arrival order is known
+		for queued() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	q.release()
+	wg.Wait()
+	return strings.Join(order, "")
+}
+
+func TestFairQueueAdmitsClientsInTurn(t *testing.T) {
+	if got := admissionOrder(t, true); got != "abaaaa" {
+		t.Errorf("fair admission order = %s, want abaaaa", got)
+	}
+	// Without fairness, b waits behind a's whole burst
+	if got := admissionOrder(t, false); got != "aaaaab" {
+		t.Errorf("unfair admission order = %s, want aaaaab", got)
+	}
+}
+
+func TestSemaphoreShedsLowPriorityFirst(t *testing.T) {
+	// 10 slots: low priority may hold 3, and 2 are kept for critical
+	s := NewPrioritySemaphore(10, 0.3, 0.2)
+	var releases []func()
+	defer func() {
+		for _, r := range releases {
+			r()
+		}
+	}()
+	acquire := func(p Priority) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		release, err := s.acquire(ctx, p)
+		if err == nil {
+			releases = append(releases, release)
+		}
+		return err
+	}
+
+	// A flood of low-priority traffic only gets its share, and is shed
+	// at once rather than queued
+	shed := 0
+	for i := 0; i < 20; i++ {
+		if err := acquire(PriorityLow); errors.Is(err, errShed) {
+			shed++
+		} else if err != nil {
+			t.Fatalf("low priority: %v", err)
+		}
+	}
+	if shed != 17 {
+		t.Fatalf("shed %d of 20 low-priority requests, want 17", shed)
+	}
+
+	// Normal traffic still fits in the rest of the shared slots
+	for i := 0; i < 5; i++ {
+		if err := acquire(PriorityNormal); err != nil {
+			t.Fatalf("normal request %d: %v", i, err)
+		}
+	}
+	if err := acquire(PriorityNormal); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("normal request beyond the shared slots: err = %v, want to wait", err)
+	}
+
+	// Critical traffic has the reserve to itself
+	for i := 0; i < 2; i++ {
+		if err := acquire(PriorityCritical); err != nil {
+			t.Fatalf("critical request %d: %v", i, err)
+		}
+	}
+	if s.InFlight() != 10 {
+		t.Fatalf("InFlight = %d, want 10", s.InFlight())
+	}
+
+	// Freed low-priority slots go back to low-priority traffic
+	releases[0]()
+	releases = releases[1:]
+	if err := acquire(PriorityLow); err != nil {
+		t.Fatalf("low priority after a release: %v", err)
+	}
+}
+
+func TestTimeoutHandlerHeadersDoNotRace(t *testing.T) {
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	h := WithTimeout(20*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(stopped)
+		// Keep writing headers while the 504 goes out, as a proxy copying
+		// a late upstream response would
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				w.WriteHeader(http.StatusOK)
+				return
+			default:
+			}
+			w.Header().Set("X-Late-"+strconv.Itoa(i%100), "1")
+			w.Header().Del("Content-Type")
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	close(stop)
+	<-stopped
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var body jsonError
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Error.Code != "TIMEOUT" {
+		t.Fatalf("body = %+v, err = %v", body, err)
+	}
+	if rec.Header().Get("X-Late-0") != "" {
+		t.Fatal("abandoned handler's headers reached the client")
+	}
+}
+
+func TestTimeoutClientCancelStopsHandlerWrites(t *testing.T) {
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	writing := make(chan struct{})
+	h := WithTimeout(time.Minute, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(stopped)
+		// Ignore the canceled context and keep streaming, as a handler
+		// blocked in a write would once it wakes up
+		close(writing)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			w.Header().Set("X-Chunk", "1")
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rec := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		close(served)
+	}()
+	<-writing
+	cancel()
+	<-served
+
+	// The response is finished: reading it must not race the handler,
+	// which is still running
+	n := rec.Body.Len()
+	time.Sleep(20 * time.Millisecond)
+	if rec.Body.Len() != n {
+		t.Errorf("handler wrote %d bytes after ServeHTTP returned", rec.Body.Len()-n)
+	}
+	close(stop)
+	<-stopped
+}
+
+func TestTimeoutWriterCopiesHeaders(t *testing.T) {
+	h := WithTimeout(time.Second, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if w.Header().Get("X-Outer") != "1" {
+			t.Error("handler can't see headers set by outer middleware")
+		}
+		w.Header().Del("X-Outer")
+		w.Header().Set("Trailer", "X-Sum")
+		w.Header().Set("X-Inner", "1")
+		w.Write([]byte("ok"))
+		w.Header().Set("X-Sum", "abc")
+	}))
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("X-Outer", "1")
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Header().Get("X-Inner") != "1" || rec.Header().Get("X-Outer") != "" {
+		t.Fatalf("headers = %v", rec.Header())
+	}
+	if rec.Header().Get("X-Sum") != "abc" {
+		t.Fatalf("trailer lost: %v", rec.Header())
+	}
+}
+
+func TestIdempotencyDoesNotStoreAbortedResponse(t *testing.T) {
+	calls := 0
+	c := NewIdempotencyCache(IdempotencyConfig{
+		Header: "Idempotency-Key", Methods: []string{"POST"},
+		TTL: time.Minute, MaxEntries: 10, MaxBytes: 1 << 20,
+	})
+	h := WithIdempotency(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		if calls == 1 {
+			panic(http.ErrAbortHandler)
+		}
+	}))
+
+	send := func() {
+		defer func() { recover() }()
+		req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+		req.Header.Set("Idempotency-Key", "k1")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send()
+	send()
+	if calls != 2 {
+		t.Fatalf("handler ran %d times, want 2: an aborted response was replayed", calls)
+	}
+	send()
+	if calls != 2 {
+		t.Fatalf("handler ran %d times, want the completed response replayed", calls)
+	}
+}
+
+func TestIdempotencyKeyReusedWithDifferentQuery(t *testing.T) {
+	calls := 0
+	c := NewIdempotencyCache(IdempotencyConfig{
+		Header: "Idempotency-Key", Methods: []string{"POST"},
+		TTL: time.Minute, MaxEntries: 10, MaxBytes: 1 << 20,
+	})
+	h := WithIdempotency(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+
+	send := func(target string) int {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"qty":1}`))
+		req.Header.Set("Idempotency-Key", "k1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	send("/orders?account=a")
+	if code := send("/orders?account=b"); code != http.StatusUnprocessableEntity {
+		t.Fatalf("different query: status %d, want 422", code)
+	}
+	if code := send("/orders?account=a"); code != http.StatusOK || calls != 1 {
+		t.Fatalf("same query: status %d after %d calls, want the first response replayed", code, calls)
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	required := false
+	var seen *http.Request
+	h := WithAPIKeyAuth(APIKeyConfig{
+		Store:    NewStaticKeyStore(map[string]string{"acme": "k-acme"}),
+		Required: func(*http.Request) bool { return required },
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	}))
+
+	tests := []struct {
+		key      string
+		required bool
+		status   int
+		id       string
+	}{
+		{key: "k-acme", status: http.StatusOK, id: "acme"},
+		{key: "k-acme", required: true, status: http.StatusOK, id: "acme"},
+		{key: "k-stale", status: http.StatusUnauthorized},
+		{key: "k-stale", required: true, status: http.StatusUnauthorized},
+		{status: http.StatusOK},
+		{required: true, status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		required, seen = tt.required, nil
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("key %q required=%v: status %d, want %d", tt.key, tt.required, rec.Code, tt.status)
+			continue
+		}
+		if seen == nil {
+			continue
+		}
+		if v := seen.Header.Get("X-API-Key"); v != "" {
+			t.Errorf("key %q forwarded to the next handler", v)
+		}
+		if key, _ := GetAPIKey(seen); key.ID != tt.id {
+			t.Errorf("key %q: identity %q, want %q", tt.key, key.ID, tt.id)
+		}
+	}
+}
+
+func TestAllowListMatchesVerifiedKey(t *testing.T) {
+	allow, err := NewAllowList(nil, []string{"k-acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reason string
+	h := WithAPIKeyAuth(APIKeyConfig{
+		Store: NewStaticKeyStore(map[string]string{"acme": "k-acme"}),
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason, _ = allow.match(r, "192.0.2.1", "X-API-Key")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", "k-acme")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if reason != "api_key" {
+		t.Fatalf("allow-listed key not matched after auth removed the header")
+	}
+}
+
+func TestRateLimitRejectionNamesScope(t *testing.T) {
+	for _, tt := range []struct {
+		key   KeyFunc
+		scope string
+	}{
+		{nil, "per-ip"},
+		{func(*http.Request) string { return "tenant:acme" }, "per-key"},
+	} {
+		h := WithRateLimit(RateLimitConfig{
+			Global: NewTokenBucket(1000, 1000, time.Minute),
+			PerKey: NewPerKeyTokenBucket(0.001, 1, time.Minute),
+			Key:    tt.key,
+		}, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+		var rec *httptest.ResponseRecorder
+		for i := 0; i < 2; i++ {
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+		if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "("+tt.scope+")") {
+			t.Errorf("got %d %q, want a %s rejection", rec.Code, rec.Body, tt.scope)
+		}
+	}
+}
+
+func TestAllowListUpdate(t *testing.T) {
+	allow, err := NewAllowList([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	matches := func(ip string) bool {
+		_, ok := allow.match(req, ip, "X-API-Key")
+		return ok
+	}
+	if !matches("10.1.2.3") || matches("192.0.2.1") {
+		t.Fatal("initial allow-list not applied")
+	}
+
+	if err := allow.Update([]string{"192.0.2.1"}, []string{"k-probe"}); err != nil {
+		t.Fatal(err)
+	}
+	if matches("10.1.2.3") || !matches("192.0.2.1") {
+		t.Fatal("update not applied")
+	}
+	if cidrs, keys := allow.Snapshot(); len(cidrs) != 1 || cidrs[0] != "192.0.2.1/32" || keys != 1 {
+		t.Fatalf("snapshot = %v, %d keys", cidrs, keys)
+	}
+
+	if err := allow.Update([]string{"not-an-ip"}, nil); err == nil {
+		t.Fatal("invalid entry accepted")
+	}
+	if !matches("192.0.2.1") {
+		t.Fatal("failed update replaced the allow-list")
+	}
+}
+
+func TestAPIKeyHeaderConfigurable(t *testing.T) {
+	allow, err := NewAllowList(nil, []string{"k-acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Partner-Key", "k-acme")
+	if reason, _ := allow.match(req, "192.0.2.1", "X-Partner-Key"); reason != "api_key" {
+		t.Error("allow-listed key in the configured header not matched")
+	}
+
+	other := httptest.NewRequest(http.MethodGet, "/", nil)
+	other.Header.Set("X-Partner-Key", "k-other")
+	if idempotencyScope(req, "X-Partner-Key") == idempotencyScope(other, "X-Partner-Key") {
+		t.Error("callers with different keys in the configured header share an idempotency scope")
+	}
+}
+
+func TestExperimentCookieStableForAuthenticatedUsers(t *testing.T) {
+	h := WithExperiments(ExperimentConfig{
+		Experiments: []Experiment{{Name: "checkout", Buckets: []ExperimentBucket{{"old", 50}, {"new", 50}}}},
+		Header:      "X-Experiment-Bucket",
+		Cookie:      "gw_exp",
+		Secret:      []byte("secret"),
+		MaxAge:      time.Hour,
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(WithClaims(req.Context(), map[string]any{"sub": "user-1"}))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := serve(nil).Result().Cookies()
+	if len(first) != 1 {
+		t.Fatalf("first request set %d cookies, want 1", len(first))
+	}
+	if got := serve(first[0]).Header().Values("Set-Cookie"); len(got) != 0 {
+		t.Fatalf("valid cookie reissued: %v", got)
+	}
+}
+
+// pingMessage is message test.v1.Ping { string name = 1; int32 n = 2; }
+func pingMessage(t *testing.T) *protobuf.Message {
+	t.Helper()
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     kind.Enum(),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("test/v1/ping.proto"),
+		Package: proto.String("test.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Ping"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("n", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+			},
+		}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := protobuf.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := set.Message("test.v1.Ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTranscodeRequest(t *testing.T) {
+	m := pingMessage(t)
+	var got []byte
+	var gotType string
+	h := WithTranscoding(TranscodeConfig{Request: m, Response: m, MaxBytes: 64},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = io.ReadAll(r.Body)
+			gotType = r.Header.Get("Content-Type")
+			w.Header().Set("X-Accept", r.Header.Get("Accept"))
+		}))
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+		wantPath    string
+	}{
+		{"valid", "application/json", `{"name":"hi","n":7}`, 200, ""},
+		{"json suffix", "application/vnd.ping+json; charset=utf-8", `{}`, 200, ""},
+		{"not json content type", "text/plain", `{}`, http.StatusUnsupportedMediaType, ""},
+		{"invalid json", "application/json", `{"name":`, http.StatusBadRequest, ""},
+		{"unknown field", "application/json", `{"nope":1}`, http.StatusBadRequest, "$.nope"},
+		{"out of range", "application/json", `{"n":2147483648}`, http.StatusBadRequest, "$.n"},
+		{"too large", "application/json", `{"name":"` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			req := httptest.NewRequest("POST", "/ping", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want != http.StatusOK {
+				if got != nil {
+					t.Fatal("rejected body reached the upstream")
+				}
+				if tt.wantPath != "" && !strings.Contains(rec.Body.String(), strconv.Quote(tt.wantPath)) {
+					t.Fatalf("body %s doesn't name %s", rec.Body, tt.wantPath)
+				}
+				return
+			}
+			if gotType != protobuf.ContentType || rec.Header().Get("X-Accept") != protobuf.ContentType {
+				t.Fatalf("Content-Type = %q, Accept = %q", gotType, rec.Header().Get("X-Accept"))
+			}
+			if tt.name == "valid" && string(got) != "\x0a\x02hi\x10\x07" {
+				t.Fatalf("upstream got %q", got)
+			}
+		})
+	}
+}
+
+func TestBodyRejectionsUseErrorShape(t *testing.T) {
+	sch, err := schema.Compile([]byte(`{"type":"object","required":["name"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		body     string
+		header   string
+		want     int
+		wantCode string
+		wantPath string
+	}{
+		{"schema", WithJSONSchema(JSONSchemaConfig{Schema: sch}, ok), `{}`, "", 400, "SCHEMA_VIOLATION", "$"},
+		{"schema invalid json", WithJSONSchema(JSONSchemaConfig{Schema: sch}, ok), `{`, "", 400, "INVALID_JSON", ""},
+		{"transcode", WithTranscoding(TranscodeConfig{Request: pingMessage(t)}, ok), `{"nope":1}`, "", 400, "INVALID_BODY", "$.nope"},
+		{"checksum", WithChecksum(ChecksumConfig{Algorithms: []string{"md5"}}, ok), `{}`, "AAAAAAAAAAAAAAAAAAAAAA==", 400, "CHECKSUM_MISMATCH", ""},
+		{"checksum malformed", WithChecksum(ChecksumConfig{Algorithms: []string{"md5"}}, ok), `{}`, "zz", 400, "INVALID_CHECKSUM", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				req.Header.Set("Content-MD5", tt.header)
+			}
+			req = req.WithContext(context.WithValue(req.Context(), requestIDKey, "req-1"))
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Fatalf("Content-Type = %q", ct)
+			}
+			var body jsonError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %s: %v", rec.Body, err)
+			}
+			e := body.Error
+			if e.Code != tt.wantCode || e.Message == "" || e.RequestID != "req-1" {
+				t.Fatalf("error = %+v, want code %s", e, tt.wantCode)
+			}
+			if tt.wantPath == "" && len(e.Details) != 0 || tt.wantPath != "" && (len(e.Details) != 1 || e.Details[0].Path != tt.wantPath) {
+				t.Fatalf("details = %+v, want path %q", e.Details, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	tests := []struct {
+		host, scheme string
+		want         string
+		hostname     string
+	}{
+		{"Example.COM", "", "example.com", "example.com"},
+		{"example.com.", "http", "example.com", "example.com"},
+		{"example.com:80", "http", "example.com", "example.com"},
+		{"example.com:443", "https", "example.com", "example.com"},
+		{"example.com:80", "", "example.com", "example.com"},
+		{"example.com:443", "http", "example.com:443", "example.com"},
+		{"example.com:80", "https", "example.com:80", "example.com"},
+		{"example.com:8080", "http", "example.com:8080", "example.com"},
+		{" example.com ", "", "example.com", "example.com"},
+		{"[2001:DB8::1]", "", "[2001:db8::1]", "[2001:db8::1]"},
+		{"[2001:db8:0:0::1]:443", "https", "[2001:db8::1]", "[2001:db8::1]"},
+		{"[2001:db8::1]:8443", "https", "[2001:db8::1]:8443", "[2001:db8::1]"},
+		{"2001:db8::1", "", "[2001:db8::1]", "[2001:db8::1]"},
+		{"[::ffff:10.0.0.1]", "", "[::ffff:10.0.0.1]", "[::ffff:10.0.0.1]"},
+		{"10.0.0.1:80", "http", "10.0.0.1", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := CanonicalHost(tt.host, tt.scheme); got != tt.want {
+			t.Errorf("CanonicalHost(%q, %q) = %q, want %q", tt.host, tt.scheme, got, tt.want)
+		}
+		if got := CanonicalHostname(tt.host); got != tt.hostname {
+			t.Errorf("CanonicalHostname(%q) = %q, want %q", tt.host, got, tt.hostname)
+		}
+	}
+}
+
+func TestTrailersSurviveDeclaredLength(t *testing.T) {
+	body := "hello trailers"
+	srv := httptest.NewServer(WithRequestID(WithTrailers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// As the proxy does when relaying an upstream's length
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		io.WriteString(w, body)
+	}))))
+	defer srv.Close()
+
+	do := func(method string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL, nil)
+		req.Header.Set("TE", "trailers")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || (method == http.MethodGet && string(got) != body) {
+			t.Fatalf("%s body %q, %v", method, got, err)
+		}
+		return resp
+	}
+
+	get := do(http.MethodGet)
+	if get.Trailer.Get("X-Gateway-Status") != "200" || get.Trailer.Get("X-Request-ID") == "" {
+		t.Fatalf("trailers %v, want status and request ID after the body", get.Trailer)
+	}
+	head := do(http.MethodHead)
+	if head.Header.Get("Trailer") != "" || head.ContentLength != int64(len(body)) {
+		t.Fatalf("HEAD announced trailers %q, Content-Length %d", head.Header.Get("Trailer"), head.ContentLength)
+	}
+}
+
+func TestCORSPreflightFollowsRouteMethods(t *testing.T) {
+	routes := map[string]MethodSet{
+		"/orders":  NewMethodSet([]string{"GET", "POST", "OPTIONS"}),
+		"/reports": NewMethodSet([]string{"GET"}),
+	}
+	var reached bool
+	h := WithCORS(CORSConfig{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"GET", "POST", "DELETE"},
+		Methods:        func(r *http.Request) MethodSet { return routes[r.URL.Path] },
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	preflight := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, path, nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := preflight("/orders")
+	if rec.Code != http.StatusNoContent || reached {
+		t.Fatalf("/orders: status %d, want the preflight answered", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+		t.Errorf("/orders: Access-Control-Allow-Methods = %q, want the route's methods", got)
+	}
+
+	rec = preflight("/reports")
+	if !reached || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("/reports: preflight answered on a route without OPTIONS")
+	}
+}
+
+// rawServer serves the smuggling guard behind FramingListener and returns
+// a function sending raw bytes on one connection to it
+func rawServer(t *testing.T) (send func(raw string) *http.Response, bodies *[]string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []string
+	srv := &http.Server{
+		ConnContext: FramingConnContext,
+		Handler: WithSmugglingGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			seen = append(seen, string(b))
+		})),
+	}
+	go srv.Serve(FramingListener(ln))
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	return func(raw string) *http.Response {
+		if _, err := io.WriteString(conn, raw); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}, &seen
+}
+
+func TestSmugglingGuardRejectsLengthWithChunked(t *testing.T) {
+	send, bodies := rawServer(t)
+	resp := send("POST / HTTP/1.1\r\nHost: gw\r\n" + "Content-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n" + "0\r\n\r\nG")
+	if resp.StatusCode != http.StatusBadRequest || !resp.Close {
+		t.Fatalf("status %d, close=%v; want 400 closing the connection", resp.StatusCode, resp.Close)
+	}
+	if len(*bodies) != 0 {
+		t.Fatal("request reached the handler")
+	}
+}
+
+func TestSmugglingGuardFollowsBodies(t *testing.T) {
+	send, bodies := rawServer(t)
+	// A body that looks like a smuggled header block is only a body
+	decoy := "x\r\n\r\nPOST / HTTP/1.1\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n"
+	requests := []string{
+		"POST /a HTTP/1.1\r\nHost: gw\r\nContent-Length: " + strconv.Itoa(len(decoy)) + "\r\n\r\n" + decoy,
+		"POST /b HTTP/1.1\r\nHost: gw\r\nTransfer-Encoding: chunked\r\n\r\n" + "5;ext=1\r\nhello\r\n0\r\nX-Sum: 1\r\n\r\n",
+		"GET /c HTTP/1.1\r\nHost: gw\r\n\r\n",
+	}
+	for i, raw := range requests {
+		if resp := send(raw); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i, resp.StatusCode)
+		}
+	}
+	if want := []string{decoy, "hello", ""}; !slices.Equal(*bodies, want) {
+		t.Fatalf("bodies = %q, want %q", *bodies, want)
+	}
+
+	resp := send("POST /d HTTP/1.1\r\nHost: gw\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n0\r\n\r\n")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("conflict after clean requests: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestExtractClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		peer    string
+		xff     []string
+		want    string
+	}{
+		{"no proxies trusted by default", nil, "10.0.0.1:5000", []string{"1.2.3.4"}, "10.0.0.1"},
+		{"empty trusted list", []string{}, "10.0.0.1:5000", []string{"1.2.3.4"}, "10.0.0.1"},
+		{"untrusted peer's XFF ignored", []string{"10.0.0.0/8"}, "203.0.113.9:5000", []string{"1.2.3.4"}, "203.0.113.9"},
+		{"trusted peer without XFF", []string{"10.0.0.0/8"}, "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"rightmost untrusted hop", []string{"10.0.0.0/8"}, "10.0.0.1:5000", []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{"trusted hops skipped", []string{"10.0.0.0/8"}, "10.0.0.1:5000", []string{"6.6.6.6, 1.2.3.4, 10.1.1.1, 10.2.2.2"}, "1.2.3.4"},
+		{"hop with a port", []string{"10.0.0.0/8"}, "10.0.0.1:5000", []string{"1.2.3.4:51234"}, "1.2.3.4"},
+		{"IPv6 hop with a port", []string{"10.0.0.0/8"}, "10.0.0.1:5000", []string{"[2001:db8::1]:443"}, "2001:db8::1"},
+		{"garbage stops at the last trusted hop", []string{"10.0.0.0/8"}, "10.0.0.1:5000", []string{"1.2.3.4, unknown, 10.2.2.2"}, "10.2.2.2"},
+		{"garbage next to the peer", []string{"10.0.0.0/8"}, "10.0.0.1:5000", []string{"1.2.3.4, not-an-ip"}, "10.0.0.1"},
+		{"multiple header lines", []string{"10.0.0.0/8"}, "10.0.0.1:5000", []string{"6.6.6.6", "1.2.3.4, 10.2.2.2"}, "1.2.3.4"},
+		{"everyone trusted", []string{"10.0.0.0/8", "1.2.3.4"}, "10.0.0.1:5000", []string{"1.2.3.4, 10.2.2.2"}, "1.2.3.4"},
+		{"single trusted address", []string{"10.0.0.1"}, "10.0.0.2:5000", []string{"1.2.3.4"}, "10.0.0.2"},
+		{"peer without a port", []string{"10.0.0.0/8"}, "10.0.0.1", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"unparseable peer", []string{"10.0.0.0/8"}, "pipe", []string{"1.2.3.4"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.trusted != nil {
+				if err := SetTrustedProxies(tt.trusted); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { trustedProxies.Store(nil) })
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := ExtractClientIP(r); got != tt.want {
+				t.Errorf("ExtractClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetTrustedProxiesRejectsGarbage(t *testing.T) {
+	for _, cidrs := range [][]string{{"10.0.0.0/33"}, {"proxy.internal"}} {
+		if err := SetTrustedProxies(cidrs); err == nil {
+			t.Errorf("SetTrustedProxies(%v) accepted", cidrs)
+		}
+	}
+	if trustedProxies.Load() != nil {
+		t.Error("a rejected list replaced the trusted proxies")
+	}
+}
+
+func TestSlidingWindowWeightsPreviousWindow(t *testing.T) {
+	s := NewSlidingWindow(10, 10*time.Second, 0)
+	t0 := s.start
+	at := func(d time.Duration) time.Time { return t0.Add(d) }
+
+	for i := 0; i < 10; i++ {
+		if !s.Allow(at(time.Second)) {
+			t.Fatalf("request %d rejected", i+1)
+		}
+	}
+	if s.Allow(at(time.Second)) {
+		t.Fatal("11th request allowed")
+	}
+
+	// Halfway into the next window half of the previous one still counts
+	allowed := 0
+	for s.Allow(at(15 * time.Second)) {
+		allowed++
+	}
+	if allowed != 5 {
+		t.Fatalf("allowed %d at the window midpoint, want 5", allowed)
+	}
+
+	// Two windows on, nothing is left of the first
+	if q := s.Quota(at(35 * time.Second)); q.Remaining != 10 || q.Reset != 0 || q.RetryIn != 0 {
+		t.Fatalf("quota after two idle windows = %+v", q)
+	}
+}
+
+func TestSlidingWindowQuota(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests time.Duration // when 10 requests are counted
+		now      time.Duration
+		want     Quota
+	}{
+		// Full this window: room opens only once the next window has
+		// slid a tenth of the way over it
+		{"room only in the next window", time.Second, 5 * time.Second,
+			Quota{Limit: 10, Remaining: 0, Reset: 15 * time.Second, RetryIn: 6 * time.Second}},
+		// Full last window: room opens as it slides out of this one
+		{"room later this window", time.Second, 10 * time.Second,
+			Quota{Limit: 10, Remaining: 0, Reset: 10 * time.Second, RetryIn: time.Second}},
+		{"partly aged out", time.Second, 16 * time.Second,
+			Quota{Limit: 10, Remaining: 6, Reset: 4 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSlidingWindow(10, 10*time.Second, 0)
+			t0 := s.start
+			for i := 0; i < 10; i++ {
+				s.Allow(t0.Add(tt.requests))
+			}
+			if q := s.Quota(t0.Add(tt.now)); q != tt.want {
+				t.Fatalf("Quota = %+v, want %+v", q, tt.want)
+			}
+			if tt.want.RetryIn == 0 {
+				return
+			}
+			retry := t0.Add(tt.now + tt.want.RetryIn)
+			if s.Allow(retry.Add(-time.Millisecond)) {
+				t.Fatal("allowed before RetryIn")
+			}
+			if !s.Allow(retry) {
+				t.Fatal("rejected at RetryIn")
+			}
+		})
+	}
+}
+
+func TestSlidingWindowQuotaMixedWindows(t *testing.T) {
+	s := NewSlidingWindow(10, 10*time.Second, 0)
+	t0 := s.start
+	for i := 0; i < 8; i++ {
+		s.Allow(t0.Add(time.Second))
+	}
+	// At 12s the previous window weighs 8*0.8 = 6.4, leaving room for 3
+	allowed := 0
+	for s.Allow(t0.Add(12 * time.Second)) {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Fatalf("allowed %d at 12s, want 3", allowed)
+	}
+
+	// At 14s: 8*0.6+3 = 7.8
+	q := s.Quota(t0.Add(14 * time.Second))
+	if want := (Quota{Limit: 10, Remaining: 2, Reset: 16 * time.Second}); q != want {
+		t.Fatalf("Quota = %+v, want %+v", q, want)
+	}
+	s.Allow(t0.Add(14 * time.Second))
+	s.Allow(t0.Add(14 * time.Second))
+	// 8*0.6+5 = 9.8; room for one more once 8*(1-e)+5 <= 9, at e = 0.5
+	q = s.Quota(t0.Add(14 * time.Second))
+	if want := (Quota{Limit: 10, Remaining: 0, Reset: 16 * time.Second, RetryIn: time.Second}); q != want {
+		t.Fatalf("Quota = %+v, want %+v", q, want)
+	}
+	if s.Allow(t0.Add(15*time.Second - time.Millisecond)) {
+		t.Fatal("allowed before RetryIn")
+	}
+	if !s.Allow(t0.Add(15 * time.Second)) {
+		t.Fatal("rejected at RetryIn")
+	}
+}
+
+func TestPerKeySlidingWindowEvictsIdleKeys(t *testing.T) {
+	p := NewPerKeySlidingWindow(5, time.Second, time.Minute)
+	defer p.Stop()
+	now := time.Now()
+	p.Get("idle").Allow(now)
+	p.Get("busy").Allow(now.Add(50 * time.Second))
+
+	p.evictIdle(now.Add(70 * time.Second))
+	if _, ok := p.Inspect("idle"); ok {
+		t.Error("key idle past the TTL kept")
+	}
+	if p.Reset("idle") {
+		t.Error("Reset found an evicted key")
+	}
+	state, ok := p.Inspect("busy")
+	if !ok {
+		t.Fatal("key seen within the TTL evicted")
+	}
+	if state.Burst != 5 || !state.LastSeen.Equal(now.Add(50*time.Second)) {
+		t.Errorf("busy state = %+v", state)
+	}
+	if !p.Reset("busy") {
+		t.Fatal("Reset missed a known key")
+	}
+	if state, _ := p.Inspect("busy"); state.Tokens != 5 {
+		t.Errorf("tokens after Reset = %v, want 5", state.Tokens)
+	}
+}
+
+// errorCode returns the code of a WriteJSONError body
+func errorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var body jsonError
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body %q: %v", rec.Body.String(), err)
+	}
+	return body.Error.Code
+}
+
+func TestForwardedForLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    ForwardedForConfig
+		xff    []string
+		want   []string // X-Forwarded-For seen upstream
+		reject bool
+	}{
+		{"within the limit", ForwardedForConfig{MaxEntries: 3, Action: "trim"}, []string{"1.1.1.1, 2.2.2.2"}, []string{"1.1.1.1, 2.2.2.2"}, false},
+		{"trim keeps the newest", ForwardedForConfig{MaxEntries: 3, Action: "trim"}, []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}, []string{"2.2.2.2, 3.3.3.3"}, false},
+		{"trim across header lines", ForwardedForConfig{MaxEntries: 3, Action: "trim"}, []string{"1.1.1.1, 2.2.2.2", "3.3.3.3,4.4.4.4"}, []string{"3.3.3.3, 4.4.4.4"}, false},
+		{"empty entries ignored", ForwardedForConfig{MaxEntries: 3, Action: "trim"}, []string{"1.1.1.1,, 2.2.2.2, "}, []string{"1.1.1.1,, 2.2.2.2, "}, false},
+		{"empty entries dropped when trimming", ForwardedForConfig{MaxEntries: 3, Action: "trim"}, []string{"1.1.1.1,, 2.2.2.2, ,3.3.3.3"}, []string{"2.2.2.2, 3.3.3.3"}, false},
+		{"no room left", ForwardedForConfig{MaxEntries: 1, Action: "trim"}, []string{"1.1.1.1"}, nil, false},
+		{"reject", ForwardedForConfig{MaxEntries: 3, Action: "reject"}, []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}, nil, true},
+		{"disabled", ForwardedForConfig{MaxEntries: 0, Action: "reject"}, []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}, []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen []string
+			called := false
+			h := WithForwardedForLimit(tt.cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				seen = r.Header.Values("X-Forwarded-For")
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			if tt.reject {
+				if called || rec.Code != http.StatusBadRequest || errorCode(t, rec) != "TOO_MANY_FORWARDED_FOR" {
+					t.Fatalf("called=%v status=%d body=%s", called, rec.Code, rec.Body)
+				}
+				return
+			}
+			if !called || !slices.Equal(seen, tt.want) {
+				t.Fatalf("called=%v X-Forwarded-For = %q, want %q", called, seen, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderSizeLimit(t *testing.T) {
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = "example.com"                // "Host: example.com\r\n" = 19
+		r.Header.Set("X-A", "12345")          // 12
+		r.Header["X-B"] = []string{"1", "22"} // 8 + 9
+		return r
+	}
+	const size = 19 + 12 + 8 + 9
+
+	for _, tt := range []struct {
+		max  int
+		pass bool
+	}{
+		{size, true},
+		{size - 1, false},
+		{0, true}, // disabled
+	} {
+		called := false
+		h := WithHeaderSizeLimit(tt.max, http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newRequest())
+		if called != tt.pass {
+			t.Fatalf("max %d: handler called = %v, want %v", tt.max, called, tt.pass)
+		}
+		if tt.pass {
+			continue
+		}
+		if rec.Code != http.StatusRequestHeaderFieldsTooLarge {
+			t.Fatalf("max %d: status = %d, want 431", tt.max, rec.Code)
+		}
+		if code := errorCode(t, rec); code != "HEADERS_TOO_LARGE" {
+			t.Fatalf("code = %q", code)
+		}
+		if !strings.Contains(rec.Body.String(), `"message":"request header fields too large"`) {
+			t.Fatalf("body = %s", rec.Body)
+		}
+	}
+}
+
+func TestHeaderSummary(t *testing.T) {
+	sizes := map[string]int{"A": 10, "B": 30, "C": 20, "D": 20, "E": 5, "F": 1}
+	if got := headerSummary(sizes); got != "B=30,C=20,D=20,A=10,E=5" {
+		t.Errorf("headerSummary = %q", got)
+	}
+}
+
+func TestBodyPolicy(t *testing.T) {
+	type seen struct {
+		called bool
+		body   string
+		length int64
+		header string
+	}
+	serve := func(action string, r *http.Request) (*httptest.ResponseRecorder, seen) {
+		var got seen
+		h := WithBodyPolicy(BodyPolicyConfig{Methods: []string{"get", "HEAD", "DELETE"}, Action: action},
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				got = seen{true, string(b), r.ContentLength, r.Header.Get("Content-Length")}
+			}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec, got
+	}
+	withBody := func(method string) *http.Request {
+		r := httptest.NewRequest(method, "/", strings.NewReader("payload"))
+		r.Header.Set("Content-Length", "7")
+		return r
+	}
+	chunked := func(method string) *http.Request {
+		r := httptest.NewRequest(method, "/", strings.NewReader("payload"))
+		r.ContentLength = -1
+		r.TransferEncoding = []string{"chunked"}
+		return r
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		for _, r := range []*http.Request{withBody(http.MethodGet), withBody(http.MethodDelete), chunked(http.MethodGet)} {
+			rec, got := serve("reject", r)
+			if got.called || rec.Code != http.StatusBadRequest || errorCode(t, rec) != "BODY_NOT_ALLOWED" {
+				t.Fatalf("%s: called=%v status=%d body=%s", r.Method, got.called, rec.Code, rec.Body)
+			}
+		}
+		if _, got := serve("reject", httptest.NewRequest(http.MethodGet, "/", nil)); !got.called {
+			t.Fatal("bodyless GET rejected")
+		}
+		if _, got := serve("reject", withBody(http.MethodPost)); got.body != "payload" {
+			t.Fatalf("POST body = %q", got.body)
+		}
+	})
+
+	t.Run("strip", func(t *testing.T) {
+		for _, r := range []*http.Request{withBody(http.MethodGet), chunked(http.MethodDelete)} {
+			_, got := serve("strip", r)
+			if want := (seen{true, "", 0, ""}); got != want {
+				t.Fatalf("%s: upstream saw %+v, want %+v", r.Method, got, want)
+			}
+		}
+		if _, got := serve("strip", withBody(http.MethodPost)); got.body != "payload" || got.length != 7 {
+			t.Fatalf("POST body stripped: %+v", got)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		for _, action := range []string{"off", ""} {
+			if _, got := serve(action, withBody(http.MethodGet)); got.body != "payload" || got.length != 7 {
+				t.Fatalf("action %q touched the body: %+v", action, got)
+			}
+		}
+	})
+}
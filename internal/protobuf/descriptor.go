@@ -0,0 +1,467 @@
+// Package protobuf transcodes between JSON and the Protobuf binary format
+// using message types from a descriptor set, as written by
+// `protoc --include_imports --descriptor_set_out`. JSON follows the proto3
+// JSON mapping: lowerCamelCase names (original names are accepted too),
+// 64-bit integers as strings, enums by name, bytes as base64. Features it
+// doesn't implement (groups, editions, and well-known types with a special
+// JSON form such as Timestamp) are refused when a message type is looked
+// up rather than silently mistranslated.
+package protobuf
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Field types (FieldDescriptorProto.Type)
+const (
+	kindDouble   = 1
+	kindFloat    = 2
+	kindInt64    = 3
+	kindUint64   = 4
+	kindInt32    = 5
+	kindFixed64  = 6
+	kindFixed32  = 7
+	kindBool     = 8
+	kindString   = 9
+	kindGroup    = 10
+	kindMessage  = 11
+	kindBytes    = 12
+	kindUint32   = 13
+	kindEnum     = 14
+	kindSfixed32 = 15
+	kindSfixed64 = 16
+	kindSint32   = 17
+	kindSint64   = 18
+)
+
+// labelRepeated is FieldDescriptorProto.Label for repeated fields
+const labelRepeated = 3
+
+// specialJSON lists well-known types whose JSON form differs from that of
+// an ordinary message; transcoding them generically would be wrong
+var specialJSON = map[string]bool{
+	"google.protobuf.Any": true, "google.protobuf.Timestamp": true, "google.protobuf.Duration": true,
+	"google.protobuf.Struct": true, "google.protobuf.Value": true, "google.protobuf.ListValue": true,
+	"google.protobuf.FieldMask": true, "google.protobuf.NullValue": true,
+	"google.protobuf.DoubleValue": true, "google.protobuf.FloatValue": true,
+	"google.protobuf.Int64Value": true, "google.protobuf.UInt64Value": true,
+	"google.protobuf.Int32Value": true, "google.protobuf.UInt32Value": true,
+	"google.protobuf.BoolValue": true, "google.protobuf.StringValue": true,
+	"google.protobuf.BytesValue": true,
+}
+
+// Set holds the message and enum types of a descriptor set
+type Set struct {
+	messages map[string]*Message // by full name, e.g. acme.orders.v1.Order
+	enums    map[string]*enum
+}
+
+// Message is a message type that can be transcoded
+type Message struct {
+	name     string
+	fields   []*field          // by number
+	byNumber map[int32]*field  // wire lookups
+	byName   map[string]*field // JSON lookups, by JSON and original name
+	mapEntry bool              // synthetic entry type of a map field
+}
+
+type field struct {
+	name     string
+	jsonName string
+	number   int32
+	kind     int32
+	typeName string // message or enum types, fully qualified
+	repeated bool
+	packed   bool // repeated scalars are written packed
+	presence bool // explicitly set zero values are kept (proto2, optional, oneof, messages)
+	oneof    int  // index of the (non-synthetic) oneof, -1 if none
+
+	message *Message
+	enum    *enum
+}
+
+type enum struct {
+	name     string
+	byNumber map[int32]string
+	byName   map[string]int32
+}
+
+// Name returns the message's full name
+func (m *Message) Name() string {
+	return m.name
+}
+
+// isMap reports whether f is a map field, whose entries have the key in
+// field 1 and the value in field 2
+func (f *field) isMap() bool {
+	return f.repeated && f.kind == kindMessage && f.message.mapEntry
+}
+
+// Load reads a binary FileDescriptorSet
+func Load(path string) (*Set, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes a binary FileDescriptorSet and links its types. Every
+// referenced type must be in the set, so compile it with --include_imports.
+func Parse(data []byte) (*Set, error) {
+	s := &Set{messages: make(map[string]*Message), enums: make(map[string]*enum)}
+	err := eachField(data, func(f wireField) error {
+		if f.number == 1 && f.wireType == wireBytes {
+			return s.parseFile(f.data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %w", err)
+	}
+	if len(s.messages) == 0 {
+		return nil, fmt.Errorf("descriptor set defines no messages")
+	}
+
+	for _, m := range s.messages {
+		for _, f := range m.fields {
+			if err := s.link(m, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// Message looks up a message type by its full name. It fails if the type,
+// or any type reachable from it, can't be transcoded faithfully.
+func (s *Set) Message(name string) (*Message, error) {
+	m, ok := s.messages[strings.TrimPrefix(name, ".")]
+	if !ok {
+		return nil, fmt.Errorf("message %s not found in descriptor set", name)
+	}
+	if err := checkSupported(m, make(map[*Message]bool)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func checkSupported(m *Message, seen map[*Message]bool) error {
+	if seen[m] {
+		return nil
+	}
+	seen[m] = true
+	for _, f := range m.fields {
+		if f.kind == kindGroup {
+			return fmt.Errorf("%s.%s: groups are not supported", m.name, f.name)
+		}
+		if specialJSON[f.typeName] {
+			return fmt.Errorf("%s.%s: %s has a special JSON mapping, which is not supported", m.name, f.name, f.typeName)
+		}
+		if f.message != nil {
+			if err := checkSupported(f.message, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// link resolves a field's message or enum type
+func (s *Set) link(m *Message, f *field) error {
+	if f.typeName == "" {
+		return nil
+	}
+	if msg, ok := s.messages[f.typeName]; ok && (f.kind == kindMessage || f.kind == kindGroup || f.kind == 0) {
+		if f.kind == 0 {
+			f.kind = kindMessage
+		}
+		f.message = msg
+		return nil
+	}
+	if e, ok := s.enums[f.typeName]; ok && (f.kind == kindEnum || f.kind == 0) {
+		f.kind = kindEnum
+		f.enum = e
+		return nil
+	}
+	return fmt.Errorf("%s.%s: type %s not found in descriptor set (compile with --include_imports)", m.name, f.name, f.typeName)
+}
+
+// parseFile reads a FileDescriptorProto
+func (s *Set) parseFile(b []byte) error {
+	var (
+		pkg, syntax     string
+		messages, enums [][]byte
+	)
+	err := eachField(b, func(f wireField) error {
+		switch {
+		case f.number == 2 && f.wireType == wireBytes:
+			pkg = string(f.data)
+		case f.number == 4 && f.wireType == wireBytes:
+			messages = append(messages, f.data)
+		case f.number == 5 && f.wireType == wireBytes:
+			enums = append(enums, f.data)
+		case f.number == 12 && f.wireType == wireBytes:
+			syntax = string(f.data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	switch syntax {
+	case "", "proto2", "proto3":
+	default:
+		return fmt.Errorf("package %s: syntax %q is not supported", pkg, syntax)
+	}
+	for _, mb := range messages {
+		if err := s.parseMessage(mb, pkg, syntax); err != nil {
+			return err
+		}
+	}
+	for _, eb := range enums {
+		if err := s.parseEnum(eb, pkg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMessage reads a DescriptorProto and its nested types
+func (s *Set) parseMessage(b []byte, scope, syntax string) error {
+	var (
+		name                  string
+		fields, nested, enums [][]byte
+		options               []byte
+	)
+	err := eachField(b, func(f wireField) error {
+		if f.wireType != wireBytes {
+			return nil
+		}
+		switch f.number {
+		case 1:
+			name = string(f.data)
+		case 2:
+			fields = append(fields, f.data)
+		case 3:
+			nested = append(nested, f.data)
+		case 4:
+			enums = append(enums, f.data)
+		case 7:
+			options = f.data
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m := &Message{
+		name:     qualify(scope, name),
+		byNumber: make(map[int32]*field, len(fields)),
+		byName:   make(map[string]*field, 2*len(fields)),
+	}
+	err = eachField(options, func(f wireField) error {
+		if f.number == 7 && f.wireType == wireVarint {
+			m.mapEntry = f.num != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, fb := range fields {
+		f, err := parseField(fb, syntax)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.name, err)
+		}
+		m.fields = append(m.fields, f)
+		m.byNumber[f.number] = f
+		m.byName[f.name] = f
+		m.byName[f.jsonName] = f
+	}
+	sort.Slice(m.fields, func(i, j int) bool { return m.fields[i].number < m.fields[j].number })
+	s.messages[m.name] = m
+
+	for _, nb := range nested {
+		if err := s.parseMessage(nb, m.name, syntax); err != nil {
+			return err
+		}
+	}
+	for _, eb := range enums {
+		if err := s.parseEnum(eb, m.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseField reads a FieldDescriptorProto
+func parseField(b []byte, syntax string) (*field, error) {
+	f := &field{oneof: -1}
+	var (
+		label          uint64
+		packed         = -1 // unset
+		inOneof        bool
+		proto3Optional bool
+	)
+	err := eachField(b, func(w wireField) error {
+		switch {
+		case w.number == 1 && w.wireType == wireBytes:
+			f.name = string(w.data)
+		case w.number == 3 && w.wireType == wireVarint:
+			f.number = int32(w.num)
+		case w.number == 4 && w.wireType == wireVarint:
+			label = w.num
+		case w.number == 5 && w.wireType == wireVarint:
+			f.kind = int32(w.num)
+		case w.number == 6 && w.wireType == wireBytes:
+			f.typeName = strings.TrimPrefix(string(w.data), ".")
+		case w.number == 8 && w.wireType == wireBytes:
+			return eachField(w.data, func(o wireField) error {
+				if o.number == 2 && o.wireType == wireVarint {
+					packed = int(min(o.num, 1))
+				}
+				return nil
+			})
+		case w.number == 9 && w.wireType == wireVarint:
+			inOneof = true
+			f.oneof = int(w.num)
+		case w.number == 10 && w.wireType == wireBytes:
+			f.jsonName = string(w.data)
+		case w.number == 17 && w.wireType == wireVarint:
+			proto3Optional = w.num != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.name == "" || f.number <= 0 {
+		return nil, fmt.Errorf("field %q: missing name or number", f.name)
+	}
+	if f.jsonName == "" {
+		f.jsonName = lowerCamel(f.name)
+	}
+
+	f.repeated = label == labelRepeated
+	if f.repeated {
+		if packed >= 0 {
+			f.packed = packed == 1
+		} else {
+			f.packed = syntax == "proto3"
+		}
+		f.packed = f.packed && packable(f.kind)
+	}
+	if proto3Optional {
+		f.oneof = -1 // synthetic oneof: presence only
+	}
+	f.presence = !f.repeated && (syntax != "proto3" || proto3Optional || inOneof || f.kind == kindMessage)
+	return f, nil
+}
+
+// parseEnum reads an EnumDescriptorProto. With allow_alias, the first name
+// of a number is the one written to JSON.
+func (s *Set) parseEnum(b []byte, scope string) error {
+	e := &enum{byNumber: make(map[int32]string), byName: make(map[string]int32)}
+	err := eachField(b, func(f wireField) error {
+		if f.wireType != wireBytes {
+			return nil
+		}
+		switch f.number {
+		case 1:
+			e.name = string(f.data)
+		case 2:
+			var name string
+			var number int32
+			err := eachField(f.data, func(v wireField) error {
+				switch {
+				case v.number == 1 && v.wireType == wireBytes:
+					name = string(v.data)
+				case v.number == 2 && v.wireType == wireVarint:
+					number = int32(v.num)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			e.byName[name] = number
+			if _, dup := e.byNumber[number]; !dup {
+				e.byNumber[number] = name
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	e.name = qualify(scope, e.name)
+	s.enums[e.name] = e
+	return nil
+}
+
+func qualify(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// lowerCamel derives a JSON name the way protoc does: underscores are
+// dropped and the letter after each is upper-cased
+func lowerCamel(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range name {
+		switch {
+		case c == '_':
+			upper = true
+		case upper && 'a' <= c && c <= 'z':
+			b.WriteRune(c - 'a' + 'A')
+			upper = false
+		default:
+			b.WriteRune(c)
+			upper = false
+		}
+	}
+	return b.String()
+}
+
+// packable reports whether repeated fields of the kind can be packed
+func packable(kind int32) bool {
+	switch kind {
+	case kindString, kindBytes, kindMessage, kindGroup:
+		return false
+	}
+	return true
+}
+
+// wireTypeOf is the wire type a single value of the kind is written with
+func wireTypeOf(kind int32) int {
+	switch kind {
+	case kindDouble, kindFixed64, kindSfixed64:
+		return wireFixed64
+	case kindFloat, kindFixed32, kindSfixed32:
+		return wireFixed32
+	case kindString, kindBytes, kindMessage:
+		return wireBytes
+	}
+	return wireVarint
+}
+
+// ContentType is sent to upstreams for transcoded bodies
+const ContentType = "application/x-protobuf"
+
+// IsContentType reports whether a Content-Type header names Protobuf
+func IsContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case "application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,674 @@
+package protobuf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// maxDepth bounds message nesting in either direction, so a hostile body
+// can't exhaust the stack
+const maxDepth = 100
+
+// ErrInvalidJSON is returned by FromJSON for bodies that aren't JSON at all
+var ErrInvalidJSON = errors.New("invalid JSON")
+
+// FieldError is a JSON value that doesn't fit the message type
+type FieldError struct {
+	Path    string // e.g. $.items[0].name
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// ---------------- JSON to Protobuf ----------------
+
+// FromJSON encodes a JSON object as the message in wire format. Unknown
+// fields, values of the wrong type, and integers out of range are
+// rejected with a *FieldError; null fields are left unset. Fields are
+// written in number order, so equal input yields equal output.
+func (m *Message) FromJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, ErrInvalidJSON
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, ErrInvalidJSON
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil, &FieldError{Path: "$", Message: "expected an object"}
+	}
+	return m.encode(nil, obj, "$", 0)
+}
+
+func (m *Message) encode(b []byte, obj map[string]any, path string, depth int) ([]byte, error) {
+	if depth > maxDepth {
+		return nil, &FieldError{Path: path, Message: "nested too deeply"}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make(map[*field]any, len(obj))
+	setBy := make(map[*field]string, len(obj))
+	oneofs := make(map[int]string)
+	for _, k := range keys {
+		f, ok := m.byName[k]
+		if !ok {
+			return nil, &FieldError{Path: path + "." + k, Message: "unknown field"}
+		}
+		if other, dup := setBy[f]; dup {
+			return nil, &FieldError{Path: path + "." + k, Message: "duplicate of " + other}
+		}
+		setBy[f] = k
+		if obj[k] == nil {
+			continue
+		}
+		if f.oneof >= 0 {
+			if other, dup := oneofs[f.oneof]; dup {
+				return nil, &FieldError{Path: path + "." + k, Message: "only one of " + other + " and " + k + " may be set"}
+			}
+			oneofs[f.oneof] = k
+		}
+		values[f] = obj[k]
+	}
+
+	var err error
+	for _, f := range m.fields {
+		v, ok := values[f]
+		if !ok {
+			continue
+		}
+		if b, err = f.encode(b, v, path+"."+setBy[f], depth); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (f *field) encode(b []byte, v any, path string, depth int) ([]byte, error) {
+	var err error
+	switch {
+	case f.isMap():
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, &FieldError{Path: path, Message: "expected an object"}
+		}
+		keyField, valueField := f.message.byNumber[1], f.message.byNumber[2]
+		if keyField == nil || valueField == nil {
+			return nil, &FieldError{Path: path, Message: "malformed map type " + f.message.name}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			elemPath := path + "[" + strconv.Quote(k) + "]"
+			if obj[k] == nil {
+				return nil, &FieldError{Path: elemPath, Message: "null is not a valid map value"}
+			}
+			var key any = k
+			if keyField.kind == kindBool {
+				if key, err = strconv.ParseBool(k); err != nil {
+					return nil, &FieldError{Path: elemPath, Message: "map key must be true or false"}
+				}
+			}
+			entry := appendTag(nil, 1, wireTypeOf(keyField.kind))
+			if entry, err = keyField.encodeValue(entry, key, elemPath, depth); err != nil {
+				return nil, err
+			}
+			entry = appendTag(entry, 2, wireTypeOf(valueField.kind))
+			if entry, err = valueField.encodeValue(entry, obj[k], elemPath, depth); err != nil {
+				return nil, err
+			}
+			b = appendBytes(appendTag(b, f.number, wireBytes), entry)
+		}
+		return b, nil
+
+	case f.repeated:
+		elems, ok := v.([]any)
+		if !ok {
+			return nil, &FieldError{Path: path, Message: "expected an array"}
+		}
+		var packed []byte
+		for i, e := range elems {
+			elemPath := path + "[" + strconv.Itoa(i) + "]"
+			if e == nil {
+				return nil, &FieldError{Path: elemPath, Message: "null is not a valid array element"}
+			}
+			if f.packed {
+				if packed, err = f.encodeValue(packed, e, elemPath, depth); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			b = appendTag(b, f.number, wireTypeOf(f.kind))
+			if b, err = f.encodeValue(b, e, elemPath, depth); err != nil {
+				return nil, err
+			}
+		}
+		if len(packed) > 0 {
+			b = appendBytes(appendTag(b, f.number, wireBytes), packed)
+		}
+		return b, nil
+
+	default:
+		b = appendTag(b, f.number, wireTypeOf(f.kind))
+		return f.encodeValue(b, v, path, depth)
+	}
+}
+
+// encodeValue appends a single value, without its tag
+func (f *field) encodeValue(b []byte, v any, path string, depth int) ([]byte, error) {
+	switch f.kind {
+	case kindMessage:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, &FieldError{Path: path, Message: "expected an object"}
+		}
+		inner, err := f.message.encode(nil, obj, path, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(b, inner), nil
+
+	case kindBool:
+		bv, ok := v.(bool)
+		if !ok {
+			return nil, &FieldError{Path: path, Message: "expected a boolean"}
+		}
+		if bv {
+			return appendVarint(b, 1), nil
+		}
+		return appendVarint(b, 0), nil
+
+	case kindString:
+		s, ok := v.(string)
+		if !ok {
+			return nil, &FieldError{Path: path, Message: "expected a string"}
+		}
+		return appendBytes(b, []byte(s)), nil
+
+	case kindBytes:
+		s, ok := v.(string)
+		if !ok {
+			return nil, &FieldError{Path: path, Message: "expected a base64 string"}
+		}
+		raw, err := decodeBase64(s)
+		if err != nil {
+			return nil, &FieldError{Path: path, Message: "expected a base64 string"}
+		}
+		return appendBytes(b, raw), nil
+
+	case kindEnum:
+		if s, ok := v.(string); ok {
+			n, ok := f.enum.byName[s]
+			if !ok {
+				return nil, &FieldError{Path: path, Message: fmt.Sprintf("unknown value %q for enum %s", s, f.enum.name)}
+			}
+			return appendVarint(b, uint64(int64(n))), nil
+		}
+		n, err := parseSigned(v, 32)
+		if err != nil {
+			return nil, &FieldError{Path: path, Message: "expected an enum name or number"}
+		}
+		return appendVarint(b, uint64(n)), nil
+
+	case kindFloat, kindDouble:
+		bits := 64
+		if f.kind == kindFloat {
+			bits = 32
+		}
+		x, err := parseFloat(v, bits)
+		if err != nil {
+			return nil, &FieldError{Path: path, Message: err.Error()}
+		}
+		if bits == 32 {
+			return appendFixed32(b, math.Float32bits(float32(x))), nil
+		}
+		return appendFixed64(b, math.Float64bits(x)), nil
+
+	case kindInt32, kindSint32, kindSfixed32, kindInt64, kindSint64, kindSfixed64:
+		bits := 64
+		if f.kind == kindInt32 || f.kind == kindSint32 || f.kind == kindSfixed32 {
+			bits = 32
+		}
+		n, err := parseSigned(v, bits)
+		if err != nil {
+			return nil, &FieldError{Path: path, Message: err.Error()}
+		}
+		switch f.kind {
+		case kindSint32, kindSint64:
+			return appendVarint(b, encodeZigZag(n)), nil
+		case kindSfixed32:
+			return appendFixed32(b, uint32(n)), nil
+		case kindSfixed64:
+			return appendFixed64(b, uint64(n)), nil
+		}
+		return appendVarint(b, uint64(n)), nil
+
+	case kindUint32, kindFixed32, kindUint64, kindFixed64:
+		bits := 64
+		if f.kind == kindUint32 || f.kind == kindFixed32 {
+			bits = 32
+		}
+		n, err := parseUnsigned(v, bits)
+		if err != nil {
+			return nil, &FieldError{Path: path, Message: err.Error()}
+		}
+		switch f.kind {
+		case kindFixed32:
+			return appendFixed32(b, uint32(n)), nil
+		case kindFixed64:
+			return appendFixed64(b, n), nil
+		}
+		return appendVarint(b, n), nil
+	}
+	return nil, &FieldError{Path: path, Message: fmt.Sprintf("unsupported field type %d", f.kind)}
+}
+
+// numberText accepts JSON numbers and, as the mapping allows, numbers
+// quoted as strings
+func numberText(v any) (string, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		return string(v), true
+	case string:
+		return v, true
+	}
+	return "", false
+}
+
+// parseSigned reads an integer; integral values written with a fraction
+// or exponent (1.0, 1e3) are accepted, as in the proto3 JSON mapping
+func parseSigned(v any, bits int) (int64, error) {
+	s, ok := numberText(v)
+	if !ok {
+		return 0, errors.New("expected an integer")
+	}
+	if n, err := strconv.ParseInt(s, 10, bits); err == nil {
+		return n, nil
+	} else if errors.Is(err, strconv.ErrRange) {
+		return 0, errors.New("integer out of range")
+	}
+	x, err := strconv.ParseFloat(s, 64)
+	if err != nil || x != math.Trunc(x) {
+		return 0, errors.New("expected an integer")
+	}
+	limit := math.Ldexp(1, bits-1)
+	if x < -limit || x >= limit {
+		return 0, errors.New("integer out of range")
+	}
+	return int64(x), nil
+}
+
+func parseUnsigned(v any, bits int) (uint64, error) {
+	s, ok := numberText(v)
+	if !ok {
+		return 0, errors.New("expected an integer")
+	}
+	if n, err := strconv.ParseUint(s, 10, bits); err == nil {
+		return n, nil
+	} else if errors.Is(err, strconv.ErrRange) {
+		return 0, errors.New("integer out of range")
+	}
+	x, err := strconv.ParseFloat(s, 64)
+	if err != nil || x != math.Trunc(x) {
+		return 0, errors.New("expected a non-negative integer")
+	}
+	if x < 0 || x >= math.Ldexp(1, bits) {
+		return 0, errors.New("integer out of range")
+	}
+	return uint64(x), nil
+}
+
+func parseFloat(v any, bits int) (float64, error) {
+	s, ok := numberText(v)
+	if !ok {
+		return 0, errors.New("expected a number")
+	}
+	switch s {
+	case "NaN":
+		return math.NaN(), nil
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	}
+	x, err := strconv.ParseFloat(s, bits)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return 0, errors.New("number out of range")
+		}
+		return 0, errors.New("expected a number")
+	}
+	return x, nil
+}
+
+// decodeBase64 accepts standard and URL-safe base64, padded or not
+func decodeBase64(s string) ([]byte, error) {
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, errors.New("invalid base64")
+}
+
+// ---------------- Protobuf to JSON ----------------
+
+// ToJSON decodes the message from wire format as a JSON object. Fields are
+// written in number order; unknown fields are dropped and, as in proto3,
+// fields without explicit presence are omitted when zero.
+func (m *Message) ToJSON(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := m.writeJSON(&buf, data, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *Message) writeJSON(buf *bytes.Buffer, data []byte, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%s: nested too deeply", m.name)
+	}
+
+	got := make(map[*field][]wireField)
+	err := eachField(data, func(w wireField) error {
+		f := m.byNumber[w.number]
+		if f == nil {
+			return nil
+		}
+		// Repeated scalars may arrive packed or not, whatever the schema says
+		if f.repeated && packable(f.kind) && w.wireType == wireBytes {
+			values, err := unpack(w.data, f.kind)
+			if err != nil {
+				return fmt.Errorf("%s.%s: %w", m.name, f.name, err)
+			}
+			got[f] = append(got[f], values...)
+			return nil
+		}
+		if w.wireType != wireTypeOf(f.kind) {
+			return fmt.Errorf("%s.%s: unexpected wire type %d", m.name, f.name, w.wireType)
+		}
+		switch {
+		case f.repeated:
+			got[f] = append(got[f], w)
+		case f.kind == kindMessage && len(got[f]) > 0:
+			// Repeated occurrences of a message field are merged, which
+			// is what decoding their concatenation does
+			prev := got[f][0].data
+			w.data = append(prev[:len(prev):len(prev)], w.data...)
+			got[f] = []wireField{w}
+		default:
+			got[f] = []wireField{w}
+		}
+		if f.oneof >= 0 {
+			// The last member of a oneof on the wire wins
+			for _, other := range m.fields {
+				if other != f && other.oneof == f.oneof {
+					delete(got, other)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	buf.WriteByte('{')
+	first := true
+	for _, f := range m.fields {
+		values, ok := got[f]
+		if !ok || (!f.repeated && !f.presence && isZero(f, values[0])) {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		writeString(buf, f.jsonName)
+		buf.WriteByte(':')
+
+		switch {
+		case f.isMap():
+			err = writeMap(buf, f.message, values, depth)
+		case f.repeated:
+			buf.WriteByte('[')
+			for i, w := range values {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if err = f.writeValue(buf, w, depth); err != nil {
+					break
+				}
+			}
+			buf.WriteByte(']')
+		default:
+			err = f.writeValue(buf, values[0], depth)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// writeMap writes map entries as a JSON object; for duplicate keys the
+// last entry wins, and missing keys or values are zero
+func writeMap(buf *bytes.Buffer, entry *Message, entries []wireField, depth int) error {
+	keyField, valueField := entry.byNumber[1], entry.byNumber[2]
+	if keyField == nil || valueField == nil {
+		return fmt.Errorf("malformed map type %s", entry.name)
+	}
+	var keys []string
+	values := make(map[string]*wireField)
+	for _, e := range entries {
+		var key, value *wireField
+		err := eachField(e.data, func(w wireField) error {
+			var f *field
+			switch w.number {
+			case 1:
+				f, key = keyField, &w
+			case 2:
+				f, value = valueField, &w
+			default:
+				return nil
+			}
+			if w.wireType != wireTypeOf(f.kind) {
+				return fmt.Errorf("%s.%s: unexpected wire type %d", entry.name, f.name, w.wireType)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		k := mapKey(keyField, key)
+		if _, seen := values[k]; !seen {
+			keys = append(keys, k)
+		}
+		values[k] = value
+	}
+
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeString(buf, k)
+		buf.WriteByte(':')
+		if values[k] == nil {
+			writeZero(buf, valueField)
+			continue
+		}
+		if err := valueField.writeValue(buf, *values[k], depth); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// mapKey formats a map key as its JSON object key
+func mapKey(f *field, w *wireField) string {
+	if w == nil {
+		w = &wireField{}
+	}
+	switch f.kind {
+	case kindString:
+		return string(w.data)
+	case kindBool:
+		return strconv.FormatBool(w.num != 0)
+	case kindInt32, kindSfixed32:
+		return strconv.FormatInt(int64(int32(w.num)), 10)
+	case kindSint32, kindSint64:
+		return strconv.FormatInt(decodeZigZag(w.num), 10)
+	case kindInt64, kindSfixed64:
+		return strconv.FormatInt(int64(w.num), 10)
+	}
+	return strconv.FormatUint(w.num, 10)
+}
+
+// unpack splits a packed repeated field into its values
+func unpack(data []byte, kind int32) ([]wireField, error) {
+	var values []wireField
+	for len(data) > 0 {
+		w := wireField{wireType: wireTypeOf(kind)}
+		switch w.wireType {
+		case wireFixed32:
+			if len(data) < 4 {
+				return nil, errTruncated
+			}
+			w.num = uint64(data[0]) | uint64(data[1])<<8 | uint64(data[2])<<16 | uint64(data[3])<<24
+			data = data[4:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, errTruncated
+			}
+			w.num = uint64(data[0]) | uint64(data[1])<<8 | uint64(data[2])<<16 | uint64(data[3])<<24 |
+				uint64(data[4])<<32 | uint64(data[5])<<40 | uint64(data[6])<<48 | uint64(data[7])<<56
+			data = data[8:]
+		default:
+			v, n, err := consumeVarint(data)
+			if err != nil {
+				return nil, err
+			}
+			w.num = v
+			data = data[n:]
+		}
+		values = append(values, w)
+	}
+	return values, nil
+}
+
+func isZero(f *field, w wireField) bool {
+	switch f.kind {
+	case kindMessage:
+		return false
+	case kindString, kindBytes:
+		return len(w.data) == 0
+	}
+	return w.num == 0
+}
+
+func (f *field) writeValue(buf *bytes.Buffer, w wireField, depth int) error {
+	switch f.kind {
+	case kindMessage:
+		return f.message.writeJSON(buf, w.data, depth+1)
+	case kindString:
+		if !utf8.Valid(w.data) {
+			return fmt.Errorf("field %s: invalid UTF-8", f.name)
+		}
+		writeString(buf, string(w.data))
+	case kindBytes:
+		writeString(buf, base64.StdEncoding.EncodeToString(w.data))
+	case kindBool:
+		buf.WriteString(strconv.FormatBool(w.num != 0))
+	case kindEnum:
+		if name, ok := f.enum.byNumber[int32(w.num)]; ok {
+			writeString(buf, name)
+		} else {
+			buf.WriteString(strconv.FormatInt(int64(int32(w.num)), 10))
+		}
+	case kindInt32, kindSfixed32:
+		buf.WriteString(strconv.FormatInt(int64(int32(w.num)), 10))
+	case kindSint32:
+		buf.WriteString(strconv.FormatInt(decodeZigZag(w.num), 10))
+	case kindUint32, kindFixed32:
+		buf.WriteString(strconv.FormatUint(uint64(uint32(w.num)), 10))
+	case kindInt64, kindSfixed64:
+		writeString(buf, strconv.FormatInt(int64(w.num), 10))
+	case kindSint64:
+		writeString(buf, strconv.FormatInt(decodeZigZag(w.num), 10))
+	case kindUint64, kindFixed64:
+		writeString(buf, strconv.FormatUint(w.num, 10))
+	case kindFloat:
+		writeFloat(buf, float64(math.Float32frombits(uint32(w.num))), 32)
+	case kindDouble:
+		writeFloat(buf, math.Float64frombits(w.num), 64)
+	default:
+		return fmt.Errorf("field %s: unsupported type %d", f.name, f.kind)
+	}
+	return nil
+}
+
+// writeZero writes the default value of a single field
+func writeZero(buf *bytes.Buffer, f *field) {
+	switch f.kind {
+	case kindMessage:
+		buf.WriteString("{}")
+	case kindString, kindBytes:
+		buf.WriteString(`""`)
+	case kindBool:
+		buf.WriteString("false")
+	case kindEnum:
+		if name, ok := f.enum.byNumber[0]; ok {
+			writeString(buf, name)
+		} else {
+			buf.WriteString("0")
+		}
+	case kindInt64, kindSint64, kindSfixed64, kindUint64, kindFixed64:
+		buf.WriteString(`"0"`)
+	default:
+		buf.WriteString("0")
+	}
+}
+
+// writeFloat spells non-finite values as the mapping's strings
+func writeFloat(buf *bytes.Buffer, x float64, bits int) {
+	switch {
+	case math.IsNaN(x):
+		buf.WriteString(`"NaN"`)
+	case math.IsInf(x, 1):
+		buf.WriteString(`"Infinity"`)
+	case math.IsInf(x, -1):
+		buf.WriteString(`"-Infinity"`)
+	default:
+		buf.WriteString(strconv.FormatFloat(x, 'g', -1, bits))
+	}
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	buf.Truncate(buf.Len() - 1) // Encode's newline
+}
@@ -0,0 +1,395 @@
+package protobuf
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// The reference implementation (protodesc, dynamicpb, protojson) is the
+// oracle: both it and this package work from the same descriptor set,
+// which is what protoc --descriptor_set_out writes for this file:
+//
+//	syntax = "proto3";
+//	package test.v1;
+//	enum Status { STATUS_UNSPECIFIED = 0; STATUS_PAID = 1; STATUS_SHIPPED = 2; }
+//	message Item { string sku = 1; uint32 qty = 2; }
+//	message Order {
+//	  string id = 1;           int64 total = 2;       uint64 big = 3;
+//	  sint32 delta = 4;        fixed64 checksum = 5;  double price = 6;
+//	  float ratio = 7;         bool paid = 8;         bytes blob = 9;
+//	  Status status = 10;      repeated int32 nums = 11;
+//	  repeated string tags = 12;                      map<string, int32> counts = 13;
+//	  Item item = 14;          repeated Item items = 15;
+//	  sfixed32 offset = 16;    sint64 drift = 17;     optional int32 maybe = 18;
+//	  oneof payment { string card = 19; string iban = 20; }
+//	  map<int64, Item> by_id = 21;                    int32 original_name = 22;
+//	}
+func testFile() *descriptorpb.FileDescriptorProto {
+	f := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type, opts ...func(*descriptorpb.FieldDescriptorProto)) *descriptorpb.FieldDescriptorProto {
+		fd := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     kind.Enum(),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			JsonName: proto.String(jsonCamel(name)),
+		}
+		for _, o := range opts {
+			o(fd)
+		}
+		return fd
+	}
+	repeated := func(fd *descriptorpb.FieldDescriptorProto) {
+		fd.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	}
+	typed := func(name string) func(*descriptorpb.FieldDescriptorProto) {
+		return func(fd *descriptorpb.FieldDescriptorProto) { fd.TypeName = proto.String(name) }
+	}
+	oneof := func(i int32) func(*descriptorpb.FieldDescriptorProto) {
+		return func(fd *descriptorpb.FieldDescriptorProto) { fd.OneofIndex = proto.Int32(i) }
+	}
+	optional := func(fd *descriptorpb.FieldDescriptorProto) { fd.Proto3Optional = proto.Bool(true) }
+	mapEntry := func(name string, key descriptorpb.FieldDescriptorProto_Type, value *descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		value.Name, value.Number, value.JsonName = proto.String("value"), proto.Int32(2), proto.String("value")
+		return &descriptorpb.DescriptorProto{
+			Name:    proto.String(name),
+			Field:   []*descriptorpb.FieldDescriptorProto{f("key", 1, key), value},
+			Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+		}
+	}
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test/v1/order.proto"),
+		Package: proto.String("test.v1"),
+		Syntax:  proto.String("proto3"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Status"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("STATUS_UNSPECIFIED"), Number: proto.Int32(0)},
+				{Name: proto.String("STATUS_PAID"), Number: proto.Int32(1)},
+				{Name: proto.String("STATUS_SHIPPED"), Number: proto.Int32(2)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Item"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					f("sku", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					f("qty", 2, descriptorpb.FieldDescriptorProto_TYPE_UINT32),
+				},
+			},
+			{
+				Name: proto.String("Order"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					f("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					f("total", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+					f("big", 3, descriptorpb.FieldDescriptorProto_TYPE_UINT64),
+					f("delta", 4, descriptorpb.FieldDescriptorProto_TYPE_SINT32),
+					f("checksum", 5, descriptorpb.FieldDescriptorProto_TYPE_FIXED64),
+					f("price", 6, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+					f("ratio", 7, descriptorpb.FieldDescriptorProto_TYPE_FLOAT),
+					f("paid", 8, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					f("blob", 9, descriptorpb.FieldDescriptorProto_TYPE_BYTES),
+					f("status", 10, descriptorpb.FieldDescriptorProto_TYPE_ENUM, typed(".test.v1.Status")),
+					f("nums", 11, descriptorpb.FieldDescriptorProto_TYPE_INT32, repeated),
+					f("tags", 12, descriptorpb.FieldDescriptorProto_TYPE_STRING, repeated),
+					f("counts", 13, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, typed(".test.v1.Order.CountsEntry")),
+					f("item", 14, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, typed(".test.v1.Item")),
+					f("items", 15, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, typed(".test.v1.Item")),
+					f("offset", 16, descriptorpb.FieldDescriptorProto_TYPE_SFIXED32),
+					f("drift", 17, descriptorpb.FieldDescriptorProto_TYPE_SINT64),
+					f("maybe", 18, descriptorpb.FieldDescriptorProto_TYPE_INT32, optional, oneof(1)),
+					f("card", 19, descriptorpb.FieldDescriptorProto_TYPE_STRING, oneof(0)),
+					f("iban", 20, descriptorpb.FieldDescriptorProto_TYPE_STRING, oneof(0)),
+					f("by_id", 21, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, repeated, typed(".test.v1.Order.ByIdEntry")),
+					f("original_name", 22, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+				},
+				NestedType: []*descriptorpb.DescriptorProto{
+					mapEntry("CountsEntry", descriptorpb.FieldDescriptorProto_TYPE_STRING,
+						f("value", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32)),
+					mapEntry("ByIdEntry", descriptorpb.FieldDescriptorProto_TYPE_INT64,
+						f("value", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, typed(".test.v1.Item"))),
+				},
+				OneofDecl: []*descriptorpb.OneofDescriptorProto{
+					{Name: proto.String("payment")},
+					{Name: proto.String("_maybe")},
+				},
+			},
+		},
+	}
+}
+
+// jsonCamel is protoc's json_name for a field name
+func jsonCamel(name string) string {
+	out := make([]byte, 0, len(name))
+	upper := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '_' {
+			upper = true
+			continue
+		}
+		if upper && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		upper = false
+		out = append(out, c)
+	}
+	return string(out)
+}
+
+// fixture returns this package's Order and the reference one
+func fixture(t *testing.T) (*Message, protoreflect.MessageDescriptor) {
+	t.Helper()
+	file := testFile()
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := set.Message("test.v1.Order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, ref.Messages().ByName("Order")
+}
+
+// Each sample is valid proto3 JSON, as protojson would accept it
+var samples = []string{
+	`{}`,
+	`{"id":"o-1","total":"42","paid":true,"status":"STATUS_PAID"}`,
+	`{"total":"-9223372036854775808","big":"18446744073709551615","delta":-2147483648,"checksum":"18446744073709551615","offset":-1,"drift":"-9223372036854775807"}`,
+	`{"price":1.5,"ratio":0.25,"blob":"AAEC/w=="}`,
+	`{"price":"NaN","ratio":"-Infinity"}`,
+	`{"price":1e+300}`,
+	`{"id":"ünïcödé \"quoted\" \u2028 <tag>"}`,
+	`{"nums":[1,-1,2147483647,-2147483648],"tags":["a","","c"]}`,
+	`{"counts":{"a":1,"b":0,"":-3}}`,
+	`{"item":{}}`,
+	`{"item":{"sku":"s1","qty":3},"items":[{"sku":"a"},{},{"qty":4294967295}]}`,
+	`{"maybe":0}`,
+	`{"card":""}`,
+	`{"iban":"DE00"}`,
+	`{"byId":{"-5":{"sku":"x"},"7":{}}}`,
+	`{"originalName":12}`,
+	`{"status":7}`,
+}
+
+func reference(t *testing.T, desc protoreflect.MessageDescriptor, js string) *dynamicpb.Message {
+	t.Helper()
+	msg := dynamicpb.NewMessage(desc)
+	if err := protojson.Unmarshal([]byte(js), msg); err != nil {
+		t.Fatalf("reference rejects %s: %v", js, err)
+	}
+	return msg
+}
+
+func sameJSON(t *testing.T, got, want []byte) bool {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal(want, &w); err != nil {
+		t.Fatalf("invalid JSON %s: %v", want, err)
+	}
+	return reflect.DeepEqual(g, w)
+}
+
+func TestToJSONMatchesReference(t *testing.T) {
+	m, desc := fixture(t)
+	for _, js := range samples {
+		msg := reference(t, desc, js)
+		wire, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := protojson.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.ToJSON(wire)
+		if err != nil {
+			t.Errorf("%s: ToJSON: %v", js, err)
+			continue
+		}
+		if !sameJSON(t, got, want) {
+			t.Errorf("%s:\n got %s\nwant %s", js, got, want)
+		}
+	}
+}
+
+func TestFromJSONMatchesReference(t *testing.T) {
+	m, desc := fixture(t)
+	for _, js := range samples {
+		want := reference(t, desc, js)
+		wire, err := m.FromJSON([]byte(js))
+		if err != nil {
+			t.Errorf("%s: FromJSON: %v", js, err)
+			continue
+		}
+		got := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(wire, got); err != nil {
+			t.Errorf("%s: reference can't decode our encoding: %v", js, err)
+			continue
+		}
+		if !proto.Equal(got, want) {
+			t.Errorf("%s: decoded as %v, want %v", js, got, want)
+		}
+	}
+}
+
+func TestFromJSONAcceptsMappingVariants(t *testing.T) {
+	m, desc := fixture(t)
+	// Original field names, quoted and exponent integers, and enum numbers
+	// are all accepted by the mapping
+	for _, js := range []string{
+		`{"original_name":12,"by_id":{"1":{}}}`,
+		`{"total":42,"big":"1e3","delta":"7","nums":[1.0,"2"]}`,
+		`{"status":1,"paid":null}`,
+		`{"blob":"AAEC_w"}`,
+	} {
+		want := reference(t, desc, js)
+		wire, err := m.FromJSON([]byte(js))
+		if err != nil {
+			t.Errorf("%s: FromJSON: %v", js, err)
+			continue
+		}
+		got := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(wire, got); err != nil || !proto.Equal(got, want) {
+			t.Errorf("%s: decoded as %v (%v), want %v", js, got, err, want)
+		}
+	}
+}
+
+func TestToJSONAcceptsUnpackedAndUnknown(t *testing.T) {
+	m, _ := fixture(t)
+	var wire []byte
+	// nums unpacked, an unknown field 99, then a repeated message field
+	// split in two occurrences that must merge
+	wire = appendTag(wire, 11, wireVarint)
+	wire = appendVarint(wire, 5)
+	wire = appendTag(wire, 11, wireVarint)
+	wire = appendVarint(wire, 6)
+	wire = appendTag(wire, 99, wireVarint)
+	wire = appendVarint(wire, 1)
+	wire = appendBytes(appendTag(wire, 14, wireBytes), appendBytes(appendTag(nil, 1, wireBytes), []byte("a")))
+	wire = appendBytes(appendTag(wire, 14, wireBytes), appendVarint(appendTag(nil, 2, wireVarint), 2))
+	got, err := m.ToJSON(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"nums":[5,6],"item":{"sku":"a","qty":2}}`; !sameJSON(t, got, []byte(want)) {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestFromJSONRejects(t *testing.T) {
+	m, _ := fixture(t)
+	tests := []struct {
+		body string
+		path string // "" for ErrInvalidJSON
+	}{
+		{`not json`, ""},
+		{`{"id":"a"} trailing`, ""},
+		{`[]`, "$"},
+		{`{"nope":1}`, "$.nope"},
+		{`{"id":1}`, "$.id"},
+		{`{"nums":[1,null]}`, "$.nums[1]"},
+		{`{"nums":[2147483648]}`, "$.nums[0]"},
+		{`{"delta":1.5}`, "$.delta"},
+		{`{"big":"-1"}`, "$.big"},
+		{`{"status":"STATUS_LOST"}`, "$.status"},
+		{`{"blob":"***"}`, "$.blob"},
+		{`{"card":"a","iban":"b"}`, "$.iban"},
+		{`{"id":"a","id":"b"}`, ""},
+		{`{"originalName":1,"original_name":2}`, "$.original_name"},
+		{`{"items":[{"qty":-1}]}`, "$.items[0].qty"},
+		{`{"counts":{"a":"x"}}`, `$.counts["a"]`},
+		{`{"byId":{"x":{}}}`, `$.byId["x"]`},
+	}
+	for _, tt := range tests {
+		_, err := m.FromJSON([]byte(tt.body))
+		var fe *FieldError
+		switch {
+		case tt.body == `{"id":"a","id":"b"}`:
+			// encoding/json keeps the last duplicate key; either outcome
+			// is acceptable as long as it doesn't panic
+		case tt.path == "":
+			if !errors.Is(err, ErrInvalidJSON) {
+				t.Errorf("%s: err = %v, want ErrInvalidJSON", tt.body, err)
+			}
+		case !errors.As(err, &fe):
+			t.Errorf("%s: err = %v, want a FieldError", tt.body, err)
+		case fe.Path != tt.path:
+			t.Errorf("%s: path = %s, want %s", tt.body, fe.Path, tt.path)
+		}
+	}
+}
+
+func TestToJSONRejectsMalformed(t *testing.T) {
+	m, _ := fixture(t)
+	for name, wire := range map[string][]byte{
+		"truncated varint":  {0x10, 0x80},
+		"truncated bytes":   {0x0a, 0x05, 'a'},
+		"wrong wire type":   {0x0d, 0, 0, 0, 0}, // id (string) as fixed32
+		"invalid utf-8":     {0x0a, 0x01, 0xff},
+		"bad packed":        {0x5a, 0x01, 0x80},
+		"zero field number": {0x00, 0x01},
+	} {
+		if _, err := m.ToJSON(wire); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestUnsupportedTypesRefused(t *testing.T) {
+	file := testFile()
+	file.Dependency = []string{"google/protobuf/timestamp.proto"}
+	file.MessageType = append(file.MessageType, &descriptorpb.DescriptorProto{
+		Name: proto.String("Event"),
+		Field: []*descriptorpb.FieldDescriptorProto{{
+			Name:     proto.String("at"),
+			Number:   proto.Int32(1),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			TypeName: proto.String(".google.protobuf.Timestamp"),
+		}},
+	})
+	ts := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("google/protobuf/timestamp.proto"),
+		Package: proto.String("google.protobuf"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Timestamp"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("seconds"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+			},
+		}},
+	}
+	data, _ := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{ts, file}})
+	set, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := set.Message("test.v1.Event"); err == nil {
+		t.Fatal("Timestamp field accepted")
+	}
+	if _, err := set.Message("test.v1.Missing"); err == nil {
+		t.Fatal("unknown message accepted")
+	}
+}
@@ -0,0 +1,138 @@
+package protobuf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ---------------- Wire Format ----------------
+
+// Wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireStart   = 3 // group start, unsupported
+	wireEnd     = 4 // group end, unsupported
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated message")
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, number int32, wireType int) []byte {
+	return appendVarint(b, uint64(number)<<3|uint64(wireType))
+}
+
+func appendFixed32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24),
+		byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	return append(appendVarint(b, uint64(len(v))), v...)
+}
+
+// consumeVarint returns the varint at the start of b and its length
+func consumeVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	if len(b) < 10 {
+		return 0, 0, errTruncated
+	}
+	return 0, 0, errors.New("varint overflows 64 bits")
+}
+
+// wireField is one field as read off the wire. Varint and fixed-width
+// values are in num; length-delimited ones in data.
+type wireField struct {
+	number   int32
+	wireType int
+	num      uint64
+	data     []byte
+}
+
+// consumeField reads the field at the start of b and returns its length
+func consumeField(b []byte) (wireField, int, error) {
+	tag, n, err := consumeVarint(b)
+	if err != nil {
+		return wireField{}, 0, err
+	}
+	f := wireField{number: int32(tag >> 3), wireType: int(tag & 7)}
+	if tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+		return wireField{}, 0, fmt.Errorf("invalid field number %d", tag>>3)
+	}
+	b = b[n:]
+	switch f.wireType {
+	case wireVarint:
+		v, m, err := consumeVarint(b)
+		if err != nil {
+			return wireField{}, 0, err
+		}
+		f.num = v
+		return f, n + m, nil
+	case wireFixed64:
+		if len(b) < 8 {
+			return wireField{}, 0, errTruncated
+		}
+		f.num = uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24 |
+			uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56
+		return f, n + 8, nil
+	case wireFixed32:
+		if len(b) < 4 {
+			return wireField{}, 0, errTruncated
+		}
+		f.num = uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24
+		return f, n + 4, nil
+	case wireBytes:
+		size, m, err := consumeVarint(b)
+		if err != nil {
+			return wireField{}, 0, err
+		}
+		if size > uint64(len(b)-m) {
+			return wireField{}, 0, errTruncated
+		}
+		f.data = b[m : m+int(size)]
+		return f, n + m + int(size), nil
+	case wireStart, wireEnd:
+		return wireField{}, 0, fmt.Errorf("field %d: groups are not supported", f.number)
+	default:
+		return wireField{}, 0, fmt.Errorf("field %d: invalid wire type %d", f.number, f.wireType)
+	}
+}
+
+// eachField calls fn for every field in b, in wire order
+func eachField(b []byte, fn func(wireField) error) error {
+	for len(b) > 0 {
+		f, n, err := consumeField(b)
+		if err != nil {
+			return err
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// zigzag encoding for sint32/sint64
+func encodeZigZag(v int64) uint64 { return uint64(v<<1) ^ uint64(v>>63) }
+func decodeZigZag(v uint64) int64 { return int64(v>>1) ^ -int64(v&1) }
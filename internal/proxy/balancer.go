@@ -0,0 +1,414 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Load Balancing ----------------
+
+// Backend is one upstream replica
+type Backend struct {
+	URL    *url.URL
+	Weight int // relative share of traffic (values < 1 count as 1)
+}
+
+// Balancer picks the backend for each request. Implementations must be
+// safe for concurrent use.
+type Balancer interface {
+	Next(r *http.Request) *Backend
+}
+
+// BalancerConfig selects how requests are spread across backends
+type BalancerConfig struct {
+	Policy string // weighted_random (default), round_robin, least_conn or consistent_hash
+	HashOn string // consistent_hash key: ip (default), path, header:<Name> or cookie:<Name>
+}
+
+// NewBalancer builds the configured balancing policy over backends
+func NewBalancer(cfg BalancerConfig, backends []Backend) (Balancer, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no backends")
+	}
+	switch cfg.Policy {
+	case "", "weighted_random", "round_robin", "least_conn":
+	case "consistent_hash":
+		// Checked even for one backend so a bad key fails at startup
+		if _, err := hashKeyFunc(cfg.HashOn); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown balancer %q", cfg.Policy)
+	}
+	if len(backends) == 1 {
+		return single{&backends[0]}, nil
+	}
+	switch cfg.Policy {
+	case "round_robin":
+		return newRoundRobin(backends), nil
+	case "least_conn":
+		return newLeastConn(backends), nil
+	case "consistent_hash":
+		key, _ := hashKeyFunc(cfg.HashOn)
+		return newHashRing(backends, key), nil
+	default:
+		return newWeightedRandom(backends), nil
+	}
+}
+
+// HeaderSelect pins requests to a backend by the value of a request header,
+// ahead of the balancing policy (e.g. X-Prefer: fresh to an authoritative
+// tier)
+type HeaderSelect struct {
+	Header string
+	Values map[string]string // header value (case-insensitive) -> backend URL
+}
+
+// NewHeaderSelector builds a balancer that sends requests whose sel.Header
+// matches a configured value to that value's backend. Everything else is
+// balanced by policy over the backends no value is mapped to, or over all
+// of them if every backend is mapped.
+func NewHeaderSelector(cfg BalancerConfig, backends []Backend, sel HeaderSelect) (Balancer, error) {
+	pinned := make(map[string]*Backend, len(sel.Values))
+	mapped := make(map[int]bool, len(sel.Values))
+	for value, raw := range sel.Values {
+		i := backendIndex(backends, raw)
+		if i < 0 {
+			return nil, fmt.Errorf("%s=%s: not one of the upstream URLs", value, raw)
+		}
+		pinned[strings.ToLower(value)] = &backends[i]
+		mapped[i] = true
+	}
+
+	var rest []Backend
+	for i, b := range backends {
+		if !mapped[i] {
+			rest = append(rest, b)
+		}
+	}
+	if len(rest) == 0 {
+		rest = backends
+	}
+	fallback, err := NewBalancer(cfg, rest)
+	if err != nil {
+		return nil, err
+	}
+	return &headerSelector{header: sel.Header, pinned: pinned, fallback: fallback}, nil
+}
+
+func backendIndex(backends []Backend, raw string) int {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return -1
+	}
+	for i, b := range backends {
+		if b.URL.String() == u.String() {
+			return i
+		}
+	}
+	return -1
+}
+
+type headerSelector struct {
+	header   string
+	pinned   map[string]*Backend
+	fallback Balancer
+}
+
+func (s *headerSelector) Next(r *http.Request) *Backend {
+	if b, ok := s.pinned[strings.ToLower(strings.TrimSpace(r.Header.Get(s.header)))]; ok {
+		return b
+	}
+	return s.fallback.Next(r)
+}
+
+// single always returns its only backend
+type single struct {
+	b *Backend
+}
+
+func (s single) Next(*http.Request) *Backend { return s.b }
+
+// weightedRandom picks each request's backend independently with
+// probability proportional to its weight. Unlike round-robin this doesn't
+// synchronize with other gateway replicas, so load stays decorrelated.
+type weightedRandom struct {
+	backends []Backend
+	cum      []int // cumulative weights
+	total    int
+}
+
+func newWeightedRandom(backends []Backend) *weightedRandom {
+	w := &weightedRandom{backends: backends, cum: make([]int, len(backends))}
+	for i, b := range backends {
+		weight := b.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		w.total += weight
+		w.cum[i] = w.total
+	}
+	return w
+}
+
+func (w *weightedRandom) Next(*http.Request) *Backend {
+	// The package-level math/rand source is safe for concurrent use
+	n := rand.Intn(w.total)
+	i := sort.SearchInts(w.cum, n+1)
+	return &w.backends[i]
+}
+
+// roundRobin cycles through the backends in a fixed order, visiting each
+// in proportion to its weight. The order interleaves backends (smooth
+// weighted round-robin) rather than sending a backend's whole share in a
+// burst.
+type roundRobin struct {
+	order []*Backend
+	next  atomic.Uint64
+}
+
+func newRoundRobin(backends []Backend) *roundRobin {
+	weights := make([]int, len(backends))
+	current := make([]int, len(backends))
+	total := 0
+	for i, b := range backends {
+		weights[i] = max(b.Weight, 1)
+		total += weights[i]
+	}
+	rr := &roundRobin{order: make([]*Backend, 0, total)}
+	for n := 0; n < total; n++ {
+		best := 0
+		for i := range current {
+			current[i] += weights[i]
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		rr.order = append(rr.order, &backends[best])
+	}
+	return rr
+}
+
+func (rr *roundRobin) Next(*http.Request) *Backend {
+	n := rr.next.Add(1) - 1
+	return rr.order[n%uint64(len(rr.order))]
+}
+
+// leastConn sends each request to the backend with the fewest attempts in
+// flight relative to its weight, so slow replicas stop getting new work
+// while they're backed up. Attempts are counted by inflightTransport.
+type leastConn struct {
+	backends []Backend
+	active   map[string]*atomic.Int64 // attempts in flight by host
+}
+
+func newLeastConn(backends []Backend) *leastConn {
+	lc := &leastConn{backends: backends, active: make(map[string]*atomic.Int64, len(backends))}
+	for _, b := range backends {
+		lc.active[b.URL.Host] = new(atomic.Int64)
+	}
+	return lc
+}
+
+func (lc *leastConn) Next(*http.Request) *Backend {
+	// Start at a random backend so ties (an idle route) are spread evenly
+	start := rand.Intn(len(lc.backends))
+	var best *Backend
+	var bestActive, bestWeight int64
+	for i := range lc.backends {
+		b := &lc.backends[(start+i)%len(lc.backends)]
+		active, weight := lc.active[b.URL.Host].Load(), int64(max(b.Weight, 1))
+		// Fewer in flight per unit of weight wins: a/w < best/bestW
+		if best == nil || active*bestWeight < bestActive*weight {
+			best, bestActive, bestWeight = b, active, weight
+		}
+	}
+	return best
+}
+
+// begin counts an attempt to host until the returned func is called.
+// Hosts outside the balancer (a pinned header value) aren't counted.
+func (lc *leastConn) begin(host string) func() {
+	n, ok := lc.active[host]
+	if !ok {
+		return func() {}
+	}
+	n.Add(1)
+	var once sync.Once
+	return func() { once.Do(func() { n.Add(-1) }) }
+}
+
+// leastConnOf finds the least_conn policy behind b, if any
+func leastConnOf(b Balancer) *leastConn {
+	switch b := b.(type) {
+	case *leastConn:
+		return b
+	case *headerSelector:
+		return leastConnOf(b.fallback)
+	case *outlierBalancer:
+		return leastConnOf(b.next)
+	}
+	return nil
+}
+
+// inflightTransport sits below the retry layer so least_conn sees every
+// attempt. An attempt stays in flight until its response body is closed.
+type inflightTransport struct {
+	next http.RoundTripper
+	lc   *leastConn
+}
+
+func (t *inflightTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	done := t.lc.begin(req.URL.Host)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.Body == nil || resp.Body == http.NoBody {
+		done()
+		return resp, err
+	}
+	// Upgraded connections need their body to stay writable
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+		resp.Body = &inflightConn{ReadWriteCloser: rwc, done: done}
+	} else {
+		resp.Body = &inflightBody{ReadCloser: resp.Body, done: done}
+	}
+	return resp, nil
+}
+
+type inflightBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *inflightBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+type inflightConn struct {
+	io.ReadWriteCloser
+	done func()
+}
+
+func (c *inflightConn) Close() error {
+	c.done()
+	return c.ReadWriteCloser.Close()
+}
+
+// hashRing maps each request's key onto a ring of backend points, so a
+// given client keeps reaching the same replica (warm caches, sticky
+// sessions) and adding or removing a replica only moves the keys next to
+// its points. Requests without a key are spread by weight instead.
+type hashRing struct {
+	points   []uint64 // sorted
+	owners   []*Backend
+	key      func(*http.Request) string
+	fallback *weightedRandom
+}
+
+// hashPoints is the number of ring points per unit of weight; more points
+// spread keys more evenly
+const hashPoints = 100
+
+func newHashRing(backends []Backend, key func(*http.Request) string) *hashRing {
+	type point struct {
+		hash  uint64
+		owner *Backend
+	}
+	var points []point
+	for i := range backends {
+		b := &backends[i]
+		for n := 0; n < hashPoints*max(b.Weight, 1); n++ {
+			points = append(points, point{hash64(b.URL.String() + "#" + strconv.Itoa(n)), b})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	h := &hashRing{key: key, fallback: newWeightedRandom(backends)}
+	for _, p := range points {
+		h.points = append(h.points, p.hash)
+		h.owners = append(h.owners, p.owner)
+	}
+	return h
+}
+
+func (h *hashRing) Next(r *http.Request) *Backend {
+	key := h.key(r)
+	if key == "" {
+		return h.fallback.Next(r)
+	}
+	// The first point at or after the key's hash, wrapping around
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= hash64(key) })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[i]
+}
+
+// hash64 is FNV-1a finished with a 64-bit mixer, since FNV alone clusters
+// similar keys such as a backend's numbered points
+func hash64(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	x := f.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// hashKeyFunc parses a consistent_hash key: ip (the client IP), path,
+// header:<Name> or cookie:<Name>
+func hashKeyFunc(on string) (func(*http.Request) string, error) {
+	kind, name, _ := strings.Cut(on, ":")
+	switch strings.ToLower(kind) {
+	case "", "ip":
+		return middleware.ExtractClientIP, nil
+	case "path":
+		return func(r *http.Request) string { return r.URL.Path }, nil
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("hash key %q: missing header name", on)
+		}
+		return func(r *http.Request) string { return r.Header.Get(name) }, nil
+	case "cookie":
+		if name == "" {
+			return nil, fmt.Errorf("hash key %q: missing cookie name", on)
+		}
+		return func(r *http.Request) string {
+			c, err := r.Cookie(name)
+			if err != nil {
+				return ""
+			}
+			return c.Value
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown hash key %q (want ip, path, header:<Name> or cookie:<Name>)", on)
+	}
+}
+
+// nextOther picks a backend for r other than the one at host. A balancer
+// that keeps returning host (a pinned header value, or weights heavily
+// skewed towards it) gets a few chances before host is used again.
+func nextOther(b Balancer, r *http.Request, host string) *Backend {
+	var next *Backend
+	for i := 0; i < 8; i++ {
+		if next = b.Next(r); next.URL.Host != host {
+			break
+		}
+	}
+	return next
+}
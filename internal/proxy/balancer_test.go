@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func testBackends(weights ...int) []Backend {
+	backends := make([]Backend, len(weights))
+	for i, w := range weights {
+		backends[i] = Backend{URL: &url.URL{Scheme: "http", Host: fmt.Sprintf("10.0.0.%d:80", i+1)}, Weight: w}
+	}
+	return backends
+}
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	backends := testBackends(1, 2, 7)
+	b, err := NewBalancer(BalancerConfig{Policy: "weighted_random"}, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers, perWorker = 8, 25000
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := make(map[string]int)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for i := 0; i < perWorker; i++ {
+				local[b.Next(req).URL.Host]++
+			}
+			mu.Lock()
+			for host, n := range local {
+				counts[host] += n
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, be := range backends {
+		got := float64(counts[be.URL.Host]) / (workers * perWorker)
+		want := float64(be.Weight) / 10
+		if math.Abs(got-want) > 0.01 {
+			t.Errorf("%s (weight %d) got %.3f of requests, want %.2f±0.01", be.URL.Host, be.Weight, got, want)
+		}
+	}
+}
+
+func TestLeastConnPicksFewestInFlightPerWeight(t *testing.T) {
+	backends := testBackends(1, 1, 2)
+	b, err := NewBalancer(BalancerConfig{Policy: "least_conn"}, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := leastConnOf(b)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	hosts := func(i int) string { return backends[i].URL.Host }
+
+	doneA := lc.begin(hosts(0))
+	lc.begin(hosts(1))
+	lc.begin(hosts(2))
+	// a, b: 1 per weight; c: 1 over weight 2
+	for i := 0; i < 20; i++ {
+		if got := b.Next(req).URL.Host; got != hosts(2) {
+			t.Fatalf("picked %s, want the weight 2 backend with half the load", got)
+		}
+	}
+	doneA()
+	doneA() // done is idempotent
+	if got := b.Next(req).URL.Host; got != hosts(0) {
+		t.Fatalf("picked %s, want the idle backend", got)
+	}
+	if n := lc.active[hosts(0)].Load(); n != 0 {
+		t.Fatalf("%d in flight after done, want 0", n)
+	}
+}
+
+func TestLeastConnAvoidsBusyReplica(t *testing.T) {
+	hold := make(chan struct{})
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Hold") != "" {
+				w.WriteHeader(http.StatusOK)
+				w.(http.Flusher).Flush()
+				<-hold
+			}
+			io.WriteString(w, name)
+		}))
+	}
+	a, b := newUpstream("a"), newUpstream("b")
+	defer a.Close()
+	defer b.Close()
+	ua, _ := url.Parse(a.URL)
+	ub, _ := url.Parse(b.URL)
+	rp, err := NewBalancedProxy([]Backend{{URL: ua, Weight: 1}, {URL: ub, Weight: 1}},
+		Config{Attempts: 1, Balancer: BalancerConfig{Policy: "least_conn"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := httptest.NewServer(rp)
+	defer gw.Close()
+
+	// A streaming response keeps its replica busy until the body is done
+	req, _ := http.NewRequest(http.MethodGet, gw.URL, nil)
+	req.Header.Set("X-Hold", "1")
+	held, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		resp, err := http.Get(gw.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		counts[string(body)]++
+	}
+	close(hold)
+	heldBody, _ := io.ReadAll(held.Body)
+	held.Body.Close()
+
+	busy := string(heldBody)
+	if counts[busy] != 0 {
+		t.Fatalf("%d of 10 requests went to busy replica %s: %v", counts[busy], busy, counts)
+	}
+}
+
+func TestConsistentHashSticksAndSpreads(t *testing.T) {
+	backends := testBackends(1, 1, 2)
+	b, err := NewBalancer(BalancerConfig{Policy: "consistent_hash", HashOn: "header:X-User-ID"}, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keys = 20000
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User-ID", fmt.Sprintf("user-%d", i))
+		first := b.Next(req).URL.Host
+		for j := 0; j < 3; j++ {
+			if again := b.Next(req).URL.Host; again != first {
+				t.Fatalf("user-%d moved from %s to %s", i, first, again)
+			}
+		}
+		counts[first]++
+	}
+	for _, be := range backends {
+		got := float64(counts[be.URL.Host]) / keys
+		want := float64(be.Weight) / 4
+		if math.Abs(got-want) > 0.05 {
+			t.Errorf("%s (weight %d) owns %.3f of keys, want %.2f±0.05", be.URL.Host, be.Weight, got, want)
+		}
+	}
+
+	// Keyless requests are spread rather than piled on one replica
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		seen[b.Next(httptest.NewRequest(http.MethodGet, "/", nil)).URL.Host] = true
+	}
+	if len(seen) != len(backends) {
+		t.Errorf("requests without the key reached %d of %d backends", len(seen), len(backends))
+	}
+}
+
+func TestConsistentHashAddingReplicaMovesFewKeys(t *testing.T) {
+	before, _ := NewBalancer(BalancerConfig{Policy: "consistent_hash", HashOn: "path"}, testBackends(1, 1, 1))
+	grown := testBackends(1, 1, 1, 1)
+	after, _ := NewBalancer(BalancerConfig{Policy: "consistent_hash", HashOn: "path"}, grown)
+	added := grown[3].URL.Host
+
+	const keys = 20000
+	moved := 0
+	for i := 0; i < keys; i++ {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/items/%d", i), nil)
+		from, to := before.Next(req).URL.Host, after.Next(req).URL.Host
+		if from == to {
+			continue
+		}
+		moved++
+		if to != added {
+			t.Fatalf("%s moved from %s to %s, an existing replica", req.URL.Path, from, to)
+		}
+	}
+	// Ideally a quarter of the keys move, all to the new replica
+	if share := float64(moved) / keys; math.Abs(share-0.25) > 0.05 {
+		t.Errorf("%.3f of keys moved, want about 0.25", share)
+	}
+}
+
+func TestHashKeys(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/a/b?x=1", nil)
+	req.RemoteAddr = "192.0.2.7:5555"
+	req.Header.Set("X-Tenant", "acme")
+	req.AddCookie(&http.Cookie{Name: "sid", Value: "s1"})
+	for on, want := range map[string]string{
+		"":                "192.0.2.7",
+		"ip":              "192.0.2.7",
+		"path":            "/a/b",
+		"header:X-Tenant": "acme",
+		"cookie:sid":      "s1",
+		"cookie:missing":  "",
+	} {
+		key, err := hashKeyFunc(on)
+		if err != nil {
+			t.Fatalf("%q: %v", on, err)
+		}
+		if got := key(req); got != want {
+			t.Errorf("%q: key %q, want %q", on, got, want)
+		}
+	}
+	for _, on := range []string{"header:", "cookie", "query:x"} {
+		if _, err := NewBalancer(BalancerConfig{Policy: "consistent_hash", HashOn: on}, testBackends(1)); err == nil {
+			t.Errorf("hash key %q accepted", on)
+		}
+	}
+}
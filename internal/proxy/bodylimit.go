@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Response Size Limit ----------------
+
+var errResponseTooLarge = errors.New("upstream response body exceeds limit")
+
+// limitResponse enforces a maximum upstream body size. Responses that
+// declare a larger Content-Length are rejected up front (502); streamed
+// bodies are cut off at the limit, which aborts the client connection so
+// the truncation is visible rather than silently accepted.
+func limitResponse(resp *http.Response, limit int64) error {
+	if limit <= 0 || resp.Body == nil {
+		return nil
+	}
+	if resp.ContentLength > limit {
+		resp.Body.Close()
+		return fmt.Errorf("%w: content-length %d > %d", errResponseTooLarge, resp.ContentLength, limit)
+	}
+	resp.Body = &limitedBody{rc: resp.Body, remaining: limit, limit: limit, req: resp.Request}
+	return nil
+}
+
+type limitedBody struct {
+	rc        io.ReadCloser
+	remaining int64
+	limit     int64
+	req       *http.Request
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Only an error if the upstream actually has more to send
+		var one [1]byte
+		if n, _ := b.rc.Read(one[:]); n == 0 {
+			return 0, io.EOF
+		}
+		logger.Log.Error("upstream_response_truncated",
+			slog.String("request_id", middleware.GetRequestID(b.req)),
+			slog.String("upstream", b.req.URL.Host),
+			slog.String("method", b.req.Method),
+			slog.String("path", b.req.URL.Path),
+			slog.Int64("limit_bytes", b.limit),
+		)
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.rc.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.rc.Close()
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Circuit Breaker ----------------
+
+// errCircuitOpen is returned without contacting the upstream
+var errCircuitOpen = errors.New("circuit open")
+
+// BreakerConfig controls the per-host circuit breaker. The failure and
+// latency conditions are independent: either one opens the circuit.
+type BreakerConfig struct {
+	Threshold int           // consecutive failed requests that open the circuit (0 disables)
+	Cooldown  time.Duration // how long the circuit stays open before a probe is let through
+
+	// The circuit also opens when the LatencyPercentile (e.g. 0.99) of
+	// requests completed within the last LatencyWindow exceeds
+	// LatencyThreshold, once the window holds LatencyMinRequests. Only a
+	// request's last attempt is timed, up to its response headers. A
+	// half-open probe slower than the threshold counts as failed. Zero
+	// LatencyThreshold disables it. LatencyMinRequests below
+	// 1/(1-LatencyPercentile) lets a single slow request open the circuit.
+	LatencyThreshold   time.Duration
+	LatencyPercentile  float64
+	LatencyWindow      time.Duration
+	LatencyMinRequests int
+}
+
+// maxLatencySamples bounds the samples kept per host; beyond it the oldest
+// are dropped early, so a busy host is judged on its most recent requests
+const maxLatencySamples = 4096
+
+type latencySample struct {
+	at   time.Time
+	slow bool // above LatencyThreshold
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuit tracks one upstream host
+type circuit struct {
+	state    circuitState
+	failures int       // consecutive, while closed
+	openedAt time.Time // while open
+	probing  bool      // a half-open probe is in flight
+
+	// Latency samples within the window, oldest first, while closed
+	samples []latencySample
+	slow    int
+}
+
+// attemptLatency carries the time to response headers of a request's
+// last upstream attempt from below the retry layer up to the breaker, so
+// backoff sleeps between retries don't count as upstream latency
+type attemptLatency struct {
+	d   time.Duration
+	set bool
+}
+
+type attemptLatencyKey struct{}
+
+// attemptTimer times each attempt for the breaker; it is only installed
+// when the breaker judges latency
+type attemptTimer struct {
+	next http.RoundTripper
+}
+
+func (t *attemptTimer) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if l, ok := req.Context().Value(attemptLatencyKey{}).(*attemptLatency); ok {
+		l.d, l.set = time.Since(start), true
+	}
+	return resp, err
+}
+
+// record adds a completed request's latency and reports whether the
+// window's percentile now exceeds the threshold
+func (c *circuit) record(cfg BreakerConfig, now time.Time, d time.Duration) bool {
+	sample := latencySample{at: now, slow: d > cfg.LatencyThreshold}
+	if sample.slow {
+		c.slow++
+	}
+	c.samples = append(c.samples, sample)
+
+	drop := 0
+	for drop < len(c.samples) && (now.Sub(c.samples[drop].at) > cfg.LatencyWindow || len(c.samples)-drop > maxLatencySamples) {
+		if c.samples[drop].slow {
+			c.slow--
+		}
+		drop++
+	}
+	c.samples = c.samples[drop:]
+
+	n := len(c.samples)
+	if n < cfg.LatencyMinRequests {
+		return false
+	}
+	// The percentile is above the threshold when fewer than
+	// ceil(percentile*n) samples are at or below it
+	return n-c.slow < int(math.Ceil(cfg.LatencyPercentile*float64(n)))
+}
+
+func (c *circuit) resetLatency() {
+	c.samples = nil
+	c.slow = 0
+}
+
+// breakerTransport sits outside the retry layer, so a request counts once
+// no matter how many attempts it took. While a host's circuit is open,
+// requests fail immediately instead of spending the retry budget on it.
+type breakerTransport struct {
+	next http.RoundTripper
+	cfg  BreakerConfig
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+func newBreakerTransport(next http.RoundTripper, cfg BreakerConfig) *breakerTransport {
+	return &breakerTransport{next: next, cfg: cfg, circuits: make(map[string]*circuit)}
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	probe, ok := t.acquire(host, time.Now())
+	if !ok {
+		logger.Log.Debug("circuit_rejected",
+			slog.String("request_id", middleware.GetRequestID(req)),
+			slog.String("upstream", host),
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+		)
+		return nil, fmt.Errorf("%w for %s", errCircuitOpen, host)
+	}
+
+	latency := &attemptLatency{}
+	if t.cfg.LatencyThreshold > 0 {
+		req = req.WithContext(context.WithValue(req.Context(), attemptLatencyKey{}, latency))
+	}
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && classifyError(err) == ErrClassCanceled:
+		// The client gave up; that says nothing about the upstream
+		t.release(host, probe)
+	case err != nil || resp.StatusCode >= 500:
+		t.failure(host, probe)
+	case latency.set && t.tooSlow(host, probe, latency.d):
+		// The circuit was opened
+	default:
+		t.success(host, probe)
+	}
+	return resp, err
+}
+
+// acquire reports whether a request to host may proceed, and whether it is
+// the single probe of a half-open circuit
+func (t *breakerTransport) acquire(host string, now time.Time) (probe, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, found := t.circuits[host]
+	if !found {
+		c = &circuit{}
+		t.circuits[host] = c
+	}
+	switch c.state {
+	case circuitOpen:
+		if now.Sub(c.openedAt) < t.cfg.Cooldown {
+			return false, false
+		}
+		c.state = circuitHalfOpen
+		fallthrough
+	case circuitHalfOpen:
+		if c.probing {
+			return false, false
+		}
+		c.probing = true
+		return true, true
+	}
+	return false, true
+}
+
+func (t *breakerTransport) release(host string, probe bool) {
+	if !probe {
+		return
+	}
+	t.mu.Lock()
+	t.circuits[host].probing = false
+	t.mu.Unlock()
+}
+
+func (t *breakerTransport) failure(host string, probe bool) {
+	t.mu.Lock()
+	c := t.circuits[host]
+	if probe {
+		c.probing = false
+	}
+	// Requests admitted before the circuit opened may still be finishing
+	if c.state == circuitOpen {
+		t.mu.Unlock()
+		return
+	}
+	c.failures++
+	if !probe && (t.cfg.Threshold == 0 || c.failures < t.cfg.Threshold) {
+		t.mu.Unlock()
+		return
+	}
+	failures := c.failures
+	t.open(c)
+	t.mu.Unlock()
+
+	logger.Log.Warn("circuit_opened",
+		slog.String("upstream", host),
+		slog.String("reason", "failures"),
+		slog.Int("failures", failures),
+		slog.String("cooldown", t.cfg.Cooldown.String()),
+	)
+}
+
+// tooSlow records a successful request's latency and opens the circuit if
+// the host has become too slow: a slow half-open probe, or a percentile
+// over the threshold while closed. It reports whether it opened it.
+func (t *breakerTransport) tooSlow(host string, probe bool, d time.Duration) bool {
+	t.mu.Lock()
+	c := t.circuits[host]
+	var requests, slow int
+	switch {
+	case probe:
+		if d <= t.cfg.LatencyThreshold {
+			t.mu.Unlock()
+			return false
+		}
+		c.probing = false
+		requests, slow = 1, 1
+	case c.state == circuitClosed && c.record(t.cfg, time.Now(), d):
+		requests, slow = len(c.samples), c.slow
+	default:
+		t.mu.Unlock()
+		return false
+	}
+	t.open(c)
+	t.mu.Unlock()
+
+	logger.Log.Warn("circuit_opened",
+		slog.String("upstream", host),
+		slog.String("reason", "latency"),
+		slog.Int("requests", requests),
+		slog.Int("slow", slow),
+		slog.String("threshold", t.cfg.LatencyThreshold.String()),
+		slog.String("cooldown", t.cfg.Cooldown.String()),
+	)
+	return true
+}
+
+// open moves c to open; the caller holds t.mu. Latency is judged afresh
+// once the circuit closes again.
+func (t *breakerTransport) open(c *circuit) {
+	c.state = circuitOpen
+	c.openedAt = time.Now()
+	c.resetLatency()
+}
+
+func (t *breakerTransport) success(host string, probe bool) {
+	t.mu.Lock()
+	c := t.circuits[host]
+	if probe {
+		c.probing = false
+	}
+	c.failures = 0
+	if c.state == circuitClosed || !probe {
+		t.mu.Unlock()
+		return
+	}
+	c.state = circuitClosed
+	t.mu.Unlock()
+
+	logger.Log.Info("circuit_closed",
+		slog.String("upstream", host),
+	)
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubTransport answers every request with status after delay
+type stubTransport struct {
+	status int
+	delay  time.Duration
+	calls  int
+}
+
+func (t *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	time.Sleep(t.delay)
+	return &http.Response{StatusCode: t.status, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func breakerGet(t *testing.T, rt http.RoundTripper) error {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "http://upstream/", nil)
+	resp, err := rt.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestBreakerFailureThreshold(t *testing.T) {
+	up := &stubTransport{status: http.StatusBadGateway}
+	b := newBreakerTransport(up, BreakerConfig{Threshold: 3, Cooldown: time.Hour})
+	for i := 0; i < 3; i++ {
+		if err := breakerGet(t, b); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if err := breakerGet(t, b); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("after 3 failures: err = %v, want circuit open", err)
+	}
+	if up.calls != 3 {
+		t.Fatalf("upstream called %d times, want 3", up.calls)
+	}
+}
+
+func TestBreakerFailureCountResetsOnSuccess(t *testing.T) {
+	up := &stubTransport{status: http.StatusBadGateway}
+	b := newBreakerTransport(up, BreakerConfig{Threshold: 3, Cooldown: time.Hour})
+	for i := 0; i < 10; i++ {
+		up.status = http.StatusBadGateway
+		if i%3 == 2 {
+			up.status = http.StatusOK
+		}
+		if err := breakerGet(t, b); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	cfg := BreakerConfig{LatencyThreshold: 100 * time.Millisecond, LatencyPercentile: 0.9, LatencyWindow: time.Minute, LatencyMinRequests: 10}
+	tests := []struct {
+		fast, slow int
+		open       bool
+	}{
+		{fast: 9, slow: 0},             // below the minimum
+		{fast: 8, slow: 1},             // below the minimum, though slow
+		{fast: 9, slow: 1},             // p90 is the 9th fastest: fast
+		{fast: 8, slow: 2, open: true}, // p90 is slow
+		{fast: 90, slow: 10},
+		{fast: 89, slow: 11, open: true},
+	}
+	for _, tt := range tests {
+		c := &circuit{}
+		now := time.Now()
+		var open bool
+		for i := 0; i < tt.fast; i++ {
+			open = c.record(cfg, now, 10*time.Millisecond)
+		}
+		for i := 0; i < tt.slow; i++ {
+			open = c.record(cfg, now, time.Second)
+		}
+		if open != tt.open {
+			t.Errorf("%d fast, %d slow: open = %v, want %v", tt.fast, tt.slow, open, tt.open)
+		}
+	}
+}
+
+func TestLatencyWindowExpires(t *testing.T) {
+	cfg := BreakerConfig{LatencyThreshold: 100 * time.Millisecond, LatencyPercentile: 0.5, LatencyWindow: time.Second, LatencyMinRequests: 2}
+	c := &circuit{}
+	start := time.Now()
+	c.record(cfg, start, time.Second)
+	// The slow sample has left the window by the time the second arrives
+	if c.record(cfg, start.Add(2*time.Second), time.Second) {
+		t.Fatal("opened on samples outside the window")
+	}
+	if c.record(cfg, start.Add(2*time.Second), time.Second) != true {
+		t.Fatal("didn't open on two slow samples in the window")
+	}
+}
+
+func TestBreakerLatencyOpensAndProbes(t *testing.T) {
+	up := &stubTransport{status: http.StatusOK, delay: 30 * time.Millisecond}
+	b := newBreakerTransport(&attemptTimer{next: up}, BreakerConfig{
+		Cooldown:           50 * time.Millisecond,
+		LatencyThreshold:   20 * time.Millisecond,
+		LatencyPercentile:  0.5,
+		LatencyWindow:      time.Minute,
+		LatencyMinRequests: 2,
+	})
+	breakerGet(t, b)
+	breakerGet(t, b)
+	if err := breakerGet(t, b); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("slow upstream: err = %v, want circuit open", err)
+	}
+
+	// A slow probe reopens the circuit, a fast one closes it
+	time.Sleep(60 * time.Millisecond)
+	breakerGet(t, b)
+	if err := breakerGet(t, b); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("after slow probe: err = %v, want circuit open", err)
+	}
+	up.delay = 0
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := breakerGet(t, b); err != nil {
+			t.Fatalf("after fast probe: %v", err)
+		}
+	}
+}
+
+// backoffTransport sleeps before each of its two attempts, standing in
+// for the retry layer's backoff
+type backoffTransport struct {
+	next  http.RoundTripper
+	sleep time.Duration
+}
+
+func (t *backoffTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	for i := 0; i < 2; i++ {
+		time.Sleep(t.sleep)
+		resp, err = t.next.RoundTrip(req)
+	}
+	return resp, err
+}
+
+func TestBreakerLatencyIgnoresRetryBackoff(t *testing.T) {
+	up := &stubTransport{status: http.StatusOK}
+	b := newBreakerTransport(&backoffTransport{next: &attemptTimer{next: up}, sleep: 30 * time.Millisecond}, BreakerConfig{
+		Cooldown:           time.Hour,
+		LatencyThreshold:   20 * time.Millisecond,
+		LatencyPercentile:  0.5,
+		LatencyWindow:      time.Minute,
+		LatencyMinRequests: 1,
+	})
+	for i := 0; i < 3; i++ {
+		if err := breakerGet(t, b); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Response Cache ----------------
+
+const (
+	defaultCacheEntries = 1000
+	defaultCacheBytes   = 1 << 20
+)
+
+// Cache answers repeated GETs from memory while the stored response is
+// fresh. TTL is the freshness when the upstream gives none; an upstream
+// max-age (or s-maxage, for shared entries) overrides it per response.
+//
+// By default only anonymous requests are cached, and responses marked
+// private are not kept. Private also caches requests from authenticated
+// callers (verified JWT subject or API key) under their identity, which
+// is the only place Cache-Control: private responses are kept; such
+// entries are never served to another identity or to anonymous callers.
+type Cache struct {
+	TTL        time.Duration
+	MaxEntries int   // least recently used entries are evicted beyond this
+	MaxBytes   int64 // larger bodies are relayed but not kept
+	Private    bool
+
+	// CredentialHeaders are request headers, besides Authorization and
+	// Cookie, that carry credentials, e.g. the API key header. Requests
+	// with them bypass the cache unless they're cached per identity.
+	CredentialHeaders []string
+}
+
+// cacheTransport sits below stale-if-error and the fallback, so their
+// stand-in responses are never cached as fresh ones
+type cacheTransport struct {
+	next       http.RoundTripper
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+	private    bool
+	creds      []string
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newCacheTransport(next http.RoundTripper, cfg Cache) *cacheTransport {
+	t := &cacheTransport{
+		next:       next,
+		ttl:        cfg.TTL,
+		maxEntries: cfg.MaxEntries,
+		maxBytes:   cfg.MaxBytes,
+		private:    cfg.Private,
+		creds:      append([]string{"Authorization", "Cookie"}, cfg.CredentialHeaders...),
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+	if t.maxEntries <= 0 {
+		t.maxEntries = defaultCacheEntries
+	}
+	if t.maxBytes <= 0 {
+		t.maxBytes = defaultCacheBytes
+	}
+	return t
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, identity, ok := t.key(req)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	if hit := t.lookup(req, key); hit != nil {
+		return hit, nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set("X-Cache", "MISS")
+	if fresh, ok := t.storable(resp, identity); ok {
+		resp.Body = &staleCapture{
+			ReadCloser: resp.Body,
+			limit:      t.maxBytes,
+			done: func(body []byte) {
+				now := time.Now()
+				t.store(&cacheEntry{
+					key:     key,
+					status:  resp.StatusCode,
+					header:  resp.Header.Clone(),
+					body:    body,
+					stored:  now,
+					expires: now.Add(fresh),
+				})
+			},
+		}
+	}
+	return resp, nil
+}
+
+// key identifies a cached response and the identity it belongs to ("" for
+// shared entries), or reports that req must go to the upstream
+func (t *cacheTransport) key(req *http.Request) (key, identity string, ok bool) {
+	if req.Method != http.MethodGet {
+		return "", "", false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return "", "", false
+	}
+	identity = cacheIdentity(req)
+	if identity != "" && !t.private {
+		return "", "", false
+	}
+	// Credentials the gateway didn't verify could change the response in
+	// ways the key can't capture
+	if identity == "" {
+		for _, h := range t.creds {
+			if req.Header.Get(h) != "" {
+				return "", "", false
+			}
+		}
+	}
+	// A stored gzip body must only go to clients that asked for gzip
+	return identity + "\n" + canonicalURL(req) + "\n" + req.Header.Get("Accept-Encoding"), identity, true
+}
+
+// canonicalURL is the part of a stored response's key naming the resource.
+// Equivalent spellings of the upstream host share entries.
+func canonicalURL(req *http.Request) string {
+	u := *req.URL
+	u.Host = middleware.CanonicalHost(u.Host, u.Scheme)
+	return u.String()
+}
+
+// cacheIdentity names the caller the gateway authenticated, "" for
+// anonymous requests. Prefixes keep key IDs and subjects apart.
+func cacheIdentity(req *http.Request) string {
+	if key, ok := middleware.GetAPIKey(req); ok {
+		return "apikey:" + key.ID
+	}
+	if sub, ok := middleware.GetClaims(req)["sub"].(string); ok && sub != "" {
+		return "sub:" + sub
+	}
+	return ""
+}
+
+// storable reports whether resp may be cached, and for how long it stays
+// fresh
+func (t *cacheTransport) storable(resp *http.Response, identity string) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusOK || resp.ContentLength > t.maxBytes {
+		return 0, false
+	}
+	if len(resp.Header.Values("Set-Cookie")) > 0 {
+		return 0, false
+	}
+	// The key only covers Accept-Encoding, so responses varying on
+	// anything else can't be told apart
+	for _, v := range resp.Header.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" && !strings.EqualFold(h, "Accept-Encoding") {
+				return 0, false
+			}
+		}
+	}
+	fresh, shared := t.ttl, time.Duration(-1)
+	for _, v := range resp.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(d), "=")
+			secs, err := strconv.Atoi(strings.Trim(val, `"`))
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache":
+				return 0, false
+			case "private":
+				if identity == "" {
+					return 0, false
+				}
+			case "max-age":
+				if err == nil && secs >= 0 {
+					fresh = time.Duration(secs) * time.Second
+				}
+			case "s-maxage":
+				if err == nil && secs >= 0 {
+					shared = time.Duration(secs) * time.Second
+				}
+			}
+		}
+	}
+	// s-maxage only applies to entries shared between callers
+	if identity == "" && shared >= 0 {
+		fresh = shared
+	}
+	return fresh, fresh > 0
+}
+
+func (t *cacheTransport) store(e *cacheEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.entries[e.key]; ok {
+		t.order.Remove(el)
+	}
+	t.entries[e.key] = t.order.PushFront(e)
+	for t.order.Len() > t.maxEntries {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// lookup builds a response from the entry for key if it is still fresh
+func (t *cacheTransport) lookup(req *http.Request, key string) *http.Response {
+	now := time.Now()
+	t.mu.Lock()
+	el, ok := t.entries[key]
+	var e *cacheEntry
+	if ok {
+		e = el.Value.(*cacheEntry)
+		if now.After(e.expires) {
+			t.order.Remove(el)
+			delete(t.entries, key)
+			e = nil
+		} else {
+			t.order.MoveToFront(el)
+		}
+	}
+	t.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+
+	h := e.header.Clone()
+	h.Set("Age", strconv.FormatInt(int64(now.Sub(e.stored)/time.Second), 10))
+	h.Set("X-Cache", "HIT")
+	return &http.Response{
+		Status:        strconv.Itoa(e.status) + " " + http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
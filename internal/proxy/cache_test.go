@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"apigateway/internal/middleware"
+)
+
+// echoKeyTransport answers with the API key the upstream saw
+type echoKeyTransport struct {
+	calls int
+}
+
+func (t *echoKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Control": {"max-age=60"}},
+		Body:       io.NopCloser(strings.NewReader("for " + req.Header.Get("X-API-Key"))),
+		Request:    req,
+	}, nil
+}
+
+func cachedGet(t *testing.T, rt http.RoundTripper, apiKey, id string) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "http://upstream/items", nil)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	if id != "" {
+		req = req.WithContext(middleware.WithAPIKey(req.Context(), middleware.APIKey{ID: id}))
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return string(body)
+}
+
+func TestCacheNeverSharesBetweenAPIKeys(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		up := &echoKeyTransport{}
+		rt := newCacheTransport(up, Cache{TTL: time.Minute, Private: private, CredentialHeaders: []string{"X-API-Key"}})
+
+		// Verified keys (identity in context) and unverified ones alike
+		for _, verified := range []bool{false, true} {
+			idA, idB := "", ""
+			if verified {
+				idA, idB = "partner-a", "partner-b"
+			}
+			for i := 0; i < 2; i++ {
+				if got := cachedGet(t, rt, "key-a", idA); got != "for key-a" {
+					t.Fatalf("private=%v: key A got %q", private, got)
+				}
+				if got := cachedGet(t, rt, "key-b", idB); got != "for key-b" {
+					t.Fatalf("private=%v: key B got %q", private, got)
+				}
+			}
+		}
+		if got := cachedGet(t, rt, "", ""); got != "for " {
+			t.Fatalf("private=%v: anonymous caller got %q", private, got)
+		}
+	}
+}
+
+func TestCacheSharesAnonymousAndPrivateEntries(t *testing.T) {
+	up := &echoKeyTransport{}
+	rt := newCacheTransport(up, Cache{TTL: time.Minute, Private: true, CredentialHeaders: []string{"X-API-Key"}})
+	cachedGet(t, rt, "", "")
+	cachedGet(t, rt, "", "")
+	cachedGet(t, rt, "key-a", "a")
+	cachedGet(t, rt, "key-a", "a")
+	if up.calls != 2 {
+		t.Fatalf("upstream called %d times, want 2", up.calls)
+	}
+}
+
+func TestCacheKeyCanonicalizesHost(t *testing.T) {
+	rt := newCacheTransport(&echoKeyTransport{}, Cache{TTL: time.Minute})
+	key := func(rawURL string) string {
+		k, _, ok := rt.key(httptest.NewRequest(http.MethodGet, rawURL, nil))
+		if !ok {
+			t.Fatalf("%s: not cacheable", rawURL)
+		}
+		return k
+	}
+	for _, same := range [][2]string{
+		{"http://example.com/a", "http://Example.COM:80/a"},
+		{"https://example.com/a", "https://example.com.:443/a"},
+		{"http://[2001:db8::1]/a", "http://[2001:DB8:0::1]:80/a"},
+	} {
+		if key(same[0]) != key(same[1]) {
+			t.Errorf("%s and %s have different keys", same[0], same[1])
+		}
+	}
+	for _, different := range [][2]string{
+		{"http://example.com/a", "http://example.com:8080/a"},
+		{"http://example.com/a", "https://example.com/a"},
+		{"https://example.com/a", "https://example.com:80/a"},
+	} {
+		if key(different[0]) == key(different[1]) {
+			t.Errorf("%s and %s share a key", different[0], different[1])
+		}
+	}
+}
+
+func TestStaleKeyCanonicalizesHost(t *testing.T) {
+	key := func(rawURL string) string {
+		k, ok := staleKey(httptest.NewRequest(http.MethodGet, rawURL, nil))
+		if !ok {
+			t.Fatalf("%s: not storable", rawURL)
+		}
+		return k
+	}
+	if key("http://example.com/a") != key("http://Example.COM.:80/a") {
+		t.Error("equivalent hosts have different stale keys")
+	}
+	if key("http://example.com/a") == key("http://example.com:8080/a") {
+		t.Error("different ports share a stale key")
+	}
+}
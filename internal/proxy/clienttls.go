@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// ---------------- Upstream TLS ----------------
+
+// ClientTLS configures how the proxy authenticates itself to an upstream
+// and verifies it. Files are read once, when the proxy is built.
+type ClientTLS struct {
+	CertFile string // PEM client certificate chain for mutual TLS (with KeyFile)
+	KeyFile  string // PEM private key for CertFile
+	CAFile   string // PEM bundle trusted for the upstream instead of the system roots
+
+	// InsecureSkipVerify accepts any upstream certificate. For development
+	// only: it removes protection against interception.
+	InsecureSkipVerify bool
+}
+
+// apply loads the files into tc
+func (c *ClientTLS) apply(tc *tls.Config) error {
+	if c == nil {
+		return nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("client certificate and key must be set together")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return fmt.Errorf("client certificate %s: %w", c.CertFile, err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return fmt.Errorf("CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("CA bundle %s: no PEM certificates found", c.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	tc.InsecureSkipVerify = c.InsecureSkipVerify
+	return nil
+}
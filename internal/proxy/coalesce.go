@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Request Coalescing ----------------
+
+// defaultCoalesceBytes caps the shared response body when MaxBytes is unset
+const defaultCoalesceBytes = 1 << 20
+
+// negotiationHeaders are always part of the key: a gzip or XML response
+// must not reach a client that asked for neither
+var negotiationHeaders = []string{"Accept", "Accept-Encoding"}
+
+// Coalesce merges concurrent identical GET/HEAD requests into a single
+// upstream call. Requests are identical when method, URL (path and query),
+// Accept, Accept-Encoding, and the values of Headers all match.
+type Coalesce struct {
+	Headers  []string // further request headers that contribute to the key
+	MaxBytes int64    // largest response body shared with waiting requests
+}
+
+// coalescingTransport sits outside retries and the circuit breaker, so the
+// whole upstream exchange happens once per key. Requests carrying
+// credentials are only coalesced when those headers are part of the key,
+// and responses that set cookies or are marked private are never shared.
+type coalescingTransport struct {
+	next     http.RoundTripper
+	headers  []string
+	maxBytes int64
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done   chan struct{}
+	resp   *http.Response // status and headers; the body is in body
+	body   []byte
+	err    error
+	shared bool // false: waiters must make their own request
+}
+
+func newCoalescingTransport(next http.RoundTripper, cfg Coalesce) *coalescingTransport {
+	t := &coalescingTransport{
+		next:     next,
+		headers:  append([]string(nil), negotiationHeaders...),
+		maxBytes: cfg.MaxBytes,
+		calls:    make(map[string]*coalescedCall),
+	}
+	if t.maxBytes <= 0 {
+		t.maxBytes = defaultCoalesceBytes
+	}
+	for _, h := range cfg.Headers {
+		if h = http.CanonicalHeaderKey(h); !t.keyed(h) {
+			t.headers = append(t.headers, h)
+		}
+	}
+	return t
+}
+
+func (t *coalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, ok := t.key(req)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	t.mu.Lock()
+	if c, found := t.calls[key]; found {
+		t.mu.Unlock()
+		return t.wait(req, c)
+	}
+	c := &coalescedCall{done: make(chan struct{})}
+	t.calls[key] = c
+	t.mu.Unlock()
+
+	// The exchange is shared, so one client hanging up must not cancel it
+	// for the rest; the leader's deadline (route timeout) still applies
+	ctx := context.WithoutCancel(req.Context())
+	if deadline, ok := req.Context().Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	leaderResp := t.settle(c, resp, err)
+
+	t.mu.Lock()
+	delete(t.calls, key)
+	t.mu.Unlock()
+	close(c.done)
+
+	if leaderResp != nil {
+		return leaderResp, nil
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.clone(req), nil
+}
+
+// key builds the coalescing key, or reports that req must go alone
+func (t *coalescingTransport) key(req *http.Request) (string, bool) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return "", false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return "", false
+	}
+	for _, private := range []string{"Authorization", "Cookie"} {
+		if req.Header.Get(private) != "" && !t.keyed(private) {
+			return "", false
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(req.Method)
+	b.WriteByte(' ')
+	b.WriteString(req.URL.String())
+	// The API key header is gone by now; partners only share with themselves
+	if key, ok := middleware.GetAPIKey(req); ok {
+		b.WriteString("\napikey:")
+		b.WriteString(key.ID)
+	}
+	for _, h := range t.headers {
+		b.WriteByte('\n')
+		b.WriteString(h)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(req.Header.Values(h), ","))
+	}
+	return b.String(), true
+}
+
+func (t *coalescingTransport) keyed(header string) bool {
+	for _, h := range t.headers {
+		if h == header {
+			return true
+		}
+	}
+	return false
+}
+
+// settle records the leader's outcome. If the response can't be shared it
+// is handed back to the leader as-is (still streaming) and waiters retry
+// on their own.
+func (t *coalescingTransport) settle(c *coalescedCall, resp *http.Response, err error) *http.Response {
+	if err != nil {
+		c.err = err
+		c.shared = true
+		return nil
+	}
+	if !shareable(resp) || resp.ContentLength > t.maxBytes {
+		return resp
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, t.maxBytes+1))
+	if err != nil {
+		resp.Body.Close()
+		c.err = err
+		c.shared = true
+		return nil
+	}
+	if int64(len(buf)) > t.maxBytes {
+		resp.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(buf), resp.Body), Closer: resp.Body}
+		return resp
+	}
+	resp.Body.Close()
+	c.resp, c.body, c.shared = resp, buf, true
+	return nil
+}
+
+func (t *coalescingTransport) wait(req *http.Request, c *coalescedCall) (*http.Response, error) {
+	select {
+	case <-c.done:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if !c.shared {
+		return t.next.RoundTrip(req)
+	}
+
+	logger.Log.Debug("request_coalesced",
+		slog.String("request_id", middleware.GetRequestID(req)),
+		slog.String("upstream", req.URL.Host),
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+	)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.clone(req), nil
+}
+
+// clone gives each waiter its own headers and body reader, since
+// ModifyResponse and the client copy both mutate them
+func (c *coalescedCall) clone(req *http.Request) *http.Response {
+	resp := *c.resp
+	resp.Header = c.resp.Header.Clone()
+	resp.Trailer = c.resp.Trailer.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(c.body))
+	resp.ContentLength = int64(len(c.body))
+	resp.TransferEncoding = nil
+	resp.Request = req
+	return &resp
+}
+
+// shareable rejects responses meant for a single client
+func shareable(resp *http.Response) bool {
+	if len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, v := range resp.Header.Values("Cache-Control") {
+		if strings.Contains(strings.ToLower(v), "private") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCoalesceKeyNegotiation(t *testing.T) {
+	rt := newCoalescingTransport(nil, Coalesce{Headers: []string{"accept", "X-Report"}})
+	key := func(h http.Header) string {
+		req := httptest.NewRequest(http.MethodGet, "http://upstream/report?q=1", nil)
+		req.Header = h
+		k, ok := rt.key(req)
+		if !ok {
+			t.Fatal("request not coalesced")
+		}
+		return k
+	}
+	base := http.Header{"Accept": {"application/json"}, "Accept-Encoding": {"gzip"}, "X-Report": {"a"}}
+	if key(base) != key(base.Clone()) {
+		t.Fatal("identical requests have different keys")
+	}
+	for name, change := range map[string]func(http.Header){
+		"Accept-Encoding": func(h http.Header) { h.Del("Accept-Encoding") },
+		"Accept":          func(h http.Header) { h.Set("Accept", "application/xml") },
+		"X-Report":        func(h http.Header) { h.Set("X-Report", "b") },
+	} {
+		h := base.Clone()
+		change(h)
+		if key(h) == key(base) {
+			t.Errorf("requests differing in %s share a key", name)
+		}
+	}
+	if len(rt.headers) != 3 {
+		t.Errorf("key headers = %v, want Accept listed once", rt.headers)
+	}
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// ---------------- Connection Age ----------------
+
+// agedDialer stamps every upstream connection with a retirement timer.
+// Some NAT gateways and load balancers silently drop flows after a fixed
+// time regardless of traffic, so keepalives alone don't help: the first
+// request on such a connection fails. When the timer fires an idle
+// connection is closed at once and a busy one as soon as its last
+// request finishes, so the transport dials a fresh one on demand.
+type agedDialer struct {
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	maxAge time.Duration
+}
+
+func (d *agedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &agedConn{Conn: conn}
+	c.timer = time.AfterFunc(jitteredAge(d.maxAge), c.expire)
+	return c, nil
+}
+
+// jitteredAge adds up to 10% to maxAge, so a pool dialed in one burst
+// isn't retired in one
+func jitteredAge(maxAge time.Duration) time.Duration {
+	return maxAge + time.Duration(rand.Int63n(int64(maxAge)/10+1))
+}
+
+// agedConn counts the requests using it, so expiry never cuts one short
+type agedConn struct {
+	net.Conn
+	timer *time.Timer
+
+	mu      sync.Mutex
+	busy    int
+	expired bool
+}
+
+func (c *agedConn) expire() {
+	c.mu.Lock()
+	c.expired = true
+	idle := c.busy == 0
+	c.mu.Unlock()
+	if idle {
+		c.Close()
+	}
+}
+
+func (c *agedConn) acquire() {
+	c.mu.Lock()
+	c.busy++
+	c.mu.Unlock()
+}
+
+func (c *agedConn) release() {
+	c.mu.Lock()
+	c.busy--
+	retire := c.expired && c.busy == 0
+	c.mu.Unlock()
+	if retire {
+		c.Close()
+	}
+}
+
+func (c *agedConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// agedConnOf finds the agedConn under a pooled connection, looking
+// through TLS
+func agedConnOf(conn net.Conn) *agedConn {
+	for conn != nil {
+		if c, ok := conn.(*agedConn); ok {
+			return c
+		}
+		inner, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = inner.NetConn()
+	}
+	return nil
+}
+
+// agedTransport marks the connection a request runs on as busy until
+// its response body is closed. A connection expiring in the instant
+// between being handed out and marked busy fails before anything is
+// written, which the transport retries on a new connection.
+type agedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *agedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn *agedConn
+	trace := &httptrace.ClientTrace{
+		// Called again if the transport retries on another connection
+		GotConn: func(info httptrace.GotConnInfo) {
+			if conn != nil {
+				conn.release()
+			}
+			if conn = agedConnOf(info.Conn); conn != nil {
+				conn.acquire()
+			}
+		},
+	}
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if conn == nil {
+		return resp, err
+	}
+	if err != nil {
+		conn.release()
+		return nil, err
+	}
+	// An upgraded connection leaves the pool for good, so it stays busy
+	// until closed rather than being cut off at its age
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, nil
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: conn.release}
+	return resp, nil
+}
+
+// agedConnPool retires HTTP/2 connections. Many requests share one as
+// concurrent streams, so under steady traffic it is never idle and the
+// agedConn timer alone would never close it. Once a connection is past
+// its age, the request that finds it is its last: it is marked not to
+// take new streams, so the transport dials a fresh one, and it closes by
+// itself when its streams finish.
+type agedConnPool struct {
+	http2.ClientConnPool
+	maxAge time.Duration
+
+	mu     sync.Mutex
+	retire map[*http2.ClientConn]time.Time // from the first request on each
+}
+
+func (p *agedConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	cc, err := p.ClientConnPool.GetClientConn(req, addr)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	at, ok := p.retire[cc]
+	switch {
+	case !ok:
+		p.retire[cc] = time.Now().Add(jitteredAge(p.maxAge))
+	case time.Now().After(at):
+		cc.SetDoNotReuse()
+		delete(p.retire, cc)
+	}
+	return cc, nil
+}
+
+// MarkDead is called for every connection once it is closed
+func (p *agedConnPool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	delete(p.retire, cc)
+	p.mu.Unlock()
+	p.ClientConnPool.MarkDead(cc)
+}
+
+// releasingBody releases its connection once, on the first Close
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
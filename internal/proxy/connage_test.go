@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConnAgeRetiresBusyConnections keeps a connection busy with
+// overlapping requests well past its age and checks it is replaced and
+// closed anyway, over HTTP/1.1 and HTTP/2
+func TestConnAgeRetiresBusyConnections(t *testing.T) {
+	for _, h2 := range []bool{false, true} {
+		var opened, closed atomic.Int32
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(5 * time.Millisecond)
+		}))
+		srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+			switch s {
+			case http.StateNew:
+				opened.Add(1)
+			case http.StateClosed:
+				closed.Add(1)
+			}
+		}
+		srv.EnableHTTP2 = h2
+		srv.StartTLS()
+
+		cfg := Config{MaxConnAge: 100 * time.Millisecond}
+		base := &http.Transport{
+			DialContext:       (&agedDialer{dial: (&net.Dialer{}).DialContext, maxAge: cfg.MaxConnAge}).DialContext,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: h2,
+		}
+		if !h2 {
+			base.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+		if err := configureHTTP2(base, cfg); err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &agedTransport{next: base}}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ctx.Err() == nil {
+					resp, err := client.Get(srv.URL)
+					if err != nil {
+						t.Errorf("h2=%v: %v", h2, err)
+						return
+					}
+					if (resp.ProtoMajor == 2) != h2 {
+						t.Errorf("h2=%v: got %s", h2, resp.Proto)
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			}()
+		}
+		wg.Wait()
+		cancel()
+
+		// Four workers need at most four connections at a time; more
+		// means old ones were replaced, and replaced ones must close
+		time.Sleep(50 * time.Millisecond)
+		if n := opened.Load(); n < 8 {
+			t.Errorf("h2=%v: %d connections opened in 7 lifetimes", h2, n)
+		}
+		if n := closed.Load(); n < 4 {
+			t.Errorf("h2=%v: only %d retired connections closed", h2, n)
+		}
+		base.CloseIdleConnections()
+		srv.Close()
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Dead-letter Sink ----------------
+
+// defaultDeadLetterBytes caps captured request bodies when MaxBytes is unset
+const defaultDeadLetterBytes = 1 << 20
+
+// DeadLetter is a failed write request captured for later replay or inspection
+type DeadLetter struct {
+	Time      time.Time   `json:"time"`
+	RequestID string      `json:"request_id"`
+	Upstream  string      `json:"upstream"`
+	Method    string      `json:"method"`
+	Path      string      `json:"path"`
+	Query     string      `json:"query,omitempty"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"` // body exceeded the capture limit
+	Status    int         `json:"status,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// DeadLetterSink persists dead letters (a file, a queue, ...)
+type DeadLetterSink interface {
+	Write(ctx context.Context, dl DeadLetter) error
+}
+
+// NopSink discards dead letters
+type NopSink struct{}
+
+// Write implements DeadLetterSink
+func (NopSink) Write(context.Context, DeadLetter) error { return nil }
+
+// FileSink appends dead letters to a file as JSON lines
+type FileSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileSink opens (or creates) path for appending
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f}, nil
+}
+
+// Write implements DeadLetterSink
+func (s *FileSink) Write(_ context.Context, dl DeadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.f.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying file
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// redactedHeaders are never written to a sink
+var redactedHeaders = []string{"Authorization", "Cookie", "X-Api-Key", "Proxy-Authorization"}
+
+// deadLetterTransport captures non-idempotent requests on critical routes
+// and hands them to the sink when the upstream call ultimately fails
+type deadLetterTransport struct {
+	next     http.RoundTripper
+	sink     DeadLetterSink
+	maxBytes int64
+}
+
+func (t *deadLetterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isIdempotent(req.Method) {
+		return t.next.RoundTrip(req)
+	}
+
+	limit := t.maxBytes
+	if limit <= 0 {
+		limit = defaultDeadLetterBytes
+	}
+
+	// Capture a bounded prefix of the body while still forwarding all of it
+	var captured []byte
+	truncated := false
+	if req.Body != nil && req.Body != http.NoBody {
+		buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(buf)) > limit {
+			truncated = true
+			captured = buf[:limit]
+		} else {
+			captured = buf
+		}
+		// Forward a clone so the caller's request is left as it was handed in
+		body := req.Body
+		req = req.Clone(req.Context())
+		req.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(buf), body), Closer: body}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode < 500 {
+		return resp, nil
+	}
+
+	dl := DeadLetter{
+		Time:      time.Now().UTC(),
+		RequestID: middleware.GetRequestID(req),
+		Upstream:  req.URL.Host,
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Query:     req.URL.RawQuery,
+		Header:    req.Header.Clone(),
+		Body:      captured,
+		Truncated: truncated,
+	}
+	for _, h := range redactedHeaders {
+		dl.Header.Del(h)
+	}
+	if err != nil {
+		dl.Error = err.Error()
+	} else {
+		dl.Status = resp.StatusCode
+	}
+
+	// Use a fresh context: the request's may already be cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if werr := t.sink.Write(ctx, dl); werr != nil {
+		logger.Log.Error("dead_letter_failed",
+			slog.String("request_id", dl.RequestID),
+			slog.String("upstream", dl.Upstream),
+			slog.String("method", dl.Method),
+			slog.String("path", dl.Path),
+			slog.String("error", werr.Error()),
+		)
+	} else {
+		logger.Log.Warn("dead_lettered",
+			slog.String("request_id", dl.RequestID),
+			slog.String("upstream", dl.Upstream),
+			slog.String("method", dl.Method),
+			slog.String("path", dl.Path),
+			slog.Int("status", dl.Status),
+		)
+	}
+	return resp, err
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// memorySink keeps dead letters in memory
+type memorySink struct{ letters []DeadLetter }
+
+func (s *memorySink) Write(_ context.Context, dl DeadLetter) error {
+	s.letters = append(s.letters, dl)
+	return nil
+}
+
+// roundTripFunc adapts a function to http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestDeadLetterLeavesCallerRequestAlone(t *testing.T) {
+	var forwarded string
+	sink := &memorySink{}
+	dlt := &deadLetterTransport{sink: sink, next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		b, _ := io.ReadAll(req.Body)
+		forwarded = string(b)
+		return &http.Response{StatusCode: http.StatusBadGateway, Body: http.NoBody, Request: req}, nil
+	})}
+
+	req := httptest.NewRequest(http.MethodPost, "http://upstream/orders", strings.NewReader(`{"id":1}`))
+	body := req.Body
+	resp, err := dlt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if req.Body != body {
+		t.Fatal("caller's request body was replaced")
+	}
+	if forwarded != `{"id":1}` {
+		t.Fatalf("upstream got %q, want the full body", forwarded)
+	}
+	if len(sink.letters) != 1 || string(sink.letters[0].Body) != `{"id":1}` {
+		t.Fatalf("dead letters = %+v, want one with the body", sink.letters)
+	}
+}
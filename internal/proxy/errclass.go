@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// Upstream error classes, used as keys for status overrides
+const (
+	ErrClassRefused  = "refused"  // nothing listening / connection reset on connect
+	ErrClassTimeout  = "timeout"  // dial, header, or deadline timeouts
+	ErrClassTLS      = "tls"      // handshake or certificate failures
+	ErrClassProtocol = "protocol" // malformed responses and anything unrecognized
+	ErrClassCanceled = "canceled" // the client went away first
+	ErrClassCircuit  = "circuit"  // rejected by an open circuit breaker
+)
+
+// StatusClientClosedRequest is the nginx convention for a client that hung
+// up before the upstream answered; it only ever reaches logs
+const StatusClientClosedRequest = 499
+
+// DefaultErrorStatus maps error classes to the status returned to clients
+var DefaultErrorStatus = map[string]int{
+	ErrClassRefused:  http.StatusServiceUnavailable,
+	ErrClassTimeout:  http.StatusGatewayTimeout,
+	ErrClassTLS:      http.StatusBadGateway,
+	ErrClassProtocol: http.StatusBadGateway,
+	ErrClassCanceled: StatusClientClosedRequest,
+	ErrClassCircuit:  http.StatusServiceUnavailable,
+}
+
+// classifyError buckets a transport error. Cancellation is checked first:
+// a client disconnect surfaces as a canceled context even mid-dial.
+func classifyError(err error) string {
+	if errors.Is(err, errCircuitOpen) {
+		return ErrClassCircuit
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrClassCanceled
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrClassTimeout
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return ErrClassRefused
+	}
+
+	var (
+		recordErr tls.RecordHeaderError
+		alertErr  tls.AlertError
+		verifyErr *tls.CertificateVerificationError
+		unknownCA x509.UnknownAuthorityError
+		hostErr   x509.HostnameError
+		invalid   x509.CertificateInvalidError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &unknownCA) || errors.As(err, &hostErr) || errors.As(err, &invalid) {
+		return ErrClassTLS
+	}
+
+	return ErrClassProtocol
+}
+
+// errorStatus resolves the client status for class, preferring overrides
+func errorStatus(class string, overrides map[string]int) int {
+	if s, ok := overrides[class]; ok {
+		return s
+	}
+	return DefaultErrorStatus[class]
+}
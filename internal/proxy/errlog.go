@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"apigateway/internal/logger"
+)
+
+// ---------------- Error Log Aggregation ----------------
+
+// maxErrorKeys bounds the distinct errors tracked per window; beyond it,
+// errors are logged individually rather than growing the map
+const maxErrorKeys = 1024
+
+// ErrorLog collapses identical proxy errors during an outage. The first
+// occurrence of an error (same upstream, class, status, and message) is
+// logged as usual; repeats within the window are only counted, and one
+// proxy_error_repeated line reports the total when the window ends.
+// Safe for concurrent use and meant to be shared by all proxies.
+type ErrorLog struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[errorKey]*errorEntry
+	closed  bool
+}
+
+type errorKey struct {
+	upstream string
+	class    string
+	status   int
+	message  string
+}
+
+type errorEntry struct {
+	level    slog.Level
+	occurred int
+	timer    *time.Timer
+}
+
+// NewErrorLog aggregates repeats over the given window
+func NewErrorLog(window time.Duration) *ErrorLog {
+	return &ErrorLog{window: window, entries: make(map[errorKey]*errorEntry)}
+}
+
+// first counts an occurrence and reports whether it is the first of its
+// window, and so should be logged in full. A nil ErrorLog logs everything.
+func (l *ErrorLog) first(level slog.Level, upstream, class string, status int, message string) bool {
+	if l == nil {
+		return true
+	}
+	key := errorKey{upstream: upstream, class: class, status: status, message: message}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok {
+		e.occurred++
+		return false
+	}
+	if l.closed || len(l.entries) >= maxErrorKeys {
+		return true
+	}
+	e := &errorEntry{level: level, occurred: 1}
+	e.timer = time.AfterFunc(l.window, func() { l.flush(key) })
+	l.entries[key] = e
+	return true
+}
+
+func (l *ErrorLog) flush(key errorKey) {
+	l.mu.Lock()
+	e, ok := l.entries[key]
+	delete(l.entries, key)
+	l.mu.Unlock()
+	if ok {
+		l.report(key, e)
+	}
+}
+
+// report writes the summary for a window; a lone occurrence was already
+// logged in full and needs none
+func (l *ErrorLog) report(key errorKey, e *errorEntry) {
+	if e.occurred < 2 {
+		return
+	}
+	logger.Log.Log(context.Background(), e.level, "proxy_error_repeated",
+		slog.String("upstream", key.upstream),
+		slog.String("class", key.class),
+		slog.Int("status", key.status),
+		slog.String("error", key.message),
+		slog.Int("occurred", e.occurred),
+		slog.String("window", l.window.String()),
+	)
+}
+
+// Close writes the summaries of windows still open, e.g. at shutdown.
+// Errors recorded afterwards are logged individually.
+func (l *ErrorLog) Close() {
+	l.mu.Lock()
+	entries := l.entries
+	l.entries = make(map[errorKey]*errorEntry)
+	l.closed = true
+	l.mu.Unlock()
+	for key, e := range entries {
+		e.timer.Stop()
+		l.report(key, e)
+	}
+}
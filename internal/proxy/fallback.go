@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Fallback Content ----------------
+
+// Fallback is a static response for reads that the upstream can't serve,
+// e.g. an empty list so a UI degrades instead of breaking
+type Fallback struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// fallbackTransport sits outside retries, the circuit breaker, and
+// stale-if-error, so the static answer is only used once all of them have
+// failed: a transport error (not the client going away) or a 502/503/504.
+// A 500 means the upstream was reached and is passed through.
+type fallbackTransport struct {
+	next     http.RoundTripper
+	fallback Fallback
+}
+
+func (t *fallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.next.RoundTrip(req)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil:
+		if req.Context().Err() != nil {
+			return nil, err // the client gave up
+		}
+		return t.serve(req, "error"), nil
+	case unavailable(resp.StatusCode):
+		discardResponse(resp)
+		return t.serve(req, strconv.Itoa(resp.StatusCode)), nil
+	}
+	return resp, nil
+}
+
+func unavailable(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *fallbackTransport) serve(req *http.Request, reason string) *http.Response {
+	logger.Log.Warn("fallback_response_served",
+		slog.String("request_id", middleware.GetRequestID(req)),
+		slog.String("upstream", req.URL.Host),
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.String("reason", reason),
+	)
+
+	h := make(http.Header)
+	h.Set("Content-Type", t.fallback.ContentType)
+	h.Set("Content-Length", strconv.Itoa(len(t.fallback.Body)))
+	// A placeholder must not be cached in place of real content
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Fallback", "true")
+	return &http.Response{
+		Status:        strconv.Itoa(t.fallback.Status) + " " + http.StatusText(t.fallback.Status),
+		StatusCode:    t.fallback.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(t.fallback.Body)),
+		ContentLength: int64(len(t.fallback.Body)),
+		Request:       req,
+	}
+}
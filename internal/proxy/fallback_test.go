@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testFallback = Fallback{Status: http.StatusOK, ContentType: "application/json", Body: []byte(`{"items":[]}`)}
+
+func TestFallbackAnswersReads(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		for _, tc := range []struct {
+			name   string
+			status int
+			err    error
+		}{
+			{"transport error", 0, errors.New("connection refused")},
+			{"502", http.StatusBadGateway, nil},
+			{"503", http.StatusServiceUnavailable, nil},
+			{"504", http.StatusGatewayTimeout, nil},
+		} {
+			up := &stubUpstream{status: tc.status, err: tc.err, body: "upstream error page"}
+			rt := &fallbackTransport{next: up, fallback: testFallback}
+			resp, body, err := fetch(t, rt, httptest.NewRequest(method, "http://upstream/items", nil))
+			if err != nil {
+				t.Fatalf("%s %s: %v", method, tc.name, err)
+			}
+			if resp.StatusCode != http.StatusOK || body != `{"items":[]}` {
+				t.Errorf("%s %s: got %d %q", method, tc.name, resp.StatusCode, body)
+			}
+			h := resp.Header
+			if h.Get("Content-Type") != "application/json" || h.Get("Content-Length") != "12" ||
+				h.Get("Cache-Control") != "no-store" || h.Get("X-Fallback") != "true" {
+				t.Errorf("%s %s: headers = %v", method, tc.name, h)
+			}
+		}
+	}
+}
+
+func TestFallbackPassesThrough(t *testing.T) {
+	for _, tc := range []struct {
+		name, method string
+		status       int
+	}{
+		{"500 reached the upstream", http.MethodGet, http.StatusInternalServerError},
+		{"success", http.MethodGet, http.StatusOK},
+		{"client error", http.MethodGet, http.StatusNotFound},
+		{"POST", http.MethodPost, http.StatusServiceUnavailable},
+		{"DELETE", http.MethodDelete, http.StatusBadGateway},
+	} {
+		up := &stubUpstream{status: tc.status, body: "from upstream"}
+		rt := &fallbackTransport{next: up, fallback: testFallback}
+		resp, body, err := fetch(t, rt, httptest.NewRequest(tc.method, "http://upstream/items", nil))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if resp.StatusCode != tc.status || body != "from upstream" || resp.Header.Get("X-Fallback") != "" {
+			t.Errorf("%s: got %d %q %v", tc.name, resp.StatusCode, body, resp.Header)
+		}
+	}
+
+	up := &stubUpstream{err: errors.New("connection refused")}
+	rt := &fallbackTransport{next: up, fallback: testFallback}
+	if _, _, err := fetch(t, rt, httptest.NewRequest(http.MethodPut, "http://upstream/items", nil)); err == nil {
+		t.Error("PUT transport error replaced by the fallback")
+	}
+}
+
+func TestFallbackNotServedToCanceledClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	up := &stubUpstream{err: context.Canceled}
+	rt := &fallbackTransport{next: up, fallback: testFallback}
+	req := httptest.NewRequest(http.MethodGet, "http://upstream/items", nil).WithContext(ctx)
+	if _, _, err := fetch(t, rt, req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want the cancellation", err)
+	}
+}
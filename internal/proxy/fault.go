@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Fault Injection ----------------
+
+// Fault types understood by Fault.Type
+const (
+	FaultRefused     = "refused" // dial error, as if nothing listens upstream
+	FaultUnavailable = "503"     // synthetic 503 response
+	FaultTimeout     = "timeout" // hang until the header timeout, then time out
+)
+
+// Fault short-circuits a fraction of upstream attempts with a synthetic
+// failure before they reach the network, for resilience testing
+type Fault struct {
+	Type string
+	Rate float64
+}
+
+// faultTransport sits directly above the base transport, so every retry
+// attempt is sampled independently and retries, dead-lettering, and error
+// classification all see the same errors a real outage would produce
+type faultTransport struct {
+	next    http.RoundTripper
+	fault   Fault
+	timeout time.Duration // how long a timeout fault hangs
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rand.Float64() >= t.fault.Rate {
+		return t.next.RoundTrip(req)
+	}
+
+	logger.Log.Debug("fault_injected",
+		slog.String("request_id", middleware.GetRequestID(req)),
+		slog.String("upstream", req.URL.Host),
+		slog.String("fault", t.fault.Type),
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+	)
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	switch t.fault.Type {
+	case FaultUnavailable:
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       io.NopCloser(strings.NewReader("injected fault\n")),
+			Request:    req,
+		}, nil
+
+	case FaultTimeout:
+		timer := time.NewTimer(t.timeout)
+		defer timer.Stop()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+
+	default: // FaultRefused
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+}
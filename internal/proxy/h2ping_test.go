@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blackholeRelay forwards TCP connections to addr until blackhole is
+// called, after which existing connections silently drop all traffic, as
+// a stateful firewall that forgot them would
+type blackholeRelay struct {
+	net.Listener
+	addr     string
+	accepted atomic.Int32
+
+	mu    sync.Mutex
+	conns []*atomic.Bool // dropping flags of the connections so far
+}
+
+func newBlackholeRelay(t *testing.T, addr string) *blackholeRelay {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &blackholeRelay{Listener: ln, addr: addr}
+	go r.serve()
+	t.Cleanup(func() { ln.Close() })
+	return r
+}
+
+func (r *blackholeRelay) serve() {
+	for {
+		client, err := r.Accept()
+		if err != nil {
+			return
+		}
+		r.accepted.Add(1)
+		server, err := net.Dial("tcp", r.addr)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		dropping := new(atomic.Bool)
+		r.mu.Lock()
+		r.conns = append(r.conns, dropping)
+		r.mu.Unlock()
+		pipe := func(dst, src net.Conn) {
+			buf := make([]byte, 32<<10)
+			for {
+				n, err := src.Read(buf)
+				if n > 0 && !dropping.Load() {
+					dst.Write(buf[:n])
+				}
+				if err != nil {
+					dst.Close()
+					return
+				}
+			}
+		}
+		go pipe(server, client)
+		go pipe(client, server)
+	}
+}
+
+func (r *blackholeRelay) blackhole() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, dropping := range r.conns {
+		dropping.Store(true)
+	}
+}
+
+func TestH2PingPrunesDeadConnections(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+	relay := newBlackholeRelay(t, upstream.Listener.Addr().String())
+
+	target, _ := url.Parse("https://" + relay.Addr().String())
+	rp, err := NewBalancedProxy([]Backend{{URL: target, Weight: 1}}, Config{
+		Attempts:        1,
+		ReadIdleTimeout: 100 * time.Millisecond,
+		PingTimeout:     100 * time.Millisecond,
+		DirectEgress:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Talk to the pinging transport directly, trusting the test certificate
+	transport := rp.Transport.(*preserveTransport).next.(*retryingRoundTripper).next.(*http.Transport)
+	transport.TLSClientConfig.InsecureSkipVerify = true
+	defer transport.CloseIdleConnections()
+	get := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Fatalf("got %s, want HTTP/2", resp.Proto)
+		}
+		_, err = io.ReadAll(resp.Body)
+		return err
+	}
+
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	relay.blackhole()
+	// Long enough for an unanswered ping to condemn the connection
+	time.Sleep(500 * time.Millisecond)
+	if err := get(); err != nil {
+		t.Fatalf("request after the connection died: %v", err)
+	}
+	if n := relay.accepted.Load(); n != 2 {
+		t.Fatalf("%d connections opened, want the dead one replaced by a second", n)
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// ---------------- Hop-by-hop Headers ----------------
+
+// hopHeaders are connection-scoped and must not be forwarded (RFC 7230 section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type preservedKey struct{}
+
+// stripHopByHop removes hop-by-hop headers, including any named in the
+// Connection header, except those in preserve. It returns the preserved
+// headers that httputil.ReverseProxy would strip again after the director
+// runs, so they can be restored just before the request goes upstream.
+func stripHopByHop(h http.Header, preserve map[string]bool) http.Header {
+	var restore http.Header
+
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+			if name != "" && !preserve[name] {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		vv, ok := h[name]
+		if !ok {
+			continue
+		}
+		if preserve[name] {
+			if restore == nil {
+				restore = make(http.Header)
+			}
+			restore[name] = vv
+			continue
+		}
+		// "TE: trailers" is required by gRPC and is passed through by the stdlib
+		if name == "Te" && len(vv) == 1 && strings.EqualFold(vv[0], "trailers") {
+			continue
+		}
+		h.Del(name)
+	}
+	return restore
+}
+
+// preserveTransport re-applies allow-listed hop-by-hop headers that the
+// reverse proxy stripped after the director ran
+type preserveTransport struct {
+	next http.RoundTripper
+}
+
+func (t *preserveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if saved, ok := req.Context().Value(preservedKey{}).(http.Header); ok {
+		for name, vv := range saved {
+			req.Header[name] = vv
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// withPreserved stashes headers for preserveTransport on the outbound request
+func withPreserved(r *http.Request, saved http.Header) {
+	*r = *r.WithContext(context.WithValue(r.Context(), preservedKey{}, saved))
+}
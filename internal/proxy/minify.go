@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+)
+
+// ---------------- Response Minification ----------------
+
+// defaultMinifyBytes caps body buffering when MaxBytes is unset
+const defaultMinifyBytes = 1 << 20
+
+// Minify strips insignificant whitespace from response bodies. It runs on
+// the decoded body, after URL rewriting, and the gzip middleware compresses
+// the result for clients that accept it.
+type Minify struct {
+	JSON     bool
+	HTML     bool
+	MaxBytes int64 // larger (decoded) bodies are forwarded untouched
+}
+
+// apply minifies resp's body in place. Only complete 200 bodies are
+// touched: a 206 carries a byte range of the full representation, and
+// rewriting it would break the Content-Range offsets. Other content types,
+// encodings other than gzip, oversized and malformed bodies pass through
+// unchanged.
+func (m *Minify) apply(resp *http.Response) error {
+	if m == nil || resp.StatusCode != http.StatusOK || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	contentType := resp.Header.Get("Content-Type")
+	isHTML := false
+	switch {
+	case m.JSON && isJSON(contentType):
+	case m.HTML && isHTMLType(contentType):
+		isHTML = true
+	default:
+		return nil
+	}
+	maxBytes := m.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMinifyBytes
+	}
+	body, ok, err := decodedBody(resp, maxBytes)
+	if !ok || err != nil {
+		return err
+	}
+
+	var out []byte
+	if isHTML {
+		out = minifyHTML(body)
+	} else {
+		// Compact only drops whitespace between tokens; string contents,
+		// key order, and number spellings are kept byte for byte
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, body); err != nil {
+			return nil
+		}
+		out = buf.Bytes()
+	}
+	if len(out) == len(body) {
+		return nil // nothing to gain; keep the original encoding and ETag
+	}
+	replaceBody(resp, out)
+	return nil
+}
+
+func isHTMLType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/html"
+}
+
+// rawElements keep their content verbatim: whitespace in them is
+// significant (pre, textarea) or not HTML at all (script, style)
+var rawElements = []string{"pre", "textarea", "script", "style"}
+
+// minifyHTML collapses each run of whitespace in text and between
+// attributes to a single character (a newline if the run had one, else a
+// space), which browsers render the same. Quoted attribute values,
+// comments, and raw elements are copied unchanged.
+func minifyHTML(src []byte) []byte {
+	out := make([]byte, 0, len(src))
+	inTag := false
+	var quote byte
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case quote != 0:
+			out = append(out, c)
+			if c == quote {
+				quote = 0
+			}
+			continue
+		case inTag && (c == '"' || c == '\''):
+			quote = c
+			out = append(out, c)
+			continue
+		case inTag && c == '>':
+			inTag = false
+			out = append(out, c)
+			continue
+		case !inTag && c == '<':
+			if bytes.HasPrefix(src[i:], []byte("<!--")) {
+				end := bytes.Index(src[i+4:], []byte("-->"))
+				if end < 0 {
+					return append(out, src[i:]...)
+				}
+				out = append(out, src[i:i+4+end+3]...)
+				i += 4 + end + 2
+				continue
+			}
+			if name := rawElementAt(src[i:]); name != "" {
+				// Copy the whole element, through its closing tag
+				end := indexFold(src[i+1:], "</"+name)
+				if end < 0 {
+					return append(out, src[i:]...)
+				}
+				closeEnd := bytes.IndexByte(src[i+1+end:], '>')
+				if closeEnd < 0 {
+					return append(out, src[i:]...)
+				}
+				stop := i + 1 + end + closeEnd + 1
+				out = append(out, src[i:stop]...)
+				i = stop - 1
+				continue
+			}
+			inTag = true
+			out = append(out, c)
+			continue
+		}
+
+		if !isHTMLSpace(c) {
+			out = append(out, c)
+			continue
+		}
+		sep := byte(' ')
+		for ; i < len(src) && isHTMLSpace(src[i]); i++ {
+			if src[i] == '\n' {
+				sep = '\n'
+			}
+		}
+		i--
+		out = append(out, sep)
+	}
+	return out
+}
+
+// rawElementAt returns the name of the raw element whose start tag begins
+// b, or ""
+func rawElementAt(b []byte) string {
+	for _, name := range rawElements {
+		n := len(name) + 1
+		if len(b) > n && bytes.EqualFold(b[1:n], []byte(name)) {
+			switch b[n] {
+			case '>', ' ', '\t', '\n', '\r', '\f', '/':
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// indexFold is a case-insensitive bytes.Index for an ASCII needle
+func indexFold(b []byte, needle string) int {
+	for i := 0; i+len(needle) <= len(b); i++ {
+		if bytes.EqualFold(b[i:i+len(needle)], []byte(needle)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
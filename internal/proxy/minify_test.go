@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMinifyOnlyCompleteResponses(t *testing.T) {
+	m := &Minify{JSON: true}
+	body := "{ \"a\": 1,\n  \"b\": [1, 2] }"
+	for _, tt := range []struct {
+		status int
+		want   string
+	}{
+		{http.StatusOK, `{"a":1,"b":[1,2]}`},
+		{http.StatusPartialContent, body},
+		{http.StatusNotFound, body},
+	} {
+		resp := &http.Response{
+			StatusCode: tt.status,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}
+		if tt.status == http.StatusPartialContent {
+			resp.Header.Set("Content-Range", "bytes 0-24/100")
+		}
+		if err := m.apply(resp); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		if string(got) != tt.want {
+			t.Errorf("%d: body %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
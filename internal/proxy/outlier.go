@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"apigateway/internal/logger"
+)
+
+// ---------------- Outlier Ejection ----------------
+
+// OutlierConfig controls passive ejection of failing replicas from a
+// route's rotation
+type OutlierConfig struct {
+	Threshold int           // consecutive failed attempts that eject a replica (0 disables)
+	Cooldown  time.Duration // how long an ejected replica is skipped before it is tried again
+}
+
+// outlierDetector tracks each replica's recent attempts. Unlike the circuit
+// breaker, which fails requests to a broken host, it only steers selection
+// away from one while other replicas are available.
+type outlierDetector struct {
+	cfg OutlierConfig
+
+	mu    sync.Mutex
+	hosts map[string]*outlierHost
+}
+
+type outlierHost struct {
+	failures     int // consecutive
+	lastFailure  time.Time
+	ejectedUntil time.Time // zero while in rotation
+}
+
+func newOutlierDetector(cfg OutlierConfig) *outlierDetector {
+	return &outlierDetector{cfg: cfg, hosts: make(map[string]*outlierHost)}
+}
+
+// ejected reports whether host is out of rotation, putting it back once
+// its cooldown has passed
+func (d *outlierDetector) ejected(host string, now time.Time) bool {
+	d.mu.Lock()
+	h, ok := d.hosts[host]
+	if !ok || h.ejectedUntil.IsZero() {
+		d.mu.Unlock()
+		return false
+	}
+	if now.Before(h.ejectedUntil) {
+		d.mu.Unlock()
+		return true
+	}
+	h.ejectedUntil = time.Time{}
+	h.failures = 0
+	d.mu.Unlock()
+
+	logger.Log.Info("upstream_reinstated", slog.String("upstream", host))
+	return false
+}
+
+// record counts the outcome of one attempt against host
+func (d *outlierDetector) record(host string, failed bool) {
+	d.mu.Lock()
+	h, ok := d.hosts[host]
+	if !ok {
+		h = &outlierHost{}
+		d.hosts[host] = h
+	}
+	if !failed {
+		h.failures = 0
+		d.mu.Unlock()
+		return
+	}
+	h.failures++
+	h.lastFailure = time.Now()
+	// Attempts sent before the ejection may still be finishing
+	if !h.ejectedUntil.IsZero() || h.failures < d.cfg.Threshold {
+		d.mu.Unlock()
+		return
+	}
+	failures := h.failures
+	h.ejectedUntil = h.lastFailure.Add(d.cfg.Cooldown)
+	d.mu.Unlock()
+
+	logger.Log.Warn("upstream_ejected",
+		slog.String("upstream", host),
+		slog.Int("failures", failures),
+		slog.String("cooldown", d.cfg.Cooldown.String()),
+	)
+}
+
+// leastRecentlyFailed picks the backend whose last failure is oldest, the
+// one most likely to have recovered
+func (d *outlierDetector) leastRecentlyFailed(backends []Backend) *Backend {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	best := &backends[0]
+	var oldest time.Time
+	for i := range backends {
+		var last time.Time
+		if h, ok := d.hosts[backends[i].URL.Host]; ok {
+			last = h.lastFailure
+		}
+		if i == 0 || last.Before(oldest) {
+			best, oldest = &backends[i], last
+		}
+	}
+	return best
+}
+
+// outlierBalancer skips ejected backends when choosing with next
+type outlierBalancer struct {
+	next     Balancer
+	backends []Backend
+	detector *outlierDetector
+}
+
+func (b *outlierBalancer) Next(r *http.Request) *Backend {
+	now := time.Now()
+	for i := 0; i < 2*len(b.backends); i++ {
+		if next := b.next.Next(r); !b.detector.ejected(next.URL.Host, now) {
+			return next
+		}
+	}
+	// The policy keeps choosing ejected replicas (a pinned header value, or
+	// a skewed weight): take any replica still in rotation
+	for i := range b.backends {
+		if !b.detector.ejected(b.backends[i].URL.Host, now) {
+			return &b.backends[i]
+		}
+	}
+	// Everything is ejected; sending nowhere would be worse
+	return b.detector.leastRecentlyFailed(b.backends)
+}
+
+// outlierTransport sits below the retry layer, so every attempt counts
+// against the replica it was sent to
+type outlierTransport struct {
+	next     http.RoundTripper
+	detector *outlierDetector
+}
+
+func (t *outlierTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && classifyError(err) == ErrClassCanceled:
+		// The client gave up; that says nothing about the upstream
+	case err != nil || resp.StatusCode >= 500:
+		t.detector.record(req.URL.Host, true)
+	default:
+		t.detector.record(req.URL.Host, false)
+	}
+	return resp, err
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOutlierTransportCountsFailures(t *testing.T) {
+	d := newOutlierDetector(OutlierConfig{Threshold: 3, Cooldown: time.Minute})
+	var status int
+	var err error
+	rt := &outlierTransport{detector: d, next: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: status, Body: http.NoBody}, nil
+	})}
+	send := func(s int, e error) {
+		status, err = s, e
+		req := httptest.NewRequest(http.MethodGet, "http://10.0.0.1:80/", nil)
+		if resp, _ := rt.RoundTrip(req); resp != nil {
+			resp.Body.Close()
+		}
+	}
+	now := time.Now()
+
+	send(http.StatusInternalServerError, nil)
+	send(0, errors.New("connection refused"))
+	send(http.StatusOK, nil) // a success resets the streak
+	send(http.StatusBadGateway, nil)
+	send(http.StatusServiceUnavailable, nil)
+	if d.ejected("10.0.0.1:80", now) {
+		t.Fatal("ejected before Threshold consecutive failures")
+	}
+
+	// The client going away says nothing about the replica
+	send(0, fmt.Errorf("read body: %w", context.Canceled))
+	send(http.StatusNotFound, nil) // 4xx is the client's fault, and a success
+	send(http.StatusBadGateway, nil)
+	send(http.StatusBadGateway, nil)
+	if d.ejected("10.0.0.1:80", now) {
+		t.Fatal("canceled or 4xx attempts counted as failures")
+	}
+	send(0, errors.New("connection reset"))
+	if !d.ejected("10.0.0.1:80", time.Now()) {
+		t.Fatal("not ejected after Threshold consecutive failures")
+	}
+	if d.ejected("10.0.0.2:80", time.Now()) {
+		t.Fatal("another replica ejected")
+	}
+}
+
+func TestOutlierReinstatedAfterCooldown(t *testing.T) {
+	d := newOutlierDetector(OutlierConfig{Threshold: 1, Cooldown: time.Minute})
+	d.record("a:80", true)
+	if !d.ejected("a:80", time.Now().Add(59*time.Second)) {
+		t.Fatal("reinstated before the cooldown")
+	}
+	if d.ejected("a:80", time.Now().Add(61*time.Second)) {
+		t.Fatal("still ejected after the cooldown")
+	}
+	// Reinstatement starts a fresh streak
+	d.record("a:80", false)
+	if d.ejected("a:80", time.Now()) {
+		t.Fatal("ejected again without failing")
+	}
+	d.record("a:80", true)
+	if !d.ejected("a:80", time.Now()) {
+		t.Fatal("not ejected after failing again")
+	}
+}
+
+func TestOutlierBalancerSkipsEjected(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	next, err := NewBalancer(BalancerConfig{Policy: "round_robin"}, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newOutlierDetector(OutlierConfig{Threshold: 2, Cooldown: 50 * time.Millisecond})
+	b := &outlierBalancer{next: next, backends: backends, detector: d}
+	ejectedHost := backends[1].URL.Host
+	d.record(ejectedHost, true)
+	d.record(ejectedHost, true)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 30; i++ {
+		if got := b.Next(req).URL.Host; got == ejectedHost {
+			t.Fatalf("ejected %s chosen", got)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	seen := false
+	for i := 0; i < 30; i++ {
+		seen = seen || b.Next(req).URL.Host == ejectedHost
+	}
+	if !seen {
+		t.Fatal("replica not back in rotation after the cooldown")
+	}
+}
+
+func TestOutlierBalancerAllEjected(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	next, err := NewBalancer(BalancerConfig{Policy: "round_robin"}, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newOutlierDetector(OutlierConfig{Threshold: 1, Cooldown: time.Minute})
+	b := &outlierBalancer{next: next, backends: backends, detector: d}
+	now := time.Now()
+	for i, ago := range []time.Duration{time.Second, 3 * time.Second, 2 * time.Second} {
+		host := backends[i].URL.Host
+		d.record(host, true)
+		d.hosts[host].lastFailure = now.Add(-ago)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 5; i++ {
+		if got := b.Next(req); got != &backends[1] {
+			t.Fatalf("chose %s, want the least recently failed %s", got.URL.Host, backends[1].URL.Host)
+		}
+	}
+}
+
+func TestOutlierBalancerPinnedToEjected(t *testing.T) {
+	backends := testBackends(1, 1)
+	d := newOutlierDetector(OutlierConfig{Threshold: 1, Cooldown: time.Minute})
+	// A policy that always picks the first replica, like a pinned hash key
+	pinned := balancerFunc(func(*http.Request) *Backend { return &backends[0] })
+	b := &outlierBalancer{next: pinned, backends: backends, detector: d}
+	d.record(backends[0].URL.Host, true)
+	if got := b.Next(httptest.NewRequest(http.MethodGet, "/", nil)); got != &backends[1] {
+		t.Fatalf("chose %s, want the replica still in rotation", got.URL.Host)
+	}
+}
+
+// balancerFunc adapts a function to Balancer
+type balancerFunc func(*http.Request) *Backend
+
+func (f balancerFunc) Next(r *http.Request) *Backend { return f(r) }
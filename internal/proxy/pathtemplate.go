@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ---------------- Path Templates ----------------
+
+// PathTemplate reshapes upstream request paths, e.g. pattern
+// "/api/v1/users/{id}" with template "/internal/user?id={id}". Pattern
+// segments are literals, "{name}" for one segment, or a final "{name...}"
+// for the remainder of the path. Templates may use parameters in both the
+// path and the query; the client's own query parameters are kept.
+type PathTemplate struct {
+	segments []string
+	rest     string // catch-all parameter name, if any
+	path     string // template path, with {name} placeholders
+	query    string // template query, with {name} placeholders
+}
+
+// ParsePathTemplate validates pattern and template against each other
+func ParsePathTemplate(pattern, template string) (*PathTemplate, error) {
+	if !strings.HasPrefix(pattern, "/") || !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("path pattern and template must start with /")
+	}
+	t := &PathTemplate{segments: strings.Split(strings.Trim(pattern, "/"), "/")}
+	t.path, t.query, _ = strings.Cut(template, "?")
+
+	names := make(map[string]bool)
+	for i, seg := range t.segments {
+		name, ok := paramName(seg)
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(name, "...") {
+			if i != len(t.segments)-1 {
+				return nil, fmt.Errorf("catch-all %s must be the last segment", seg)
+			}
+			name = strings.TrimSuffix(name, "...")
+			t.rest = name
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate parameter %q", name)
+		}
+		names[name] = true
+	}
+
+	// Every placeholder in the template must be captured by the pattern
+	for rest := template; ; {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			break
+		}
+		end := strings.Index(rest[open:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in template %q", template)
+		}
+		if name := rest[open+1 : open+end]; !names[name] {
+			return nil, fmt.Errorf("template parameter %q is not in the pattern", name)
+		}
+		rest = rest[open+end+1:]
+	}
+	return t, nil
+}
+
+func paramName(seg string) (string, bool) {
+	if len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}' {
+		return seg[1 : len(seg)-1], true
+	}
+	return "", false
+}
+
+// Rewrite applies the template to u in place. Paths that don't match the
+// pattern are left untouched and Rewrite reports false.
+func (t *PathTemplate) Rewrite(u *url.URL) bool {
+	params, ok := t.match(u.EscapedPath())
+	if !ok {
+		return false
+	}
+
+	path := t.path
+	for name, value := range params {
+		// Catch-all values keep their slashes; everything else is one segment
+		escaped := url.PathEscape(value)
+		if name == t.rest {
+			parts := strings.Split(value, "/")
+			for i, p := range parts {
+				parts[i] = url.PathEscape(p)
+			}
+			escaped = strings.Join(parts, "/")
+		}
+		path = strings.ReplaceAll(path, "{"+name+"}", escaped)
+	}
+	unescaped, err := url.PathUnescape(path)
+	if err != nil {
+		return false
+	}
+	u.Path, u.RawPath = unescaped, path
+	if u.RawPath == u.Path {
+		u.RawPath = ""
+	}
+
+	if t.query != "" {
+		q := u.Query()
+		for _, kv := range strings.Split(t.query, "&") {
+			k, v, _ := strings.Cut(kv, "=")
+			for name, value := range params {
+				k = strings.ReplaceAll(k, "{"+name+"}", value)
+				v = strings.ReplaceAll(v, "{"+name+"}", value)
+			}
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+	}
+	return true
+}
+
+// match captures unescaped parameters from an escaped path, splitting on
+// literal slashes only so an encoded %2F stays inside its segment
+func (t *PathTemplate) match(escapedPath string) (map[string]string, bool) {
+	parts := strings.Split(strings.Trim(escapedPath, "/"), "/")
+	for i, p := range parts {
+		unescaped, err := url.PathUnescape(p)
+		if err != nil {
+			return nil, false
+		}
+		parts[i] = unescaped
+	}
+	params := make(map[string]string)
+	for i, seg := range t.segments {
+		name, isParam := paramName(seg)
+		if isParam && strings.HasSuffix(name, "...") {
+			if i >= len(parts) {
+				return nil, false
+			}
+			params[strings.TrimSuffix(name, "...")] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch {
+		case isParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[name] = parts[i]
+		case seg != parts[i]:
+			return nil, false
+		}
+	}
+	if len(parts) != len(t.segments) {
+		return nil, false
+	}
+	return params, true
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestPathTemplateRewrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  string
+		template string
+		in       string
+		want     string // "" = left untouched
+	}{
+		{"segment to query", "/api/v1/users/{id}", "/internal/user?id={id}", "/api/v1/users/42", "/internal/user?id=42"},
+		{"client query kept", "/api/v1/users/{id}", "/internal/user?id={id}", "/api/v1/users/42?fields=name", "/internal/user?fields=name&id=42"},
+		{"template query wins", "/api/v1/users/{id}", "/internal/user?id={id}", "/api/v1/users/42?id=7", "/internal/user?id=42"},
+		{"query value escaped", "/api/v1/users/{id}", "/internal/user?id={id}", "/api/v1/users/a%26b%3Dc%20d", "/internal/user?id=a%26b%3Dc+d"},
+		{"encoded slash stays in segment", "/api/v1/users/{id}", "/internal/user?id={id}", "/api/v1/users/a%2Fb", "/internal/user?id=a%2Fb"},
+		{"segment to segment", "/api/v1/users/{id}/posts/{post}", "/internal/posts/{post}?author={id}", "/api/v1/users/42/posts/7", "/internal/posts/7?author=42"},
+		{"path segment escaped", "/api/v1/users/{id}", "/internal/users/{id}", "/api/v1/users/a%2Fb%20c", "/internal/users/a%2Fb%20c"},
+		{"catch-all keeps slashes", "/files/{path...}", "/blobs/{path}", "/files/a/b%20c/d.txt", "/blobs/a/b%20c/d.txt"},
+		{"catch-all to query", "/files/{path...}", "/blob?key={path}", "/files/a/b", "/blob?key=a%2Fb"},
+		{"literal mismatch", "/api/v1/users/{id}", "/internal/user?id={id}", "/api/v1/groups/42", ""},
+		{"too few segments", "/api/v1/users/{id}", "/internal/user?id={id}", "/api/v1/users", ""},
+		{"too many segments", "/api/v1/users/{id}", "/internal/user?id={id}", "/api/v1/users/42/posts", ""},
+		{"empty parameter", "/api/v1/users/{id}", "/internal/user?id={id}", "/api/v1/users/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParsePathTemplate(tt.pattern, tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, _ := url.Parse(tt.in)
+			ok := tmpl.Rewrite(u)
+			if tt.want == "" {
+				if ok || u.String() != tt.in {
+					t.Fatalf("rewrote %s to %s, want it untouched", tt.in, u)
+				}
+				return
+			}
+			if !ok || u.String() != tt.want {
+				t.Fatalf("rewrote %s to %s (%v), want %s", tt.in, u, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePathTemplateErrors(t *testing.T) {
+	for _, tt := range []struct{ pattern, template string }{
+		{"api/{id}", "/internal/{id}"},
+		{"/api/{id}", "internal/{id}"},
+		{"/api/{id}", "/internal?user={name}"},
+		{"/api/{id}/{id}", "/internal/{id}"},
+		{"/api/{rest...}/more", "/internal/{rest}"},
+		{"/api/{id}", "/internal/{id"},
+	} {
+		if _, err := ParsePathTemplate(tt.pattern, tt.template); err == nil {
+			t.Errorf("ParsePathTemplate(%q, %q) accepted", tt.pattern, tt.template)
+		}
+	}
+}
+
+func TestPathTemplateInDirector(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	tmpl, err := ParsePathTemplate("/api/v1/users/{id}", "/internal/user?id={id}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := NewReverseProxy(target, Config{Attempts: 1, PathTemplate: tmpl})
+
+	for in, want := range map[string]string{
+		"/api/v1/users/j%C3%B6rg%20k": "/internal/user?id=j%C3%B6rg+k",
+		// Paths outside the pattern are forwarded unchanged
+		"/api/v1/health": "/api/v1/health",
+	} {
+		rec := httptest.NewRecorder()
+		rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, in, nil))
+		if rec.Body.String() != want {
+			t.Errorf("%s reached the upstream as %s, want %s", in, rec.Body, want)
+		}
+	}
+}
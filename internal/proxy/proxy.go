@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"math"
@@ -11,10 +12,14 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"apigateway/internal/logger"
 	"apigateway/internal/middleware"
+
+	"golang.org/x/net/http2"
 )
 
 // Config holds reverse proxy configuration
@@ -23,39 +28,284 @@ type Config struct {
 	BaseBackoff  time.Duration
 	MaxBackoff   time.Duration
 	TargetServer string
+
+	// MinRetryInterval is the least time between the starts of consecutive
+	// attempts, however fast the failed one was (zero disables)
+	MinRetryInterval time.Duration
+
+	// ResponseHeaderTimeout bounds the wait for upstream response headers
+	// (zero uses the 20s default)
+	ResponseHeaderTimeout time.Duration
+
+	// OutboundProxy routes upstream traffic through a fixed egress proxy,
+	// overriding HTTP(S)_PROXY from the environment. DirectEgress bypasses
+	// any proxy. With neither set, ProxyFromEnvironment is used.
+	OutboundProxy *url.URL
+	DirectEgress  bool
+
+	// TLS version bounds for upstream connections (zero MinTLSVersion means
+	// TLS 1.2, zero MaxTLSVersion the newest supported)
+	MinTLSVersion uint16
+	MaxTLSVersion uint16
+
+	// ClientTLS adds a client certificate, a private CA bundle, or both
+	// for upstreams that need them (nil uses the system roots, no client
+	// certificate)
+	ClientTLS *ClientTLS
+
+	// IsolateConnections gives every backend its own transport, so replicas
+	// never share a connection pool, TLS session cache, or HTTP/2
+	// connection. DisableHTTP2 speaks HTTP/1.1 only, one request per
+	// connection at a time.
+	IsolateConnections bool
+	DisableHTTP2       bool
+
+	// PreserveHeaders are never stripped as hop-by-hop, even when listed in
+	// the Connection header. This is an escape hatch for unusual upstream
+	// contracts: forwarding connection-scoped headers can break framing or
+	// leak proxy credentials upstream, so keep it empty unless required.
+	PreserveHeaders []string
+
+	// HTTP/2 upstream health checks: after ReadIdleTimeout without frames
+	// the connection is pinged, and closed if no reply arrives within
+	// PingTimeout (zero ReadIdleTimeout disables pings)
+	ReadIdleTimeout time.Duration
+	PingTimeout     time.Duration
+
+	// MaxConnAge retires upstream connections this long after they were
+	// dialed, once their in-flight requests finish (zero disables), for
+	// NATs that silently drop long-lived flows. MaxIdleConnAge closes
+	// connections left idle in the pool this long (zero means 90s).
+	MaxConnAge     time.Duration
+	MaxIdleConnAge time.Duration
+
+	// FlushInterval controls response streaming to the client (zero buffers,
+	// negative flushes after every write)
+	FlushInterval time.Duration
+
+	// MaxResponseBytes caps the upstream response body (zero or negative
+	// disables the limit, e.g. for streaming passthrough routes)
+	MaxResponseBytes int64
+
+	// Recorder receives upstream latency, retry, and error observations
+	// (nil disables)
+	Recorder Recorder
+
+	// DeadLetter receives non-idempotent requests that still failed after
+	// retries (nil disables capture). DeadLetterMaxBytes bounds the body kept.
+	DeadLetter         DeadLetterSink
+	DeadLetterMaxBytes int64
+
+	// RetryMatch optionally marks otherwise successful responses as retryable
+	// based on their body (nil disables body inspection)
+	RetryMatch *RetryMatch
+
+	// RetryOn429 retries idempotent requests answered 429 Too Many
+	// Requests, like 5xx responses
+	RetryOn429 bool
+
+	// Breaker opens a per-host circuit after consecutive failed requests
+	// or while requests are too slow (zero thresholds disable it)
+	Breaker BreakerConfig
+
+	// Outlier takes replicas that keep failing out of rotation for a while
+	// (threshold 0, or a single backend, disables it)
+	Outlier OutlierConfig
+
+	// Balancer selects the policy used when there are several backends
+	Balancer BalancerConfig
+
+	// Select pins requests to a backend by request header before
+	// balancing (nil disables)
+	Select *HeaderSelect
+
+	// ErrorStatus overrides DefaultErrorStatus per error class
+	ErrorStatus map[string]int
+
+	// ErrorLog collapses repeated identical proxy_error lines into periodic
+	// counts (nil logs every error)
+	ErrorLog *ErrorLog
+
+	// Replay controls how request bodies are buffered so idempotent
+	// requests can be retried
+	Replay ReplayConfig
+
+	// StripPrefix is removed from request paths before forwarding
+	// (empty forwards paths unchanged)
+	StripPrefix string
+
+	// PathTemplate reshapes matching request paths for the upstream
+	// (nil forwards paths unchanged)
+	PathTemplate *PathTemplate
+
+	// StripQuery drops the client's query string before forwarding, for
+	// upstreams that ignore it (false forwards it unchanged)
+	StripQuery bool
+
+	// Fault injects synthetic upstream failures for resilience testing
+	// (nil disables)
+	Fault *Fault
+
+	// Cache answers repeated GETs from memory while fresh (nil disables)
+	Cache *Cache
+
+	// StaleIfError serves the last good response to a GET when the upstream
+	// fails (nil disables)
+	StaleIfError *StaleIfError
+
+	// Fallback answers GET/HEAD with static content when the upstream is
+	// unavailable and no stale response exists (nil disables)
+	Fallback *Fallback
+
+	// Coalesce merges concurrent identical GET/HEAD requests into one
+	// upstream call (nil disables)
+	Coalesce *Coalesce
+
+	// Transcode decodes Protobuf responses as JSON (nil disables)
+	Transcode *Transcode
+
+	// URLRewrite maps upstream base URLs to external ones in JSON response
+	// bodies (nil disables)
+	URLRewrite *URLRewrite
+
+	// Minify strips insignificant whitespace from JSON/HTML response
+	// bodies (nil disables)
+	Minify *Minify
+
+	// ResponseHeaders strips or renames upstream response headers before
+	// they reach the client (nil forwards them unchanged)
+	ResponseHeaders *HeaderRules
 }
 
 // NewReverseProxy creates a reverse proxy with retries and proper header handling
 func NewReverseProxy(target *url.URL, cfg Config) *httputil.ReverseProxy {
-	// Base transport with sane timeouts + SNI
-	base := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   5 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          256,
-		MaxIdleConnsPerHost:   64,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   5 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		ResponseHeaderTimeout: 20 * time.Second,
-		TLSClientConfig: &tls.Config{
-			ServerName: cfg.TargetServer,
-			MinVersion: tls.VersionTLS12,
-		},
+	rp, _ := NewBalancedProxy([]Backend{{URL: target, Weight: 1}}, cfg) // a single backend can't fail
+	return rp
+}
+
+// NewBalancedProxy creates a reverse proxy that spreads requests across
+// backends using cfg.Balancer
+func NewBalancedProxy(backends []Backend, cfg Config) (*httputil.ReverseProxy, error) {
+	var balancer Balancer
+	var err error
+	if cfg.Select != nil {
+		balancer, err = NewHeaderSelector(cfg.Balancer, backends, *cfg.Select)
+	} else {
+		balancer, err = NewBalancer(cfg.Balancer, backends)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var outliers *outlierDetector
+	if cfg.Outlier.Threshold > 0 && len(backends) > 1 {
+		outliers = newOutlierDetector(cfg.Outlier)
+		balancer = &outlierBalancer{next: balancer, backends: backends, detector: outliers}
+	}
+	upstreamName := backends[0].URL.Host
+	if len(backends) > 1 {
+		upstreamName = fmt.Sprintf("%s (+%d)", upstreamName, len(backends)-1)
+	}
+
+	var base http.RoundTripper
+	if cfg.IsolateConnections && len(backends) > 1 {
+		isolated := &isolatedTransport{byHost: make(map[string]http.RoundTripper, len(backends))}
+		for _, b := range backends {
+			if isolated.byHost[b.URL.Host], err = NewTransport(backends, cfg); err != nil {
+				return nil, err
+			}
+		}
+		base = isolated
+	} else if base, err = NewTransport(backends, cfg); err != nil {
+		return nil, err
+	}
+
+	// Aged connections are only closed between requests
+	if cfg.MaxConnAge > 0 {
+		base = &agedTransport{next: base}
+	}
+
+	// Injected faults replace the network call itself
+	var attempt http.RoundTripper = base
+	if cfg.Fault != nil && cfg.Fault.Rate > 0 {
+		attempt = &faultTransport{next: base, fault: *cfg.Fault, timeout: cfg.responseHeaderTimeout()}
+	}
+
+	// The breaker judges latency per attempt, not across backoff sleeps
+	if cfg.Breaker.LatencyThreshold > 0 {
+		attempt = &attemptTimer{next: attempt}
+	}
+
+	// Time each attempt below the retry layer so retries are observed too
+	if cfg.Recorder != nil {
+		attempt = &timedTransport{next: attempt, recorder: cfg.Recorder}
+	}
+
+	// Every attempt counts towards its replica's ejection
+	if outliers != nil {
+		attempt = &outlierTransport{next: attempt, detector: outliers}
+	}
+
+	// least_conn counts every attempt while it is in flight
+	if lc := leastConnOf(balancer); lc != nil {
+		attempt = &inflightTransport{next: attempt, lc: lc}
 	}
 
 	// Wrap transport with retries
 	retrying := &retryingRoundTripper{
-		next:      base,
+		next:      attempt,
 		attempts:  cfg.Attempts,
 		baseDelay: cfg.BaseBackoff,
 		maxDelay:  cfg.MaxBackoff,
+		minGap:    cfg.MinRetryInterval,
+		match:     cfg.RetryMatch,
+		retry429:  cfg.RetryOn429,
+		replay:    cfg.Replay,
+		recorder:  cfg.Recorder,
+	}
+	if len(backends) > 1 {
+		retrying.balancer = balancer
+	}
+
+	// Fail fast on hosts that keep failing, or are too slow to be of use,
+	// instead of retrying into them
+	var outer http.RoundTripper = retrying
+	if cfg.Breaker.Threshold > 0 || cfg.Breaker.LatencyThreshold > 0 {
+		outer = newBreakerTransport(outer, cfg.Breaker)
+	}
+
+	// Critical routes capture failed writes for later replay
+	if cfg.DeadLetter != nil {
+		outer = &deadLetterTransport{next: outer, sink: cfg.DeadLetter, maxBytes: cfg.DeadLetterMaxBytes}
+	}
+
+	// Fresh reads are answered without an upstream call
+	if cfg.Cache != nil {
+		outer = newCacheTransport(outer, *cfg.Cache)
+	}
+
+	// Reads fall back to their last good response during outages
+	if cfg.StaleIfError != nil {
+		outer = newStaleTransport(outer, *cfg.StaleIfError)
+	}
+
+	// Reads that still failed get a static default instead of an error
+	if cfg.Fallback != nil {
+		outer = &fallbackTransport{next: outer, fallback: *cfg.Fallback}
+	}
+
+	// Identical concurrent reads share one upstream exchange
+	if cfg.Coalesce != nil {
+		outer = newCoalescingTransport(outer, *cfg.Coalesce)
+	}
+
+	preserve := make(map[string]bool, len(cfg.PreserveHeaders))
+	for _, h := range cfg.PreserveHeaders {
+		preserve[http.CanonicalHeaderKey(h)] = true
 	}
 
 	director := func(r *http.Request) {
+		target := balancer.Next(r).URL
+
 		// Set upstream target scheme/host
 		r.URL.Scheme = target.Scheme
 		r.URL.Host = target.Host
@@ -63,6 +313,20 @@ func NewReverseProxy(target *url.URL, cfg Config) *httputil.ReverseProxy {
 		// Set Host header to upstream host
 		r.Host = target.Host
 
+		// Cleared before the path template so its own query parameters
+		// still apply, and before the transports so coalescing and stale
+		// keys see the URL the upstream gets
+		if cfg.StripQuery {
+			r.URL.RawQuery = ""
+			r.URL.ForceQuery = false
+		}
+
+		if cfg.PathTemplate != nil && cfg.PathTemplate.Rewrite(r.URL) {
+			middleware.SetUpstreamPath(r, r.URL.Path)
+		} else if cfg.StripPrefix != "" && stripPrefix(r.URL, cfg.StripPrefix) {
+			middleware.SetUpstreamPath(r, r.URL.Path)
+		}
+
 		// Set X-Real-IP header
 		clientIP := middleware.ExtractClientIP(r)
 		if clientIP != "" {
@@ -88,29 +352,216 @@ func NewReverseProxy(target *url.URL, cfg Config) *httputil.ReverseProxy {
 			}
 		}
 
-		// Remove hop-by-hop headers
-		r.Header.Del("Connection")
+		// Remove hop-by-hop headers (except allow-listed ones)
+		if saved := stripHopByHop(r.Header, preserve); saved != nil {
+			withPreserved(r, saved)
+		}
 	}
 
 	rp := &httputil.ReverseProxy{
-		Director:  director,
-		Transport: retrying,
+		Director:      director,
+		Transport:     &preserveTransport{next: outer},
+		FlushInterval: cfg.FlushInterval,
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, e error) {
-			logger.Log.Error("proxy_error",
-				slog.String("request_id", middleware.GetRequestID(r)),
-				slog.String("upstream", target.Host),
-				slog.String("method", r.Method),
-				slog.String("path", r.URL.Path),
-				slog.String("error", e.Error()),
-			)
-			http.Error(w, "bad gateway", http.StatusBadGateway)
+			class := classifyError(e)
+			status := errorStatus(class, cfg.ErrorStatus)
+
+			// A client that hung up isn't an upstream failure, and an open
+			// circuit was already reported when it opened
+			level := slog.LevelError
+			switch class {
+			case ErrClassCanceled:
+				level = slog.LevelInfo
+			case ErrClassCircuit:
+				level = slog.LevelWarn
+			}
+			if cfg.ErrorLog.first(level, upstreamName, class, status, e.Error()) {
+				logger.Log.Log(r.Context(), level, "proxy_error",
+					slog.String("request_id", middleware.GetRequestID(r)),
+					slog.String("upstream", upstreamName),
+					slog.String("method", r.Method),
+					slog.String("path", r.URL.Path),
+					slog.String("class", class),
+					slog.Int("status", status),
+					slog.String("error", e.Error()),
+				)
+			}
+
+			if class == ErrClassCanceled {
+				// Nobody is listening; record the status for access logs only
+				w.WriteHeader(status)
+				return
+			}
+			text := http.StatusText(status)
+			middleware.WriteJSONError(w, status, strings.ToUpper(strings.ReplaceAll(text, " ", "_")),
+				strings.ToLower(text), middleware.GetRequestID(r))
 		},
 		ModifyResponse: func(resp *http.Response) error {
+			watchTruncation(resp)
+			if err := limitResponse(resp, cfg.MaxResponseBytes); err != nil {
+				return err
+			}
+			// First, so the JSON transforms below also see transcoded bodies
+			if err := cfg.Transcode.apply(resp); err != nil {
+				return err
+			}
+			if err := cfg.URLRewrite.apply(resp); err != nil {
+				return err
+			}
+			if err := cfg.Minify.apply(resp); err != nil {
+				return err
+			}
+			// Last, so nothing earlier can reintroduce a filtered header
+			cfg.ResponseHeaders.apply(resp.Header)
 			return nil
 		},
 	}
 
-	return rp
+	return rp, nil
+}
+
+// NewTransport builds the connection-level transport NewBalancedProxy uses
+// for backends: timeouts, SNI, client TLS, the egress proxy and HTTP/2.
+// Health probes use it so they reach upstreams the way requests do.
+func NewTransport(backends []Backend, cfg Config) (*http.Transport, error) {
+	// Egress proxy: environment by default, overridable per upstream
+	egress := http.ProxyFromEnvironment
+	switch {
+	case cfg.DirectEgress:
+		egress = nil
+	case cfg.OutboundProxy != nil:
+		egress = http.ProxyURL(cfg.OutboundProxy)
+	}
+
+	minTLS := cfg.MinTLSVersion
+	if minTLS == 0 {
+		minTLS = tls.VersionTLS12
+	}
+
+	idleConnTimeout := cfg.MaxIdleConnAge
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = 90 * time.Second
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if cfg.MaxConnAge > 0 {
+		dial = (&agedDialer{dial: dial, maxAge: cfg.MaxConnAge}).DialContext
+	}
+	t := &http.Transport{
+		Proxy:                 egress,
+		DialContext:           dial,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   64,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: cfg.responseHeaderTimeout(),
+		TLSClientConfig: &tls.Config{
+			ServerName: serverName(cfg.TargetServer, backends),
+			MinVersion: minTLS,
+			MaxVersion: cfg.MaxTLSVersion,
+		},
+	}
+	if err := cfg.ClientTLS.apply(t.TLSClientConfig); err != nil {
+		return nil, err
+	}
+	if cfg.DisableHTTP2 {
+		// A non-nil empty map keeps ALPN from ever selecting h2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		return t, nil
+	}
+
+	if err := configureHTTP2(t, cfg); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// responseHeaderTimeout defaults ResponseHeaderTimeout to 20s
+func (cfg Config) responseHeaderTimeout() time.Duration {
+	if cfg.ResponseHeaderTimeout <= 0 {
+		return 20 * time.Second
+	}
+	return cfg.ResponseHeaderTimeout
+}
+
+// configureHTTP2 switches t to the x/net HTTP/2 client when a setting
+// needs it; otherwise the standard library's built-in one is kept
+func configureHTTP2(t *http.Transport, cfg Config) error {
+	if cfg.ReadIdleTimeout <= 0 && cfg.MaxConnAge <= 0 {
+		return nil
+	}
+	h2, err := http2.ConfigureTransports(t)
+	if err != nil {
+		return err
+	}
+	// Ping idle HTTP/2 connections so ones silently dropped by stateful
+	// firewalls are pruned before a request is sent on them
+	if cfg.ReadIdleTimeout > 0 {
+		h2.ReadIdleTimeout = cfg.ReadIdleTimeout
+		h2.PingTimeout = cfg.PingTimeout
+	}
+	// A busy HTTP/2 connection always has a stream in flight, so it must
+	// stop taking new ones to ever be retired
+	if cfg.MaxConnAge > 0 {
+		h2.ConnPool = &agedConnPool{
+			ClientConnPool: h2.ConnPool,
+			maxAge:         cfg.MaxConnAge,
+			retire:         make(map[*http2.ClientConn]time.Time),
+		}
+	}
+	return nil
+}
+
+// stripPrefix removes prefix from u's path, leaving at least "/". The
+// prefix must end at a segment boundary: /api/users strips from
+// /api/users/1 but not /api/usersx.
+func stripPrefix(u *url.URL, prefix string) bool {
+	if u.Path != prefix && !strings.HasPrefix(u.Path, prefix+"/") {
+		return false
+	}
+	u.Path = "/" + strings.TrimPrefix(u.Path[len(prefix):], "/")
+	// Keep escapes like %2F in the remainder when the prefix itself is unescaped
+	if u.RawPath == prefix || strings.HasPrefix(u.RawPath, prefix+"/") {
+		u.RawPath = "/" + strings.TrimPrefix(u.RawPath[len(prefix):], "/")
+	} else {
+		u.RawPath = ""
+	}
+	return true
+}
+
+// serverName pins SNI only for single-backend proxies; with several
+// backends the transport derives it from each request's host
+func serverName(target string, backends []Backend) string {
+	if len(backends) > 1 {
+		return ""
+	}
+	return target
+}
+
+// isolatedTransport sends each request through the transport owned by its
+// backend. Go pools connections by scheme and host:port, so requests never
+// reuse a connection opened for another host name; isolation additionally
+// keeps replicas from sharing pool limits and TLS session state, whatever
+// the transport underneath.
+type isolatedTransport struct {
+	byHost map[string]http.RoundTripper // backend host:port -> transport
+}
+
+func (t *isolatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt, ok := t.byHost[req.URL.Host]
+	if !ok {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("no transport for upstream %s", req.URL.Host)
+	}
+	return rt.RoundTrip(req)
 }
 
 // ---------------- Retries ----------------
@@ -130,6 +581,12 @@ type retryingRoundTripper struct {
 	attempts  int
 	baseDelay time.Duration
 	maxDelay  time.Duration
+	minGap    time.Duration
+	match     *RetryMatch
+	retry429  bool
+	replay    ReplayConfig
+	recorder  Recorder
+	balancer  Balancer // set when there are replicas; retries move to another one
 }
 
 func (rt *retryingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -144,7 +601,38 @@ func (rt *retryingRoundTripper) RoundTrip(req *http.Request) (*http.Response, er
 		return rt.next.RoundTrip(req)
 	}
 
+	// Server request bodies can only be read once; keep a copy for retries
+	if canRetry && attempts > 1 && req.GetBody == nil && req.Body != nil && req.Body != http.NoBody {
+		buffered, cleanup, err := bufferBody(req, rt.replay)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		if !buffered {
+			// Too large to keep: send once, releasing any partial spill after
+			resp, err := rt.next.RoundTrip(req)
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+			resp.Body = &cleanupBody{ReadCloser: resp.Body, cleanup: cleanup}
+			return resp, nil
+		}
+		resp, err := rt.roundTripWithRetries(req, attempts, canRetry)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		resp.Body = &cleanupBody{ReadCloser: resp.Body, cleanup: cleanup}
+		return resp, nil
+	}
+
+	return rt.roundTripWithRetries(req, attempts, canRetry)
+}
+
+func (rt *retryingRoundTripper) roundTripWithRetries(req *http.Request, attempts int, canRetry bool) (*http.Response, error) {
 	var lastErr error
+	host := req.URL.Host
 	for i := 0; i < attempts; i++ {
 		// Clone the request for each attempt
 		tryReq := req.Clone(req.Context())
@@ -156,6 +644,16 @@ func (rt *retryingRoundTripper) RoundTrip(req *http.Request) (*http.Response, er
 			tryReq.Body = body
 		}
 
+		// Retry on a different replica than the one that just failed
+		if i > 0 && rt.balancer != nil {
+			target := nextOther(rt.balancer, req, host).URL
+			tryReq.URL.Scheme = target.Scheme
+			tryReq.URL.Host = target.Host
+			tryReq.Host = target.Host
+			host = target.Host
+		}
+
+		started := time.Now()
 		resp, err := rt.next.RoundTrip(tryReq)
 		// Network/transport error: retry if allowed
 		if err != nil {
@@ -163,37 +661,73 @@ func (rt *retryingRoundTripper) RoundTrip(req *http.Request) (*http.Response, er
 			if !canRetry || i == attempts-1 {
 				return nil, err
 			}
+			rt.observeRetry(host, "error")
 			logger.Log.Warn("proxy_retry",
 				slog.String("request_id", middleware.GetRequestID(req)),
-				slog.String("upstream", req.URL.Host),
+				slog.String("upstream", host),
 				slog.String("method", req.Method),
 				slog.String("path", req.URL.Path),
 				slog.Int("attempt", i+1),
 				slog.Int("max_attempts", attempts),
 				slog.String("error", err.Error()),
 			)
-			sleepBackoff(req.Context(), rt.baseDelay, rt.maxDelay, i)
+			rt.backoff(req.Context(), i, started, 0)
 			continue
 		}
 
-		// If upstream returns 5xx, retry for idempotent requests
+		// If upstream returns 5xx (or 429), retry for idempotent requests,
+		// waiting at least as long as its Retry-After asks
+		if canRetry && i < attempts-1 && resp.StatusCode == http.StatusTooManyRequests && rt.retry429 {
+			rt.observeRetry(host, "429")
+			logger.Log.Warn("proxy_retry_429",
+				slog.String("request_id", middleware.GetRequestID(req)),
+				slog.String("upstream", host),
+				slog.String("method", req.Method),
+				slog.String("path", req.URL.Path),
+				slog.Int("attempt", i+1),
+				slog.Int("max_attempts", attempts),
+			)
+			wait := retryAfter(resp, time.Now())
+			discardResponse(resp)
+			rt.backoff(req.Context(), i, started, wait)
+			continue
+		}
 		if resp.StatusCode >= 500 && resp.StatusCode <= 599 && canRetry && i < attempts-1 {
+			rt.observeRetry(host, "5xx")
 			logger.Log.Warn("proxy_retry_5xx",
 				slog.String("request_id", middleware.GetRequestID(req)),
-				slog.String("upstream", req.URL.Host),
+				slog.String("upstream", host),
+				slog.String("method", req.Method),
+				slog.String("path", req.URL.Path),
+				slog.Int("status", resp.StatusCode),
+				slog.Int("attempt", i+1),
+				slog.Int("max_attempts", attempts),
+			)
+			wait := retryAfter(resp, time.Now())
+			discardResponse(resp)
+			rt.backoff(req.Context(), i, started, wait)
+			continue
+		}
+
+		// Some upstreams report transient failures inside a 2xx envelope
+		if canRetry && i < attempts-1 && rt.match.retryable(resp) {
+			rt.observeRetry(host, "body")
+			logger.Log.Warn("proxy_retry_body",
+				slog.String("request_id", middleware.GetRequestID(req)),
+				slog.String("upstream", host),
 				slog.String("method", req.Method),
 				slog.String("path", req.URL.Path),
 				slog.Int("status", resp.StatusCode),
 				slog.Int("attempt", i+1),
 				slog.Int("max_attempts", attempts),
 			)
-			// Must close body before retrying to avoid leaks
-			io.Copy(io.Discard, resp.Body)
-			resp.Body.Close()
-			sleepBackoff(req.Context(), rt.baseDelay, rt.maxDelay, i)
+			discardResponse(resp)
+			rt.backoff(req.Context(), i, started, 0)
 			continue
 		}
 
+		// Only this attempt's response is returned; discarded attempts never
+		// contribute headers (Set-Cookie included) to what the client sees
 		return resp, nil
 	}
 
@@ -203,18 +737,46 @@ func (rt *retryingRoundTripper) RoundTrip(req *http.Request) (*http.Response, er
 	return nil, lastErr
 }
 
-func sleepBackoff(ctx context.Context, base, max time.Duration, attempt int) {
-	if base <= 0 {
-		base = 100 * time.Millisecond
+func (rt *retryingRoundTripper) observeRetry(upstream, reason string) {
+	if rt.recorder != nil {
+		rt.recorder.ObserveRetry(upstream, reason)
 	}
-	if max <= 0 {
-		max = 2 * time.Second
+}
+
+// maxDrainBytes bounds how much of a discarded response is read so its
+// connection can be reused; anything larger is closed instead
+const maxDrainBytes = 256 << 10
+
+// discardResponse releases a response that will not reach the client
+func discardResponse(resp *http.Response) {
+	io.CopyN(io.Discard, resp.Body, maxDrainBytes)
+	resp.Body.Close()
+}
+
+// retryAfter reads a Retry-After header in either delay-seconds or
+// HTTP-date form; missing, malformed, or past values yield 0
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0
 	}
-	// Exponential backoff: base * 2^attempt, capped
-	mult := math.Pow(2, float64(attempt))
-	d := time.Duration(float64(base) * mult)
-	if d > max {
-		d = max
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs <= 0 || secs > math.MaxInt64/int64(time.Second) {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// backoff waits before the attempt after the one that began at started
+func (rt *retryingRoundTripper) backoff(ctx context.Context, attempt int, started time.Time, atLeast time.Duration) {
+	d := backoffDelay(rt.baseDelay, rt.maxDelay, rt.minGap, attempt, time.Since(started), atLeast)
+	if d == 0 {
+		return
 	}
 	timer := time.NewTimer(d)
 	defer timer.Stop()
@@ -226,3 +788,36 @@ func sleepBackoff(ctx context.Context, base, max time.Duration, attempt int) {
 		return
 	}
 }
+
+// backoffDelay is how long to wait before the next attempt. The exponential
+// delay (at least minGap) spaces the starts of attempts, so time the failed
+// attempt already took counts towards it: an upstream that refuses
+// connections instantly still gets the full spacing, and one that timed out
+// slowly is retried at once. atLeast is the upstream's requested delay (0 if
+// none), counted from its response. Both are capped at max, so a long
+// Retry-After can't hold the request indefinitely.
+func backoffDelay(base, max, minGap time.Duration, attempt int, elapsed, atLeast time.Duration) time.Duration {
+	if base <= 0 {
+		base = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 2 * time.Second
+	}
+	// Exponential backoff: base * 2^attempt
+	mult := math.Pow(2, float64(attempt))
+	d := time.Duration(float64(base) * mult)
+	if d < minGap {
+		d = minGap
+	}
+	d -= elapsed
+	if atLeast > d {
+		d = atLeast
+	}
+	if d > max {
+		d = max
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"apigateway/internal/middleware"
+)
+
+func TestGzipChunkedUpstreamCompressedOnce(t *testing.T) {
+	text := strings.Repeat("already compressed upstream body\n", 400)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		// Flushing before the end forces chunked transfer
+		for i := 0; i < 4; i++ {
+			io.WriteString(gz, text[i*len(text)/4:(i+1)*len(text)/4])
+			gz.Flush()
+			w.(http.Flusher).Flush()
+		}
+		gz.Close()
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	gw := httptest.NewServer(middleware.WithGzip(middleware.GzipConfig{},
+		NewReverseProxy(target, Config{Attempts: 1})))
+	defer gw.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, gw.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req) // no transparent decompression
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Values("Content-Encoding"); len(got) != 1 || got[0] != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want a single gzip", got)
+	}
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" || resp.ContentLength != -1 {
+		t.Fatalf("framing = %v, Content-Length %d; want chunked", resp.TransferEncoding, resp.ContentLength)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("body isn't valid gzip: %v", err)
+	}
+	if string(got) != text {
+		t.Fatalf("body decompressed once = %.40q..., want the upstream text", got)
+	}
+}
+
+func TestSingleAttemptDoesNotRetry503(t *testing.T) {
+	for _, attempts := range []int{1, 3} {
+		var mu sync.Mutex
+		calls := 0
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		target, _ := url.Parse(upstream.URL)
+		rec := httptest.NewRecorder()
+		NewReverseProxy(target, Config{Attempts: attempts, BaseBackoff: time.Millisecond}).
+			ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		upstream.Close()
+
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("attempts=%d: status = %d, want 503", attempts, rec.Code)
+		}
+		if calls != attempts {
+			t.Errorf("attempts=%d: upstream called %d times", attempts, calls)
+		}
+	}
+}
+
+func TestRetryKeepsOnlyFinalAttemptsCookies(t *testing.T) {
+	var mu sync.Mutex
+	attempt := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempt++
+		n := attempt
+		mu.Unlock()
+		w.Header().Add("Set-Cookie", "attempt="+strconv.Itoa(n))
+		w.Header().Add("Set-Cookie", "session=s"+strconv.Itoa(n))
+		w.Header().Set("X-Attempt", strconv.Itoa(n))
+		if n < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "busy")
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	rp := NewReverseProxy(target, Config{Attempts: 3, BaseBackoff: time.Millisecond})
+
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("got %d %q, want the third attempt's response", rec.Code, rec.Body)
+	}
+	cookies := rec.Header().Values("Set-Cookie")
+	if len(cookies) != 2 || cookies[0] != "attempt=3" || cookies[1] != "session=s3" {
+		t.Fatalf("Set-Cookie = %q, want only the final attempt's", cookies)
+	}
+	if got := rec.Header().Values("X-Attempt"); len(got) != 1 || got[0] != "3" {
+		t.Fatalf("X-Attempt = %q, want 3", got)
+	}
+}
+
+func TestStripQuery(t *testing.T) {
+	for _, strip := range []bool{true, false} {
+		var mu sync.Mutex
+		var seen []string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen = append(seen, r.URL.RawQuery)
+			mu.Unlock()
+		}))
+		target, _ := url.Parse(upstream.URL)
+		rp := NewReverseProxy(target, Config{Attempts: 1, StripQuery: strip})
+		for _, q := range []string{"?a=1", "?a=2&b", "?"} {
+			rp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items"+q, nil))
+		}
+		upstream.Close()
+
+		mu.Lock()
+		if strip {
+			if len(seen) != 3 || seen[0] != "" || seen[1] != "" || seen[2] != "" {
+				t.Errorf("stripping: upstream saw queries %q, want none", seen)
+			}
+		} else if len(seen) != 3 || seen[0] != "a=1" || seen[1] != "a=2&b" {
+			t.Errorf("preserving: upstream saw queries %q", seen)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name                string
+		base, max, minGap   time.Duration
+		attempt             int
+		elapsed, retryAfter time.Duration
+		want                time.Duration
+	}{
+		{"fast fail waits the full backoff", 100 * ms, 2000 * ms, 0, 0, 0, 0, 100 * ms},
+		{"exponential", 100 * ms, 2000 * ms, 0, 2, 0, 0, 400 * ms},
+		{"capped", 100 * ms, 2000 * ms, 0, 10, 0, 0, 2000 * ms},
+		{"min interval floors a small backoff", 10 * ms, 2000 * ms, 300 * ms, 0, 0, 0, 300 * ms},
+		{"fast fail under min interval", 10 * ms, 2000 * ms, 300 * ms, 0, 5 * ms, 0, 295 * ms},
+		{"elapsed time counts", 100 * ms, 2000 * ms, 0, 1, 150 * ms, 0, 50 * ms},
+		{"slow fail retries at once", 100 * ms, 2000 * ms, 300 * ms, 0, 5000 * ms, 0, 0},
+		{"retry-after beats a shorter backoff", 100 * ms, 2000 * ms, 0, 0, 0, 1000 * ms, 1000 * ms},
+		{"retry-after after a slow fail", 100 * ms, 2000 * ms, 0, 0, 5000 * ms, 1000 * ms, 1000 * ms},
+		{"retry-after capped", 100 * ms, 2000 * ms, 0, 0, 0, 60000 * ms, 2000 * ms},
+		{"defaults", 0, 0, 0, 0, 0, 0, 100 * ms},
+	}
+	for _, tt := range tests {
+		got := backoffDelay(tt.base, tt.max, tt.minGap, tt.attempt, tt.elapsed, tt.retryAfter)
+		if got != tt.want {
+			t.Errorf("%s: backoffDelay = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for v, want := range map[string]time.Duration{
+		"":                              0,
+		"5":                             5 * time.Second,
+		" 5 ":                           5 * time.Second,
+		"0":                             0,
+		"-3":                            0,
+		"soon":                          0,
+		"99999999999999999":             0,
+		"Wed, 01 Jan 2025 12:00:30 GMT": 30 * time.Second,
+		"Wed, 01 Jan 2025 11:59:00 GMT": 0,
+	} {
+		resp := &http.Response{Header: http.Header{"Retry-After": {v}}}
+		if got := retryAfter(resp, now); got != want {
+			t.Errorf("retryAfter(%q) = %v, want %v", v, got, want)
+		}
+	}
+}
+
+// attemptGaps proxies one GET through an upstream that answers 503 after
+// delay and returns the time between the start of each attempt and the
+// end of the one before
+func attemptGaps(t *testing.T, cfg Config, delay time.Duration) []time.Duration {
+	t.Helper()
+	var mu sync.Mutex
+	var gaps []time.Duration
+	var ended time.Time
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if !ended.IsZero() {
+			gaps = append(gaps, time.Since(ended))
+		}
+		mu.Unlock()
+		time.Sleep(delay)
+		mu.Lock()
+		ended = time.Now()
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	rec := httptest.NewRecorder()
+	NewReverseProxy(target, cfg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want the last attempt's 503", rec.Code)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(gaps) != cfg.Attempts-1 {
+		t.Fatalf("%d retries, want %d", len(gaps), cfg.Attempts-1)
+	}
+	return gaps
+}
+
+func TestRetryFastFailWaitsMinInterval(t *testing.T) {
+	gaps := attemptGaps(t, Config{
+		Attempts:         3,
+		BaseBackoff:      time.Millisecond,
+		MaxBackoff:       time.Second,
+		MinRetryInterval: 150 * time.Millisecond,
+	}, 0)
+	for i, gap := range gaps {
+		if gap < 140*time.Millisecond {
+			t.Errorf("retry %d came %v after an instant failure, want about 150ms", i+1, gap)
+		}
+	}
+}
+
+func TestRetrySlowFailSkipsBackoff(t *testing.T) {
+	gaps := attemptGaps(t, Config{
+		Attempts:         2,
+		BaseBackoff:      200 * time.Millisecond,
+		MaxBackoff:       time.Second,
+		MinRetryInterval: 100 * time.Millisecond,
+	}, 300*time.Millisecond)
+	if gaps[0] > 100*time.Millisecond {
+		t.Errorf("retry came %v after a slow failure, want at once", gaps[0])
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	tests := []struct {
+		path     string
+		stripped bool
+		want     string
+	}{
+		{"/api/users", true, "/"},
+		{"/api/users/", true, "/"},
+		{"/api/users/42", true, "/42"},
+		{"/api/users/a%2Fb", true, "/a%2Fb"},
+		{"/api/usersx", false, "/api/usersx"},
+		{"/api/user", false, "/api/user"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse("http://gw" + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stripPrefix(u, "/api/users"); got != tt.stripped {
+			t.Errorf("%s: stripped = %v, want %v", tt.path, got, tt.stripped)
+		}
+		if got := u.EscapedPath(); got != tt.want {
+			t.Errorf("%s: path = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
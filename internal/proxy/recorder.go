@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Upstream Metrics ----------------
+
+// Recorder receives per-attempt upstream observations
+type Recorder interface {
+	ObserveUpstream(upstream, statusClass, traceID string, d time.Duration) // traceID may be empty
+	ObserveRetry(upstream, reason string)                                   // reason: error, 5xx, or body
+	ObserveError(upstream, class string)                                    // class: see classifyError
+}
+
+// timedTransport times each upstream attempt (including retries) and
+// reports it labeled by backend host and status class
+type timedTransport struct {
+	next     http.RoundTripper
+	recorder Recorder
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	class := "error"
+	if err == nil {
+		class = strconv.Itoa(resp.StatusCode/100) + "xx"
+	} else {
+		t.recorder.ObserveError(req.URL.Host, classifyError(err))
+	}
+	t.recorder.ObserveUpstream(req.URL.Host, class, middleware.TraceID(req), time.Since(start))
+	return resp, err
+}
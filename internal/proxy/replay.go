@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Retry Replay Buffer ----------------
+
+// Spill strategies for request bodies larger than ReplayConfig.MemoryBytes
+const (
+	SpillNone = "none" // don't buffer; the request is sent once without retries
+	SpillGzip = "gzip" // keep the body gzip-compressed in memory
+	SpillFile = "file" // stream the body to a temp file
+)
+
+// defaultReplayMemoryBytes bounds plain in-memory buffering when unset
+const defaultReplayMemoryBytes = 1 << 20
+
+// ReplayConfig controls how request bodies are kept for retries. Incoming
+// server requests can't be re-read, so retrying one with a body means
+// keeping a copy; large uploads can spill to a cheaper store.
+type ReplayConfig struct {
+	MemoryBytes int64  // bodies up to this size are kept as-is in memory
+	Spill       string // strategy above MemoryBytes: none, gzip, or file
+	MaxBytes    int64  // largest body spilled; bigger bodies aren't retried (0 = unlimited)
+	TempDir     string // directory for spill files (empty = os.TempDir)
+}
+
+// bufferBody makes req.Body replayable by setting req.GetBody. It reports
+// false when the body is too large to keep, in which case req.Body still
+// yields the full original stream and the request must not be retried.
+// cleanup releases spilled storage and is never nil.
+func bufferBody(req *http.Request, cfg ReplayConfig) (ok bool, cleanup func(), err error) {
+	cleanup = func() {}
+	memory := cfg.MemoryBytes
+	if memory <= 0 {
+		memory = defaultReplayMemoryBytes
+	}
+
+	head, err := io.ReadAll(io.LimitReader(req.Body, memory+1))
+	if err != nil {
+		return false, cleanup, err
+	}
+	if int64(len(head)) <= memory {
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(head))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(head)), nil
+		}
+		return true, cleanup, nil
+	}
+
+	// Spill stores see the head first, then at most the remaining budget
+	rest := req.Body
+	remaining := io.Reader(rest)
+	if cfg.MaxBytes > 0 {
+		remaining = io.LimitReader(rest, cfg.MaxBytes-int64(len(head))+1)
+	}
+
+	switch cfg.Spill {
+	case SpillGzip:
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		if _, err := gz.Write(head); err != nil {
+			// Nothing past head was read: send it once as received
+			req.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(head), rest), Closer: rest}
+			return false, cleanup, nil
+		}
+		// Past this point, deflate holds bytes it hasn't written out yet, so
+		// a failed write loses body data and fails the request. Writes to a
+		// bytes.Buffer don't fail, so this only guards against gzip itself.
+		n, err := io.Copy(gz, remaining)
+		if err != nil {
+			return false, cleanup, err
+		}
+		if err := gz.Close(); err != nil {
+			return false, cleanup, err
+		}
+		replay := func() (io.ReadCloser, error) {
+			return gzip.NewReader(bytes.NewReader(compressed.Bytes()))
+		}
+		if cfg.MaxBytes > 0 && int64(len(head))+n > cfg.MaxBytes {
+			stored, _ := replay()
+			req.Body = &replayBody{Reader: io.MultiReader(stored, rest), Closer: rest}
+			return false, cleanup, nil
+		}
+		rest.Close()
+		req.Body, _ = replay()
+		req.GetBody = replay
+		return true, cleanup, nil
+
+	case SpillFile:
+		f, err := os.CreateTemp(cfg.TempDir, "gateway-replay-*")
+		if err != nil {
+			return false, cleanup, err
+		}
+		cleanup = func() {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		spill := &spillWriter{w: f}
+		_, err = spill.Write(head)
+		if err == nil {
+			_, err = spill.copyFrom(remaining)
+		}
+		if spill.err != nil {
+			// Disk full or similar: send the request once, from what was
+			// stored, the chunk that failed, and whatever wasn't read yet
+			logger.Log.Warn("replay_spill_failed",
+				slog.String("request_id", middleware.GetRequestID(req)),
+				slog.String("method", req.Method),
+				slog.String("path", req.URL.Path),
+				slog.String("error", spill.err.Error()),
+			)
+			stored := io.NewSectionReader(f, 0, spill.written)
+			req.Body = &replayBody{Reader: io.MultiReader(stored, bytes.NewReader(spill.failed), rest), Closer: rest}
+			return false, cleanup, nil
+		}
+		if err != nil {
+			cleanup()
+			return false, func() {}, err
+		}
+		size := spill.written
+		replay := func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(f, 0, size)), nil
+		}
+		if cfg.MaxBytes > 0 && size > cfg.MaxBytes {
+			stored, _ := replay()
+			req.Body = &replayBody{Reader: io.MultiReader(stored, rest), Closer: rest}
+			return false, cleanup, nil
+		}
+		rest.Close()
+		req.Body, _ = replay()
+		req.GetBody = replay
+		return true, cleanup, nil
+
+	default: // SpillNone
+		req.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(head), rest), Closer: rest}
+		return false, cleanup, nil
+	}
+}
+
+// spillWriter counts the bytes that reached a spill store, and keeps the
+// part of a chunk that a failed write didn't store, so the body can still
+// be sent once
+type spillWriter struct {
+	w       io.Writer
+	written int64
+	failed  []byte
+	err     error
+}
+
+func (s *spillWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.written += int64(n)
+	if err != nil {
+		s.failed = append([]byte(nil), p[n:]...)
+		s.err = err
+	}
+	return n, err
+}
+
+// copyFrom copies r into the store. r's WriterTo is hidden so a failed
+// chunk is only ever bytes that were already read from r.
+func (s *spillWriter) copyFrom(r io.Reader) (int64, error) {
+	return io.Copy(s, struct{ io.Reader }{r})
+}
+
+// cleanupBody runs cleanup once the response body is closed, since the
+// transport may still be reading the request body until then
+type cleanupBody struct {
+	io.ReadCloser
+	cleanup func()
+}
+
+func (b *cleanupBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cleanup()
+	return err
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// fullDisk accepts room bytes, then fails every write
+type fullDisk struct {
+	bytes.Buffer
+	room int
+}
+
+func (d *fullDisk) Write(p []byte) (int, error) {
+	n := min(len(p), d.room-d.Len())
+	d.Buffer.Write(p[:n])
+	if n < len(p) {
+		return n, errors.New("no space left on device")
+	}
+	return n, nil
+}
+
+func TestSpillWriterKeepsUnstoredBytes(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 10000)
+	disk := &fullDisk{room: 12345}
+	spill := &spillWriter{w: disk}
+	rest := bytes.NewReader(body)
+	if _, err := spill.copyFrom(rest); err == nil || spill.err == nil {
+		t.Fatal("write failure not reported")
+	}
+	if spill.written != int64(disk.Len()) {
+		t.Fatalf("counted %d bytes written, store has %d", spill.written, disk.Len())
+	}
+	// What was stored, the failed chunk, and the unread rest make up the body
+	got, _ := io.ReadAll(io.MultiReader(bytes.NewReader(disk.Bytes()), bytes.NewReader(spill.failed), rest))
+	if !bytes.Equal(got, body) {
+		t.Fatalf("reassembled %d bytes, want the %d byte body", len(got), len(body))
+	}
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import "net/http"
+
+// ---------------- Response Header Filtering ----------------
+
+// HeaderRules hides upstream implementation details from clients
+type HeaderRules struct {
+	Strip  []string          // response headers removed entirely, e.g. Server
+	Rename map[string]string // old name -> new name, values kept
+}
+
+// apply strips then renames. A renamed header replaces any existing header
+// with the new name rather than merging into it.
+func (h *HeaderRules) apply(header http.Header) {
+	if h == nil {
+		return
+	}
+	for _, name := range h.Strip {
+		header.Del(name)
+	}
+	for from, to := range h.Rename {
+		values := header.Values(from)
+		if len(values) == 0 {
+			continue
+		}
+		header.Del(from)
+		header[http.CanonicalHeaderKey(to)] = values
+	}
+}
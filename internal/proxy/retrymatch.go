@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ---------------- Body-based Retry Predicate ----------------
+
+// defaultRetryMatchBytes caps body buffering when MaxBytes is unset
+const defaultRetryMatchBytes = 64 << 10
+
+// RetryMatch describes a response that should be retried even though the
+// upstream did not return a 5xx, e.g. a 200 carrying {"error":"try_again"}
+type RetryMatch struct {
+	Status   int    // status code to inspect (0 matches any status)
+	JSONPath string // dot-separated path into a JSON body, e.g. "error.code"
+	Value    string // expected value at JSONPath, or a body substring when JSONPath is empty
+	MaxBytes int64  // largest body that will be buffered for inspection
+}
+
+// retryable buffers up to MaxBytes of the response body and reports whether
+// it matches. The body is always restored so a non-matching response can
+// still be relayed to the client unchanged.
+func (m *RetryMatch) retryable(resp *http.Response) bool {
+	if m == nil || m.Value == "" || resp.Body == nil {
+		return false
+	}
+	if m.Status != 0 && resp.StatusCode != m.Status {
+		return false
+	}
+	// Compressed bodies can't be inspected without decoding them
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return false
+	}
+
+	limit := m.MaxBytes
+	if limit <= 0 {
+		limit = defaultRetryMatchBytes
+	}
+	if resp.ContentLength > limit {
+		return false
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	resp.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(buf), resp.Body), Closer: resp.Body}
+	if err != nil || int64(len(buf)) > limit {
+		return false
+	}
+
+	if m.JSONPath == "" {
+		return bytes.Contains(buf, []byte(m.Value))
+	}
+	return jsonPathEquals(buf, m.JSONPath, m.Value)
+}
+
+// jsonPathEquals walks a dot-separated path through decoded JSON objects
+// and compares the leaf value's string form against want
+func jsonPathEquals(body []byte, path, want string) bool {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return false
+	}
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return false
+		}
+		if v, ok = obj[key]; !ok {
+			return false
+		}
+	}
+	return fmt.Sprint(v) == want
+}
+
+// replayBody re-attaches already-consumed bytes in front of the original body
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
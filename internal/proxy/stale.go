@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Stale-if-error ----------------
+
+const (
+	defaultStaleEntries = 1000
+	defaultStaleBytes   = 1 << 20
+)
+
+// StaleIfError keeps the last good response to each GET so it can stand in
+// when the upstream fails. Window is how long after it was received an
+// entry may be served; an upstream Cache-Control stale-if-error directive
+// overrides it per response (RFC 5861).
+type StaleIfError struct {
+	Window     time.Duration
+	MaxEntries int   // least recently stored entries are evicted beyond this
+	MaxBytes   int64 // larger bodies are relayed but not kept
+}
+
+// staleTransport sits outside retries and the circuit breaker, so a stale
+// entry is only served once the upstream has genuinely failed: a transport
+// error (not the client going away) or a 500/502/503/504 after retries.
+// Like coalescing, it never keeps responses to credentialed requests or
+// responses meant for a single client.
+type staleTransport struct {
+	next       http.RoundTripper
+	window     time.Duration
+	maxEntries int
+	maxBytes   int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is most recently stored
+}
+
+type staleEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+	window time.Duration
+}
+
+func newStaleTransport(next http.RoundTripper, cfg StaleIfError) *staleTransport {
+	t := &staleTransport{
+		next:       next,
+		window:     cfg.Window,
+		maxEntries: cfg.MaxEntries,
+		maxBytes:   cfg.MaxBytes,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+	if t.maxEntries <= 0 {
+		t.maxEntries = defaultStaleEntries
+	}
+	if t.maxBytes <= 0 {
+		t.maxBytes = defaultStaleBytes
+	}
+	return t
+}
+
+func (t *staleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, ok := staleKey(req)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil:
+		if req.Context().Err() != nil {
+			return nil, err // the client gave up; nothing failed upstream
+		}
+		if stale := t.serve(req, key, "error"); stale != nil {
+			return stale, nil
+		}
+		return nil, err
+	case upstreamFailure(resp.StatusCode):
+		if stale := t.serve(req, key, strconv.Itoa(resp.StatusCode)); stale != nil {
+			discardResponse(resp)
+			return stale, nil
+		}
+		return resp, nil
+	}
+
+	if window, ok := t.storable(resp); ok {
+		resp.Body = &staleCapture{
+			ReadCloser: resp.Body,
+			limit:      t.maxBytes,
+			done: func(body []byte) {
+				t.store(&staleEntry{
+					key:    key,
+					status: resp.StatusCode,
+					header: resp.Header.Clone(),
+					body:   body,
+					stored: time.Now(),
+					window: window,
+				})
+			},
+		}
+	}
+	return resp, nil
+}
+
+// staleKey identifies a stored response, or reports that req can't use one
+func staleKey(req *http.Request) (string, bool) {
+	if req.Method != http.MethodGet {
+		return "", false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return "", false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" {
+		return "", false
+	}
+	// The API key header is gone by now, but the response may still be
+	// the partner's own
+	if _, ok := middleware.GetAPIKey(req); ok {
+		return "", false
+	}
+	// A stored gzip body must only go to clients that asked for gzip
+	return canonicalURL(req) + "\n" + req.Header.Get("Accept-Encoding"), true
+}
+
+func upstreamFailure(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// storable reports whether resp may stand in for later failures, and for
+// how long
+func (t *staleTransport) storable(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusOK || !shareable(resp) || resp.ContentLength > t.maxBytes {
+		return 0, false
+	}
+	// The key only covers Accept-Encoding, so responses varying on
+	// anything else can't be told apart
+	for _, v := range resp.Header.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" && !strings.EqualFold(h, "Accept-Encoding") {
+				return 0, false
+			}
+		}
+	}
+	window := t.window
+	for _, v := range resp.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(d), "=")
+			switch strings.ToLower(name) {
+			case "no-store":
+				return 0, false
+			case "stale-if-error":
+				if secs, err := strconv.Atoi(strings.Trim(val, `"`)); err == nil && secs >= 0 {
+					window = time.Duration(secs) * time.Second
+				}
+			}
+		}
+	}
+	return window, window > 0
+}
+
+func (t *staleTransport) store(e *staleEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if el, ok := t.entries[e.key]; ok {
+		t.order.Remove(el)
+	}
+	t.entries[e.key] = t.order.PushFront(e)
+	for t.order.Len() > t.maxEntries {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		delete(t.entries, oldest.Value.(*staleEntry).key)
+	}
+}
+
+// serve builds a response from the stored entry for key if it is still
+// within its window
+func (t *staleTransport) serve(req *http.Request, key, reason string) *http.Response {
+	t.mu.Lock()
+	el, ok := t.entries[key]
+	var e *staleEntry
+	if ok {
+		e = el.Value.(*staleEntry)
+		if time.Since(e.stored) > e.window {
+			t.order.Remove(el)
+			delete(t.entries, key)
+			e = nil
+		}
+	}
+	t.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+
+	age := time.Since(e.stored)
+	logger.Log.Warn("stale_response_served",
+		slog.String("request_id", middleware.GetRequestID(req)),
+		slog.String("upstream", req.URL.Host),
+		slog.String("method", req.Method),
+		slog.String("path", req.URL.Path),
+		slog.String("reason", reason),
+		slog.Int64("age_seconds", int64(age/time.Second)),
+	)
+
+	h := e.header.Clone()
+	h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	h.Add("Warning", `110 - "Response is Stale"`)
+	h.Set("X-Cache", "STALE")
+	return &http.Response{
+		Status:        strconv.Itoa(e.status) + " " + http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// staleCapture copies the body as the client reads it and hands the copy
+// over once it has been read completely; oversized or failed bodies are
+// dropped
+type staleCapture struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int64
+	over  bool
+	done  func([]byte)
+}
+
+func (c *staleCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.over {
+		if int64(c.buf.Len()+n) > c.limit {
+			c.over = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !c.over && c.done != nil {
+		c.done(c.buf.Bytes())
+		c.done = nil
+	}
+	return n, err
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubUpstream answers with status, header and body, or fails with err
+type stubUpstream struct {
+	status        int
+	header        http.Header
+	body          string
+	unknownLength bool // send no Content-Length
+	err           error
+}
+
+func (u *stubUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	h := u.header.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+	resp := &http.Response{
+		StatusCode:    u.status,
+		Header:        h,
+		Body:          io.NopCloser(strings.NewReader(u.body)),
+		ContentLength: int64(len(u.body)),
+		Request:       req,
+	}
+	if u.unknownLength {
+		resp.ContentLength = -1
+	}
+	return resp, nil
+}
+
+// fetch sends req (a GET when nil) through rt and reads the whole body, as
+// the proxy would
+func fetch(t *testing.T, rt http.RoundTripper, req *http.Request) (*http.Response, string, error) {
+	t.Helper()
+	if req == nil {
+		req = httptest.NewRequest(http.MethodGet, "http://upstream/items", nil)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b), nil
+}
+
+func TestStaleServedOnFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		err    error
+	}{
+		{"transport error", 0, errors.New("connection refused")},
+		{"500", http.StatusInternalServerError, nil},
+		{"502", http.StatusBadGateway, nil},
+		{"503", http.StatusServiceUnavailable, nil},
+		{"504", http.StatusGatewayTimeout, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			up := &stubUpstream{status: http.StatusOK, body: "fresh", header: http.Header{"Content-Type": {"text/plain"}}}
+			rt := newStaleTransport(up, StaleIfError{Window: time.Minute})
+			if _, body, err := fetch(t, rt, nil); err != nil || body != "fresh" {
+				t.Fatalf("first fetch = %q, %v", body, err)
+			}
+
+			up.status, up.err, up.body = tc.status, tc.err, "failed"
+			resp, body, err := fetch(t, rt, nil)
+			if err != nil {
+				t.Fatalf("stale entry not served: %v", err)
+			}
+			if resp.StatusCode != http.StatusOK || body != "fresh" {
+				t.Fatalf("got %d %q, want the stored 200", resp.StatusCode, body)
+			}
+			if resp.Header.Get("X-Cache") != "STALE" || resp.Header.Get("Age") != "0" ||
+				!strings.Contains(resp.Header.Get("Warning"), "110") || resp.Header.Get("Content-Type") != "text/plain" {
+				t.Errorf("stale headers = %v", resp.Header)
+			}
+		})
+	}
+}
+
+func TestStalePassesOtherStatuses(t *testing.T) {
+	up := &stubUpstream{status: http.StatusOK, body: "fresh"}
+	rt := newStaleTransport(up, StaleIfError{Window: time.Minute})
+	fetch(t, rt, nil)
+
+	for _, status := range []int{http.StatusNotFound, http.StatusNotImplemented, http.StatusTooManyRequests} {
+		up.status, up.body = status, "upstream says so"
+		if resp, body, _ := fetch(t, rt, nil); resp.StatusCode != status || body != "upstream says so" {
+			t.Errorf("%d replaced by %d %q", status, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestStaleNotServedToCanceledClient(t *testing.T) {
+	up := &stubUpstream{status: http.StatusOK, body: "fresh"}
+	rt := newStaleTransport(up, StaleIfError{Window: time.Minute})
+	fetch(t, rt, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	up.err = context.Canceled
+	req := httptest.NewRequest(http.MethodGet, "http://upstream/items", nil).WithContext(ctx)
+	if _, _, err := fetch(t, rt, req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want the cancellation", err)
+	}
+}
+
+func TestStaleWindowExpires(t *testing.T) {
+	up := &stubUpstream{status: http.StatusOK, body: "fresh"}
+	rt := newStaleTransport(up, StaleIfError{Window: time.Minute})
+	fetch(t, rt, nil)
+
+	rt.mu.Lock()
+	for _, el := range rt.entries {
+		el.Value.(*staleEntry).stored = time.Now().Add(-61 * time.Second)
+	}
+	rt.mu.Unlock()
+
+	up.status = http.StatusBadGateway
+	if resp, _, _ := fetch(t, rt, nil); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expired entry served: %d", resp.StatusCode)
+	}
+	if len(rt.entries) != 0 {
+		t.Error("expired entry kept")
+	}
+}
+
+func TestStaleStorable(t *testing.T) {
+	rt := newStaleTransport(nil, StaleIfError{Window: time.Minute, MaxBytes: 10})
+	for _, tc := range []struct {
+		name   string
+		status int
+		header http.Header
+		length int64
+		window time.Duration
+		ok     bool
+	}{
+		{"plain 200", 200, nil, 5, time.Minute, true},
+		{"not 200", 203, nil, 5, 0, false},
+		{"stale-if-error overrides", 200, http.Header{"Cache-Control": {"max-age=0, stale-if-error=300"}}, 5, 5 * time.Minute, true},
+		{"quoted stale-if-error", 200, http.Header{"Cache-Control": {`stale-if-error="30"`}}, 5, 30 * time.Second, true},
+		{"stale-if-error=0", 200, http.Header{"Cache-Control": {"stale-if-error=0"}}, 5, 0, false},
+		{"malformed stale-if-error", 200, http.Header{"Cache-Control": {"stale-if-error=soon"}}, 5, time.Minute, true},
+		{"no-store", 200, http.Header{"Cache-Control": {"public", "No-Store"}}, 5, 0, false},
+		{"private", 200, http.Header{"Cache-Control": {"private, max-age=60"}}, 5, 0, false},
+		{"Set-Cookie", 200, http.Header{"Set-Cookie": {"s=1"}}, 5, 0, false},
+		{"Vary Accept-Encoding", 200, http.Header{"Vary": {"accept-encoding"}}, 5, time.Minute, true},
+		{"Vary other", 200, http.Header{"Vary": {"Accept-Encoding, Accept-Language"}}, 5, 0, false},
+		{"too large", 200, nil, 11, 0, false},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Header: tc.header, ContentLength: tc.length}
+		if resp.Header == nil {
+			resp.Header = http.Header{}
+		}
+		window, ok := rt.storable(resp)
+		if ok != tc.ok || (ok && window != tc.window) {
+			t.Errorf("%s: storable = %v, %v; want %v, %v", tc.name, window, ok, tc.window, tc.ok)
+		}
+	}
+}
+
+func TestStaleSkipsUnstorableRequestsAndBodies(t *testing.T) {
+	// Longer than MaxBytes with no Content-Length, so only the capture
+	// while relaying can tell
+	up := &stubUpstream{status: http.StatusOK, body: "0123456789abcdef", unknownLength: true}
+	rt := newStaleTransport(up, StaleIfError{Window: time.Minute, MaxBytes: 10})
+	if _, body, _ := fetch(t, rt, nil); body != up.body {
+		t.Fatalf("oversized body not relayed: %q", body)
+	}
+
+	up.body = "short"
+	authed := httptest.NewRequest(http.MethodGet, "http://upstream/items", nil)
+	authed.Header.Set("Authorization", "Bearer x")
+	fetch(t, rt, authed)
+	head := httptest.NewRequest(http.MethodHead, "http://upstream/items", nil)
+	fetch(t, rt, head)
+
+	if len(rt.entries) != 0 {
+		t.Fatalf("stored %d entries, want none", len(rt.entries))
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"apigateway/internal/protobuf"
+)
+
+// ---------------- Protobuf Transcoding ----------------
+
+// defaultTranscodeBytes caps body buffering when MaxBytes is unset
+const defaultTranscodeBytes = 1 << 20
+
+// Transcode decodes Protobuf responses as JSON for routes whose upstream
+// speaks Protobuf; middleware.WithTranscoding handles the request side.
+type Transcode struct {
+	Message  *protobuf.Message
+	MaxBytes int64 // larger (decoded) bodies fail the request with 502
+}
+
+// apply replaces a successful Protobuf response with its JSON form. Other
+// statuses and content types pass through, so an upstream's own JSON or
+// text errors still reach the client. A body that can't be transcoded is
+// an upstream failure: the client can't read Protobuf.
+func (t *Transcode) apply(resp *http.Response) error {
+	if t == nil || resp.Body == nil || resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	// An empty body is a valid message with every field at its default
+	ok := resp.StatusCode >= 200 && resp.StatusCode <= 299 && resp.StatusCode != http.StatusNoContent
+	if !ok || !protobuf.IsContentType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	maxBytes := t.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultTranscodeBytes
+	}
+	body, ok, err := decodedBody(resp, maxBytes)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		resp.Body.Close()
+		return fmt.Errorf("protobuf response too large or in an unsupported encoding (limit %d bytes)", maxBytes)
+	}
+	out, err := t.Message.ToJSON(body)
+	if err != nil {
+		return fmt.Errorf("protobuf response is not a valid %s: %w", t.Message.Name(), err)
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	replaceBody(resp, out)
+	return nil
+}
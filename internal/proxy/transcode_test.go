@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"apigateway/internal/protobuf"
+)
+
+// pingMessage is message test.v1.Ping { string name = 1; int32 n = 2; }
+func pingMessage(t *testing.T) *protobuf.Message {
+	t.Helper()
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     kind.Enum(),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("test/v1/ping.proto"),
+		Package: proto.String("test.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Ping"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("n", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+			},
+		}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := protobuf.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := set.Message("test.v1.Ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTranscodeResponse(t *testing.T) {
+	m := pingMessage(t)
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		body        string
+		wantStatus  int
+		wantBody    string
+	}{
+		// name = "hi", n = 7
+		{"valid", protobuf.ContentType, 200, "\x0a\x02hi\x10\x07", 200, `{"name":"hi","n":7}`},
+		{"empty message", protobuf.ContentType, 200, "", 200, `{}`},
+		{"truncated", protobuf.ContentType, 200, "\x0a\x05hi", http.StatusBadGateway, ""},
+		{"wrong wire type", protobuf.ContentType, 200, "\x0d\x00\x00\x00\x00", http.StatusBadGateway, ""},
+		{"upstream error passes through", "application/json", 500, `{"oops":true}`, 500, `{"oops":true}`},
+		{"non-2xx protobuf untouched", protobuf.ContentType, 404, "\xff", 404, "\xff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer upstream.Close()
+			target, _ := url.Parse(upstream.URL)
+			rp := NewReverseProxy(target, Config{Attempts: 1, Transcode: &Transcode{Message: m}})
+
+			rec := httptest.NewRecorder()
+			rp.ServeHTTP(rec, httptest.NewRequest("GET", "/ping", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %q)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Fatalf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
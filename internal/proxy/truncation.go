@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Mid-stream Failures ----------------
+
+// watchTruncation logs upstream failures that happen after the response
+// headers were already relayed. The status can't be changed at that point;
+// httputil.ReverseProxy aborts the client connection on a body copy error,
+// so the client sees an incomplete transfer rather than a clean 200.
+func watchTruncation(resp *http.Response) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+	resp.Body = &truncationBody{rc: resp.Body, resp: resp}
+}
+
+type truncationBody struct {
+	rc     io.ReadCloser
+	resp   *http.Response
+	copied int64
+}
+
+func (b *truncationBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.copied += int64(n)
+	// A cancelled request context means the client left, not the upstream
+	if err != nil && err != io.EOF && b.resp.Request.Context().Err() == nil {
+		req := b.resp.Request
+		logger.Log.Error("upstream_truncated",
+			slog.String("request_id", middleware.GetRequestID(req)),
+			slog.String("upstream", req.URL.Host),
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", b.resp.StatusCode),
+			slog.Int64("bytes_relayed", b.copied),
+			slog.String("error", err.Error()),
+		)
+	}
+	return n, err
+}
+
+func (b *truncationBody) Close() error {
+	return b.rc.Close()
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"apigateway/internal/logger"
+)
+
+// syncBuffer collects log output written from server goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestUpstreamTruncationAbortsClient(t *testing.T) {
+	first := strings.Repeat("partial ", 64)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, first)
+		w.(http.Flusher).Flush() // headers and a chunk are out: 200 is committed
+		// Drop the connection without the terminating chunk
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	for _, tt := range []struct {
+		name          string
+		flushInterval time.Duration
+	}{
+		{"buffered", 0},
+		{"periodic flush", 10 * time.Millisecond},
+		{"flush every write", -1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs syncBuffer
+			saved := logger.Log
+			logger.Log = slog.New(slog.NewTextHandler(&logs, nil))
+			defer func() { logger.Log = saved }()
+
+			gw := httptest.NewServer(NewReverseProxy(target, Config{Attempts: 1, FlushInterval: tt.flushInterval}))
+			defer gw.Close()
+
+			resp, err := http.Get(gw.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d, want the upstream's 200", resp.StatusCode)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err == nil {
+				t.Fatalf("client read a complete %d byte body; want an incomplete transfer", len(body))
+			}
+			if !strings.HasPrefix(first, string(body)) {
+				t.Fatalf("client got %q, want a prefix of what the upstream sent", body)
+			}
+			if !strings.Contains(logs.String(), "msg=upstream_truncated") {
+				t.Fatalf("no upstream_truncated event in:\n%s", logs.String())
+			}
+		})
+	}
+}
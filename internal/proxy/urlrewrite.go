@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ---------------- JSON URL Rewriting ----------------
+
+// defaultURLRewriteBytes caps body buffering when MaxBytes is unset
+const defaultURLRewriteBytes = 1 << 20
+
+// URLRewrite replaces upstream base URLs with the gateway's external base
+// URL inside JSON response bodies, so HATEOAS and pagination links stay
+// followable by clients
+type URLRewrite struct {
+	rules    [][2]string // from, to; longest from first
+	maxBytes int64
+}
+
+// NewURLRewrite maps upstream base URLs (keys) to external ones (values).
+// Bodies larger than maxBytes are forwarded untouched.
+func NewURLRewrite(rules map[string]string, maxBytes int64) *URLRewrite {
+	if maxBytes <= 0 {
+		maxBytes = defaultURLRewriteBytes
+	}
+	u := &URLRewrite{maxBytes: maxBytes}
+	for from, to := range rules {
+		u.rules = append(u.rules, [2]string{strings.TrimSuffix(from, "/"), strings.TrimSuffix(to, "/")})
+	}
+	sort.Slice(u.rules, func(i, j int) bool { return len(u.rules[i][0]) > len(u.rules[j][0]) })
+	return u
+}
+
+// apply rewrites resp's body in place. Anything it can't safely handle
+// (non-JSON, unknown encodings, oversized or malformed bodies, or several
+// JSON values in a row) passes through unchanged. Only string values are rewritten, never keys.
+func (u *URLRewrite) apply(resp *http.Response) error {
+	if u == nil || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	if !isJSON(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	body, ok, err := decodedBody(resp, u.maxBytes)
+	if !ok || err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil
+	}
+	// More than one value (NDJSON, trailing garbage): re-encoding doc alone
+	// would drop the rest, so the body is left as sent
+	if _, err := dec.Token(); err != io.EOF {
+		return nil
+	}
+	doc, changed := u.rewrite(doc)
+	if !changed {
+		return nil
+	}
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil
+	}
+	replaceBody(resp, out.Bytes())
+	return nil
+}
+
+// decodedBody buffers resp's body, gunzipping it if needed, for transforms
+// that rewrite whole bodies. ok is false when the body must pass through
+// untouched (unknown encoding, over maxBytes before or after decoding, or
+// corrupt gzip); resp.Body still yields the original bytes either way.
+func decodedBody(resp *http.Response, maxBytes int64) (body []byte, ok bool, err error) {
+	if resp.ContentLength > maxBytes {
+		return nil, false, nil
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != "" && encoding != "identity" && encoding != "gzip" {
+		return nil, false, nil
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(raw)) > maxBytes {
+		resp.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(raw), resp.Body), Closer: resp.Body}
+		return nil, false, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(raw))
+
+	if encoding != "gzip" {
+		return raw, true, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false, nil
+	}
+	// Decompressed size is bounded too: a small gzip body can expand hugely
+	body, err = io.ReadAll(io.LimitReader(zr, maxBytes+1))
+	if err != nil || int64(len(body)) > maxBytes {
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// replaceBody swaps in a transformed body. It is sent uncompressed; the
+// gzip middleware can compress it again for the client.
+func replaceBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("ETag")
+}
+
+func (u *URLRewrite) rewrite(v any) (any, bool) {
+	switch v := v.(type) {
+	case string:
+		return u.rewriteString(v)
+	case map[string]any:
+		changed := false
+		for k, elem := range v {
+			if nv, ok := u.rewrite(elem); ok {
+				v[k] = nv
+				changed = true
+			}
+		}
+		return v, changed
+	case []any:
+		changed := false
+		for i, elem := range v {
+			if nv, ok := u.rewrite(elem); ok {
+				v[i] = nv
+				changed = true
+			}
+		}
+		return v, changed
+	}
+	return v, false
+}
+
+// rewriteString replaces a leading base URL, matching only whole path
+// segments so http://svc:80 doesn't match http://svc:8080
+func (u *URLRewrite) rewriteString(s string) (string, bool) {
+	for _, r := range u.rules {
+		if !strings.HasPrefix(s, r[0]) {
+			continue
+		}
+		rest := s[len(r[0]):]
+		if rest == "" || strings.ContainsAny(rest[:1], "/?#") {
+			return r[1] + rest, true
+		}
+	}
+	return s, false
+}
+
+// isJSON matches application/json and +json media types
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestURLRewriteApply(t *testing.T) {
+	u := NewURLRewrite(map[string]string{"http://svc:8080": "https://api.example.com"}, 0)
+	tests := []struct {
+		name, body, want string
+	}{
+		{"rewritten", `{"next":"http://svc:8080/items?page=2"}`, `{"next":"https://api.example.com/items?page=2"}` + "\n"},
+		{"trailing whitespace", "{\"self\":\"http://svc:8080/a\"}\n\n", `{"self":"https://api.example.com/a"}` + "\n"},
+		{"other port untouched", `{"next":"http://svc:80801/x"}`, `{"next":"http://svc:80801/x"}`},
+		{"ndjson untouched", "{\"self\":\"http://svc:8080/a\"}\n{\"self\":\"http://svc:8080/b\"}\n", "{\"self\":\"http://svc:8080/a\"}\n{\"self\":\"http://svc:8080/b\"}\n"},
+		{"trailing garbage untouched", `{"self":"http://svc:8080/a"} trailing`, `{"self":"http://svc:8080/a"} trailing`},
+		{"malformed untouched", `{"self":"http://svc:8080/a"`, `{"self":"http://svc:8080/a"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{"Content-Type": {"application/json"}},
+				Body:   io.NopCloser(strings.NewReader(tt.body)),
+			}
+			if err := u.apply(resp); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			if string(got) != tt.want {
+				t.Fatalf("body %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Weighted Variants ----------------
+
+// Variant is one version of a route's upstream, e.g. "stable" or
+// "canary", with its own proxy
+type Variant struct {
+	Name    string
+	Handler http.Handler
+	Weight  int // relative share of traffic; 0 takes none
+}
+
+// VariantPin keeps clients on one variant. Header (empty disables) names a
+// request header whose value picks a variant outright, even one with no
+// weight, e.g. for testing a canary before it takes traffic. Cookie (empty
+// disables) is set to the variant a client was first sent to, as a session
+// cookie; it is honored while that variant still has weight, so taking a
+// variant's weight to 0 moves its clients back.
+type VariantPin struct {
+	Header string
+	Cookie string
+}
+
+// WeightedProxy splits a route's traffic between variants by weight. The
+// weights can be changed while serving. The chosen variant is logged as
+// variant on request_completed, so error rates can be compared.
+type WeightedProxy struct {
+	variants map[string]http.Handler
+	pin      VariantPin
+
+	mu      sync.Mutex // serializes SetWeights
+	weights atomic.Pointer[variantWeights]
+}
+
+// variantWeights is replaced as a whole, so readers never see a mix of
+// old and new weights
+type variantWeights struct {
+	names  []string
+	cum    []int // cumulative weights
+	total  int
+	byName map[string]int
+}
+
+// NewWeightedProxy builds a proxy over variants, which need distinct names
+// and at least one positive weight
+func NewWeightedProxy(variants []Variant, pin VariantPin) (*WeightedProxy, error) {
+	p := &WeightedProxy{variants: make(map[string]http.Handler, len(variants)), pin: pin}
+	weights := make(map[string]int, len(variants))
+	for _, v := range variants {
+		if _, ok := p.variants[v.Name]; ok {
+			return nil, fmt.Errorf("variant %q listed twice", v.Name)
+		}
+		p.variants[v.Name] = v.Handler
+		weights[v.Name] = v.Weight
+	}
+	if err := p.SetWeights(weights); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetWeights replaces the weights of the named variants; variants not
+// mentioned keep theirs
+func (p *WeightedProxy) SetWeights(weights map[string]int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	merged := p.Weights()
+	for name, w := range weights {
+		if _, ok := p.variants[name]; !ok {
+			return fmt.Errorf("unknown variant %q", name)
+		}
+		if w < 0 {
+			return fmt.Errorf("variant %q: negative weight %d", name, w)
+		}
+		merged[name] = w
+	}
+
+	vw := &variantWeights{byName: merged}
+	for name := range merged {
+		vw.names = append(vw.names, name)
+	}
+	sort.Strings(vw.names)
+	for _, name := range vw.names {
+		vw.total += merged[name]
+		vw.cum = append(vw.cum, vw.total)
+	}
+	if vw.total == 0 {
+		return fmt.Errorf("at least one variant needs a positive weight")
+	}
+	p.weights.Store(vw)
+	return nil
+}
+
+// Weights returns the current weight of every variant
+func (p *WeightedProxy) Weights() map[string]int {
+	out := make(map[string]int, len(p.variants))
+	if vw := p.weights.Load(); vw != nil {
+		for name, w := range vw.byName {
+			out[name] = w
+		}
+	}
+	return out
+}
+
+func (p *WeightedProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := p.pinned(r)
+	if name == "" {
+		name = p.pick()
+		if p.pin.Cookie != "" {
+			http.SetCookie(w, &http.Cookie{
+				Name:     p.pin.Cookie,
+				Value:    name,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	}
+	middleware.SetVariant(r, name)
+	p.variants[name].ServeHTTP(w, r)
+}
+
+// pinned returns the variant r is pinned to, "" if none
+func (p *WeightedProxy) pinned(r *http.Request) string {
+	if p.pin.Header != "" {
+		if name := r.Header.Get(p.pin.Header); name != "" {
+			if _, ok := p.variants[name]; ok {
+				return name
+			}
+		}
+	}
+	if p.pin.Cookie != "" {
+		if c, err := r.Cookie(p.pin.Cookie); err == nil && p.weights.Load().byName[c.Value] > 0 {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func (p *WeightedProxy) pick() string {
+	vw := p.weights.Load()
+	// The package-level math/rand source is safe for concurrent use
+	n := rand.Intn(vw.total)
+	return vw.names[sort.SearchInts(vw.cum, n+1)]
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// variantNamer answers with its own name in X-Variant
+func variantNamer(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Variant", name)
+	})
+}
+
+func newTestWeighted(t *testing.T, stable, canary int, pin VariantPin) *WeightedProxy {
+	t.Helper()
+	p, err := NewWeightedProxy([]Variant{
+		{Name: "stable", Handler: variantNamer("stable"), Weight: stable},
+		{Name: "canary", Handler: variantNamer("canary"), Weight: canary},
+	}, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// serveVariant sends r through p and returns the variant that answered
+func serveVariant(p *WeightedProxy, r *http.Request) (string, *httptest.ResponseRecorder) {
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, r)
+	return rec.Header().Get("X-Variant"), rec
+}
+
+func TestWeightedSplitFollowsWeights(t *testing.T) {
+	p := newTestWeighted(t, 80, 20, VariantPin{})
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		name, _ := serveVariant(p, httptest.NewRequest(http.MethodGet, "/", nil))
+		counts[name]++
+	}
+	if c := counts["canary"]; c < 1700 || c > 2300 {
+		t.Errorf("canary got %d of 10000 requests at weight 20/100", c)
+	}
+
+	if err := p.SetWeights(map[string]int{"canary": 0}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if name, _ := serveVariant(p, httptest.NewRequest(http.MethodGet, "/", nil)); name != "stable" {
+			t.Fatalf("request sent to %s at weight 0", name)
+		}
+	}
+}
+
+func TestWeightedHeaderPinsZeroWeightVariant(t *testing.T) {
+	p := newTestWeighted(t, 100, 0, VariantPin{Header: "X-Canary"})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Canary", "canary")
+	if name, _ := serveVariant(p, r); name != "canary" {
+		t.Errorf("pinned request went to %s", name)
+	}
+	r.Header.Set("X-Canary", "nonexistent")
+	if name, _ := serveVariant(p, r); name != "stable" {
+		t.Errorf("unknown variant header went to %s", name)
+	}
+}
+
+func TestWeightedCookiePinning(t *testing.T) {
+	p := newTestWeighted(t, 50, 50, VariantPin{Cookie: "variant"})
+
+	first, rec := serveVariant(p, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "variant" || cookies[0].Value != first {
+		t.Fatalf("first pick %s set cookies %v", first, cookies)
+	}
+	if !cookies[0].HttpOnly || cookies[0].Path != "/" {
+		t.Errorf("cookie = %+v", cookies[0])
+	}
+
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookies[0])
+		name, rec := serveVariant(p, r)
+		if name != first {
+			t.Fatalf("pinned client moved from %s to %s", first, name)
+		}
+		if len(rec.Result().Cookies()) != 0 {
+			t.Fatal("cookie set again for a pinned client")
+		}
+	}
+
+	// Taking the pinned variant's weight away moves its clients
+	other := map[string]string{"stable": "canary", "canary": "stable"}[first]
+	if err := p.SetWeights(map[string]int{first: 0, other: 100}); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookies[0])
+	name, rec := serveVariant(p, r)
+	if name != other {
+		t.Errorf("client stayed on %s at weight 0", name)
+	}
+	if c := rec.Result().Cookies(); len(c) != 1 || c[0].Value != other {
+		t.Errorf("cookie not moved to %s: %v", other, c)
+	}
+}
+
+func TestWeightedSetWeightsValidation(t *testing.T) {
+	p := newTestWeighted(t, 90, 10, VariantPin{})
+	for _, weights := range []map[string]int{
+		{"beta": 10},
+		{"canary": -1},
+		{"canary": 0, "stable": 0},
+	} {
+		if err := p.SetWeights(weights); err == nil {
+			t.Errorf("SetWeights(%v) accepted", weights)
+		}
+	}
+	if w := p.Weights(); w["stable"] != 90 || w["canary"] != 10 {
+		t.Errorf("rejected update changed weights to %v", w)
+	}
+
+	if err := p.SetWeights(map[string]int{"canary": 30}); err != nil {
+		t.Fatal(err)
+	}
+	if w := p.Weights(); w["stable"] != 90 || w["canary"] != 30 {
+		t.Errorf("weights = %v, want unmentioned stable kept", w)
+	}
+
+	if _, err := NewWeightedProxy([]Variant{{Name: "a", Weight: 1}, {Name: "a", Weight: 1}}, VariantPin{}); err == nil {
+		t.Error("duplicate variant names accepted")
+	}
+	if _, err := NewWeightedProxy([]Variant{{Name: "a"}, {Name: "b"}}, VariantPin{}); err == nil {
+		t.Error("all-zero weights accepted")
+	}
+}
@@ -0,0 +1,302 @@
+package redis
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"apigateway/internal/logger"
+	"apigateway/internal/middleware"
+)
+
+// ---------------- Shared Token Buckets ----------------
+
+// retryInterval is how long the limiter stays on its in-memory fallback
+// after Redis fails, so requests don't each wait out a timeout
+const retryInterval = 5 * time.Second
+
+// tokenBucket refills and optionally takes a token atomically, using the
+// server's clock so replicas with skewed clocks agree. Buckets are hashes
+// {tokens, ts} that expire once idle. Returns {allowed, tokens, ts}.
+//
+// Redis before 5 replicates a script by rerunning it on replicas, so it
+// refuses writes after a non-deterministic command like TIME unless the
+// script opts into replicating its effects instead. From 5 on that is the
+// default and the call is a no-op.
+var tokenBucket = NewScript(`
+redis.replicate_commands()
+
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local initial = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+local take = ARGV[5] == "1"
+
+local t = redis.call("TIME")
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+  if not take then
+    return {0, "", ""}
+  end
+  tokens, ts = initial, now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+if take then
+  if tokens >= 1 then
+    tokens = tokens - 1
+    allowed = 1
+  end
+  redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+  redis.call("PEXPIRE", KEYS[1], ttl)
+  ts = now
+end
+return {allowed, tostring(tokens), tostring(ts)}
+`)
+
+// Limits configures a shared token bucket
+type Limits struct {
+	Rate            float64 // tokens per second
+	Burst           float64
+	InitialFraction float64       // share of Burst a new key starts with (0 = full)
+	TTL             time.Duration // idle buckets expire after this (at least a full refill)
+}
+
+// normalized applies middleware.NewTokenBucket's floors
+func (lim Limits) normalized() Limits {
+	if lim.Rate <= 0 {
+		lim.Rate = 1
+	}
+	if lim.Burst < 1 {
+		lim.Burst = 1
+	}
+	return lim
+}
+
+// Limiter keeps token buckets in Redis so every gateway replica draws from
+// the same ones. When Redis can't be reached, decisions fall back to the
+// replica's in-memory buckets until it answers again.
+type Limiter struct {
+	client *Client
+	prefix string
+
+	down    atomic.Bool
+	retryAt atomic.Int64 // unix nanos before which Redis isn't tried
+}
+
+// NewLimiter stores buckets under keys starting with prefix
+func NewLimiter(client *Client, prefix string) *Limiter {
+	return &Limiter{client: client, prefix: prefix}
+}
+
+// Bucket returns a single shared bucket, e.g. the global limit
+func (l *Limiter) Bucket(name string, lim Limits, fallback middleware.Limiter) middleware.Limiter {
+	return &bucket{limiter: l, key: l.prefix + name, lim: lim.normalized(), fallback: func() middleware.Limiter { return fallback }}
+}
+
+// PerKey returns shared buckets per client key, named name:key
+func (l *Limiter) PerKey(name string, lim Limits, fallback middleware.KeyedLimiter) middleware.KeyedLimiter {
+	return &perKey{limiter: l, name: l.prefix + name + ":", lim: lim.normalized(), fallback: fallback}
+}
+
+// available reports whether Redis should be tried
+func (l *Limiter) available() bool {
+	return time.Now().UnixNano() >= l.retryAt.Load()
+}
+
+func (l *Limiter) failed(err error) {
+	l.retryAt.Store(time.Now().Add(retryInterval).UnixNano())
+	if l.down.CompareAndSwap(false, true) {
+		logger.Log.Warn("rate_limit_backend_unavailable",
+			slog.String("backend", "redis"),
+			slog.String("error", err.Error()),
+			slog.String("retry_in", retryInterval.String()),
+		)
+	}
+}
+
+func (l *Limiter) succeeded() {
+	if l.down.CompareAndSwap(true, false) {
+		logger.Log.Info("rate_limit_backend_recovered",
+			slog.String("backend", "redis"),
+		)
+	}
+}
+
+// state is a bucket as last seen in Redis
+type state struct {
+	allowed bool
+	tokens  float64
+	ts      time.Time
+	found   bool
+}
+
+func (l *Limiter) run(key string, lim Limits, take bool) (state, error) {
+	ttl := lim.TTL
+	if refill := time.Duration(lim.Burst / lim.Rate * float64(time.Second)); ttl < refill {
+		ttl = refill
+	}
+	initial := lim.Burst
+	if lim.InitialFraction > 0 && lim.InitialFraction < 1 {
+		initial = max(lim.Burst*lim.InitialFraction, 1)
+	}
+	flag := "0"
+	if take {
+		flag = "1"
+	}
+	reply, err := tokenBucket.Run(context.Background(), l.client, []string{key},
+		strconv.FormatFloat(lim.Rate, 'f', -1, 64),
+		strconv.FormatFloat(lim.Burst, 'f', -1, 64),
+		strconv.FormatFloat(initial, 'f', -1, 64),
+		strconv.FormatInt(max(ttl.Milliseconds(), 1), 10),
+		flag,
+	)
+	if err != nil {
+		return state{}, err
+	}
+	fields, ok := reply.([]any)
+	if !ok || len(fields) != 3 {
+		return state{}, Error("unexpected token bucket reply")
+	}
+	allowed, _ := fields[0].(int64)
+	tokensStr, _ := fields[1].(string)
+	tsStr, _ := fields[2].(string)
+	if tokensStr == "" {
+		return state{}, nil
+	}
+	tokens, err1 := strconv.ParseFloat(tokensStr, 64)
+	ts, err2 := strconv.ParseFloat(tsStr, 64)
+	if err1 != nil || err2 != nil {
+		return state{}, Error("unexpected token bucket reply")
+	}
+	sec, frac := math.Modf(ts)
+	return state{
+		allowed: allowed == 1,
+		tokens:  tokens,
+		ts:      time.Unix(int64(sec), int64(frac*1e9)),
+		found:   true,
+	}, nil
+}
+
+// bucket is one shared bucket. Quota reports the state seen by the last
+// Allow, which for the global bucket may be another request's.
+type bucket struct {
+	limiter  *Limiter
+	key      string
+	lim      Limits
+	fallback func() middleware.Limiter
+
+	mu           sync.Mutex
+	last         state
+	haveLast     bool
+	usedFallback bool
+}
+
+func (b *bucket) Allow(now time.Time) bool {
+	if b.limiter.available() {
+		s, err := b.limiter.run(b.key, b.lim, true)
+		if err == nil {
+			b.limiter.succeeded()
+			b.mu.Lock()
+			b.last, b.haveLast, b.usedFallback = s, true, false
+			b.mu.Unlock()
+			return s.allowed
+		}
+		b.limiter.failed(err)
+	}
+	b.mu.Lock()
+	b.usedFallback = true
+	b.mu.Unlock()
+	return b.fallback().Allow(now)
+}
+
+func (b *bucket) Quota(now time.Time) middleware.Quota {
+	b.mu.Lock()
+	s, haveLast, usedFallback := b.last, b.haveLast, b.usedFallback
+	b.mu.Unlock()
+	if usedFallback {
+		return b.fallback().Quota(now)
+	}
+	if !haveLast {
+		if !b.limiter.available() {
+			return b.fallback().Quota(now)
+		}
+		var err error
+		if s, err = b.limiter.run(b.key, b.lim, false); err != nil {
+			b.limiter.failed(err)
+			return b.fallback().Quota(now)
+		}
+		if !s.found {
+			s.tokens = b.lim.Burst
+		}
+	}
+
+	q := middleware.Quota{Limit: int(b.lim.Burst), Remaining: int(s.tokens)}
+	q.Reset = time.Duration((b.lim.Burst - s.tokens) / b.lim.Rate * float64(time.Second))
+	if s.tokens < 1 {
+		q.RetryIn = time.Duration((1 - s.tokens) / b.lim.Rate * float64(time.Second))
+	}
+	return q
+}
+
+// perKey hands out a fresh bucket per request, so Quota describes that
+// request's own Allow
+type perKey struct {
+	limiter  *Limiter
+	name     string
+	lim      Limits
+	fallback middleware.KeyedLimiter
+}
+
+func (p *perKey) Get(key string) middleware.Limiter {
+	return &bucket{
+		limiter:  p.limiter,
+		key:      p.name + key,
+		lim:      p.lim,
+		fallback: func() middleware.Limiter { return p.fallback.Get(key) },
+	}
+}
+
+// Inspect reports the shared bucket; while Redis is unreachable, the
+// fallback's
+func (p *perKey) Inspect(key string) (middleware.BucketState, bool) {
+	if !p.limiter.available() {
+		return p.fallback.Inspect(key)
+	}
+	s, err := p.limiter.run(p.name+key, p.lim, false)
+	if err != nil {
+		p.limiter.failed(err)
+		return p.fallback.Inspect(key)
+	}
+	if !s.found {
+		return middleware.BucketState{}, false
+	}
+	return middleware.BucketState{Tokens: s.tokens, Burst: p.lim.Burst, LastSeen: s.ts}, true
+}
+
+// Reset deletes the shared bucket and refills the fallback's
+func (p *perKey) Reset(key string) bool {
+	reset := p.fallback.Reset(key)
+	if !p.limiter.available() {
+		return reset
+	}
+	n, err := p.limiter.client.Do(context.Background(), "DEL", p.name+key)
+	if err != nil {
+		p.limiter.failed(err)
+		return reset
+	}
+	return reset || n == int64(1)
+}
+
+func (p *perKey) Stop() {
+	p.fallback.Stop()
+}
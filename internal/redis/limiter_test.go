@@ -0,0 +1,111 @@
+package redis
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"apigateway/internal/middleware"
+)
+
+func newTestLimiter(t *testing.T, mr *miniredis.Miniredis) *Limiter {
+	t.Helper()
+	client, err := NewClient("redis://"+mr.Addr(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return NewLimiter(client, "rl:")
+}
+
+func TestTokenBucketReplicatesEffects(t *testing.T) {
+	// Writes after TIME are refused by Redis < 5 without this
+	src := tokenBucket.src
+	call, clock := strings.Index(src, "redis.replicate_commands()"), strings.Index(src, `redis.call("TIME")`)
+	if call < 0 || call > clock {
+		t.Fatal("token bucket script must call redis.replicate_commands() before TIME")
+	}
+}
+
+func TestBucketSharedAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.SetTime(time.Unix(1_700_000_000, 0))
+	lim := Limits{Rate: 1, Burst: 3, TTL: time.Minute}
+	fallback := middleware.NewTokenBucket(100, 100, time.Minute)
+	a := newTestLimiter(t, mr).Bucket("global", lim, fallback)
+	b := newTestLimiter(t, mr).Bucket("global", lim, fallback)
+
+	now := time.Now()
+	allowed := 0
+	for _, l := range []middleware.Limiter{a, b, a, b, a} {
+		if l.Allow(now) {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("allowed %d of 5 across replicas, want the burst of 3", allowed)
+	}
+	if q := b.Quota(now); q.Limit != 3 || q.Remaining != 0 || q.RetryIn <= 0 {
+		t.Fatalf("quota = %+v, want none remaining", q)
+	}
+
+	// The server's clock drives refills, not the replicas'
+	mr.SetTime(time.Unix(1_700_000_001, 0))
+	if !a.Allow(now) {
+		t.Fatal("no token refilled after a second")
+	}
+	if b.Allow(now) {
+		t.Fatal("refilled more than rate allows")
+	}
+	if ttl := mr.TTL("rl:global"); ttl < 3*time.Second {
+		t.Fatalf("bucket TTL = %v, want at least a full refill", ttl)
+	}
+}
+
+func TestPerKeyBuckets(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.SetTime(time.Unix(1_700_000_000, 0))
+	fallback := middleware.NewPerKeyTokenBucket(100, 100, time.Minute)
+	defer fallback.Stop()
+	p := newTestLimiter(t, mr).PerKey("ip", Limits{Rate: 1, Burst: 4, InitialFraction: 0.5, TTL: time.Minute}, fallback)
+
+	if _, ok := p.Inspect("10.0.0.1"); ok {
+		t.Fatal("Inspect found a bucket before any request")
+	}
+	now := time.Now()
+	// A new key starts with half the burst
+	if !p.Get("10.0.0.1").Allow(now) || !p.Get("10.0.0.1").Allow(now) || p.Get("10.0.0.1").Allow(now) {
+		t.Fatal("new key didn't start with InitialFraction of the burst")
+	}
+	if !p.Get("10.0.0.2").Allow(now) {
+		t.Fatal("keys share a bucket")
+	}
+	st, ok := p.Inspect("10.0.0.1")
+	if !ok || st.Tokens != 0 || st.Burst != 4 || !st.LastSeen.Equal(time.Unix(1_700_000_000, 0)) {
+		t.Fatalf("Inspect = %+v, %v", st, ok)
+	}
+	if !p.Reset("10.0.0.1") || mr.Exists("rl:ip:10.0.0.1") {
+		t.Fatal("Reset didn't delete the shared bucket")
+	}
+}
+
+func TestBucketFallsBackWhenRedisIsDown(t *testing.T) {
+	mr := miniredis.RunT(t)
+	l := newTestLimiter(t, mr)
+	fallback := middleware.NewTokenBucket(1, 1, time.Minute)
+	b := l.Bucket("global", Limits{Rate: 100, Burst: 100}, fallback)
+	mr.Close()
+
+	now := time.Now()
+	if !b.Allow(now) || b.Allow(now) {
+		t.Fatal("decisions didn't come from the in-memory fallback")
+	}
+	if l.available() {
+		t.Fatal("Redis retried immediately after failing")
+	}
+	if q := b.Quota(now); q.Limit != 1 {
+		t.Fatalf("quota = %+v, want the fallback's", q)
+	}
+}
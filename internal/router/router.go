@@ -1,125 +1,401 @@
 package router
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"apigateway/internal/config"
+	"apigateway/internal/flags"
+	"apigateway/internal/health"
+	"apigateway/internal/middleware"
 )
 
 // Router manages all route registrations
 type Router struct {
-	mux          *http.ServeMux
-	authProxy    *httputil.ReverseProxy
-	exampleProxy *httputil.ReverseProxy
+	mux      *http.ServeMux
+	proxies  map[string]http.Handler // by route name
+	prefixes []string                // route names, longest path prefix first
+	hosts    map[string]string       // normalized host -> route name
+	routes   map[string]config.RouteConfig
+	ready    atomic.Bool
+	chaos    bool
+	methods  map[string]middleware.MethodSet // per-route narrowing
+	schemas  map[string]middleware.JSONSchemaConfig
+	sums     map[string]middleware.ChecksumConfig
+	protos   map[string]middleware.TranscodeConfig
+	queues   map[string]*middleware.FairQueue // per-route concurrency limits
+	chains   map[string]middleware.Middleware // per-route middleware added with Use
+	handlers map[string]http.Handler          // routes wrapped in their chains, built by Use
+	patterns map[string]bool                  // mux patterns taken by Handle and RegisterRoutes
+	notFound config.APINotFoundConfig
+	metrics  http.Handler   // public /metrics (nil when served elsewhere)
+	health   *health.Prober // upstream probes (nil when disabled)
+
+	// Feature-flagged alternates: requests the route's flag is on for go
+	// to flagged[name] instead of the route's own upstreams
+	flags   flags.Provider
+	flagged map[string]*httputil.ReverseProxy
+}
+
+// New creates a new router with a proxy per route name and the routes'
+// path prefixes and overrides
+func New(proxies map[string]http.Handler, routes map[string]config.RouteConfig) *Router {
+	rt := &Router{
+		mux:      http.NewServeMux(),
+		proxies:  proxies,
+		routes:   routes,
+		methods:  make(map[string]middleware.MethodSet, len(routes)),
+		schemas:  make(map[string]middleware.JSONSchemaConfig),
+		sums:     make(map[string]middleware.ChecksumConfig),
+		protos:   make(map[string]middleware.TranscodeConfig),
+		queues:   make(map[string]*middleware.FairQueue),
+		chains:   make(map[string]middleware.Middleware),
+		handlers: make(map[string]http.Handler),
+		patterns: make(map[string]bool),
+		hosts:    make(map[string]string),
+	}
+	for _, p := range builtinPatterns {
+		rt.patterns[p] = true
+	}
+	for name, rc := range routes {
+		rt.prefixes = append(rt.prefixes, name)
+		for _, h := range rc.Hosts {
+			rt.hosts[h] = name
+		}
+		if len(rc.Methods) > 0 {
+			rt.methods[name] = middleware.NewMethodSet(rc.Methods)
+		}
+		if rc.MaxConcurrent > 0 {
+			rt.queues[name] = middleware.NewFairQueue(rc.MaxConcurrent, rc.FairQueue)
+		}
+		if len(rc.Checksums) > 0 {
+			rt.sums[name] = middleware.ChecksumConfig{Algorithms: rc.Checksums, MaxBytes: rc.ChecksumMaxBytes}
+		}
+		if rc.Schema != nil {
+			rt.schemas[name] = middleware.JSONSchemaConfig{Schema: rc.Schema, MaxBytes: rc.SchemaMaxBytes}
+		}
+		if rc.ProtoRequestType != nil || rc.ProtoResponseType != nil {
+			rt.protos[name] = middleware.TranscodeConfig{
+				Request:  rc.ProtoRequestType,
+				Response: rc.ProtoResponseType,
+				MaxBytes: rc.ProtoMaxBytes,
+			}
+		}
+	}
+	sort.Slice(rt.prefixes, func(i, j int) bool {
+		return len(routes[rt.prefixes[i]].PathPrefix) > len(routes[rt.prefixes[j]].PathPrefix)
+	})
+	rt.ready.Store(true)
+	return rt
+}
+
+// SetReady flips the readiness probe; shutdown sets it false before draining
+func (rt *Router) SetReady(ready bool) {
+	rt.ready.Store(ready)
+}
+
+// EnableChaos honors per-route fault injection settings; without it they
+// are ignored so stray chaos config can't affect production traffic
+func (rt *Router) EnableChaos() {
+	rt.chaos = true
 }
 
-// New creates a new router with the given proxies
-func New(authProxy, exampleProxy *httputil.ReverseProxy) *Router {
-	return &Router{
-		mux:          http.NewServeMux(),
-		authProxy:    authProxy,
-		exampleProxy: exampleProxy,
+// SetAPINotFound configures the structured body for unmatched /api/ paths
+func (rt *Router) SetAPINotFound(cfg config.APINotFoundConfig) {
+	rt.notFound = cfg
+}
+
+// SetMetrics serves h as /metrics on the public listener. Only used when
+// there is no admin listener to keep it off the proxied surface.
+func (rt *Router) SetMetrics(h http.Handler) {
+	rt.metrics = h
+}
+
+// SetHealth makes /healthz/ready also fail while a critical route has no
+// healthy upstream
+func (rt *Router) SetHealth(p *health.Prober) {
+	rt.health = p
+}
+
+// SetFlags routes requests of flagged routes to their alternate proxies
+// while the route's flag is on for the client
+func (rt *Router) SetFlags(p flags.Provider, proxies map[string]*httputil.ReverseProxy) {
+	rt.flags = p
+	rt.flagged = proxies
+}
+
+// Use adds middleware to the named route's requests. It runs inside the
+// global chain and before the route's own overrides (methods, timeout,
+// schema, ...); middleware from repeated calls runs in the order added.
+// The chain is wrapped once here, so middleware keeps any state it sets up
+// (limiters, caches) across requests. Call before serving.
+func (rt *Router) Use(route string, mws ...middleware.Middleware) error {
+	if _, ok := rt.routes[route]; !ok {
+		return fmt.Errorf("router: unknown route %q", route)
 	}
+	rt.chains[route] = middleware.Chain(append([]middleware.Middleware{rt.chains[route]}, mws...)...)
+	rt.handlers[route] = rt.chains[route](http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.serveRoute(w, r, route, rt.routeProxy(r, route))
+	}))
+	return nil
 }
 
+// Handle serves prefix and every path below it with h, wrapped in chain
+// (nil for none), e.g.
+//
+//	rt.Handle("/api/reports/export", middleware.Chain(auth, slow), exportHandler)
+//
+// Like routes, it runs inside the global chain. It takes precedence over
+// routes with shorter prefixes, and none of their overrides apply. It
+// fails for a prefix already handled, including those RegisterRoutes owns
+// ("/", "/api", the health probes, and "/metrics"). Call before serving.
+func (rt *Router) Handle(prefix string, chain middleware.Middleware, h http.Handler) error {
+	prefix = strings.TrimSuffix(prefix, "/")
+	patterns := []string{prefix + "/"}
+	if prefix != "" {
+		patterns = append(patterns, prefix)
+	}
+	for _, p := range patterns {
+		if rt.patterns[p] {
+			return fmt.Errorf("router: %q is already handled", p)
+		}
+	}
+	if chain != nil {
+		h = chain(h)
+	}
+	for _, p := range patterns {
+		rt.patterns[p] = true
+		rt.mux.Handle(p, h)
+	}
+	return nil
+}
+
+// builtinPatterns are the mux patterns RegisterRoutes registers
+var builtinPatterns = []string{"/", "/healthz/live", "/readyz", "/healthz/ready", "/metrics", "/api/"}
+
 // RegisterRoutes sets up all application routes
 // This is the central place to add/modify endpoints
 func (rt *Router) RegisterRoutes() {
-	// Health check endpoint - returns 200 OK for Azure App Gateway health checks
+	// Legacy health check for Azure App Gateway - reports readiness, so
+	// a draining gateway stops getting traffic
 	rt.mux.HandleFunc("/", rt.handleRoot)
 
+	// Liveness probe - 200 while the process is serving at all
+	rt.mux.HandleFunc("/healthz/live", rt.handleLive)
+
+	// Readiness probe - returns 503 once shutdown has begun
+	rt.mux.HandleFunc("/readyz", rt.handleReady)
+
+	// Readiness including upstream reachability - returns 503 when a
+	// critical route can't reach any of its upstreams
+	rt.mux.HandleFunc("/healthz/ready", rt.handleUpstreamReady)
+
+	// Prometheus scrape target
+	if rt.metrics != nil {
+		rt.mux.Handle("/metrics", rt.metrics)
+	}
+
 	// API routes - all requests to /api/* are handled here
 	rt.mux.Handle("/api/", http.HandlerFunc(rt.handleAPI))
 }
 
-// handleRoot handles the root path for health checks
+// handleRoot handles the root path for health checks, as /healthz/ready
 func (rt *Router) handleRoot(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
 		return
 	}
+	rt.handleUpstreamReady(w, r)
+}
+
+// handleLive reports that the process is up; unlike readiness it stays
+// 200 while draining, so orchestrators don't restart a gateway that is
+// shutting down cleanly
+func (rt *Router) handleLive(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
 
-// handleAPI routes API requests to appropriate upstream services
-// To add new endpoints:
-// 1. Add a new if block with strings.HasPrefix check
-// 2. Call the appropriate proxy's ServeHTTP method
-func (rt *Router) handleAPI(w http.ResponseWriter, r *http.Request) {
-	// Uncomment to enable authentication for all API routes
-	// if !rt.authenticateRequest(r) {
-	// 	http.Error(w, "Unauthorized", http.StatusUnauthorized)
-	// 	return
-	// }
-
-	// Route /api/auth/* to IAM service
-	// Examples: /api/auth/login, /api/auth/signup, /api/auth/admin/users
-	if strings.HasPrefix(r.URL.Path, "/api/auth") {
-		rt.authProxy.ServeHTTP(w, r)
+// handleReady reports whether the gateway should receive new traffic
+func (rt *Router) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !rt.ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("shutting down"))
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleUpstreamReady is handleReady that also requires a healthy upstream
+// for every critical route
+func (rt *Router) handleUpstreamReady(w http.ResponseWriter, r *http.Request) {
+	if rt.health != nil && rt.ready.Load() {
+		if down := rt.health.Unavailable(); len(down) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("no healthy upstream: " + strings.Join(down, ", ")))
+			return
+		}
+	}
+	rt.handleReady(w, r)
+}
 
-	// Route /api/example/* to example service
-	// Examples: /api/example/timestamp
-	if strings.HasPrefix(r.URL.Path, "/api/example") {
-		rt.exampleProxy.ServeHTTP(w, r)
+// handleAPI routes API requests to the route with the longest matching
+// path prefix. Built-in routes:
+//   - /api/auth/* to the IAM service (e.g. /api/auth/login, /api/auth/admin/users)
+//   - /api/example/* to the example service (e.g. /api/example/timestamp)
+//
+// To add endpoints, list them in ROUTES_FILE rather than editing this.
+func (rt *Router) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if name, ok := rt.Match(r); ok {
+		if h, ok := rt.handlers[name]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rt.serveRoute(w, r, name, rt.routeProxy(r, name))
 		return
 	}
 
 	// No matching route found
-	http.NotFound(w, r)
+	rt.apiNotFound(w, r)
 }
 
-// Handler returns the underlying http.Handler
-func (rt *Router) Handler() http.Handler {
-	return rt.mux
+// Match returns the name of the route that serves r: the one listing its
+// host, else the one with the longest path prefix matching its path. A
+// prefix matches whole segments only, so /api/users doesn't serve
+// /api/usersx.
+func (rt *Router) Match(r *http.Request) (string, bool) {
+	if name, ok := rt.hosts[middleware.CanonicalHostname(r.Host)]; ok {
+		return name, true
+	}
+	for _, name := range rt.prefixes {
+		if prefix := rt.routes[name].PathPrefix; r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			return name, true
+		}
+	}
+	return "", false
 }
 
-// authenticateRequest validates the user's authentication token
-// Uncomment this function to enable authentication before proxying
-// func (rt *Router) authenticateRequest(r *http.Request) bool {
-// 	// Extract token from Authorization header
-// 	authHeader := r.Header.Get("Authorization")
-// 	if authHeader == "" {
-// 		return false
-// 	}
-//
-// 	// Expected format: "Bearer <token>"
-// 	const bearerPrefix = "Bearer "
-// 	if !strings.HasPrefix(authHeader, bearerPrefix) {
-// 		return false
-// 	}
-//
-// 	token := strings.TrimPrefix(authHeader, bearerPrefix)
-// 	if token == "" {
-// 		return false
-// 	}
-//
-// 	// Example: Validate token by calling IAM service
-// 	// Make HTTP request to IAM service's token validation endpoint
-// 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
-// 	defer cancel()
-//
-// 	// Construct validation request
-// 	// Assuming IAM service has a /api/auth/validate endpoint
-// 	validationURL := "https://your-iam-service.com/api/auth/validate"
-// 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, validationURL, nil)
-// 	if err != nil {
-// 		return false
-// 	}
-//
-// 	// Forward the Authorization header to IAM service
-// 	req.Header.Set("Authorization", authHeader)
-//
-// 	// Send request to IAM service
-// 	client := &http.Client{Timeout: 2 * time.Second}
-// 	resp, err := client.Do(req)
-// 	if err != nil {
-// 		return false
-// 	}
-// 	defer resp.Body.Close()
-//
-// 	// Token is valid if IAM service returns 200 OK
-// 	return resp.StatusCode == http.StatusOK
-// }
+// routeProxy picks the route's flagged alternate when its flag is on for
+// the client (keyed by user ID when authenticated, else client IP), and
+// the route's own proxy otherwise
+func (rt *Router) routeProxy(r *http.Request, name string) http.Handler {
+	alt, ok := rt.flagged[name]
+	if !ok || rt.flags == nil {
+		return rt.proxies[name]
+	}
+	flag := rt.routes[name].Flag
+	percent, _ := rt.flags.Percent(r.Context(), flag)
+	key := middleware.ExtractClientIP(r)
+	if sub, ok := middleware.GetClaims(r)["sub"].(string); ok && sub != "" {
+		key = "sub:" + sub
+	}
+	if flags.Enabled(flag, key, percent) {
+		return alt
+	}
+	return rt.proxies[name]
+}
+
+// apiNotFound answers unmatched API paths with the contract's error schema.
+// Only clients that explicitly prefer HTML or plain text get the bare 404.
+func (rt *Router) apiNotFound(w http.ResponseWriter, r *http.Request) {
+	if !wantsJSON(r) {
+		http.NotFound(w, r)
+		return
+	}
+
+	field := func(name string) string {
+		if key := rt.notFound.Fields[name]; key != "" {
+			return key
+		}
+		return name
+	}
+	body := map[string]any{
+		field("code"):       rt.notFound.Code,
+		field("message"):    rt.notFound.Message,
+		field("request_id"): middleware.GetRequestID(r),
+		field("timestamp"):  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(body)
+}
+
+// wantsJSON treats missing, wildcard, and JSON Accept headers as API clients
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		switch mediaType = strings.TrimSpace(mediaType); {
+		case mediaType == "*/*", mediaType == "application/*", mediaType == "application/json",
+			strings.HasSuffix(mediaType, "+json"):
+			return true
+		}
+	}
+	return false
+}
+
+// serveRoute applies the named route's overrides before proxying
+func (rt *Router) serveRoute(w http.ResponseWriter, r *http.Request, name string, h http.Handler) {
+	if set, ok := rt.methods[name]; ok && set.Reject(w, r) {
+		return
+	}
+
+	// Per-route deadline; cancelling the context aborts the upstream call
+	if d := rt.routes[name].Timeout; d > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	// Innermost, so a slot is only held while the upstream is called
+	if q, ok := rt.queues[name]; ok {
+		h = middleware.WithFairQueue(name, q, h)
+	}
+	// Inside schema validation, which must see the client's JSON
+	if tc, ok := rt.protos[name]; ok {
+		h = middleware.WithTranscoding(tc, h)
+	}
+	if sc, ok := rt.schemas[name]; ok {
+		h = middleware.WithJSONSchema(sc, h)
+	}
+	// Outside anything that could rewrite the body the client signed
+	if cc, ok := rt.sums[name]; ok {
+		h = middleware.WithChecksum(cc, h)
+	}
+	if c := rt.routes[name].Chaos; rt.chaos && c.Fraction > 0 {
+		h = middleware.WithChaos(middleware.ChaosConfig{
+			Fraction:  c.Fraction,
+			DelayMin:  c.DelayMin,
+			DelayMax:  c.DelayMax,
+			ErrorRate: c.ErrorRate,
+		}, h)
+	}
+	h.ServeHTTP(w, r)
+}
+
+// Handler returns the underlying http.Handler. Requests for a route's
+// host go to that route on any path; the rest are routed by path.
+func (rt *Router) Handler() http.Handler {
+	if len(rt.hosts) == 0 {
+		return rt.mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := rt.hosts[middleware.CanonicalHostname(r.Host)]; ok {
+			rt.handleAPI(w, r)
+			return
+		}
+		rt.mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"apigateway/internal/config"
+)
+
+func TestMatchWholeSegments(t *testing.T) {
+	rt := New(nil, map[string]config.RouteConfig{
+		"users":   {PathPrefix: "/api/users"},
+		"profile": {PathPrefix: "/api/users/profile"},
+	})
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/users", "users"},
+		{"/api/users/", "users"},
+		{"/api/users/42", "users"},
+		{"/api/users/profile", "profile"},
+		{"/api/users/profilex", "users"},
+		{"/api/usersx", ""},
+		{"/api/user", ""},
+	}
+	for _, tt := range tests {
+		got, _ := rt.Match(httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if got != tt.want {
+			t.Errorf("%s: matched %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHosts(t *testing.T) {
+	// As config.Load leaves them
+	rt := New(nil, map[string]config.RouteConfig{
+		"auth": {PathPrefix: "/api/auth", Hosts: []string{"auth.example.com"}},
+		"v6":   {PathPrefix: "/api/v6", Hosts: []string{"[2001:db8::1]"}},
+	})
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"auth.example.com", "auth"},
+		{"Auth.Example.COM:8443", "auth"},
+		{"auth.example.com.", "auth"},
+		{"[2001:db8::1]", "v6"},
+		{"[2001:DB8:0:0::1]:8080", "v6"},
+		{"api.example.com", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/other", nil)
+		req.Host = tt.host
+		if got, _ := rt.Match(req); got != tt.want {
+			t.Errorf("%s: matched %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestUseWrapsOnce(t *testing.T) {
+	served := 0
+	rt := New(map[string]http.Handler{
+		"users": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ }),
+	}, map[string]config.RouteConfig{
+		"users": {PathPrefix: "/api/users"},
+	})
+	wraps := 0
+	err := rt.Use("users", func(next http.Handler) http.Handler {
+		wraps++
+		return next
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.RegisterRoutes()
+	for i := 0; i < 3; i++ {
+		rt.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/users/1", nil))
+	}
+	if wraps != 1 || served != 3 {
+		t.Fatalf("wrapped %d times and served %d requests, want 1 and 3", wraps, served)
+	}
+	if err := rt.Use("nope"); err == nil {
+		t.Fatal("Use accepted an unknown route")
+	}
+}
+
+func TestHandleRejectsTakenPrefixes(t *testing.T) {
+	rt := New(nil, nil)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	if err := rt.Handle("/api/reports/export", nil, ok); err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{"/api/reports/export", "/api/reports/export/", "/api", "/", "", "/metrics"} {
+		if err := rt.Handle(prefix, nil, ok); err == nil {
+			t.Errorf("Handle(%q) succeeded", prefix)
+		}
+	}
+	// Must not panic on patterns Handle already refused
+	rt.RegisterRoutes()
+}
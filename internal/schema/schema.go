@@ -0,0 +1,421 @@
+// Package schema validates decoded JSON against the subset of JSON Schema
+// needed to reject malformed request bodies at the gateway: type, enum,
+// const, object properties/required/additionalProperties, array items and
+// length, string length/pattern, and numeric bounds. Keywords that would
+// change the outcome but aren't implemented ($ref, allOf, ...) are refused
+// when the schema is loaded rather than silently ignored.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxErrors bounds how many violations Validate reports
+const maxErrors = 20
+
+// Schema is a compiled JSON Schema
+type Schema struct {
+	types      []string // nil allows any type; empty (the false schema) allows none
+	enum       []any
+	constVal   any
+	hasConst   bool
+	properties map[string]*Schema
+	required   []string
+	additional *Schema // applies to properties not listed; nil allows anything
+	noExtra    bool    // additionalProperties: false
+	items      *Schema
+	minItems   *int
+	maxItems   *int
+	minLength  *int
+	maxLength  *int
+	pattern    *regexp.Regexp
+	minimum    *float64
+	maximum    *float64
+	exclMin    *float64
+	exclMax    *float64
+}
+
+// ValidationError is a single schema violation
+type ValidationError struct {
+	Path    string `json:"path"` // e.g. $.items[0].name
+	Message string `json:"message"`
+}
+
+// annotations carry no validation meaning and are skipped
+var annotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "default": true, "examples": true, "format": true,
+	"deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+// Load reads and compiles a schema file
+func Load(path string) (*Schema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Compile(b)
+}
+
+// Compile parses a JSON Schema document
+func Compile(doc []byte) (*Schema, error) {
+	v, err := Decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return compile(v, "$")
+}
+
+// Decode parses a JSON document the way Validate expects it: numbers are
+// kept as json.Number so large integers aren't rounded, and trailing data
+// after the value is an error
+func Decode(doc []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+func compile(v any, at string) (*Schema, error) {
+	if b, ok := v.(bool); ok {
+		// true accepts anything; false accepts nothing
+		if b {
+			return &Schema{}, nil
+		}
+		return &Schema{types: []string{}}, nil
+	}
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object or boolean", at)
+	}
+
+	s := &Schema{}
+	for key, val := range obj {
+		var err error
+		switch key {
+		case "type":
+			s.types, err = stringList(val)
+			for _, t := range s.types {
+				switch t {
+				case "object", "array", "string", "number", "integer", "boolean", "null":
+				default:
+					err = fmt.Errorf("unknown type %q", t)
+				}
+			}
+		case "enum":
+			var ok bool
+			if s.enum, ok = val.([]any); !ok {
+				err = fmt.Errorf("must be an array")
+			}
+		case "const":
+			s.constVal, s.hasConst = val, true
+		case "properties":
+			props, ok := val.(map[string]any)
+			if !ok {
+				err = fmt.Errorf("must be an object")
+				break
+			}
+			s.properties = make(map[string]*Schema, len(props))
+			for name, p := range props {
+				if s.properties[name], err = compile(p, at+"."+name); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			s.required, err = stringList(val)
+		case "additionalProperties":
+			if b, ok := val.(bool); ok {
+				s.noExtra = !b
+				break
+			}
+			if s.additional, err = compile(val, at+".additionalProperties"); err != nil {
+				return nil, err
+			}
+		case "items":
+			if s.items, err = compile(val, at+".items"); err != nil {
+				return nil, err
+			}
+		case "minItems":
+			s.minItems, err = count(val)
+		case "maxItems":
+			s.maxItems, err = count(val)
+		case "minLength":
+			s.minLength, err = count(val)
+		case "maxLength":
+			s.maxLength, err = count(val)
+		case "pattern":
+			p, ok := val.(string)
+			if !ok {
+				err = fmt.Errorf("must be a string")
+				break
+			}
+			s.pattern, err = regexp.Compile(p)
+		case "minimum":
+			s.minimum, err = number(val)
+		case "maximum":
+			s.maximum, err = number(val)
+		case "exclusiveMinimum":
+			s.exclMin, err = number(val)
+		case "exclusiveMaximum":
+			s.exclMax, err = number(val)
+		default:
+			if !annotations[key] {
+				err = fmt.Errorf("unsupported keyword")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", at, key, err)
+		}
+	}
+	return s, nil
+}
+
+func stringList(v any) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("must be strings")
+			}
+			out = append(out, s)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("must be a string or an array of strings")
+}
+
+func count(v any) (*int, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("must be a non-negative integer")
+	}
+	i, err := strconv.Atoi(n.String())
+	if err != nil || i < 0 {
+		return nil, fmt.Errorf("must be a non-negative integer")
+	}
+	return &i, nil
+}
+
+func number(v any) (*float64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("must be a number")
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Validate checks a value produced by Decode and returns its violations,
+// at most maxErrors of them. An empty result means the value is valid.
+func (s *Schema) Validate(v any) []ValidationError {
+	var errs []ValidationError
+	s.validate(v, "$", &errs)
+	return errs
+}
+
+func (s *Schema) validate(v any, path string, errs *[]ValidationError) {
+	report := func(format string, args ...any) {
+		if len(*errs) < maxErrors {
+			*errs = append(*errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	if s.types != nil && !s.typeAllowed(v) {
+		if len(s.types) == 0 {
+			report("no value is allowed here")
+		} else {
+			report("expected %s, got %s", strings.Join(s.types, " or "), typeOf(v))
+		}
+		return
+	}
+	if s.hasConst && !equal(v, s.constVal) {
+		report("must equal %s", show(s.constVal))
+	}
+	if s.enum != nil && !s.inEnum(v) {
+		report("must be one of %s", show(s.enum))
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				report("missing required property %q", name)
+			}
+		}
+		// Sorted so the reported order is stable
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := path + "." + k
+			if p, ok := s.properties[k]; ok {
+				p.validate(v[k], child, errs)
+				continue
+			}
+			switch {
+			case s.noExtra:
+				report("unexpected property %q", k)
+			case s.additional != nil:
+				s.additional.validate(v[k], child, errs)
+			}
+		}
+	case []any:
+		if s.minItems != nil && len(v) < *s.minItems {
+			report("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			report("must have at most %d items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, e := range v {
+				s.items.validate(e, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.minLength != nil && n < *s.minLength {
+			report("must be at least %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			report("must be at most %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			report("must match pattern %q", s.pattern.String())
+		}
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			report("number out of range")
+			return
+		}
+		if s.minimum != nil && f < *s.minimum {
+			report("must be >= %v", *s.minimum)
+		}
+		if s.maximum != nil && f > *s.maximum {
+			report("must be <= %v", *s.maximum)
+		}
+		if s.exclMin != nil && f <= *s.exclMin {
+			report("must be > %v", *s.exclMin)
+		}
+		if s.exclMax != nil && f >= *s.exclMax {
+			report("must be < %v", *s.exclMax)
+		}
+	}
+}
+
+func (s *Schema) typeAllowed(v any) bool {
+	got := typeOf(v)
+	for _, t := range s.types {
+		if t == got || (t == "number" && got == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) inEnum(v any) bool {
+	for _, e := range s.enum {
+		if equal(v, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf names v's JSON type; whole numbers are "integer"
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		if f, err := v.Float64(); err == nil && f == float64(int64(f)) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// equal compares decoded JSON values, treating 1 and 1.0 as the same number
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		bn, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == bn {
+			return true
+		}
+		af, err1 := a.Float64()
+		bf, err2 := bn.Float64()
+		return err1 == nil && err2 == nil && af == bf
+	case []any:
+		bs, ok := b.([]any)
+		if !ok || len(a) != len(bs) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], bs[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bm, ok := b.(map[string]any)
+		if !ok || len(a) != len(bm) {
+			return false
+		}
+		for k, av := range a {
+			bv, ok := bm[k]
+			if !ok || !equal(av, bv) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func show(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
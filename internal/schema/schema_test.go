@@ -0,0 +1,187 @@
+package schema
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const orderSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"title": "order",
+	"type": "object",
+	"required": ["id", "items"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"status": {"enum": ["open", "closed"]},
+		"kind": {"const": "order"},
+		"note": {"type": ["string", "null"], "maxLength": 5},
+		"sku": {"type": "string", "pattern": "^[A-Z]{3}-[0-9]+$"},
+		"items": {
+			"type": "array",
+			"minItems": 1,
+			"maxItems": 2,
+			"items": {
+				"type": "object",
+				"required": ["qty"],
+				"properties": {"qty": {"type": "number", "exclusiveMinimum": 0, "exclusiveMaximum": 100}}
+			}
+		}
+	}
+}`
+
+func mustCompile(t *testing.T, doc string) *Schema {
+	t.Helper()
+	s, err := Compile([]byte(doc))
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	return s
+}
+
+func validate(t *testing.T, s *Schema, doc string) []ValidationError {
+	t.Helper()
+	v, err := Decode([]byte(doc))
+	if err != nil {
+		t.Fatalf("Decode(%s): %v", doc, err)
+	}
+	return s.Validate(v)
+}
+
+func TestValidate(t *testing.T) {
+	s := mustCompile(t, orderSchema)
+	for _, tc := range []struct {
+		name, doc string
+		want      []ValidationError // nil means valid
+	}{
+		{"valid", `{"id": 1, "items": [{"qty": 2.5}], "note": null, "sku": "ABC-12", "kind": "order"}`, nil},
+		{"whole float is an integer", `{"id": 3.0, "items": [{"qty": 1}]}`, nil},
+		{"not an object", `[]`, []ValidationError{{"$", "expected object, got array"}}},
+		{"missing required", `{"items": [{"qty": 1}]}`, []ValidationError{{"$", `missing required property "id"`}}},
+		{"extra property", `{"id": 1, "items": [{"qty": 1}], "x": 1}`, []ValidationError{{"$", `unexpected property "x"`}}},
+		{"wrong type", `{"id": "1", "items": [{"qty": 1}]}`, []ValidationError{{"$.id", "expected integer, got string"}}},
+		{"fraction is not an integer", `{"id": 1.5, "items": [{"qty": 1}]}`, []ValidationError{{"$.id", "expected integer, got number"}}},
+		{"minimum", `{"id": 0, "items": [{"qty": 1}]}`, []ValidationError{{"$.id", "must be >= 1"}}},
+		{"enum", `{"id": 1, "items": [{"qty": 1}], "status": "lost"}`, []ValidationError{{"$.status", `must be one of ["open","closed"]`}}},
+		{"const", `{"id": 1, "items": [{"qty": 1}], "kind": "refund"}`, []ValidationError{{"$.kind", `must equal "order"`}}},
+		{"maxLength counts runes", `{"id": 1, "items": [{"qty": 1}], "note": "ééééé"}`, nil},
+		{"maxLength", `{"id": 1, "items": [{"qty": 1}], "note": "toolong"}`, []ValidationError{{"$.note", "must be at most 5 characters"}}},
+		{"pattern", `{"id": 1, "items": [{"qty": 1}], "sku": "abc"}`, []ValidationError{{"$.sku", `must match pattern "^[A-Z]{3}-[0-9]+$"`}}},
+		{"minItems", `{"id": 1, "items": []}`, []ValidationError{{"$.items", "must have at least 1 items"}}},
+		{"maxItems", `{"id": 1, "items": [{"qty": 1}, {"qty": 1}, {"qty": 1}]}`, []ValidationError{{"$.items", "must have at most 2 items"}}},
+		{"nested path", `{"id": 1, "items": [{"qty": 1}, {}]}`, []ValidationError{{"$.items[1]", `missing required property "qty"`}}},
+		{"exclusive bounds", `{"id": 1, "items": [{"qty": 0}, {"qty": 100}]}`, []ValidationError{
+			{"$.items[0].qty", "must be > 0"},
+			{"$.items[1].qty", "must be < 100"},
+		}},
+		{"errors in key order", `{"z": 1, "a": 1, "id": 1, "items": [{"qty": 1}]}`, []ValidationError{
+			{"$", `unexpected property "a"`},
+			{"$", `unexpected property "z"`},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := validate(t, s, tc.doc)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("error %d = %v, want %v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBooleanSchemas(t *testing.T) {
+	s := mustCompile(t, `{"properties": {"any": true, "never": false}, "additionalProperties": {"type": "boolean"}}`)
+	if errs := validate(t, s, `{"any": [1, {"x": null}], "flag": true}`); len(errs) != 0 {
+		t.Errorf("true schema rejected a value: %v", errs)
+	}
+	errs := validate(t, s, `{"never": 1, "flag": "yes"}`)
+	want := []ValidationError{
+		{"$.flag", "expected boolean, got string"},
+		{"$.never", "no value is allowed here"},
+	}
+	if len(errs) != len(want) || errs[0] != want[0] || errs[1] != want[1] {
+		t.Errorf("got %v, want %v", errs, want)
+	}
+}
+
+func TestEnumComparesNumbersByValue(t *testing.T) {
+	s := mustCompile(t, `{"enum": [1, [2, {"a": 3}]]}`)
+	for _, doc := range []string{`1.0`, `[2.0, {"a": 3}]`} {
+		if errs := validate(t, s, doc); len(errs) != 0 {
+			t.Errorf("%s: %v", doc, errs)
+		}
+	}
+	for _, doc := range []string{`"1"`, `[2]`, `[2, {"a": 3, "b": 4}]`} {
+		if errs := validate(t, s, doc); len(errs) != 1 {
+			t.Errorf("%s: got %v, want one error", doc, errs)
+		}
+	}
+}
+
+func TestValidateCapsErrors(t *testing.T) {
+	s := mustCompile(t, `{"items": {"type": "string"}}`)
+	doc := "[" + strings.TrimSuffix(strings.Repeat("1,", maxErrors+5), ",") + "]"
+	if errs := validate(t, s, doc); len(errs) != maxErrors {
+		t.Errorf("got %d errors, want %d", len(errs), maxErrors)
+	}
+}
+
+func TestCompileRejectsBadSchemas(t *testing.T) {
+	for _, tc := range []struct{ doc, want string }{
+		{`"object"`, "$: schema must be an object or boolean"},
+		{`{"$ref": "#/defs/x"}`, "$: $ref: unsupported keyword"},
+		{`{"properties": {"a": {"allOf": []}}}`, "$.a: allOf: unsupported keyword"},
+		{`{"type": "float"}`, `$: type: unknown type "float"`},
+		{`{"type": ["string", 1]}`, "$: type: must be strings"},
+		{`{"enum": "a"}`, "$: enum: must be an array"},
+		{`{"minLength": -1}`, "$: minLength: must be a non-negative integer"},
+		{`{"maxItems": 1.5}`, "$: maxItems: must be a non-negative integer"},
+		{`{"minimum": "0"}`, "$: minimum: must be a number"},
+		{`{"pattern": "("}`, "$: pattern: error parsing regexp"},
+		{`{"items": 1}`, "$.items: schema must be an object or boolean"},
+		{`{"additionalProperties": {"type": 1}}`, "$.additionalProperties: type: must be a string or an array of strings"},
+	} {
+		_, err := Compile([]byte(tc.doc))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("Compile(%s) = %v, want %q", tc.doc, err, tc.want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	v, err := Decode([]byte(`{"n": 9007199254740993}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := v.(map[string]any)["n"]; show(n) != "9007199254740993" {
+		t.Errorf("large integer decoded as %s", show(n))
+	}
+	for _, doc := range []string{`{"a": 1} {"b": 2}`, `{"a": 1`, ``} {
+		if _, err := Decode([]byte(doc)); err == nil {
+			t.Errorf("Decode(%q) succeeded", doc)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(`{"type": "string"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := validate(t, s, `1`); len(errs) != 1 {
+		t.Errorf("got %v, want one error", errs)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}